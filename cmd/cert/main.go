@@ -22,6 +22,7 @@ func main() {
 	validFrom := flag.String("start-date", "", "Certificate start date (format: 'Jan 2 15:04:05 2006'), defaults to current time if empty")
 	validFor := flag.Duration("duration", 365*24*time.Hour, "Certificate validity duration")
 	isCA := flag.Bool("ca", false, "Whether to generate a CA certificate")
+	clientAuth := flag.Bool("client", false, "Whether the certificate may authenticate a TLS client too, for mutual TLS")
 	rsaBits := flag.Int("rsa-bits", 2048, "RSA key size in bits")
 	ecdsaCurve := flag.String("ecdsa-curve", "P256", "ECDSA curve (options: P224, P256, P384, P521)")
 	ed25519Key := flag.Bool("ed25519", false, "Whether to generate an Ed25519 key")
@@ -35,6 +36,7 @@ func main() {
 		ValidFrom:  *validFrom,
 		ValidFor:   *validFor,
 		IsCA:       *isCA,
+		ClientAuth: *clientAuth,
 		RsaBits:    *rsaBits,
 		EcdsaCurve: *ecdsaCurve,
 		Ed25519Key: *ed25519Key,
@@ -12,6 +12,10 @@ import (
 
 func main() {
 	mode := flag.String("mode", "simple", "simple/h1h3/advanced")
+	// Migration of the h3 connection: -migrate [-migrate-addr=192.168.1.2:0] [-watch-network=5s]
+	migrate := flag.Bool("migrate", false, "h1h3: rebind the QUIC connection to a new local socket halfway through a download")
+	migrateAddr := flag.String("migrate-addr", "", "h1h3: local address to rebind to, the same address with a new port if empty")
+	watchNetwork := flag.Duration("watch-network", 0, "h1h3: rebind when the local addresses change, checked at this interval, 0 disables")
 	flag.Parse()
 
 	cfg, err := config.LoadClientConfig(utils.ConfigPathCreate(*mode, "client", 0))
@@ -23,7 +27,11 @@ func main() {
 	if *mode == "simple" {
 		err = simpleclient.DoClientRequest(cfg.ClientAddr, cfg.ServerAddr, cfg.ClientMessage)
 	} else if *mode == "h1h3" {
-		err = h1h3client.DoClientRequest(cfg.ClientAddr, cfg.ServerAddr, cfg.ClientMessage)
+		err = h1h3client.DoClientRequest(cfg.ClientAddr, cfg.ServerAddr, cfg.ClientMessage, h1h3client.Migration{
+			MidTransfer:  *migrate,
+			LocalAddr:    *migrateAddr,
+			WatchNetwork: *watchNetwork,
+		})
 	} else {
 		log.Fatalf("unsupported mode: %s", *mode)
 	}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"quic-proxy/internal/config"
+	h3gateway "quic-proxy/internal/h3-gateway"
+	"quic-proxy/internal/utils"
+)
+
+func main() {
+	// Command line flags: -mode=gateway
+	mode := flag.String("mode", "gateway", "config directory to load gateway_0.json from")
+	flag.Parse()
+
+	cfg, err := config.LoadGatewayConfig(utils.ConfigPathCreate(*mode, "gateway", 0))
+	if err != nil {
+		log.Fatalf("failed to load gateway config: %v", err)
+	}
+
+	log.Printf(cfg.Description)
+	gateway, err := h3gateway.NewGateway(cfg)
+	if err != nil {
+		log.Fatalf("failed to create gateway: %v", err)
+	}
+	if err := gateway.ListenAndServe(); err != nil {
+		log.Fatalf("failed to start gateway: %v", err)
+	}
+}
@@ -1,18 +1,44 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"time"
 
 	"quic-proxy/internal/config"
+	"quic-proxy/internal/forwarding"
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+	headerpolicy "quic-proxy/internal/header-policy"
+	"quic-proxy/internal/metrics"
+	"quic-proxy/internal/migration"
 	http_proxy "quic-proxy/internal/proxy/http"
+	"quic-proxy/internal/routing"
+	"quic-proxy/internal/upstream"
 	"quic-proxy/internal/utils"
+	wswebtransport "quic-proxy/internal/ws-webtransport"
 )
 
 func main() {
-	// Command line flags: -mode=simple / -mode=advanced
-	mode := flag.String("mode", "simple", "simple or advanced")
+	// Subcommand: test-route [-mode=simple] <url | host:port>
+	if len(os.Args) > 1 && os.Args[1] == "test-route" {
+		testRoute(os.Args[2:])
+		return
+	}
+
+	// Command line flags: -mode=simple / -mode=advanced / -mode=webtransport
+	mode := flag.String("mode", "simple", "simple/advanced/webtransport")
+	flag.Parse()
+
+	if *mode == "webtransport" {
+		startWebTransportBridge(*mode)
+		return
+	}
 	if *mode != "simple" && *mode != "advanced" {
 		log.Fatalf("invalid mode: %s", *mode)
 	}
@@ -23,6 +49,55 @@ func main() {
 	}
 
 	log.Printf(cfg.Description)
+	// 在第一个请求之前设置上游连接池的限制
+	happyeyeballs.DefaultRoundTripper.Limits = upstream.Limits{
+		MaxConnsPerOrigin:     cfg.Upstream.MaxConnsPerOrigin,
+		MaxIdleConnsPerOrigin: cfg.Upstream.MaxIdleConnsPerOrigin,
+		IdleTimeout:           time.Duration(cfg.Upstream.IdleTimeout) * time.Second,
+	}
+	happyeyeballs.DefaultRoundTripper.TLSClientConfig.InsecureSkipVerify = cfg.Upstream.Insecure
+	forwarder, err := forwarding.New(cfg.Forwarding)
+	if err != nil {
+		log.Fatalf("invalid forwarding config: %v", err)
+	}
+	forwarding.Default = forwarder
+	policy, err := headerpolicy.New(cfg.HeaderPolicy)
+	if err != nil {
+		log.Fatalf("invalid header policy config: %v", err)
+	}
+	headerpolicy.Default = policy
+	if err := http_proxy.ConfigureConnect(cfg.Connect); err != nil {
+		log.Fatalf("invalid connect config: %v", err)
+	}
+	router, err := routing.New(cfg.Routing, happyeyeballs.DefaultRoundTripper.TLSClientConfig)
+	if err != nil {
+		log.Fatalf("invalid routing config: %v", err)
+	}
+	routing.Default = router
+	// 网络变化时清理非 persist 的 Alt-Svc 缓存
+	go utils.DefaultAltSvcCache.WatchNetwork(context.Background(), 5*time.Second)
+	mux := http.NewServeMux()
+	mux.Handle("/", metrics.Handler())
+	if cfg.Migration.Enabled || cfg.Migration.WatchNetwork > 0 {
+		conn, err := migration.Listen("udp", ":0")
+		if err != nil {
+			log.Fatalf("failed to open upstream QUIC socket: %v", err)
+		}
+		// 上游 QUIC 连接共用该套接字，迁移时一起移动
+		happyeyeballs.DefaultRoundTripper.Dialer.Conn = conn
+		if cfg.Migration.WatchNetwork > 0 {
+			go conn.Watch(context.Background(), time.Duration(cfg.Migration.WatchNetwork)*time.Second)
+		}
+		mux.Handle("/debug/migrate", migration.RebindHandler(conn))
+	}
+	if cfg.MetricsAddr != "" {
+		go func() {
+			log.Printf("Serving metrics on http://%s/debug/vars", cfg.MetricsAddr)
+			if err := http.ListenAndServe(cfg.MetricsAddr, mux); err != nil {
+				log.Printf("failed to serve metrics: %v", err)
+			}
+		}()
+	}
 	if *mode == "simple" {
 		handler := http.HandlerFunc(http_proxy.HandleRequestAndRedirect)
 		if err := http.ListenAndServe(cfg.ProxyAddr, handler); err != nil {
@@ -30,3 +105,69 @@ func main() {
 		}
 	}
 }
+
+// startWebTransportBridge Start the WebSocket to WebTransport bridge
+func startWebTransportBridge(mode string) {
+	cfg, err := config.LoadWebTransportBridgeConfig(utils.ConfigPathCreate(mode, "webtransport_bridge", 0))
+	if err != nil {
+		log.Fatalf("failed to load webtransport bridge config: %v", err)
+	}
+
+	log.Printf(cfg.Description)
+	bridge, err := wswebtransport.NewBridge(cfg)
+	if err != nil {
+		log.Fatalf("failed to create webtransport bridge: %v", err)
+	}
+	if err := bridge.ListenAndServe(); err != nil {
+		log.Fatalf("failed to start webtransport bridge: %v", err)
+	}
+}
+
+// testRoute Print the routing rule matching a URL, or the target of a CONNECT given as host:port
+func testRoute(args []string) {
+	fs := flag.NewFlagSet("test-route", flag.ExitOnError)
+	mode := fs.String("mode", "simple", "simple/advanced")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s test-route [-mode=simple] <url | host:port>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.LoadHttpProxyConfig(utils.ConfigPathCreate(*mode, "http_proxy", 0))
+	if err != nil {
+		log.Fatalf("failed to load http config: %v", err)
+	}
+	router, err := routing.New(cfg.Routing, nil)
+	if err != nil {
+		log.Fatalf("invalid routing config: %v", err)
+	}
+	defer router.Close()
+
+	target := fs.Arg(0)
+	var rule *routing.Rule
+	if u, err := url.Parse(target); err == nil && u.Scheme != "" && u.Host != "" {
+		ctx, err := router.Resolve(context.Background(), u.Hostname())
+		if err != nil {
+			log.Fatalf("%s: %v", target, err)
+		}
+		rule = router.MatchURL(ctx, u)
+	} else if host, _, err := net.SplitHostPort(target); err == nil {
+		target = "CONNECT " + target
+		ctx, err := router.Resolve(context.Background(), host)
+		if err != nil {
+			log.Fatalf("%s: %v", target, err)
+		}
+		rule = router.MatchConnect(ctx, fs.Arg(0))
+	} else {
+		log.Fatalf("invalid target %q: expected a URL or host:port", target)
+	}
+	if rule == nil {
+		fmt.Printf("%s: no rule matches, default route\n", target)
+		return
+	}
+	fmt.Printf("%s: %s\n", target, rule)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/masque"
+	"quic-proxy/internal/utils"
+)
+
+func main() {
+	// Command line flags: -mode=masque
+	mode := flag.String("mode", "masque", "config directory to load masque_client_0.json from")
+	flag.Parse()
+
+	cfg, err := config.LoadMasqueClientConfig(utils.ConfigPathCreate(*mode, "masque_client", 0))
+	if err != nil {
+		log.Fatalf("failed to load masque client config: %v", err)
+	}
+
+	log.Printf(cfg.Description)
+	client, err := masque.NewClient(cfg)
+	if err != nil {
+		log.Fatalf("failed to create masque client: %v", err)
+	}
+	if err := client.ListenAndServe(); err != nil {
+		log.Fatalf("failed to start masque client: %v", err)
+	}
+}
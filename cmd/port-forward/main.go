@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/forward"
+	"quic-proxy/internal/utils"
+)
+
+func main() {
+	// Command line flags: -mode=forward -index=1
+	mode := flag.String("mode", "forward", "config directory to load forward_<index>.json from")
+	index := flag.Int("index", 0, "config index, 0 is the listening peer and 1 the connecting one in the samples")
+	flag.Parse()
+
+	cfg, err := config.LoadForwardConfig(utils.ConfigPathCreate(*mode, "forward", *index))
+	if err != nil {
+		log.Fatalf("failed to load forward config: %v", err)
+	}
+
+	log.Printf(cfg.Description)
+	if cfg.ListenAddr == "" && cfg.PeerAddr == "" {
+		log.Fatalf("forward config needs a listen_address, a peer_address or both")
+	}
+	if cfg.ListenAddr != "" {
+		server, err := forward.NewServer(cfg)
+		if err != nil {
+			log.Fatalf("failed to create forward server: %v", err)
+		}
+		if cfg.PeerAddr == "" {
+			if err := server.ListenAndServe(); err != nil {
+				log.Fatalf("failed to start forward server: %v", err)
+			}
+			return
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				log.Fatalf("failed to start forward server: %v", err)
+			}
+		}()
+	}
+	client, err := forward.NewClient(cfg)
+	if err != nil {
+		log.Fatalf("failed to create forward client: %v", err)
+	}
+	if err := client.Run(context.Background()); err != nil {
+		log.Fatalf("failed to run forward client: %v", err)
+	}
+}
@@ -2,12 +2,41 @@ package main
 
 import (
 	"flag"
+	"log"
+
+	"quic-proxy/internal/config"
 	"quic-proxy/internal/proxy/h1h3"
+	"quic-proxy/internal/socks5"
+	"quic-proxy/internal/utils"
 )
 
 func main() {
 	verbose := flag.Bool("v", true, "should every proxy request be logged to stdout")
 	addr := flag.String("addr", ":8080", "proxy listen address")
+	socksMode := flag.String("socks5", "", "also start the SOCKS5 listener of config/<mode>/socks5_0.json, e.g. -socks5=socks5")
+	insecure := flag.Bool("insecure", false, "do not verify the certificates of upstream servers, for testing only")
 	flag.Parse()
-	h1h3.HttpsProxy(verbose, addr)
+	if *socksMode != "" {
+		startSocks5(*socksMode)
+	}
+	h1h3.HttpsProxy(verbose, addr, *insecure)
+}
+
+// startSocks5 Start the SOCKS5 listener in the background
+func startSocks5(mode string) {
+	cfg, err := config.LoadSocks5Config(utils.ConfigPathCreate(mode, "socks5", 0))
+	if err != nil {
+		log.Fatalf("failed to load socks5 config: %v", err)
+	}
+
+	log.Printf(cfg.Description)
+	server, err := socks5.NewServer(cfg)
+	if err != nil {
+		log.Fatalf("failed to create socks5 server: %v", err)
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			log.Fatalf("failed to start socks5 server: %v", err)
+		}
+	}()
 }
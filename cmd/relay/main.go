@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/relay"
+	"quic-proxy/internal/utils"
+)
+
+func main() {
+	// Command line flags: -mode=relay -role=agent -index=0
+	mode := flag.String("mode", "relay", "config directory to load server_<index>.json or agent_<index>.json from")
+	role := flag.String("role", "server", "server runs the public relay, agent exposes local services on it")
+	index := flag.Int("index", 0, "config index")
+	flag.Parse()
+
+	switch *role {
+	case "server":
+		cfg, err := config.LoadRelayServerConfig(utils.ConfigPathCreate(*mode, "server", *index))
+		if err != nil {
+			log.Fatalf("failed to load relay server config: %v", err)
+		}
+		log.Printf(cfg.Description)
+		server, err := relay.NewServer(cfg)
+		if err != nil {
+			log.Fatalf("failed to create relay server: %v", err)
+		}
+		if err := server.ListenAndServe(); err != nil {
+			log.Fatalf("failed to start relay server: %v", err)
+		}
+	case "agent":
+		cfg, err := config.LoadRelayAgentConfig(utils.ConfigPathCreate(*mode, "agent", *index))
+		if err != nil {
+			log.Fatalf("failed to load relay agent config: %v", err)
+		}
+		log.Printf(cfg.Description)
+		agent, err := relay.NewAgent(cfg)
+		if err != nil {
+			log.Fatalf("failed to create relay agent: %v", err)
+		}
+		if err := agent.Run(context.Background()); err != nil {
+			log.Fatalf("failed to run relay agent: %v", err)
+		}
+	default:
+		log.Fatalf("unknown role %q, expected server or agent", *role)
+	}
+}
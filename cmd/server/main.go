@@ -6,15 +6,21 @@ import (
 
 	"quic-proxy/internal/config"
 	h1h3server "quic-proxy/internal/h1h3-server"
+	"quic-proxy/internal/masque"
 	simpleserver "quic-proxy/internal/simple-server"
 	"quic-proxy/internal/utils"
 )
 
 func main() {
-	// Command line flags: -mode=simple / -mode=advanced / -mode=h1h3
-	mode := flag.String("mode", "simple", "simple/advanced/h1h3")
+	// Command line flags: -mode=simple / -mode=advanced / -mode=h1h3 / -mode=masque
+	mode := flag.String("mode", "simple", "simple/advanced/h1h3/masque")
 	flag.Parse()
 
+	if *mode == "masque" {
+		startMasqueServer(*mode)
+		return
+	}
+
 	cfg, err := config.LoadServerConfig(utils.ConfigPathCreate(*mode, "server", 0))
 	if err != nil {
 		log.Fatalf("failed to load server config: %v", err)
@@ -24,7 +30,7 @@ func main() {
 	if *mode == "simple" {
 		err = simpleserver.StartServer(cfg.ServerAddr)
 	} else if *mode == "h1h3" {
-		err = h1h3server.StartServer(cfg.ServerAddr, cfg.Http3Addr)
+		err = h1h3server.StartServer(cfg.ServerAddr, cfg.Http3Addr, cfg.EarlyData, cfg.FollowMigration)
 	} else {
 		log.Fatalf("unsupport mode: %s", *mode)
 	}
@@ -32,3 +38,20 @@ func main() {
 		log.Fatalf("failed to start server: %v", err)
 	}
 }
+
+// startMasqueServer Start the MASQUE CONNECT-UDP proxy
+func startMasqueServer(mode string) {
+	cfg, err := config.LoadMasqueServerConfig(utils.ConfigPathCreate(mode, "masque_server", 0))
+	if err != nil {
+		log.Fatalf("failed to load masque server config: %v", err)
+	}
+
+	log.Printf(cfg.Description)
+	server, err := masque.NewServer(cfg)
+	if err != nil {
+		log.Fatalf("failed to create masque server: %v", err)
+	}
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("failed to start masque server: %v", err)
+	}
+}
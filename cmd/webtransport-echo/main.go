@@ -0,0 +1,115 @@
+// Command webtransport-echo runs the WebSocket to WebTransport bridge end to
+// end on the local machine: the h3 server echoes WebTransport sessions at
+// the upstream URL of the bridge config, the bridge listens for WebSockets and
+// a WebSocket client sends a few messages through both.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"quic-proxy/internal/config"
+	h1h3server "quic-proxy/internal/h1h3-server"
+	"quic-proxy/internal/utils"
+	"quic-proxy/internal/websocket"
+	wswebtransport "quic-proxy/internal/ws-webtransport"
+)
+
+const (
+	certPath = "cert.pem"
+	keyPath  = "key.pem"
+)
+
+func main() {
+	// Command line flags: -mode=webtransport
+	mode := flag.String("mode", "webtransport", "config directory to load webtransport_bridge_0.json from")
+	flag.Parse()
+
+	cfg, err := config.LoadWebTransportBridgeConfig(utils.ConfigPathCreate(*mode, "webtransport_bridge", 0))
+	if err != nil {
+		log.Fatalf("failed to load webtransport bridge config: %v", err)
+	}
+	log.Printf(cfg.Description)
+
+	upstream, err := url.Parse(cfg.UpstreamURL)
+	if err != nil {
+		log.Fatalf("invalid upstream URL: %v", err)
+	}
+	if err := startEchoServer(upstream.Host); err != nil {
+		log.Fatalf("failed to start webtransport echo server: %v", err)
+	}
+	bridge, err := wswebtransport.NewBridge(cfg)
+	if err != nil {
+		log.Fatalf("failed to create webtransport bridge: %v", err)
+	}
+	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	go bridge.Serve(ln)
+
+	if err := echo(ln.Addr().String()); err != nil {
+		log.Fatalf("echo through the bridge failed: %v", err)
+	}
+}
+
+// startEchoServer Serve the demo h3 server, including the WebTransport echo, on addr
+func startEchoServer(addr string) error {
+	if err := utils.EnsureCertificate(certPath, keyPath); err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	server := h1h3server.NewDemoH3Server(addr, nil)
+	server.TLSConfig = http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	log.Printf("[h3Server] WebTransport echo on https://%s%s", addr, h1h3server.WebTransportEchoPath)
+	go server.Serve(conn)
+	return nil
+}
+
+// echo Send a few messages through the bridge and print what comes back
+func echo(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	u := &url.URL{Scheme: "http", Host: addr, Path: h1h3server.WebTransportEchoPath}
+	ws, _, err := websocket.DialH1(ctx, conn, u, addr, nil)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	log.Printf("[Client] WebSocket open to ws://%s%s", addr, u.Path)
+
+	for _, msg := range []string{"hello", "over WebTransport", "and back"} {
+		if err := ws.WriteMessage(websocket.OpText, []byte(msg)); err != nil {
+			return err
+		}
+		_, reply, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		log.Printf("[Client] Sent %q, echoed %q", msg, reply)
+	}
+
+	if err := ws.WriteFrame(websocket.CloseFrame(websocket.CloseNormal, "done")); err != nil {
+		return err
+	}
+	_, _, err = ws.ReadMessage()
+	log.Printf("[Client] WebSocket closed: %v", err)
+	return nil
+}
@@ -3,8 +3,8 @@ module quic-proxy
 go 1.23.4
 
 require (
-	github.com/ebi-yade/altsvc-go v0.1.1
 	github.com/elazarl/goproxy v1.7.0
+	github.com/quic-go/qpack v0.5.1
 	github.com/quic-go/quic-go v0.49.0
 	golang.org/x/net v0.34.0
 )
@@ -14,7 +14,6 @@ require (
 	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
 	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
 	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
-	github.com/quic-go/qpack v0.5.1 // indirect
 	go.uber.org/mock v0.5.0 // indirect
 	golang.org/x/crypto v0.32.0 // indirect
 	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ForwardConfig 经 QUIC 的 TCP 端口转发（类似 ssh -L/-R），两端实例以双向 TLS 认证对方。
+// 设置 ListenAddr 时接受对端连接，设置 PeerAddr 时连接对端并建立 Forwards 中的转发
+type ForwardConfig struct {
+	Description string `json:"description"`
+	// ListenAddr 接受对端 QUIC 连接的 UDP 地址
+	ListenAddr string `json:"listen_address"`
+	// PeerAddr 要连接的对端地址，ServerName 为空时用其主机名校验对端证书
+	PeerAddr   string `json:"peer_address"`
+	ServerName string `json:"server_name"`
+	// CertPath/KeyPath 本端证书，不存在时生成一张可用于客户端认证的自签名证书
+	CertPath string `json:"cert_path"`
+	KeyPath  string `json:"key_path"`
+	// PeerCertPath 信任的对端证书或签发它的 CA
+	PeerCertPath string `json:"peer_cert_path"`
+	// KeepAlive 保活间隔（秒），为 0 时使用 10 秒
+	KeepAlive int `json:"keep_alive"`
+	// WatchNetwork 检查本地地址变化的间隔（秒），变化时迁移到新的 UDP 套接字，为 0 时不检查
+	WatchNetwork int `json:"watch_network"`
+	// FollowMigration 接受连接时，对端地址变化后经路径验证继续使用原连接，默认关闭。
+	// 对端需使用 migration.Conn 应答验证（forward 的发起端即如此），其他 QUIC 客户端不认识验证包，地址变化后不会被跟随
+	FollowMigration bool          `json:"follow_migration"`
+	Forwards        []ForwardRule `json:"forwards"`
+}
+
+// ForwardRule 一条转发。local：本端监听 ListenAddr，连接经对端到达 TargetAddr；
+// remote：对端监听 ListenAddr，连接经本端到达 TargetAddr
+type ForwardRule struct {
+	Name      string `json:"name"`
+	Direction string `json:"direction"`
+	// Protocol tcp 或 udp，为空时为 tcp。UDP 按来源地址区分流，报文经 QUIC datagram 传输
+	Protocol   string `json:"protocol"`
+	ListenAddr string `json:"listen_address"`
+	TargetAddr string `json:"target_address"`
+	// IdleTimeout UDP 流空闲多少秒后关闭，为 0 时使用 60 秒
+	IdleTimeout int `json:"idle_timeout"`
+}
+
+// LoadForwardConfig 从指定文件读取并解析配置
+func LoadForwardConfig(path string) (*ForwardConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file error: %w", err)
+	}
+
+	var cfg ForwardConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unmarshal config file error: %w", err)
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,9 @@
+package config
+
+// ForwardingConfig 转发头部配置，Via 与 Forwarded 中标识本代理，并决定信任哪些下游代理
+type ForwardingConfig struct {
+	// ProxyName 本代理在 Via 和 Forwarded 中的名字，链路中必须唯一才能检测环路，为空时随机生成
+	ProxyName string `json:"proxy_name"`
+	// TrustedProxies 可信下游代理的 IP 或 CIDR，只保留它们传来的 X-Forwarded-For 与 Forwarded
+	TrustedProxies []string `json:"trusted_proxies"`
+}
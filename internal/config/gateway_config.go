@@ -0,0 +1,44 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// GatewayConfig 配置文件
+type GatewayConfig struct {
+	Description string `json:"description"`
+	// Http3Addr QUIC 监听地址
+	Http3Addr string `json:"http3_address"`
+	// TCPAddr 配套的 TCP(TLS) 监听地址，通过 Alt-Svc 通告 h3，为空则不启动
+	TCPAddr string `json:"tcp_address"`
+	// BackendURL 后端地址，如 http://127.0.0.1:8080
+	BackendURL string `json:"backend_url"`
+	// BackendProtocol 后端协议 h1 或 h2，http:// 后端使用 h2 时为 h2c
+	BackendProtocol string `json:"backend_protocol"`
+	// BackendInsecure 不校验后端证书
+	BackendInsecure bool   `json:"backend_insecure"`
+	CertPath        string `json:"cert_path"`
+	KeyPath         string `json:"key_path"`
+	// Forwarding Via、Forwarded 等转发头部的配置
+	Forwarding ForwardingConfig `json:"forwarding"`
+	// HeaderPolicy 协议转换时的头部规则，如严格程度与头部块大小上限
+	HeaderPolicy HeaderPolicyConfig `json:"header_policy"`
+	// EarlyData 0-RTT 策略，为空时不启用 0-RTT；接受的请求带 Early-Data: 1 转发给后端
+	EarlyData *EarlyDataConfig `json:"early_data"`
+}
+
+// LoadGatewayConfig 从指定文件读取并解析配置
+func LoadGatewayConfig(path string) (*GatewayConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file error: %w", err)
+	}
+
+	var cfg GatewayConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unmarshal config file error: %w", err)
+	}
+	return &cfg, nil
+}
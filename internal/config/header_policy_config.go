@@ -0,0 +1,11 @@
+package config
+
+// HeaderPolicyConfig 在 HTTP/1.1、h2 与 h3 之间转换时的头部规则
+type HeaderPolicyConfig struct {
+	// Strictness 严格程度：lenient 尽量修正不合规的头部；standard（默认）拒绝 RFC 9113、RFC 9114 认定为畸形的消息，其余修正；
+	// strict 连需要修正的消息（如字段值首尾有空白）也拒绝
+	Strictness string `json:"strictness"`
+	// MaxFieldSectionSize 转发的头部块大小上限，按 SETTINGS_MAX_FIELD_SECTION_SIZE 的算法计算（字段名 + 字段值 + 32），
+	// 同时在 HTTP/3 的 SETTINGS 中通告；0 表示只受对端 SETTINGS 的限制
+	MaxFieldSectionSize uint64 `json:"max_field_section_size"`
+}
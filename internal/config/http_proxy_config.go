@@ -10,6 +10,50 @@ import (
 type HttpProxyConfig struct {
 	Description string `json:"description"`
 	ProxyAddr   string `json:"proxy_address"`
+	// MetricsAddr 非空时在该地址的 /debug/vars 提供统计数据，如 0-RTT 接受率
+	MetricsAddr string `json:"metrics_address"`
+	// Upstream 上游连接池的限制，零值使用默认值
+	Upstream UpstreamConfig `json:"upstream"`
+	// Forwarding Via、Forwarded 等转发头部的配置
+	Forwarding ForwardingConfig `json:"forwarding"`
+	// HeaderPolicy 协议转换时的头部规则，如严格程度与头部块大小上限
+	HeaderPolicy HeaderPolicyConfig `json:"header_policy"`
+	// Connect CONNECT 隧道的配置
+	Connect ConnectConfig `json:"connect"`
+	// Routing 按目标选择直连、上级代理或拒绝的规则
+	Routing RoutingConfig `json:"routing"`
+	// Migration 上游 QUIC 连接的迁移
+	Migration MigrationConfig `json:"migration"`
+}
+
+// MigrationConfig 上游 QUIC 连接迁移配置
+type MigrationConfig struct {
+	// Enabled 上游 QUIC 连接共用一个可重新绑定的 UDP 套接字，可向 MetricsAddr 的 /debug/migrate 发送 POST 手动迁移
+	Enabled bool `json:"enabled"`
+	// WatchNetwork 检查本地地址变化的间隔（秒），变化时迁移，为 0 时不检查
+	WatchNetwork int `json:"watch_network"`
+}
+
+// ConnectConfig CONNECT 隧道配置
+type ConnectConfig struct {
+	// AllowedPorts 允许 CONNECT 的目标端口，为空时只允许 443
+	AllowedPorts []int `json:"allowed_ports"`
+	// AllowPrivateTargets 允许直连回环、链路本地、内网及保留地址，默认拒绝；路由规则选中的连接不受限制
+	AllowPrivateTargets bool `json:"allow_private_targets"`
+	// UpstreamURL 非空时不直接连接目标，而是经 HTTP/3 CONNECT 由该地址的 quic-proxy 转发，如 https://127.0.0.1:4433
+	UpstreamURL string `json:"upstream_url"`
+	// Insecure 不校验上游 quic-proxy 的证书
+	Insecure bool `json:"insecure"`
+}
+
+// UpstreamConfig 上游连接池配置，每个 origin 单独计数
+type UpstreamConfig struct {
+	MaxConnsPerOrigin     int `json:"max_conns_per_origin"`
+	MaxIdleConnsPerOrigin int `json:"max_idle_conns_per_origin"`
+	// IdleTimeout 连接空闲多少秒后关闭
+	IdleTimeout int `json:"idle_timeout"`
+	// Insecure 不校验上游服务器的证书，仅用于测试，默认关闭
+	Insecure bool `json:"insecure"`
 }
 
 // LoadHttpProxyConfig 从指定文件读取并解析配置
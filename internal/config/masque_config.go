@@ -0,0 +1,61 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// MasqueServerConfig MASQUE CONNECT-UDP 代理配置，同时接受普通 CONNECT 建立 TCP 隧道
+type MasqueServerConfig struct {
+	Description string `json:"description"`
+	Http3Addr   string `json:"http3_address"`
+	// Template URI 模板，为空时使用 RFC 9298 的默认模板
+	Template string `json:"template"`
+	// AllowedConnectPorts 普通 CONNECT（TCP 隧道）允许的目标端口，为空时只允许 443
+	AllowedConnectPorts []int `json:"allowed_connect_ports"`
+	// AllowedUDPPorts CONNECT-UDP 允许的目标端口，为空时只允许 53 和 443
+	AllowedUDPPorts []int `json:"allowed_udp_ports"`
+	// AllowPrivateTargets 允许 CONNECT 和 CONNECT-UDP 访问回环、链路本地、内网及保留地址，默认拒绝
+	AllowPrivateTargets bool   `json:"allow_private_targets"`
+	CertPath            string `json:"cert_path"`
+	KeyPath             string `json:"key_path"`
+}
+
+// MasqueClientConfig 将本地 UDP 端口经 MASQUE 代理转发到目标地址
+type MasqueClientConfig struct {
+	Description string `json:"description"`
+	LocalAddr   string `json:"local_address"`
+	// Template 代理的 URI 模板，包含代理地址
+	Template   string `json:"template"`
+	TargetAddr string `json:"target_address"`
+	Insecure   bool   `json:"insecure"`
+}
+
+// LoadMasqueServerConfig 从指定文件读取并解析配置
+func LoadMasqueServerConfig(path string) (*MasqueServerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file error: %w", err)
+	}
+
+	var cfg MasqueServerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unmarshal config file error: %w", err)
+	}
+	return &cfg, nil
+}
+
+// LoadMasqueClientConfig 从指定文件读取并解析配置
+func LoadMasqueClientConfig(path string) (*MasqueClientConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file error: %w", err)
+	}
+
+	var cfg MasqueClientConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unmarshal config file error: %w", err)
+	}
+	return &cfg, nil
+}
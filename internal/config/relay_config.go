@@ -0,0 +1,70 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// RelayServerConfig 反向隧道中继。位于 NAT 后的 agent 经 QUIC 连接到 AgentAddr 并注册主机名，
+// 公共监听地址收到这些主机名的请求后经 agent 的连接转发给它
+type RelayServerConfig struct {
+	Description string `json:"description"`
+	// AgentAddr 接受 agent 连接的 UDP 地址
+	AgentAddr string `json:"agent_address"`
+	// Http3Addr 公共 HTTP/3 监听地址
+	Http3Addr string `json:"http3_address"`
+	// TCPAddr 公共 TCP(TLS) 监听地址，提供 HTTP/1.1 和 h2 并通过 Alt-Svc 通告 h3，为空则不启动
+	TCPAddr  string `json:"tcp_address"`
+	CertPath string `json:"cert_path"`
+	KeyPath  string `json:"key_path"`
+	// Tokens agent 的令牌及其可以注册的主机名，如 "*.example.com" 匹配所有子域名，"*" 匹配任意主机名
+	Tokens map[string][]string `json:"tokens"`
+	// Forwarding Via、Forwarded 等转发头部的配置
+	Forwarding ForwardingConfig `json:"forwarding"`
+	// HeaderPolicy 协议转换时的头部规则，如严格程度与头部块大小上限
+	HeaderPolicy HeaderPolicyConfig `json:"header_policy"`
+}
+
+// RelayAgentConfig 反向隧道 agent，将本地服务以主机名暴露在中继上
+type RelayAgentConfig struct {
+	Description string `json:"description"`
+	// RelayAddr 中继接受 agent 连接的地址，ServerName 为空时用其主机名校验中继证书
+	RelayAddr  string `json:"relay_address"`
+	ServerName string `json:"server_name"`
+	// Insecure 不校验中继的证书
+	Insecure bool   `json:"insecure"`
+	Token    string `json:"token"`
+	// Services 主机名到本地服务地址的映射，如 "app.example.com": "http://127.0.0.1:8080"
+	Services map[string]string `json:"services"`
+	// KeepAlive 保活间隔（秒），为 0 时使用 10 秒
+	KeepAlive int `json:"keep_alive"`
+}
+
+// LoadRelayServerConfig 从指定文件读取并解析配置
+func LoadRelayServerConfig(path string) (*RelayServerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file error: %w", err)
+	}
+
+	var cfg RelayServerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unmarshal config file error: %w", err)
+	}
+	return &cfg, nil
+}
+
+// LoadRelayAgentConfig 从指定文件读取并解析配置
+func LoadRelayAgentConfig(path string) (*RelayAgentConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file error: %w", err)
+	}
+
+	var cfg RelayAgentConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unmarshal config file error: %w", err)
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,28 @@
+package config
+
+// RoutingConfig 上游路由规则，按顺序匹配，第一条匹配的规则生效，都不匹配时按代理的默认方式转发。
+// 只有 http-proxy 读取路由规则，quic-proxy 的 MITM 代理不支持路由，总是直连上游
+type RoutingConfig struct {
+	Rules []RouteRuleConfig `json:"rules"`
+}
+
+// RouteRuleConfig 一条路由规则，各条件之间为“与”，同一条件的多个值之间为“或”，条件为空时匹配任意值
+type RouteRuleConfig struct {
+	Name string `json:"name"`
+	// Hosts 主机名通配符，如 *.example.com，不区分大小写
+	Hosts []string `json:"hosts"`
+	// CIDRs 目标 IP 所在网段。有此类规则时主机名每个请求只解析一次（结果缓存 30 秒），
+	// 按解析到的地址匹配并连接；解析失败的请求返回 502，不存在的主机名不匹配任何网段
+	CIDRs []string `json:"cidrs"`
+	// Ports 目标端口，URL 未写端口时按协议取默认端口
+	Ports []int `json:"ports"`
+	// Schemes 请求的协议，如 http、https，CONNECT 隧道的协议为 connect
+	Schemes []string `json:"schemes"`
+	// Action 匹配后的动作：direct、http、socks5、masque、reject
+	Action string `json:"action"`
+	// Proxy 上游代理地址：http 为 http(s)://[user:pass@]host:port，socks5 为 socks5://[user:pass@]host:port，
+	// masque 为 quic-proxy 的 https://host:port
+	Proxy string `json:"proxy"`
+	// Insecure 不校验上游代理的证书
+	Insecure bool `json:"insecure"`
+}
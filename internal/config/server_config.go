@@ -12,6 +12,18 @@ type ServerConfig struct {
 	ServerAddr  string `json:"server_address"`
 	Http3Addr   string `json:"http3_address"`
 	UseHTTPS    bool   `json:"use_https"`
+	// EarlyData 为空时拒绝所有 0-RTT 请求
+	EarlyData *EarlyDataConfig `json:"early_data"`
+	// FollowMigration 客户端地址变化后经路径验证继续使用原连接，默认关闭。
+	// 客户端需使用 migration.Conn 应答验证，浏览器等普通 QUIC 客户端不认识验证包，只在客户端可控时开启
+	FollowMigration bool `json:"follow_migration"`
+}
+
+// EarlyDataConfig 0-RTT 策略：按路径前缀决定是否接受 early data，最长前缀优先
+type EarlyDataConfig struct {
+	Accept      bool     `json:"accept"` // 没有匹配的路径时是否接受
+	AcceptPaths []string `json:"accept_paths"`
+	RejectPaths []string `json:"reject_paths"`
 }
 
 // LoadServerConfig 从指定文件读取并解析配置
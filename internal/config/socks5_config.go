@@ -0,0 +1,33 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Socks5Config SOCKS5 监听配置，CONNECT 经 QUIC 流、UDP ASSOCIATE 经 QUIC datagram 转发到远端 quic-proxy，
+// 二者共用一条 QUIC 连接
+type Socks5Config struct {
+	Description string `json:"description"`
+	ListenAddr  string `json:"listen_address"`
+	// Users 用户名到密码的映射，为空时不需要认证
+	Users map[string]string `json:"users"`
+	// Template 远端 quic-proxy（MASQUE 代理）的 URI 模板，包含代理地址
+	Template string `json:"template"`
+	Insecure bool   `json:"insecure"`
+}
+
+// LoadSocks5Config 从指定文件读取并解析配置
+func LoadSocks5Config(path string) (*Socks5Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file error: %w", err)
+	}
+
+	var cfg Socks5Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unmarshal config file error: %w", err)
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// WebTransportBridgeConfig 终结 HTTP/1.1 客户端的 WebSocket，将消息经 WebTransport 会话转发到上游 h3 服务器
+type WebTransportBridgeConfig struct {
+	Description string `json:"description"`
+	ListenAddr  string `json:"listen_address"`
+	// UpstreamURL 上游 WebTransport 地址，如 https://127.0.0.1:8081，请求路径拼接在其后
+	UpstreamURL string `json:"upstream_url"`
+	// Insecure 不校验上游证书
+	Insecure bool `json:"insecure"`
+}
+
+// LoadWebTransportBridgeConfig 从指定文件读取并解析配置
+func LoadWebTransportBridgeConfig(path string) (*WebTransportBridgeConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file error: %w", err)
+	}
+
+	var cfg WebTransportBridgeConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unmarshal config file error: %w", err)
+	}
+	return &cfg, nil
+}
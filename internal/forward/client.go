@@ -0,0 +1,384 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+	"quic-proxy/internal/config"
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+	"quic-proxy/internal/metrics"
+	"quic-proxy/internal/migration"
+	"quic-proxy/internal/tunnel"
+)
+
+const (
+	DirectionLocal  = "local"
+	DirectionRemote = "remote"
+
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+const (
+	// minBackoff and maxBackoff bound the wait before dialing the peer again,
+	// it doubles after each failure
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// forward is one configured port forward and its counters
+type forward struct {
+	config.ForwardRule
+	counters *metrics.Forward
+}
+
+// Client keeps a connection to the peer and sets up the configured forwards
+// over it: it listens for the local ones itself and asks the peer to listen
+// for the remote ones
+type Client struct {
+	cfg      *config.ForwardConfig
+	tlsConf  *tls.Config
+	quicConf *quic.Config
+	dialer   *happyeyeballs.Dialer
+	local    []*forward
+	remote   map[string]*forward // by listenKey on the peer
+
+	mu sync.Mutex
+	// conn is the UDP socket of the connections to the peer while Run runs
+	conn  *migration.Conn
+	qconn quic.Connection
+	// ready is closed once qconn is up, a new one is made when it is lost
+	ready chan struct{}
+}
+
+// NewClient Create the client of cfg, its certificates are loaded and its
+// forwards checked right away
+func NewClient(cfg *config.ForwardConfig) (*Client, error) {
+	tlsConf, err := tlsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf.ServerName = cfg.ServerName
+	if tlsConf.ServerName == "" {
+		host, _, err := net.SplitHostPort(cfg.PeerAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer address %q: %w", cfg.PeerAddr, err)
+		}
+		tlsConf.ServerName = host
+	}
+	c := &Client{
+		cfg:      cfg,
+		tlsConf:  tlsConf,
+		quicConf: quicConfig(cfg.KeepAlive),
+		dialer:   &happyeyeballs.Dialer{},
+		remote:   make(map[string]*forward),
+		ready:    make(chan struct{}),
+	}
+	names := make(map[string]bool)
+	for _, rule := range cfg.Forwards {
+		if rule.Name == "" {
+			rule.Name = rule.Direction + ":" + rule.ListenAddr
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate forward name %q", rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.ListenAddr == "" || rule.TargetAddr == "" {
+			return nil, fmt.Errorf("forward %s needs a listen and a target address", rule.Name)
+		}
+		if rule.Protocol == "" {
+			rule.Protocol = ProtocolTCP
+		}
+		if rule.Protocol != ProtocolTCP && rule.Protocol != ProtocolUDP {
+			return nil, fmt.Errorf("forward %s: unknown protocol %q", rule.Name, rule.Protocol)
+		}
+		fwd := &forward{ForwardRule: rule, counters: metrics.ForwardCounters(rule.Name)}
+		switch rule.Direction {
+		case DirectionLocal:
+			c.local = append(c.local, fwd)
+		case DirectionRemote:
+			key := listenKey(rule.Protocol, rule.ListenAddr)
+			if c.remote[key] != nil {
+				return nil, fmt.Errorf("forward %s listens on %s like another one", rule.Name, key)
+			}
+			c.remote[key] = fwd
+		default:
+			return nil, fmt.Errorf("forward %s: unknown direction %q", rule.Name, rule.Direction)
+		}
+	}
+	return c, nil
+}
+
+// Run Listen for the local forwards, then keep a connection to the peer up
+// until ctx is done. A lost connection is dialed again with exponential
+// backoff, the tunnels opened meanwhile wait for it.
+func (c *Client) Run(ctx context.Context) error {
+	conn, err := migration.Listen("udp", ":0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	tr := &quic.Transport{Conn: conn}
+	defer tr.Close()
+	if c.cfg.WatchNetwork > 0 {
+		go conn.Watch(ctx, time.Duration(c.cfg.WatchNetwork)*time.Second)
+	}
+
+	for _, fwd := range c.local {
+		ln, err := c.listenLocal(fwd)
+		if err != nil {
+			return fmt.Errorf("forward %s: %w", fwd.Name, err)
+		}
+		defer ln.Close()
+	}
+
+	backoff := minBackoff
+	for {
+		qconn, err := c.dial(ctx, tr)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("[Forward] Connecting to %s failed, retrying in %v: %v", c.cfg.PeerAddr, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil
+			}
+			backoff = min(2*backoff, maxBackoff)
+			continue
+		}
+		backoff = minBackoff
+		log.Printf("[Forward] Connected to %s from %s", qconn.RemoteAddr(), conn.LocalAddr())
+		c.setConn(qconn)
+		go c.acceptStreams(qconn)
+		for _, fwd := range c.remote {
+			go c.register(qconn, fwd)
+		}
+		select {
+		case <-qconn.Context().Done():
+			c.setConn(nil)
+			log.Printf("[Forward] Connection to %s lost: %v", c.cfg.PeerAddr, context.Cause(qconn.Context()))
+		case <-ctx.Done():
+			c.setConn(nil)
+			qconn.CloseWithError(0, "")
+			return nil
+		}
+	}
+}
+
+// dial Open a connection to the peer, its address is resolved again each time
+func (c *Client) dial(ctx context.Context, tr *quic.Transport) (quic.Connection, error) {
+	addr, err := net.ResolveUDPAddr("udp", c.cfg.PeerAddr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	return tr.Dial(ctx, addr, c.tlsConf, c.quicConf)
+}
+
+// setConn Make qconn the connection tunnels are opened on, nil once it is lost
+func (c *Client) setConn(qconn quic.Connection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if qconn != nil {
+		c.qconn = qconn
+		close(c.ready)
+		return
+	}
+	if c.qconn != nil {
+		c.qconn = nil
+		c.ready = make(chan struct{})
+	}
+}
+
+// connection Return the connection to the peer, waiting for it to be back if it is lost
+func (c *Client) connection(ctx context.Context) (quic.Connection, error) {
+	for {
+		c.mu.Lock()
+		qconn, ready := c.qconn, c.ready
+		c.mu.Unlock()
+		if qconn != nil && qconn.Context().Err() == nil {
+			return qconn, nil
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no connection to the peer: %w", ctx.Err())
+		}
+	}
+}
+
+// listenLocal Listen for a local forward and serve it in the background
+func (c *Client) listenLocal(fwd *forward) (io.Closer, error) {
+	if fwd.Protocol == ProtocolUDP {
+		conn, err := net.ListenPacket("udp", fwd.ListenAddr)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[Forward] %s: udp %s -> peer -> %s", fwd.Name, conn.LocalAddr(), fwd.TargetAddr)
+		l := &udpListener{
+			name:     fwd.Name,
+			conn:     conn,
+			idle:     udpIdleTimeout(fwd.IdleTimeout),
+			counters: fwd.counters,
+			open: func() (quic.Connection, quic.Stream, error) {
+				return c.open(streamUDPConnect, fwd.TargetAddr)
+			},
+			flows: make(map[string]*pendingFlow),
+		}
+		go l.serve()
+		return conn, nil
+	}
+	ln, err := net.Listen("tcp", fwd.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[Forward] %s: %s -> peer -> %s", fwd.Name, ln.Addr(), fwd.TargetAddr)
+	go c.serveLocal(fwd, ln)
+	return ln, nil
+}
+
+// serveLocal Tunnel the connections accepted for a local forward to the peer
+func (c *Client) serveLocal(fwd *forward, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go c.forwardLocal(fwd, conn)
+	}
+}
+
+// forwardLocal Ask the peer to dial the target of fwd and relay conn to it
+func (c *Client) forwardLocal(fwd *forward, conn net.Conn) {
+	_, str, err := c.open(streamConnect, fwd.TargetAddr)
+	if err != nil {
+		fwd.counters.Failed.Add(1)
+		log.Printf("[Forward] %s: tunnel from %s failed: %v", fwd.Name, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	relay(fwd.Name, tunnel.NewNetConn(conn, nil), tunnel.NewStreamConn(str), fwd.counters)
+}
+
+// open Open a stream of kind to target and wait for the peer to accept it. If
+// the connection turns out to be lost meanwhile, it waits for the next one.
+func (c *Client) open(kind byte, target string) (quic.Connection, quic.Stream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	for {
+		qconn, err := c.connection(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		str, err := qconn.OpenStreamSync(ctx)
+		if err == nil {
+			if err = request(str, kind, target); err != nil {
+				tunnel.NewStreamConn(str).Close()
+			}
+		}
+		if err == nil {
+			return qconn, str, nil
+		}
+		if qconn.Context().Err() == nil || ctx.Err() != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// register Ask the peer to listen for a remote forward, as long as qconn lasts
+func (c *Client) register(qconn quic.Connection, fwd *forward) {
+	ctx, cancel := context.WithTimeout(qconn.Context(), dialTimeout)
+	defer cancel()
+	str, err := qconn.OpenStreamSync(ctx)
+	if err != nil {
+		return
+	}
+	if fwd.Protocol == ProtocolUDP {
+		err = request(str, streamUDPListen, fwd.ListenAddr, uint64(udpIdleTimeout(fwd.IdleTimeout)/time.Second))
+	} else {
+		err = request(str, streamListen, fwd.ListenAddr)
+	}
+	if err != nil {
+		log.Printf("[Forward] %s: peer can't listen on %s %s: %v", fwd.Name, fwd.Protocol, fwd.ListenAddr, err)
+		tunnel.NewStreamConn(str).Close()
+		return
+	}
+	log.Printf("[Forward] %s: peer %s %s -> %s", fwd.Name, fwd.Protocol, fwd.ListenAddr, fwd.TargetAddr)
+}
+
+// acceptStreams Serve the connections and flows the peer accepted for remote forwards
+func (c *Client) acceptStreams(qconn quic.Connection) {
+	for {
+		str, err := qconn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go c.forwardRemote(qconn, str)
+	}
+}
+
+// forwardRemote Dial the target of the remote forward str was accepted on and relay to it
+func (c *Client) forwardRemote(qconn quic.Connection, str quic.Stream) {
+	str.SetReadDeadline(time.Now().Add(dialTimeout))
+	kind, addr, err := readHeader(quicvarint.NewReader(str))
+	str.SetReadDeadline(time.Time{})
+	if err != nil {
+		tunnel.NewStreamConn(str).Close()
+		return
+	}
+	var fwd *forward
+	switch kind {
+	case streamAccepted:
+		fwd = c.remote[listenKey(ProtocolTCP, addr)]
+	case streamUDPAccepted:
+		fwd = c.remote[listenKey(ProtocolUDP, addr)]
+	}
+	if fwd == nil {
+		writeStatus(str, errors.New("unexpected stream"))
+		tunnel.NewStreamConn(str).Close()
+		return
+	}
+	if kind == streamUDPAccepted {
+		if err := serveUDPTarget(qconn, str, fwd.TargetAddr, fwd.counters); err != nil {
+			fwd.counters.Failed.Add(1)
+			log.Printf("[Forward] %s: flow to %s failed: %v", fwd.Name, fwd.TargetAddr, err)
+		}
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	conn, err := c.dialer.DialTCP(ctx, "tcp", fwd.TargetAddr)
+	cancel()
+	if werr := writeStatus(str, err); err != nil || werr != nil {
+		if err != nil {
+			fwd.counters.Failed.Add(1)
+			log.Printf("[Forward] %s: dialing %s failed: %v", fwd.Name, fwd.TargetAddr, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		tunnel.NewStreamConn(str).Close()
+		return
+	}
+	relay(fwd.Name, tunnel.NewStreamConn(str), tunnel.NewNetConn(conn, nil), fwd.counters)
+}
+
+// listenKey Identify a listener by protocol and address, a TCP and a UDP
+// forward may listen on the same address
+func listenKey(protocol, addr string) string {
+	return protocol + "/" + addr
+}
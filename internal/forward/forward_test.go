@@ -0,0 +1,435 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/testutil"
+)
+
+// peers Return the configs of two peers trusting each other's certificate,
+// the client has no peer address nor forwards yet
+func peers(t *testing.T) (server, client *config.ForwardConfig) {
+	t.Helper()
+	dir := t.TempDir()
+	server = &config.ForwardConfig{
+		CertPath:     filepath.Join(dir, "server_cert.pem"),
+		KeyPath:      filepath.Join(dir, "server_key.pem"),
+		PeerCertPath: filepath.Join(dir, "client_cert.pem"),
+		KeepAlive:    1,
+	}
+	client = &config.ForwardConfig{
+		ServerName:   "localhost",
+		CertPath:     filepath.Join(dir, "client_cert.pem"),
+		KeyPath:      filepath.Join(dir, "client_key.pem"),
+		PeerCertPath: filepath.Join(dir, "server_cert.pem"),
+		KeepAlive:    1,
+	}
+	for _, cfg := range []*config.ForwardConfig{server, client} {
+		if err := ensureCertificate(cfg.CertPath, cfg.KeyPath); err != nil {
+			t.Fatalf("failed to generate certificate: %v", err)
+		}
+	}
+	return server, client
+}
+
+// startServer Serve cfg on addr, a random loopback port if empty. The returned
+// function stops the server.
+func startServer(t *testing.T, cfg *config.ForwardConfig, addr string) (string, func()) {
+	t.Helper()
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	go server.Serve(conn)
+	stop := func() {
+		server.Close()
+		conn.Close()
+	}
+	t.Cleanup(stop)
+	return conn.LocalAddr().String(), stop
+}
+
+// startClient Run the client of cfg until the test ends
+func startClient(t *testing.T, cfg *config.ForwardConfig) *Client {
+	t.Helper()
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return client
+}
+
+// startEcho Serve TCP connections echoing what they receive
+func startEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// freeTCPAddr Return a loopback TCP address nobody listens on
+func freeTCPAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// dialForward Dial the listener of a forward, retrying while it comes up
+func dialForward(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(15 * time.Second))
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("failed to dial forward %s: %v", addr, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("write %q: %v", msg, err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read %q: %v", msg, err)
+	}
+	if string(buf) != msg {
+		t.Errorf("echo = %q, want %q", buf, msg)
+	}
+}
+
+func TestClient_Local(t *testing.T) {
+	serverCfg, clientCfg := peers(t)
+	serverAddr, _ := startServer(t, serverCfg, "")
+	listen := freeTCPAddr(t)
+	clientCfg.PeerAddr = serverAddr
+	clientCfg.Forwards = []config.ForwardRule{{Name: "test-local", Direction: DirectionLocal, ListenAddr: listen, TargetAddr: startEcho(t)}}
+	client := startClient(t, clientCfg)
+	// the counters of a name are global, they may hold earlier runs
+	counters := client.local[0].counters
+	before := struct{ opened, closed, up, down int64 }{
+		counters.Opened.Load(), counters.Closed.Load(), counters.BytesUp.Load(), counters.BytesDown.Load(),
+	}
+
+	conn := dialForward(t, listen)
+	echo(t, conn, "hello")
+	echo(t, conn, "through the peer")
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for counters.Closed.Load() != counters.Opened.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := counters.Opened.Load() - before.opened; got != 1 {
+		t.Errorf("opened = %d, want 1", got)
+	}
+	if got := counters.Closed.Load() - before.closed; got != 1 {
+		t.Errorf("closed = %d, want 1", got)
+	}
+	up, down := counters.BytesUp.Load()-before.up, counters.BytesDown.Load()-before.down
+	if up != 21 || down != 21 {
+		t.Errorf("bytes up, down = %d, %d, want 21, 21", up, down)
+	}
+}
+
+func TestClient_Remote(t *testing.T) {
+	serverCfg, clientCfg := peers(t)
+	serverAddr, _ := startServer(t, serverCfg, "")
+	listen := freeTCPAddr(t)
+	clientCfg.PeerAddr = serverAddr
+	clientCfg.Forwards = []config.ForwardRule{{Name: "test-remote", Direction: DirectionRemote, ListenAddr: listen, TargetAddr: startEcho(t)}}
+	client := startClient(t, clientCfg)
+	before := client.remote[listenKey(ProtocolTCP, listen)].counters.BytesUp.Load()
+
+	conn := dialForward(t, listen)
+	defer conn.Close()
+	echo(t, conn, "back through the client")
+	if got := client.remote[listenKey(ProtocolTCP, listen)].counters.BytesUp.Load() - before; got != 23 {
+		t.Errorf("bytes up = %d, want 23", got)
+	}
+}
+
+func TestClient_TargetUnreachable(t *testing.T) {
+	serverCfg, clientCfg := peers(t)
+	serverAddr, _ := startServer(t, serverCfg, "")
+	listen := freeTCPAddr(t)
+	clientCfg.PeerAddr = serverAddr
+	clientCfg.Forwards = []config.ForwardRule{{Name: "test-unreachable", Direction: DirectionLocal, ListenAddr: listen, TargetAddr: freeTCPAddr(t)}}
+	client := startClient(t, clientCfg)
+	before := client.local[0].counters.Failed.Load()
+
+	conn := dialForward(t, listen)
+	defer conn.Close()
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read %d bytes from a tunnel to nowhere", n)
+	}
+	if got := client.local[0].counters.Failed.Load() - before; got != 1 {
+		t.Errorf("failed = %d, want 1", got)
+	}
+}
+
+func TestClient_UntrustedPeer(t *testing.T) {
+	serverCfg, _ := peers(t)
+	serverAddr, _ := startServer(t, serverCfg, "")
+	// a client whose certificate the server doesn't know
+	_, strangerCfg := peers(t)
+	strangerCfg.PeerCertPath = serverCfg.CertPath
+	strangerCfg.PeerAddr = serverAddr
+	client, err := NewClient(strangerCfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	tr := &quic.Transport{Conn: testutil.ListenUDP(t)}
+	defer tr.Close()
+	qconn, err := client.dial(context.Background(), tr)
+	if err == nil {
+		// the server checks the client certificate after the client is done with the handshake
+		_, err = qconn.AcceptStream(context.Background())
+	}
+	if err == nil {
+		t.Errorf("server accepted an untrusted peer")
+	}
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	serverCfg, clientCfg := peers(t)
+	serverAddr, stop := startServer(t, serverCfg, "")
+	listen := freeTCPAddr(t)
+	clientCfg.PeerAddr = serverAddr
+	clientCfg.Forwards = []config.ForwardRule{{Name: "test-reconnect", Direction: DirectionLocal, ListenAddr: listen, TargetAddr: startEcho(t)}}
+	startClient(t, clientCfg)
+
+	conn := dialForward(t, listen)
+	echo(t, conn, "first connection")
+	conn.Close()
+
+	// the peer goes away and comes back on the same address
+	stop()
+	startServer(t, serverCfg, serverAddr)
+
+	conn = dialForward(t, listen)
+	defer conn.Close()
+	echo(t, conn, "second connection")
+}
+
+func TestClient_Migration(t *testing.T) {
+	serverCfg, clientCfg := peers(t)
+	serverCfg.FollowMigration = true
+	serverAddr, _ := startServer(t, serverCfg, "")
+	listen := freeTCPAddr(t)
+	clientCfg.PeerAddr = serverAddr
+	clientCfg.Forwards = []config.ForwardRule{{Name: "test-migration", Direction: DirectionLocal, ListenAddr: listen, TargetAddr: startEcho(t)}}
+	client := startClient(t, clientCfg)
+
+	conn := dialForward(t, listen)
+	defer conn.Close()
+	echo(t, conn, "before the move")
+
+	client.mu.Lock()
+	udp := client.conn
+	client.mu.Unlock()
+	udp.DrainTimeout = 100 * time.Millisecond
+	from := udp.LocalAddr().String()
+	if err := udp.Rebind(""); err != nil {
+		t.Fatalf("failed to rebind: %v", err)
+	}
+	if udp.LocalAddr().String() == from {
+		t.Fatalf("rebind kept address %s", from)
+	}
+	time.Sleep(200 * time.Millisecond)
+	echo(t, conn, "after the move, same tunnel")
+}
+
+// startUDPEcho Serve UDP packets echoing them to their source
+func startUDPEcho(t *testing.T) string {
+	t.Helper()
+	conn := testutil.ListenUDP(t)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxUDPPacket)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// echoUDP Send payload from conn to addr until it comes back, UDP may lose
+// the first packets while the flow opens
+func echoUDP(t *testing.T, conn net.PacketConn, addr string, payload []byte) {
+	t.Helper()
+	to, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatalf("invalid address %s: %v", addr, err)
+	}
+	buf := make([]byte, maxUDPPacket)
+	for range 20 {
+		if _, err := conn.WriteTo(payload, to); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			continue
+		}
+		if string(buf[:n]) != string(payload) {
+			t.Errorf("echo of %d bytes = %d bytes", len(payload), n)
+		}
+		return
+	}
+	t.Fatalf("no echo of %d bytes through %s", len(payload), addr)
+}
+
+func TestClient_LocalUDP(t *testing.T) {
+	serverCfg, clientCfg := peers(t)
+	serverAddr, _ := startServer(t, serverCfg, "")
+	listen := testutil.DeadUDPAddr(t)
+	clientCfg.PeerAddr = serverAddr
+	clientCfg.Forwards = []config.ForwardRule{{
+		Name: "test-local-udp", Direction: DirectionLocal, Protocol: ProtocolUDP,
+		ListenAddr: listen, TargetAddr: startUDPEcho(t), IdleTimeout: 1,
+	}}
+	client := startClient(t, clientCfg)
+	counters := client.local[0].counters
+	opened, closed, fallback := counters.Opened.Load(), counters.Closed.Load(), counters.StreamFallback.Load()
+
+	// two sources are two flows
+	a, b := testutil.ListenUDP(t), testutil.ListenUDP(t)
+	defer a.Close()
+	defer b.Close()
+	echoUDP(t, a, listen, []byte("query from a"))
+	echoUDP(t, b, listen, []byte("query from b"))
+	echoUDP(t, a, listen, []byte("again from a"))
+	if got := counters.Opened.Load() - opened; got != 2 {
+		t.Errorf("flows opened = %d, want 2", got)
+	}
+	if got := counters.StreamFallback.Load() - fallback; got != 0 {
+		t.Errorf("stream fallbacks = %d for small packets, want 0", got)
+	}
+
+	// too large for a datagram, it goes on the stream of the flow both ways
+	large := make([]byte, 4000)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	echoUDP(t, a, listen, large)
+	if got := counters.StreamFallback.Load() - fallback; got < 1 {
+		t.Errorf("stream fallbacks = %d, want at least 1", got)
+	}
+
+	// idle flows expire
+	deadline := time.Now().Add(5 * time.Second)
+	for counters.Closed.Load()-closed != 2 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := counters.Closed.Load() - closed; got != 2 {
+		t.Errorf("flows closed = %d, want 2", got)
+	}
+	// a source coming back after expiry gets a new flow
+	echoUDP(t, a, listen, []byte("after expiry"))
+	if got := counters.Opened.Load() - opened; got != 3 {
+		t.Errorf("flows opened = %d, want 3", got)
+	}
+}
+
+func TestClient_RemoteUDP(t *testing.T) {
+	serverCfg, clientCfg := peers(t)
+	serverAddr, _ := startServer(t, serverCfg, "")
+	listen := testutil.DeadUDPAddr(t)
+	clientCfg.PeerAddr = serverAddr
+	clientCfg.Forwards = []config.ForwardRule{{
+		Name: "test-remote-udp", Direction: DirectionRemote, Protocol: ProtocolUDP,
+		ListenAddr: listen, TargetAddr: startUDPEcho(t),
+	}}
+	client := startClient(t, clientCfg)
+	counters := client.remote[listenKey(ProtocolUDP, listen)].counters
+	up := counters.BytesUp.Load()
+
+	conn := testutil.ListenUDP(t)
+	defer conn.Close()
+	echoUDP(t, conn, listen, []byte("syslog line"))
+	if got := counters.BytesUp.Load() - up; got < 11 {
+		t.Errorf("bytes up = %d, want at least 11", got)
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	type tCase struct {
+		name string
+		kind byte
+		addr string
+	}
+	type tTable []tCase
+	table := tTable{
+		{"connect", streamConnect, "example.com:443"},
+		{"listen", streamListen, "127.0.0.1:2222"},
+		{"empty address", streamAccepted, ""},
+	}
+	for _, c := range table {
+		pr, pw := io.Pipe()
+		go func() {
+			writeHeader(pw, c.kind, c.addr)
+			pw.Close()
+		}()
+		kind, addr, err := readHeader(quicvarint.NewReader(pr))
+		if err != nil || kind != c.kind || addr != c.addr {
+			t.Errorf("%s: readHeader = %d, %q, %v, want %d, %q", c.name, kind, addr, err, c.kind, c.addr)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Package forward forwards TCP and UDP ports between two quic-proxy instances
+// over one QUIC connection, like ssh -L and -R. Each forwarded TCP connection
+// is a bidirectional QUIC stream, each UDP flow a stream too while its packets
+// go in QUIC datagrams. Both instances authenticate each other with TLS
+// certificates, the connection is kept alive, dialed again with backoff when
+// it is lost and follows the client across local address changes.
+//
+// A stream starts with a type byte and an address, a varint length followed
+// by the bytes. The side receiving it answers with a status byte, 0 for
+// success, or 1 followed by an error message, then both relay bytes:
+//
+//	connect      (0x01) client -> server: dial the address, a local forward
+//	listen       (0x02) client -> server: listen on the address as long as
+//	                    the stream is open, a remote forward
+//	accepted     (0x03) server -> client: the remote forward on the address
+//	                    accepted a connection, dial its target
+//	udp connect  (0x04) client -> server: a UDP flow to the address
+//	udp listen   (0x05) client -> server: like listen for UDP, the address is
+//	                    followed by the idle timeout of the flows in seconds
+//	udp accepted (0x06) server -> client: a UDP flow from a remote forward
+//
+// The streams of UDP flows carry the packets too large for a datagram, each
+// prefixed with its varint length. A datagram starts with the varint ID of
+// the stream of its flow, the UDP payload follows.
+package forward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/qlog"
+	"github.com/quic-go/quic-go/quicvarint"
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/metrics"
+	"quic-proxy/internal/tunnel"
+	"quic-proxy/internal/utils"
+)
+
+// NextProto is the ALPN of the connections between two instances
+const NextProto = "quic-proxy-forward"
+
+const (
+	streamConnect  byte = 0x01
+	streamListen   byte = 0x02
+	streamAccepted byte = 0x03
+
+	streamUDPConnect  byte = 0x04
+	streamUDPListen   byte = 0x05
+	streamUDPAccepted byte = 0x06
+
+	statusOK     byte = 0x00
+	statusFailed byte = 0x01
+)
+
+const (
+	// dialTimeout bounds the opening of a tunnel, including waiting for the
+	// connection to the peer to come back
+	dialTimeout = 10 * time.Second
+	// defaultKeepAlive is the keep-alive period when none is configured, the
+	// connection is declared lost after three of them without an answer
+	defaultKeepAlive = 10 * time.Second
+	// statusTimeout bounds the wait for the answer to a stream header, the
+	// peer may be dialing for up to dialTimeout
+	statusTimeout = dialTimeout + 5*time.Second
+	// maxAddrLen bounds the address of a stream header
+	maxAddrLen = 1024
+)
+
+// request Start str as a stream of kind for addr and wait for the peer to answer
+func request(str quic.Stream, kind byte, addr string, params ...uint64) error {
+	if err := writeHeader(str, kind, addr, params...); err != nil {
+		return err
+	}
+	str.SetReadDeadline(time.Now().Add(statusTimeout))
+	defer str.SetReadDeadline(time.Time{})
+	return readStatus(quicvarint.NewReader(str))
+}
+
+// writeHeader Start a stream of kind for addr, params are the varints some
+// kinds of streams take after the address
+func writeHeader(w io.Writer, kind byte, addr string, params ...uint64) error {
+	b := append([]byte{kind}, quicvarint.Append(nil, uint64(len(addr)))...)
+	b = append(b, addr...)
+	for _, param := range params {
+		b = quicvarint.Append(b, param)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readHeader Read the type and the address starting a stream
+func readHeader(r quicvarint.Reader) (byte, string, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return 0, "", err
+	}
+	addr, err := readString(r)
+	return kind, addr, err
+}
+
+// writeStatus Answer a stream header, err nil for success
+func writeStatus(w io.Writer, err error) error {
+	if err == nil {
+		_, werr := w.Write([]byte{statusOK})
+		return werr
+	}
+	msg := err.Error()
+	b := append([]byte{statusFailed}, quicvarint.Append(nil, uint64(len(msg)))...)
+	_, werr := w.Write(append(b, msg...))
+	return werr
+}
+
+// readStatus Read the answer to a stream header, the error the peer reported if it failed
+func readStatus(r quicvarint.Reader) error {
+	status, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch status {
+	case statusOK:
+		return nil
+	case statusFailed:
+		msg, err := readString(r)
+		if err != nil {
+			return err
+		}
+		return errors.New(msg)
+	default:
+		return fmt.Errorf("invalid status %d", status)
+	}
+}
+
+// readString Read a varint length and as many bytes
+func readString(r quicvarint.Reader) (string, error) {
+	l, err := quicvarint.Read(r)
+	if err != nil {
+		return "", err
+	}
+	if l > maxAddrLen {
+		return "", fmt.Errorf("address of %d bytes is too long", l)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// tlsConfig Load the certificate of this instance, generated if it doesn't
+// exist yet, and trust the certificate of the peer only. Either side requires
+// the other to present its certificate.
+func tlsConfig(cfg *config.ForwardConfig) (*tls.Config, error) {
+	if err := ensureCertificate(cfg.CertPath, cfg.KeyPath); err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertPath, cfg.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	peerPEM, err := os.ReadFile(cfg.PeerCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer certificate: %w", err)
+	}
+	peers := x509.NewCertPool()
+	if !peers.AppendCertsFromPEM(peerPEM) {
+		return nil, fmt.Errorf("no certificate in %s", cfg.PeerCertPath)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      peers,
+		ClientCAs:    peers,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		NextProtos:   []string{NextProto},
+	}, nil
+}
+
+// ensureCertificate Generate a self-signed certificate usable on both sides of
+// mutual TLS if none exists yet. Its peer has to be given a copy.
+func ensureCertificate(certPath, keyPath string) error {
+	if _, err := os.Stat(certPath); err == nil {
+		if _, err := os.Stat(keyPath); err == nil {
+			return nil
+		}
+	}
+	certGenerator := *utils.DefaultTLSCertificateGenerator
+	certGenerator.ClientAuth = true
+	certGenerator.CertPath = certPath
+	certGenerator.KeyPath = keyPath
+	if err := certGenerator.Generate(); err != nil {
+		return fmt.Errorf("failed to generate certificate: %w", err)
+	}
+	log.Printf("[Forward] Generated %s, copy it to the peer as its peer_cert_path", certPath)
+	return nil
+}
+
+// quicConfig Return the QUIC config of both sides, keep-alives every
+// keepAlive seconds
+func quicConfig(keepAlive int) *quic.Config {
+	period := time.Duration(keepAlive) * time.Second
+	if period <= 0 {
+		period = defaultKeepAlive
+	}
+	return &quic.Config{
+		KeepAlivePeriod:    period,
+		MaxIdleTimeout:     3 * period,
+		MaxIncomingStreams: 1 << 12,
+		EnableDatagrams:    true,
+		Tracer:             qlog.DefaultConnectionTracer,
+	}
+}
+
+// countedConn adds the bytes read from a tunnel side to a counter as they come
+type countedConn struct {
+	tunnel.Conn
+	n *atomic.Int64
+}
+
+func (c countedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// relay Relay a tunnel between from, the side of the listener, and to, the
+// side of the target. counters is nil when the tunnel isn't counted.
+func relay(name string, from, to tunnel.Conn, counters *metrics.Forward) {
+	if counters != nil {
+		counters.Opened.Add(1)
+		defer counters.Closed.Add(1)
+		from = countedConn{from, &counters.BytesUp}
+		to = countedConn{to, &counters.BytesDown}
+	}
+	stats, err := tunnel.Relay(from, to)
+	if err != nil && !tunnel.IsClosedError(err) {
+		log.Printf("[Forward] %s tunnel failed after %v, %d bytes up, %d bytes down: %v",
+			name, stats.Duration.Round(time.Millisecond), stats.Up, stats.Down, err)
+		return
+	}
+	log.Printf("[Forward] %s tunnel closed after %v, %d bytes up, %d bytes down",
+		name, stats.Duration.Round(time.Millisecond), stats.Up, stats.Down)
+}
@@ -0,0 +1,306 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+	"quic-proxy/internal/config"
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+	"quic-proxy/internal/migration"
+	"quic-proxy/internal/tunnel"
+)
+
+// Server accepts the connections of peers presenting the trusted
+// certificate, dials the targets of their local forwards and listens for
+// their remote forwards
+type Server struct {
+	cfg      *config.ForwardConfig
+	tlsConf  *tls.Config
+	quicConf *quic.Config
+	dialer   *happyeyeballs.Dialer
+
+	mu        sync.Mutex
+	listeners map[string]io.Closer // remote forwards by listenKey
+	conns     map[quic.Connection]struct{}
+	transport *quic.Transport
+	ln        *quic.Listener
+}
+
+// NewServer Create the server of cfg, its certificates are loaded right away
+func NewServer(cfg *config.ForwardConfig) (*Server, error) {
+	tlsConf, err := tlsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		cfg:       cfg,
+		tlsConf:   tlsConf,
+		quicConf:  quicConfig(cfg.KeepAlive),
+		dialer:    &happyeyeballs.Dialer{},
+		listeners: make(map[string]io.Closer),
+		conns:     make(map[quic.Connection]struct{}),
+	}, nil
+}
+
+// ListenAndServe Listen on the configured UDP address and serve the peers
+func (s *Server) ListenAndServe() error {
+	conn, err := net.ListenPacket("udp", s.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return s.Serve(conn)
+}
+
+// Serve Serve the peers connecting on conn until the server is closed. With
+// FollowMigration the peers keep their connection when their address changes.
+func (s *Server) Serve(conn net.PacketConn) error {
+	tr := &quic.Transport{Conn: conn}
+	if s.cfg.FollowMigration {
+		tr = &quic.Transport{Conn: migration.Follow(conn), ConnectionIDLength: migration.ConnectionIDLength}
+	}
+	ln, err := tr.Listen(s.tlsConf, s.quicConf)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.transport, s.ln = tr, ln
+	s.mu.Unlock()
+	log.Printf("[Forward] Listening on %s", conn.LocalAddr())
+	for {
+		qconn, err := ln.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(qconn)
+	}
+}
+
+// Close Stop accepting peers, close their connections and the listeners of
+// their remote forwards. The peers are told, so they reconnect right away.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, ln := range s.listeners {
+		ln.Close()
+		delete(s.listeners, addr)
+	}
+	for qconn := range s.conns {
+		qconn.CloseWithError(0, "server closed")
+		delete(s.conns, qconn)
+	}
+	if s.transport == nil {
+		return nil
+	}
+	s.ln.Close()
+	return s.transport.Close()
+}
+
+// serveConn Handle the streams of a peer until its connection is lost
+func (s *Server) serveConn(qconn quic.Connection) {
+	peer := qconn.RemoteAddr()
+	s.mu.Lock()
+	s.conns[qconn] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, qconn)
+		s.mu.Unlock()
+	}()
+	if certs := qconn.ConnectionState().TLS.PeerCertificates; len(certs) > 0 {
+		log.Printf("[Forward] Peer %s connected as %q", peer, certs[0].Subject.CommonName)
+	}
+	for {
+		str, err := qconn.AcceptStream(context.Background())
+		if err != nil {
+			log.Printf("[Forward] Peer %s disconnected: %v", peer, err)
+			return
+		}
+		go s.handleStream(qconn, str)
+	}
+}
+
+// handleStream Serve a stream of the peer according to its header
+func (s *Server) handleStream(qconn quic.Connection, str quic.Stream) {
+	str.SetReadDeadline(time.Now().Add(dialTimeout))
+	kind, addr, err := readHeader(quicvarint.NewReader(str))
+	str.SetReadDeadline(time.Time{})
+	if err != nil {
+		str.CancelRead(0)
+		str.CancelWrite(0)
+		return
+	}
+	switch kind {
+	case streamConnect:
+		s.connect(qconn, str, addr)
+	case streamListen:
+		s.listen(qconn, str, addr)
+	case streamUDPConnect:
+		if err := serveUDPTarget(qconn, str, addr, nil); err != nil {
+			log.Printf("[Forward] Flow to %s for %s failed: %v", addr, qconn.RemoteAddr(), err)
+		}
+	case streamUDPListen:
+		str.SetReadDeadline(time.Now().Add(dialTimeout))
+		idle, err := quicvarint.Read(quicvarint.NewReader(str))
+		str.SetReadDeadline(time.Time{})
+		if err != nil {
+			tunnel.NewStreamConn(str).Close()
+			return
+		}
+		s.listenUDP(qconn, str, addr, time.Duration(idle)*time.Second)
+	default:
+		writeStatus(str, fmt.Errorf("unexpected stream type %d", kind))
+		str.CancelRead(0)
+		str.Close()
+	}
+}
+
+// connect Dial addr for a local forward of the peer and relay the stream to it
+func (s *Server) connect(qconn quic.Connection, str quic.Stream, addr string) {
+	ctx, cancel := context.WithTimeout(qconn.Context(), dialTimeout)
+	conn, err := s.dialer.DialTCP(ctx, "tcp", addr)
+	cancel()
+	if werr := writeStatus(str, err); err != nil || werr != nil {
+		if err != nil {
+			log.Printf("[Forward] Dialing %s for %s failed: %v", addr, qconn.RemoteAddr(), err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		tunnel.NewStreamConn(str).Close()
+		return
+	}
+	relay(fmt.Sprintf("%s -> %s", qconn.RemoteAddr(), addr), tunnel.NewStreamConn(str), tunnel.NewNetConn(conn, nil), nil)
+}
+
+// listen Listen on addr for a remote forward of the peer while str is open
+func (s *Server) listen(qconn quic.Connection, str quic.Stream, addr string) {
+	var ln net.Listener
+	if !s.register(qconn, str, ProtocolTCP, addr, func() (io.Closer, error) {
+		var err error
+		ln, err = net.Listen("tcp", addr)
+		return ln, err
+	}) {
+		return
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.accepted(qconn, addr, conn)
+	}
+}
+
+// listenUDP Listen on addr for a remote UDP forward of the peer while str is
+// open, each source is a flow to the peer
+func (s *Server) listenUDP(qconn quic.Connection, str quic.Stream, addr string, idle time.Duration) {
+	var conn net.PacketConn
+	if !s.register(qconn, str, ProtocolUDP, addr, func() (io.Closer, error) {
+		var err error
+		conn, err = net.ListenPacket("udp", addr)
+		return conn, err
+	}) {
+		return
+	}
+	l := &udpListener{
+		name: fmt.Sprintf("udp %s for %s", addr, qconn.RemoteAddr()),
+		conn: conn,
+		idle: udpIdleTimeout(int(idle / time.Second)),
+		open: func() (quic.Connection, quic.Stream, error) {
+			ctx, cancel := context.WithTimeout(qconn.Context(), dialTimeout)
+			defer cancel()
+			str, err := qconn.OpenStreamSync(ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := request(str, streamUDPAccepted, addr); err != nil {
+				tunnel.NewStreamConn(str).Close()
+				return nil, nil, err
+			}
+			return qconn, str, nil
+		},
+		flows: make(map[string]*pendingFlow),
+	}
+	l.serve()
+}
+
+// register Open the listener of a remote forward with listen and answer str.
+// A listener already open on the address for an earlier connection is
+// replaced, the peer is reconnecting before the server noticed its old
+// connection died. The listener is closed once str or the connection ends,
+// register reports whether it was opened.
+func (s *Server) register(qconn quic.Connection, str quic.Stream, protocol, addr string, listen func() (io.Closer, error)) bool {
+	key := listenKey(protocol, addr)
+	s.mu.Lock()
+	if old := s.listeners[key]; old != nil {
+		old.Close()
+		delete(s.listeners, key)
+	}
+	ln, err := listen()
+	if err == nil {
+		s.listeners[key] = ln
+	}
+	s.mu.Unlock()
+	if werr := writeStatus(str, err); err != nil || werr != nil {
+		if err != nil {
+			log.Printf("[Forward] Listening on %s for %s failed: %v", key, qconn.RemoteAddr(), err)
+		} else {
+			s.unregister(key, ln)
+		}
+		str.CancelRead(0)
+		str.Close()
+		return false
+	}
+	log.Printf("[Forward] Listening on %s for %s", key, qconn.RemoteAddr())
+
+	// the remote forward ends with its stream or the connection
+	go func() {
+		io.Copy(io.Discard, str)
+		s.unregister(key, ln)
+		str.Close()
+		log.Printf("[Forward] Stopped listening on %s for %s", key, qconn.RemoteAddr())
+	}()
+	return true
+}
+
+// unregister Close the listener of a remote forward
+func (s *Server) unregister(key string, ln io.Closer) {
+	s.mu.Lock()
+	if s.listeners[key] == ln {
+		delete(s.listeners, key)
+	}
+	s.mu.Unlock()
+	ln.Close()
+}
+
+// accepted Hand a connection accepted by a remote forward over to the peer,
+// which dials the target
+func (s *Server) accepted(qconn quic.Connection, addr string, conn net.Conn) {
+	ctx, cancel := context.WithTimeout(qconn.Context(), dialTimeout)
+	defer cancel()
+	str, err := qconn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if err := request(str, streamAccepted, addr); err != nil {
+		log.Printf("[Forward] Peer %s refused connection from %s on %s: %v", qconn.RemoteAddr(), conn.RemoteAddr(), addr, err)
+		conn.Close()
+		tunnel.NewStreamConn(str).Close()
+		return
+	}
+	relay(fmt.Sprintf("%s -> %s", conn.RemoteAddr(), addr), tunnel.NewNetConn(conn, nil), tunnel.NewStreamConn(str), nil)
+}
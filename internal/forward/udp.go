@@ -0,0 +1,344 @@
+package forward
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+	"quic-proxy/internal/metrics"
+)
+
+const (
+	// defaultUDPIdleTimeout closes the UDP flows that carried nothing for longer
+	defaultUDPIdleTimeout = 60 * time.Second
+	// maxUDPPacket is the largest UDP payload relayed
+	maxUDPPacket = 65535
+	// flowQueueLen is how many packets wait for a flow to open before the
+	// next ones are dropped, like a full socket buffer would
+	flowQueueLen = 64
+)
+
+// flowTables holds the flows of each connection, created with the first flow
+var flowTables sync.Map // quic.Connection -> *flowTable
+
+// flowTable dispatches the datagrams of one connection to its UDP flows.
+// A datagram starts with the flow ID, the ID of the stream of the flow.
+type flowTable struct {
+	qconn quic.Connection
+
+	mu    sync.Mutex
+	flows map[quic.StreamID]*udpFlow
+}
+
+// flowsOf Return the flows of qconn, receiving its datagrams on first use
+func flowsOf(qconn quic.Connection) *flowTable {
+	if t, ok := flowTables.Load(qconn); ok {
+		return t.(*flowTable)
+	}
+	t, loaded := flowTables.LoadOrStore(qconn, &flowTable{qconn: qconn, flows: make(map[quic.StreamID]*udpFlow)})
+	if !loaded {
+		go t.(*flowTable).receive()
+	}
+	return t.(*flowTable)
+}
+
+// receive Hand the datagrams of the connection to their flows until it is closed
+func (t *flowTable) receive() {
+	defer flowTables.Delete(t.qconn)
+	for {
+		b, err := t.qconn.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+		id, n, err := quicvarint.Parse(b)
+		if err != nil {
+			continue
+		}
+		t.mu.Lock()
+		f := t.flows[quic.StreamID(id)]
+		t.mu.Unlock()
+		if f != nil {
+			f.receive(b[n:])
+		}
+	}
+}
+
+// udpFlow is the packets exchanged between one UDP source and one target. They
+// go in datagrams, or on the stream of the flow when they don't fit in one.
+// Closing the stream ends the flow on both sides.
+type udpFlow struct {
+	table   *flowTable
+	str     quic.Stream
+	deliver func(payload []byte)
+	// sent and received count payload bytes, nil when the flow isn't counted
+	sent, received *atomic.Int64
+	counters       *metrics.Forward
+
+	last      atomic.Int64 // unix nanoseconds of the last packet
+	writeMu   sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newFlow Start the flow carried by str, deliver is given the packets of the
+// peer. counters is nil when the flow isn't counted, listener tells on which
+// side of the forward the flow is.
+func newFlow(qconn quic.Connection, str quic.Stream, deliver func([]byte), counters *metrics.Forward, listener bool) *udpFlow {
+	f := &udpFlow{table: flowsOf(qconn), str: str, deliver: deliver, counters: counters, done: make(chan struct{})}
+	if counters != nil {
+		counters.Opened.Add(1)
+		if listener {
+			f.sent, f.received = &counters.BytesUp, &counters.BytesDown
+		} else {
+			f.sent, f.received = &counters.BytesDown, &counters.BytesUp
+		}
+	}
+	f.touch()
+	f.table.mu.Lock()
+	f.table.flows[str.StreamID()] = f
+	f.table.mu.Unlock()
+	go f.readStream()
+	return f
+}
+
+func (f *udpFlow) touch() {
+	f.last.Store(time.Now().UnixNano())
+}
+
+// send Send a packet to the peer, on the stream if it doesn't fit in a datagram
+func (f *udpFlow) send(payload []byte) error {
+	f.touch()
+	if f.sent != nil {
+		f.sent.Add(int64(len(payload)))
+	}
+	if f.table.qconn.ConnectionState().SupportsDatagrams {
+		b := quicvarint.Append(make([]byte, 0, 8+len(payload)), uint64(f.str.StreamID()))
+		err := f.table.qconn.SendDatagram(append(b, payload...))
+		var tooLarge *quic.DatagramTooLargeError
+		if !errors.As(err, &tooLarge) {
+			return err
+		}
+	}
+	if f.counters != nil {
+		f.counters.StreamFallback.Add(1)
+	}
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+	b := quicvarint.Append(make([]byte, 0, 8+len(payload)), uint64(len(payload)))
+	_, err := f.str.Write(append(b, payload...))
+	return err
+}
+
+// receive Deliver a packet of the peer
+func (f *udpFlow) receive(payload []byte) {
+	f.touch()
+	if f.received != nil {
+		f.received.Add(int64(len(payload)))
+	}
+	f.deliver(payload)
+}
+
+// readStream Deliver the packets the peer sent on the stream, until it ends
+func (f *udpFlow) readStream() {
+	defer f.close()
+	r := bufio.NewReader(f.str)
+	for {
+		l, err := quicvarint.Read(r)
+		if err != nil {
+			return
+		}
+		if l > maxUDPPacket {
+			log.Printf("[Forward] Flow %d: packet of %d bytes on the stream is too large", f.str.StreamID(), l)
+			return
+		}
+		payload := make([]byte, l)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		f.receive(payload)
+	}
+}
+
+// expire Close the flow once it carried nothing for idle
+func (f *udpFlow) expire(idle time.Duration) {
+	ticker := time.NewTicker(idle / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, f.last.Load())) > idle {
+				f.close()
+				return
+			}
+		}
+	}
+}
+
+// close End the flow and its stream
+func (f *udpFlow) close() {
+	f.closeOnce.Do(func() {
+		f.table.mu.Lock()
+		delete(f.table.flows, f.str.StreamID())
+		f.table.mu.Unlock()
+		f.str.CancelRead(0)
+		f.str.Close()
+		if f.counters != nil {
+			f.counters.Closed.Add(1)
+		}
+		close(f.done)
+	})
+}
+
+// udpListener is the listening side of a UDP forward. Its socket fixes the
+// protocol and the destination of the 5-tuple, so each source address is a
+// flow of its own, opened on the first packet from it.
+type udpListener struct {
+	name     string
+	conn     net.PacketConn
+	idle     time.Duration
+	counters *metrics.Forward
+	// open Opens the stream of a new flow, the peer has dialed the target
+	// when it returns
+	open func() (quic.Connection, quic.Stream, error)
+
+	mu    sync.Mutex
+	flows map[string]*pendingFlow // by source address
+}
+
+// pendingFlow queues the packets of a source until its flow is open
+type pendingFlow struct {
+	queue chan []byte
+}
+
+// serve Read the packets of the sources until conn is closed, then end the flows
+func (l *udpListener) serve() {
+	defer func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, p := range l.flows {
+			close(p.queue)
+		}
+		l.flows = nil
+	}()
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, src, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		payload := append([]byte(nil), buf[:n]...)
+		key := src.String()
+		l.mu.Lock()
+		p := l.flows[key]
+		if p == nil {
+			p = &pendingFlow{queue: make(chan []byte, flowQueueLen)}
+			l.flows[key] = p
+			go l.run(src, p)
+		}
+		select {
+		case p.queue <- payload:
+		default:
+		}
+		l.mu.Unlock()
+	}
+}
+
+// run Open the flow of src and send its packets until it is closed
+func (l *udpListener) run(src net.Addr, p *pendingFlow) {
+	defer func() {
+		l.mu.Lock()
+		if l.flows != nil && l.flows[src.String()] == p {
+			delete(l.flows, src.String())
+		}
+		l.mu.Unlock()
+	}()
+	qconn, str, err := l.open()
+	if err != nil {
+		if l.counters != nil {
+			l.counters.Failed.Add(1)
+		}
+		log.Printf("[Forward] %s: flow from %s failed: %v", l.name, src, err)
+		return
+	}
+	f := newFlow(qconn, str, func(payload []byte) {
+		l.conn.WriteTo(payload, src)
+	}, l.counters, true)
+	go f.expire(l.idle)
+	defer f.close()
+	for {
+		select {
+		case payload, ok := <-p.queue:
+			if !ok {
+				return
+			}
+			if err := f.send(payload); err != nil {
+				return
+			}
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// serveUDPTarget Dial target for a flow the peer opened on str and relay it
+// until the flow ends. counters is nil when the flow isn't counted.
+func serveUDPTarget(qconn quic.Connection, str quic.Stream, target string, counters *metrics.Forward) error {
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		writeStatus(str, err)
+		str.CancelRead(0)
+		str.Close()
+		return err
+	}
+	defer conn.Close()
+	// the flow is known before the peer hears of it and sends its first datagram
+	f := newFlow(qconn, str, func(payload []byte) {
+		conn.Write(payload)
+	}, counters, false)
+	if err := writeStatus(str, nil); err != nil {
+		f.close()
+		return err
+	}
+	go func() {
+		<-f.done
+		conn.Close()
+	}()
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			select {
+			case <-f.done:
+				return nil
+			default:
+			}
+			// a closed port answers with ICMP, the source may try again
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			continue
+		}
+		if err := f.send(buf[:n]); err != nil {
+			f.close()
+			return nil
+		}
+	}
+}
+
+// udpIdleTimeout Return the idle timeout of seconds, the default if not set
+func udpIdleTimeout(seconds int) time.Duration {
+	if seconds <= 0 {
+		return defaultUDPIdleTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
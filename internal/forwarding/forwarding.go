@@ -0,0 +1,234 @@
+// Package forwarding maintains the headers a proxy adds to what it forwards:
+// Via (RFC 9110 section 7.6.3) with the protocol version of every hop,
+// Forwarded (RFC 7239) and the de facto X-Forwarded-* headers. The
+// forwarding headers of a downstream are only kept if it is a trusted proxy,
+// and a request already carrying our Via entry is a proxy loop.
+package forwarding
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"quic-proxy/internal/config"
+	h2h3convert "quic-proxy/internal/h2h3-convert"
+)
+
+var ErrLoop = errors.New("proxy loop detected")
+
+// forwardingHeaders are replaced with our own unless the downstream is trusted
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+}
+
+// Default is used by the proxy modes that have no forwarding config of their own
+var Default = mustNew(config.ForwardingConfig{})
+
+// Forwarder adds the forwarding headers of one proxy
+type Forwarder struct {
+	// Name identifies this proxy in Via and in the by= of Forwarded
+	Name    string
+	trusted []netip.Prefix
+}
+
+// New Create a forwarder from cfg. Without a name, one is generated, it has
+// to be unique within a chain of proxies for the loops to be detected.
+func New(cfg config.ForwardingConfig) (*Forwarder, error) {
+	f := &Forwarder{Name: cfg.ProxyName}
+	if f.Name == "" {
+		var b [3]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		f.Name = "quic-proxy-" + hex.EncodeToString(b[:])
+	}
+	if !isObfuscatedID(f.Name) {
+		return nil, fmt.Errorf("invalid proxy name %q: only letters, digits, '.', '_' and '-' are allowed", f.Name)
+	}
+	for _, s := range cfg.TrustedProxies {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		f.trusted = append(f.trusted, prefix.Masked())
+	}
+	return f, nil
+}
+
+func mustNew(cfg config.ForwardingConfig) *Forwarder {
+	f, err := New(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// isObfuscatedID reports whether name can follow the "_" of an obfuscated
+// identifier, RFC 7239 section 6.3. Such names are valid Via pseudonyms too.
+func isObfuscatedID(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// CheckLoop Return ErrLoop if in already went through this proxy
+func (f *Forwarder) CheckLoop(in *http.Request) error {
+	for _, v := range in.Header.Values("Via") {
+		for _, entry := range strings.Split(v, ",") {
+			fields := strings.Fields(entry)
+			if len(fields) >= 2 && strings.EqualFold(fields[1], f.Name) {
+				return fmt.Errorf("%w: %s %s already went through %s", ErrLoop, in.Method, in.URL, f.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Request Prepare h, the header of the request forwarded for in: the
+// connection-specific headers go, and this hop is appended to Via, Forwarded
+// and X-Forwarded-For. h may be in.Header itself.
+func (f *Forwarder) Request(h http.Header, in *http.Request) {
+	via := in.Header.Values("Via")
+	var prior map[string][]string
+	if f.trusts(in.RemoteAddr) {
+		prior = make(map[string][]string, len(forwardingHeaders))
+		for _, name := range forwardingHeaders {
+			prior[name] = in.Header.Values(name)
+		}
+	}
+	h2h3convert.StripConnectionHeaders(h)
+	for _, name := range forwardingHeaders {
+		h.Del(name)
+	}
+
+	client := clientIP(in.RemoteAddr)
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	h.Set("Via", joinList(via, viaVersion(in.ProtoMajor, in.ProtoMinor)+" "+f.Name))
+	forwarded := "for=" + forwardedNode(client) + ";by=_" + f.Name + ";proto=" + proto
+	if in.Host != "" {
+		forwarded += ";host=" + quoteIfNeeded(in.Host)
+	}
+	h.Set("Forwarded", joinList(prior["Forwarded"], forwarded))
+	if client.IsValid() {
+		h.Set("X-Forwarded-For", joinList(prior["X-Forwarded-For"], client.String()))
+	} else if xff := prior["X-Forwarded-For"]; len(xff) > 0 {
+		h.Set("X-Forwarded-For", strings.Join(xff, ", "))
+	}
+	h.Set("X-Forwarded-Host", in.Host)
+	if host := prior["X-Forwarded-Host"]; len(host) > 0 {
+		h.Set("X-Forwarded-Host", host[0])
+	}
+	h.Set("X-Forwarded-Proto", proto)
+	if p := prior["X-Forwarded-Proto"]; len(p) > 0 {
+		h.Set("X-Forwarded-Proto", p[0])
+	}
+}
+
+// Response Append this hop to the Via of resp, with the protocol it was received over
+func (f *Forwarder) Response(resp *http.Response) {
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Header.Set("Via", joinList(resp.Header.Values("Via"), viaVersion(resp.ProtoMajor, resp.ProtoMinor)+" "+f.Name))
+}
+
+// trusts reports whether the peer at remoteAddr is a trusted proxy
+func (f *Forwarder) trusts(remoteAddr string) bool {
+	addr := clientIP(remoteAddr)
+	if !addr.IsValid() {
+		return false
+	}
+	for _, prefix := range f.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP Extract the IP of a RemoteAddr, the zero Addr if there is none
+func clientIP(remoteAddr string) netip.Addr {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap().WithZone("")
+}
+
+// forwardedNode Format addr as the node of a for= parameter, IPv6 addresses
+// are bracketed and quoted, RFC 7239 section 6
+func forwardedNode(addr netip.Addr) string {
+	switch {
+	case !addr.IsValid():
+		return "unknown"
+	case addr.Is6():
+		return `"[` + addr.String() + `]"`
+	default:
+		return addr.String()
+	}
+}
+
+// quoteIfNeeded Quote a parameter value that isn't a token, a host with a port for instance
+func quoteIfNeeded(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.ReplaceAll(strings.ReplaceAll(v, `\`, `\\`), `"`, `\"`) + `"`
+		}
+	}
+	return v
+}
+
+// isTokenChar reports whether c may appear in a token, RFC 9110 section 5.6.2
+func isTokenChar(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// viaVersion Return the HTTP version of a hop as Via writes it: "1.1" for
+// HTTP/1.1, "2" and "3" for HTTP/2 and HTTP/3, which have no minor version.
+// The protocol name is left out, it is HTTP.
+func viaVersion(major, minor int) string {
+	if major >= 2 {
+		return strconv.Itoa(major)
+	}
+	return strconv.Itoa(major) + "." + strconv.Itoa(minor)
+}
+
+// joinList Append v to the values of a list header, as a single field line
+func joinList(values []string, v string) string {
+	if len(values) == 0 {
+		return v
+	}
+	return strings.Join(values, ", ") + ", " + v
+}
@@ -0,0 +1,154 @@
+package forwarding
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"quic-proxy/internal/config"
+)
+
+func TestForwarder_Request(t *testing.T) {
+	f, err := New(config.ForwardingConfig{ProxyName: "edge", TrustedProxies: []string{"10.0.0.0/8", "::1"}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tTable := []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		major      int
+		header     http.Header
+		expected   http.Header
+	}{
+		{
+			name:       "untrusted client, spoofed headers dropped",
+			remoteAddr: "192.0.2.7:5000",
+			major:      1,
+			header: http.Header{
+				"X-Forwarded-For": {"1.2.3.4"}, "Forwarded": {"for=1.2.3.4"}, "X-Forwarded-Proto": {"https"},
+				"Connection": {"X-Hop, TE"}, "X-Hop": {"1"}, "Te": {"trailers"}, "Accept": {"*/*"},
+			},
+			expected: http.Header{
+				"Accept":            {"*/*"},
+				"Te":                {"trailers"},
+				"Via":               {"1.1 edge"},
+				"Forwarded":         {"for=192.0.2.7;by=_edge;proto=http;host=\"example.com:8080\""},
+				"X-Forwarded-For":   {"192.0.2.7"},
+				"X-Forwarded-Host":  {"example.com:8080"},
+				"X-Forwarded-Proto": {"http"},
+			},
+		},
+		{
+			name:       "trusted proxy, its headers are extended",
+			remoteAddr: "10.1.2.3:5000",
+			tls:        true,
+			major:      3,
+			header: http.Header{
+				"Via":               {"1.1 first"},
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"Forwarded":         {"for=198.51.100.1;proto=http"},
+				"X-Forwarded-Host":  {"origin.example"},
+				"X-Forwarded-Proto": {"http"},
+			},
+			expected: http.Header{
+				"Via":               {"1.1 first, 3 edge"},
+				"Forwarded":         {"for=198.51.100.1;proto=http, for=10.1.2.3;by=_edge;proto=https;host=\"example.com:8080\""},
+				"X-Forwarded-For":   {"198.51.100.1, 10.1.2.3"},
+				"X-Forwarded-Host":  {"origin.example"},
+				"X-Forwarded-Proto": {"http"},
+			},
+		},
+		{
+			name:       "IPv6 client over HTTP/2",
+			remoteAddr: "[2001:db8::1]:443",
+			tls:        true,
+			major:      2,
+			header:     http.Header{},
+			expected: http.Header{
+				"Via":               {"2 edge"},
+				"Forwarded":         {"for=\"[2001:db8::1]\";by=_edge;proto=https;host=\"example.com:8080\""},
+				"X-Forwarded-For":   {"2001:db8::1"},
+				"X-Forwarded-Host":  {"example.com:8080"},
+				"X-Forwarded-Proto": {"https"},
+			},
+		},
+	}
+
+	for _, tCase := range tTable {
+		in := &http.Request{
+			Method:     http.MethodGet,
+			Host:       "example.com:8080",
+			RemoteAddr: tCase.remoteAddr,
+			ProtoMajor: tCase.major,
+			ProtoMinor: 1,
+			Header:     tCase.header,
+		}
+		if tCase.major > 1 {
+			in.ProtoMinor = 0
+		}
+		if tCase.tls {
+			in.TLS = &tls.ConnectionState{}
+		}
+		// forward in place, the way goproxy does
+		f.Request(in.Header, in)
+		if !reflect.DeepEqual(in.Header, tCase.expected) {
+			t.Errorf("%s: expected %v, got %v", tCase.name, tCase.expected, in.Header)
+		}
+	}
+}
+
+func TestForwarder_Response(t *testing.T) {
+	f, _ := New(config.ForwardingConfig{ProxyName: "proxy"})
+	resp := &http.Response{ProtoMajor: 3, Header: http.Header{"Via": {"1.1 proxy"}}}
+	f.Response(resp)
+	if via := resp.Header.Get("Via"); via != "1.1 proxy, 3 proxy" {
+		t.Errorf("expected Via: 1.1 proxy, 3 proxy, got %q", via)
+	}
+}
+
+func TestForwarder_CheckLoop(t *testing.T) {
+	f, _ := New(config.ForwardingConfig{ProxyName: "edge"})
+	tTable := []struct {
+		name string
+		via  []string
+		loop bool
+	}{
+		{name: "no Via", loop: false},
+		{name: "other proxies", via: []string{"1.1 first, 2 second (comment)"}, loop: false},
+		{name: "name as a comment", via: []string{"1.1 first (edge)"}, loop: false},
+		{name: "our entry", via: []string{"1.1 first", "3 EDGE"}, loop: true},
+	}
+	for _, tCase := range tTable {
+		in, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		in.Header["Via"] = tCase.via
+		err := f.CheckLoop(in)
+		if errors.Is(err, ErrLoop) != tCase.loop {
+			t.Errorf("%s: expected loop %t, got %v", tCase.name, tCase.loop, err)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tTable := []struct {
+		name    string
+		cfg     config.ForwardingConfig
+		invalid bool
+	}{
+		{name: "generated name", cfg: config.ForwardingConfig{}},
+		{name: "name with a space", cfg: config.ForwardingConfig{ProxyName: "my proxy"}, invalid: true},
+		{name: "invalid trusted proxy", cfg: config.ForwardingConfig{TrustedProxies: []string{"10.0.0.0/33"}}, invalid: true},
+	}
+	for _, tCase := range tTable {
+		f, err := New(tCase.cfg)
+		if (err != nil) != tCase.invalid {
+			t.Errorf("%s: expected invalid %t, got %v", tCase.name, tCase.invalid, err)
+		}
+		if err == nil && !isObfuscatedID(f.Name) {
+			t.Errorf("%s: invalid name %q", tCase.name, f.Name)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -13,15 +14,32 @@ import (
 	"os"
 	"time"
 
-	"github.com/ebi-yade/altsvc-go"
 	"github.com/quic-go/quic-go"
-	"github.com/quic-go/quic-go/http3"
 	"github.com/quic-go/quic-go/qlog"
 	"golang.org/x/net/context"
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+	"quic-proxy/internal/metrics"
+	"quic-proxy/internal/migration"
 	"quic-proxy/internal/utils"
 )
 
-func DoClientRequest(clientAddress, serverAddress, message string) error {
+// Migration moves the QUIC connections of the h3 requests to a new local
+// UDP socket, the zero value never does
+type Migration struct {
+	// MidTransfer rebinds once half of a download has been received
+	MidTransfer bool
+	// LocalAddr is the address to rebind to, the same address with any port if empty
+	LocalAddr string
+	// WatchNetwork rebinds whenever the local addresses change, checked at this interval
+	WatchNetwork time.Duration
+}
+
+// enabled reports whether the connections need a socket able to rebind
+func (m Migration) enabled() bool {
+	return m.MidTransfer || m.WatchNetwork > 0
+}
+
+func DoClientRequest(clientAddress, serverAddress, message string, migrate Migration) error {
 	serverAddress = utils.NormalizeAddress(serverAddress, "https")
 	host, port, err := utils.SplitHostPort(clientAddress)
 	if err != nil {
@@ -80,35 +98,46 @@ func DoClientRequest(clientAddress, serverAddress, message string) error {
 	fmt.Println("HTTP Response:")
 	fmt.Println(string(dump))
 
-	altSvc := resp.Header.Get("Alt-Svc")
-	// simple check of h3 support
-	if altSvc != "" {
-		services, err := altsvc.Parse(altSvc)
+	// Remember the alternatives in the shared cache, it honours ma/persist/clear
+	origin := utils.OriginFromURL(req.URL)
+	if err := utils.DefaultAltSvcCache.Update(origin, resp.Header.Get("Alt-Svc")); err != nil {
+		return fmt.Errorf("failed to parse Alt-Svc header: %w", err)
+	}
+	if alts := utils.DefaultAltSvcCache.Lookup(origin, "h3"); len(alts) > 0 {
+		log.Printf("[Client] Found h3 service: %v", alts[0])
+		err = RetryClientRequestInH3(serverAddress, message, migrate)
 		if err != nil {
-			return fmt.Errorf("failed to parse Alt-Svc header: %w", err)
-		}
-		for _, service := range services {
-			if service.ProtocolID == "h3" {
-				log.Printf("[Client] Found h3 service: %v", service)
-				h3ServerAddr := fmt.Sprintf("https://%s:%s", host, service.AltAuthority.Port)
-				err = RetryClientRequestInH3(h3ServerAddr, message)
-				if err != nil {
-					return fmt.Errorf("failed to retry request in h3: %w", err)
-				}
-				break
-			}
+			return fmt.Errorf("failed to retry request in h3: %w", err)
 		}
 	}
 	return nil
 }
 
-func RetryClientRequestInH3(h3ServerAddr, message string) error {
+// RetryClientRequestInH3 Send the message to the origin again, now that its h3
+// alternative is known. QUIC is raced against TCP, so the request still
+// succeeds over TCP if the QUIC handshake fails. With migrate enabled the QUIC
+// connection moves to a new local socket while it is in use.
+func RetryClientRequestInH3(serverAddress, message string, migrate Migration) error {
 	// Certain HTTP implementations use the client address for logging or
 	// access-control purposes. Since a QUIC client's address might change during a
 	// connection (and future versions might support simultaneous use of multiple
 	// addresses), such implementations will need to either actively retrieve the
 	// client's current address or addresses when they are relevant or explicitly
 	// accept that the original address might change.
+	dialer := &happyeyeballs.Dialer{}
+	if migrate.enabled() {
+		conn, err := migration.Listen("udp", ":0")
+		if err != nil {
+			return fmt.Errorf("failed to open migratable socket: %w", err)
+		}
+		defer conn.Close()
+		dialer.Conn = conn
+		if migrate.WatchNetwork > 0 {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go conn.Watch(ctx, migrate.WatchNetwork)
+		}
+	}
 
 	caCert, err := os.ReadFile("cert.pem")
 	if err != nil {
@@ -117,20 +146,22 @@ func RetryClientRequestInH3(h3ServerAddr, message string) error {
 	caCertPool := x509.NewCertPool()
 	caCertPool.AppendCertsFromPEM(caCert)
 
-	roundTripper := &http3.Transport{
-		TLSClientConfig: &tls.Config{
+	roundTripper := happyeyeballs.NewRoundTripper(
+		dialer,
+		utils.DefaultAltSvcCache,
+		&tls.Config{
 			RootCAs:            caCertPool,
 			InsecureSkipVerify: true,
 		},
-		QUICConfig: &quic.Config{
+		&quic.Config{
 			Tracer: qlog.DefaultConnectionTracer,
 		},
-	}
+	)
 	defer roundTripper.Close()
 	hclient := &http.Client{
 		Transport: roundTripper,
 	}
-	resp, err := hclient.Post(h3ServerAddr+"/demo/echo", "text/plain", bytes.NewBuffer([]byte(message)))
+	resp, err := hclient.Post(serverAddress+"/demo/echo", "text/plain", bytes.NewBuffer([]byte(message)))
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
 	}
@@ -140,7 +171,56 @@ func RetryClientRequestInH3(h3ServerAddr, message string) error {
 	if err != nil {
 		log.Fatalf("Failed to dump response: %v", err)
 	}
-	fmt.Println("HTTP/3 Response:")
+	fmt.Printf("%s Response:\n", resp.Proto)
 	fmt.Println(string(dump))
+	resp.Body.Close()
+
+	// A new connection resumes the TLS session, a safe request then goes in its 0-RTT data
+	roundTripper.CloseIdleConnections()
+	resp, err = hclient.Get(serverAddress + "/demo/tile")
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	resp.Body.Close()
+	log.Printf("[Client] %s %s over %s, 0-RTT: %s", resp.Request.Method, resp.Request.URL, resp.Proto, metrics.ClientEarlyData)
+
+	if migrate.MidTransfer {
+		return downloadMigrating(hclient, serverAddress, dialer.Conn, migrate.LocalAddr)
+	}
+	return nil
+}
+
+// migrationDownloadSize is the size of the download the connection migrates during
+const migrationDownloadSize = 8 << 20
+
+// downloadMigrating Download from the demo server and rebind conn halfway
+// through, the download has to complete on the new socket
+func downloadMigrating(hclient *http.Client, serverAddress string, conn *migration.Conn, laddr string) error {
+	resp, err := hclient.Get(fmt.Sprintf("%s/%d", serverAddress, migrationDownloadSize))
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 3 {
+		return fmt.Errorf("download went over %s, only QUIC connections migrate", resp.Proto)
+	}
+	start := time.Now()
+	n, err := io.CopyN(io.Discard, resp.Body, migrationDownloadSize/2)
+	if err != nil {
+		return fmt.Errorf("download failed after %d bytes: %w", n, err)
+	}
+	from := conn.LocalAddr()
+	if err := conn.Rebind(laddr); err != nil {
+		return fmt.Errorf("failed to rebind: %w", err)
+	}
+	log.Printf("[Client] Moved from %s to %s after %d bytes", from, conn.LocalAddr(), n)
+	rest, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return fmt.Errorf("download failed %d bytes after the migration: %w", rest, err)
+	}
+	if n+rest != migrationDownloadSize {
+		return fmt.Errorf("download ended after %d of %d bytes", n+rest, migrationDownloadSize)
+	}
+	log.Printf("[Client] Downloaded %d bytes in %v, %d of them after the migration", n+rest, time.Since(start).Round(time.Millisecond), rest)
 	return nil
 }
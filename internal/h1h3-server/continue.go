@@ -0,0 +1,79 @@
+package h1h3_server
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	h2h3convert "quic-proxy/internal/h2h3-convert"
+)
+
+// ContinueHandler Answer the HTTP/3 requests expecting 100 Continue the way
+// net/http does over HTTP/1.1 and h2, which http3.Server doesn't: the first
+// read of the body sends 100 Continue, unless the handler already sent it or
+// a final response. A handler that doesn't read the body refuses it.
+func ContinueHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 3 || r.Method == http.MethodConnect || !h2h3convert.ExpectsContinue(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &continueWriter{ResponseWriter: w}
+		r.Body = &continueReader{ReadCloser: r.Body, w: cw}
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// continueWriter remembers whether the client was told to send the body, or
+// got its final response
+type continueWriter struct {
+	http.ResponseWriter
+	// mu orders the writes of the handler and the 100 Continue of a read
+	// that may happen on another goroutine, a proxy sending the body upstream
+	mu   sync.Mutex
+	done bool
+}
+
+func (w *continueWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if code == http.StatusContinue || code >= http.StatusOK {
+		w.done = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *continueWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.done = true
+	w.mu.Unlock()
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the http3 response writer
+func (w *continueWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// sendContinue Send 100 Continue if the client still waits for it
+func (w *continueWriter) sendContinue() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done {
+		return
+	}
+	w.done = true
+	w.ResponseWriter.WriteHeader(http.StatusContinue)
+}
+
+// continueReader asks for the body on its first read
+type continueReader struct {
+	io.ReadCloser
+	w    *continueWriter
+	once sync.Once
+}
+
+func (r *continueReader) Read(p []byte) (int, error) {
+	r.once.Do(r.w.sendContinue)
+	return r.ReadCloser.Read(p)
+}
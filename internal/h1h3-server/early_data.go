@@ -0,0 +1,79 @@
+package h1h3_server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/metrics"
+)
+
+// EarlyDataPolicy decides per path whether a request received in 0-RTT is served
+// or answered with 425 Too Early. The longest matching path prefix wins,
+// Default applies when none matches. Requests with unsafe methods are always
+// refused, early data can be replayed by an attacker.
+type EarlyDataPolicy struct {
+	Default bool
+	Paths   map[string]bool // path prefix -> accept
+	Stats   *metrics.EarlyData
+}
+
+// NewEarlyDataPolicy Build the policy described by cfg, nil refuses all early data
+func NewEarlyDataPolicy(cfg *config.EarlyDataConfig) *EarlyDataPolicy {
+	p := &EarlyDataPolicy{Paths: map[string]bool{}, Stats: metrics.ServerEarlyData}
+	if cfg == nil {
+		return p
+	}
+	p.Default = cfg.Accept
+	for _, path := range cfg.AcceptPaths {
+		p.Paths[path] = true
+	}
+	for _, path := range cfg.RejectPaths {
+		p.Paths[path] = false
+	}
+	return p
+}
+
+// Accept reports whether r may be served although it arrived in early data
+func (p *EarlyDataPolicy) Accept(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+		return false
+	}
+	accept, longest := p.Default, -1
+	for prefix, ok := range p.Paths {
+		if strings.HasPrefix(r.URL.Path, prefix) && len(prefix) > longest {
+			accept, longest = ok, len(prefix)
+		}
+	}
+	return accept
+}
+
+// IsEarlyData reports whether r was received in 0-RTT, by this server or,
+// according to the Early-Data header, by an intermediary.
+// See https://datatracker.ietf.org/doc/html/rfc8470#section-5.1
+func IsEarlyData(r *http.Request) bool {
+	if r.TLS != nil && !r.TLS.HandshakeComplete {
+		return true
+	}
+	return r.Header.Get("Early-Data") == "1"
+}
+
+// EarlyDataHandler Apply policy to the requests received in 0-RTT before next sees them
+func EarlyDataHandler(policy *EarlyDataPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsEarlyData(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		policy.Stats.Attempted.Add(1)
+		if !policy.Accept(r) {
+			policy.Stats.Rejected.Add(1)
+			log.Printf("[h3Server] Refuse %s %s in early data", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusTooEarly)
+			return
+		}
+		policy.Stats.Accepted.Add(1)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,86 @@
+package h1h3_server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/metrics"
+)
+
+func TestEarlyDataHandler(t *testing.T) {
+	policy := NewEarlyDataPolicy(&config.EarlyDataConfig{
+		Accept:      false,
+		AcceptPaths: []string{"/static/"},
+		RejectPaths: []string{"/static/private/"},
+	})
+	policy.Stats = new(metrics.EarlyData)
+	handler := EarlyDataHandler(policy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tTable := []struct {
+		method   string
+		path     string
+		early    bool
+		header   string
+		expected int
+	}{
+		{method: http.MethodGet, path: "/static/a.png", early: true, expected: http.StatusOK},
+		{method: http.MethodGet, path: "/static/private/key", early: true, expected: http.StatusTooEarly},
+		{method: http.MethodGet, path: "/api", early: true, expected: http.StatusTooEarly},
+		{method: http.MethodPost, path: "/static/upload", early: true, expected: http.StatusTooEarly},
+		// received in early data by an intermediary
+		{method: http.MethodGet, path: "/api", header: "1", expected: http.StatusTooEarly},
+		{method: http.MethodPost, path: "/api", expected: http.StatusOK},
+	}
+	for _, tCase := range tTable {
+		r := httptest.NewRequest(tCase.method, tCase.path, nil)
+		r.TLS = &tls.ConnectionState{HandshakeComplete: !tCase.early}
+		if tCase.header != "" {
+			r.Header.Set("Early-Data", tCase.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tCase.expected {
+			t.Errorf("%s %s (early=%t): expected %d, got %d", tCase.method, tCase.path, tCase.early, tCase.expected, w.Code)
+		}
+	}
+
+	if rate := policy.Stats.AcceptanceRate(); rate != 0.2 {
+		t.Errorf("expected an acceptance rate of 0.2, got %v", rate)
+	}
+}
+
+func TestEarlyDataPolicy_NoConfig(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if NewEarlyDataPolicy(nil).Accept(r) {
+		t.Errorf("expected early data to be refused without configuration")
+	}
+}
+
+func TestNewH3Server_EarlyData(t *testing.T) {
+	tTable := []struct {
+		name      string
+		earlyData *config.EarlyDataConfig
+		expected  bool
+	}{
+		{name: "no policy", expected: false},
+		{name: "policy", earlyData: &config.EarlyDataConfig{AcceptPaths: []string{"/static/"}}, expected: true},
+	}
+	for _, tCase := range tTable {
+		server := NewH3Server("", http.NotFoundHandler(), tCase.earlyData)
+		if server.QUICConfig.Allow0RTT != tCase.expected {
+			t.Errorf("%s: expected Allow0RTT %t, got %t", tCase.name, tCase.expected, server.QUICConfig.Allow0RTT)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/static/a.png", nil)
+		r.TLS = &tls.ConnectionState{HandshakeComplete: false}
+		w := httptest.NewRecorder()
+		server.Handler.ServeHTTP(w, r)
+		if accepted := w.Code != http.StatusTooEarly; accepted != tCase.expected {
+			t.Errorf("%s: expected the early request accepted=%t, got %d", tCase.name, tCase.expected, w.Code)
+		}
+	}
+}
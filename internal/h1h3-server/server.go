@@ -8,12 +8,18 @@ import (
 	"io"
 	"log"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/metrics"
+	"quic-proxy/internal/migration"
+	"quic-proxy/internal/priority"
 	"quic-proxy/internal/utils"
+	"quic-proxy/internal/webtransport"
 
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
@@ -27,7 +33,7 @@ const (
 	keyPath  = "key.pem"
 )
 
-func StartServer(h1Addr string, h3Addr string) error {
+func StartServer(h1Addr string, h3Addr string, earlyData *config.EarlyDataConfig, followMigration bool) error {
 	// Generate cert first
 	certGenerator := utils.DefaultTLSCertificateGenerator
 	certGenerator.CertPath = certPath
@@ -50,7 +56,7 @@ func StartServer(h1Addr string, h3Addr string) error {
 		}
 	}()
 	// Start H3 server
-	return StartH3Server(h3Addr)
+	return StartH3Server(h3Addr, earlyData, followMigration)
 }
 
 func StartH1Server(h1Addr, h3Addr string) error {
@@ -96,21 +102,89 @@ func StartH1Server(h1Addr, h3Addr string) error {
 	return httpServer.ListenAndServeTLS(certPath, keyPath)
 }
 
-func StartH3Server(serverAddress string) error {
-	handler := setupHandler("")
+// StartH3Server Serve the demo handlers over HTTP/3, requests received in 0-RTT
+// are served according to the earlyData policy. With followMigration the
+// clients keep their connection when they move to a new address.
+func StartH3Server(serverAddress string, earlyData *config.EarlyDataConfig, followMigration bool) error {
+	server := NewDemoH3Server(serverAddress, earlyData)
+	// notice, h3 Server will add Alt-Svc automatically
+	// See http3.generateAltSvcHeader()
+	log.Println("Starting HTTP/3 server on ", serverAddress)
+	if followMigration {
+		return ListenAndServeFollowing(server, certPath, keyPath)
+	}
+	return server.ListenAndServeTLS(certPath, keyPath)
+}
+
+// ListenAndServeFollowing Serve server on its address like ListenAndServeTLS,
+// except that clients moving to a new address keep their connection, see
+// migration.FollowConn
+func ListenAndServeFollowing(server *http3.Server, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	// the configuration of the server is kept, only the certificate comes from the files
+	tlsConf := &tls.Config{}
+	if server.TLSConfig != nil {
+		tlsConf = server.TLSConfig.Clone()
+	}
+	tlsConf.Certificates = []tls.Certificate{cert}
+	// the defaults http3.Server applies to the listeners it opens itself
+	quicConf := &quic.Config{Allow0RTT: true}
+	if server.QUICConfig != nil {
+		quicConf = server.QUICConfig.Clone()
+	}
+	if server.EnableDatagrams {
+		quicConf.EnableDatagrams = true
+	}
+	conn, err := net.ListenPacket("udp", server.Addr)
+	if err != nil {
+		return err
+	}
+	tr := &quic.Transport{Conn: migration.Follow(conn), ConnectionIDLength: migration.ConnectionIDLength}
+	defer tr.Close()
+	ln, err := tr.ListenEarly(http3.ConfigureTLSConfig(tlsConf), quicConf)
+	if err != nil {
+		return err
+	}
+	return server.ServeListener(ln)
+}
+
+// NewDemoH3Server Create the HTTP/3 server of the demo handlers, including the
+// WebTransport echo at WebTransportEchoPath
+func NewDemoH3Server(serverAddress string, earlyData *config.EarlyDataConfig) *http3.Server {
+	server := NewH3Server(serverAddress, nil, earlyData)
+	mux := setupHandler("")
+	mux.Handle(WebTransportEchoPath, WebTransportEchoHandler(webtransport.NewServer(server)))
+	server.Handler = h3Handler(EarlyDataHandler(NewEarlyDataPolicy(earlyData), mux))
+	return server
+}
+
+// NewH3Server Create the HTTP/3 server shared by the h1h3 server, the gateway,
+// the relay and the MASQUE server, the responses are scheduled by their
+// priority. 0-RTT is only enabled with an early data policy, which decides
+// what the requests received in it may do before handler sees them
+func NewH3Server(serverAddress string, handler http.Handler, earlyData *config.EarlyDataConfig) *http3.Server {
+	if handler != nil {
+		handler = h3Handler(EarlyDataHandler(NewEarlyDataPolicy(earlyData), handler))
+	}
 	// QLOGDIR is an environment variable that specifies the directory to store qlog files
 	// If QLOGDIR is not set, qlog files will not be generated
-	server := http3.Server{
+	return &http3.Server{
 		Handler: handler,
 		Addr:    serverAddress,
 		QUICConfig: &quic.Config{
-			Tracer: qlog.DefaultConnectionTracer,
+			Tracer:    qlog.DefaultConnectionTracer,
+			Allow0RTT: earlyData != nil,
 		},
 	}
-	// notice, h3 Server will add Alt-Svc automatically
-	// See http3.generateAltSvcHeader()
-	log.Println("Starting HTTP/3 server on ", serverAddress)
-	return server.ListenAndServeTLS(certPath, keyPath)
+}
+
+// h3Handler Serve handler over HTTP/3 with what http3.Server lacks: 100
+// Continue and the scheduling of the responses by priority
+func h3Handler(handler http.Handler) http.Handler {
+	return priority.Handler(ContinueHandler(handler))
 }
 
 // Size is needed by the /demo/upload handler to determine the size of the uploaded file
@@ -129,7 +203,7 @@ func generatePRData(l int) []byte {
 	return res
 }
 
-func setupHandler(www string) http.Handler {
+func setupHandler(www string) *http.ServeMux {
 	mux := http.NewServeMux()
 
 	if len(www) > 0 {
@@ -147,6 +221,8 @@ func setupHandler(www string) http.Handler {
 		})
 	}
 
+	mux.Handle("/debug/vars", metrics.Handler())
+
 	mux.HandleFunc("/demo/tile", func(w http.ResponseWriter, r *http.Request) {
 		// Small 40x40 png
 		w.Write([]byte{
@@ -0,0 +1,77 @@
+package h1h3_server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+
+	"quic-proxy/internal/webtransport"
+)
+
+// WebTransportEchoPath is where the h3 server accepts WebTransport echo sessions
+const WebTransportEchoPath = "/webtransport/echo"
+
+// WebTransportEchoHandler Accept WebTransport sessions and echo everything they
+// carry: a bidirectional stream on itself, a unidirectional stream on a new
+// unidirectional stream and a datagram as a datagram
+func WebTransportEchoHandler(s *webtransport.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := s.Upgrade(w, r)
+		if err != nil {
+			log.Printf("[h3Server] WebTransport upgrade failed: %v", err)
+			return
+		}
+		log.Printf("[h3Server] WebTransport session from %s", r.RemoteAddr)
+		go echoStreams(session)
+		go echoUniStreams(session)
+		go echoDatagrams(session)
+	})
+}
+
+// echoStreams Echo every bidirectional stream of session on itself
+func echoStreams(session *webtransport.Session) {
+	for {
+		str, err := session.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(str, str)
+			str.Close()
+		}()
+	}
+}
+
+// echoUniStreams Echo every unidirectional stream of session on a new one
+func echoUniStreams(session *webtransport.Session) {
+	for {
+		str, err := session.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			reply, err := session.OpenUniStreamSync(session.Context())
+			if err != nil {
+				str.CancelRead(0)
+				return
+			}
+			if _, err := io.Copy(reply, str); err != nil {
+				reply.CancelWrite(0)
+				return
+			}
+			reply.Close()
+		}()
+	}
+}
+
+// echoDatagrams Echo every datagram of session
+func echoDatagrams(session *webtransport.Session) {
+	for {
+		b, err := session.ReceiveDatagram(session.Context())
+		if err != nil {
+			return
+		}
+		session.SendDatagram(b)
+	}
+}
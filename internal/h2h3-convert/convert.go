@@ -0,0 +1,338 @@
+// Package h2h3_convert translates requests, responses and error codes between
+// HTTP/1.1, HTTP/2 and HTTP/3, so that every gateway shares one translation layer.
+package h2h3_convert
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+	"quic-proxy/internal/priority"
+)
+
+var (
+	ErrMissingAuthority = errors.New("request has no :authority")
+	ErrInvalidConnect   = errors.New("CONNECT request must not carry a :path")
+)
+
+// connectionSpecificHeaders must not appear in HTTP/2 and HTTP/3 messages.
+// See https://datatracker.ietf.org/doc/html/rfc9113#section-8.2.2
+// and https://datatracker.ietf.org/doc/html/rfc9114#section-4.2
+var connectionSpecificHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HeaderField is a header field as sent on the wire by HTTP/2 and HTTP/3,
+// pseudo-header fields first, all names lowercase.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Size returns the size of the field as counted by SETTINGS_MAX_FIELD_SECTION_SIZE
+// (SETTINGS_MAX_HEADER_LIST_SIZE in HTTP/2).
+func (f HeaderField) Size() uint64 {
+	return uint64(len(f.Name) + len(f.Value) + 32)
+}
+
+// StripConnectionHeaders Remove the connection-specific headers and every header
+// listed in Connection. TE is only kept if its value is "trailers", even when
+// listed in Connection as HTTP/1.1 requires.
+func StripConnectionHeaders(h http.Header) {
+	te := h.Values("Te")
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range connectionSpecificHeaders {
+		h.Del(name)
+	}
+	h.Del("Te")
+	if httpguts.HeaderValuesContainsToken(te, "trailers") {
+		h.Set("Te", "trailers")
+	}
+}
+
+// ConnectionSpecific Return the name of a field of h that HTTP/2 and HTTP/3
+// messages must not carry, TE only allowed as "trailers", "" if there is none
+func ConnectionSpecific(h http.Header) string {
+	for _, name := range connectionSpecificHeaders {
+		if _, ok := h[name]; ok {
+			return name
+		}
+	}
+	if te, ok := h["Te"]; ok && (len(te) != 1 || !strings.EqualFold(textproto.TrimString(te[0]), "trailers")) {
+		return "Te"
+	}
+	return ""
+}
+
+// MergeCookies Put the Cookie crumbs of h back in one field line, as HTTP/1.1
+// requires, RFC 9113 section 8.2.3 and RFC 9114 section 4.2.1
+func MergeCookies(h http.Header) {
+	if cookies := h["Cookie"]; len(cookies) > 1 {
+		h.Set("Cookie", strings.Join(cookies, "; "))
+	}
+}
+
+// SplitCookies Split the Cookie of h into one field line per crumb, which
+// HTTP/2 and HTTP/3 header compression handles better
+func SplitCookies(h http.Header) {
+	cookies := h["Cookie"]
+	var crumbs []string
+	for _, v := range cookies {
+		for _, crumb := range strings.Split(v, ";") {
+			if crumb = textproto.TrimString(crumb); crumb != "" {
+				crumbs = append(crumbs, crumb)
+			}
+		}
+	}
+	if len(crumbs) > len(cookies) {
+		h["Cookie"] = crumbs
+	}
+}
+
+// convertPriority Keep the RFC 9218 priority signal of a request in one field
+// line, it is end to end and the next hop schedules the response with it. A
+// malformed signal is dropped, every recipient would ignore it anyway.
+func convertPriority(h http.Header) {
+	values := h.Values("Priority")
+	if len(values) == 0 {
+		return
+	}
+	value := strings.Join(values, ", ")
+	if _, err := priority.Parse(value); err != nil {
+		h.Del("Priority")
+		return
+	}
+	h.Set("Priority", value)
+}
+
+// convertRequest Build the outgoing request for an HTTP/<major> client from
+// the incoming request r. protocol is the :protocol of an extended CONNECT.
+func convertRequest(r *http.Request, major int, protocol string) (*http.Request, error) {
+	authority := r.Host
+	if authority == "" {
+		authority = r.URL.Host
+	}
+	if authority == "" {
+		return nil, ErrMissingAuthority
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Host = authority
+	out.ProtoMajor, out.ProtoMinor = major, 0
+	out.Proto = fmt.Sprintf("HTTP/%d.0", major)
+	// share the map, the values arrive once the body was read to EOF
+	out.Trailer = r.Trailer
+	out.Header.Del(":protocol")
+	StripConnectionHeaders(out.Header)
+	convertPriority(out.Header)
+	SplitCookies(out.Header)
+
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	if major == 3 {
+		// HTTP/3 only exists on top of TLS
+		scheme = "https"
+	}
+
+	switch {
+	case r.Method == http.MethodConnect && protocol == "":
+		// authority-form, only :method and :authority are sent
+		if r.URL.Path != "" {
+			return nil, ErrInvalidConnect
+		}
+		out.URL = &url.URL{Host: authority}
+		if major == 3 {
+			// http3.Transport treats any other Proto of a CONNECT as :protocol
+			out.Proto = ""
+		}
+	default:
+		out.URL = &url.URL{
+			Scheme:   scheme,
+			Host:     authority,
+			Path:     r.URL.Path,
+			RawPath:  r.URL.RawPath,
+			RawQuery: r.URL.RawQuery,
+		}
+		if out.URL.Path == "" {
+			out.URL.Path = "/"
+		}
+		if protocol != "" {
+			if major == 3 {
+				out.Proto = protocol
+			} else {
+				out.Header.Set(":protocol", protocol)
+			}
+		}
+	}
+	return out, nil
+}
+
+// convertResponse Turn resp into an HTTP/<major> response
+func convertResponse(resp *http.Response, major int) (*http.Response, error) {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("status %d is not allowed in HTTP/%d", resp.StatusCode, major)
+	}
+	out := new(http.Response)
+	*out = *resp
+	out.Header = resp.Header.Clone()
+	StripConnectionHeaders(out.Header)
+	out.ProtoMajor, out.ProtoMinor = major, 0
+	out.Proto = fmt.Sprintf("HTTP/%d.0", major)
+	out.TransferEncoding = nil
+	return out, nil
+}
+
+// HeaderFields List the header fields an HTTP/2 or HTTP/3 client sends for r,
+// the pseudo-header fields first.
+func HeaderFields(r *http.Request) []HeaderField {
+	authority := r.Host
+	if authority == "" {
+		authority = r.URL.Host
+	}
+	fields := []HeaderField{{Name: ":method", Value: r.Method}}
+	isConnect := r.Method == http.MethodConnect
+	protocol := r.Header.Get(":protocol")
+	if isConnect && protocol == "" && r.Proto != "" && !strings.HasPrefix(r.Proto, "HTTP/") {
+		protocol = r.Proto
+	}
+	if !isConnect || protocol != "" {
+		fields = append(fields,
+			HeaderField{Name: ":scheme", Value: r.URL.Scheme},
+			HeaderField{Name: ":path", Value: r.URL.RequestURI()},
+		)
+	}
+	fields = append(fields, HeaderField{Name: ":authority", Value: authority})
+	if isConnect && protocol != "" {
+		fields = append(fields, HeaderField{Name: ":protocol", Value: protocol})
+	}
+
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		if !strings.HasPrefix(name, ":") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range r.Header[name] {
+			fields = append(fields, HeaderField{Name: strings.ToLower(name), Value: value})
+		}
+	}
+	return fields
+}
+
+// ResponseFields List the header fields of a response with status code and
+// header h as sent by HTTP/2 and HTTP/3, :status first, all names lowercase.
+func ResponseFields(code int, h http.Header) []HeaderField {
+	fields := []HeaderField{{Name: ":status", Value: strconv.Itoa(code)}}
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range h[name] {
+			fields = append(fields, HeaderField{Name: strings.ToLower(name), Value: value})
+		}
+	}
+	return fields
+}
+
+// FieldSectionSize Return the size of a field section as counted by
+// SETTINGS_MAX_FIELD_SECTION_SIZE
+func FieldSectionSize(fields []HeaderField) uint64 {
+	var size uint64
+	for _, f := range fields {
+		size += f.Size()
+	}
+	return size
+}
+
+// WriteResponse Stream resp to w, the response to r: headers, body (flushed as it arrives) and trailers.
+// It returns the error writing to w, that is when the downstream went away.
+// If reading the body fails the stream is reset with ResetStream, which does
+// not return on HTTP/2 and HTTP/1.1.
+func WriteResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) error {
+	header := w.Header()
+	for k, vv := range resp.Header {
+		header[k] = append(header[k], vv...)
+	}
+	StripConnectionHeaders(header)
+
+	// announce the trailers, so that they can follow the body. HTTP/1.1 only
+	// carries trailers in a chunked body, which Content-Length would prevent.
+	if len(resp.Trailer) > 0 {
+		header.Del("Content-Length")
+	}
+	declared := make(map[string]bool, len(resp.Trailer))
+	for k := range resp.Trailer {
+		declared[k] = true
+		header.Add("Trailer", k)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	readErr, writeErr := copyBody(w, resp.Body)
+	if writeErr != nil {
+		return writeErr
+	}
+	if readErr != nil {
+		ResetStream(w, r, readErr)
+		return readErr
+	}
+
+	for k, vv := range resp.Trailer {
+		if declared[k] {
+			header[k] = vv
+		} else {
+			header[http.TrailerPrefix+k] = vv
+		}
+	}
+	return nil
+}
+
+// copyBody Copy the body to w, flushing after every chunk so that it streams.
+// Errors reading the body and writing to w are returned separately.
+func copyBody(w http.ResponseWriter, body io.Reader) (readErr, writeErr error) {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return nil, werr
+			}
+			if ferr := rc.Flush(); ferr != nil && !errors.Is(ferr, http.ErrNotSupported) {
+				return nil, ferr
+			}
+		}
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return err, nil
+		}
+	}
+}
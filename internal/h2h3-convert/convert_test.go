@@ -0,0 +1,558 @@
+package h2h3_convert
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"quic-proxy/internal/testutil"
+)
+
+// incoming Build a request the way an HTTP/<major> server hands it to a handler
+func incoming(major int, method, authority, path string, header http.Header) *http.Request {
+	r := &http.Request{
+		Method:     method,
+		Host:       authority,
+		Header:     header,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: major,
+		TLS:        &tls.ConnectionState{},
+		Body:       http.NoBody,
+	}
+	if major == 3 {
+		r.Proto = "HTTP/3.0"
+	}
+	if r.Header == nil {
+		r.Header = http.Header{}
+	}
+	if method == http.MethodConnect && path == "" {
+		r.URL = &url.URL{Host: authority}
+	} else {
+		r.URL, _ = url.ParseRequestURI(path)
+	}
+	return r
+}
+
+func TestConvertHTTP2RequestToHTTP3(t *testing.T) {
+	extendedConnect := incoming(2, http.MethodConnect, "example.com", "/chat", http.Header{":protocol": {"websocket"}})
+
+	tTable := []struct {
+		name     string
+		input    *http.Request
+		expected []HeaderField
+		err      error
+	}{
+		{
+			name:  "GET with query",
+			input: incoming(2, http.MethodGet, "example.com:8443", "/a%2Fb?x=1", http.Header{"Accept": {"*/*"}}),
+			expected: []HeaderField{
+				{":method", "GET"}, {":scheme", "https"}, {":path", "/a%2Fb?x=1"}, {":authority", "example.com:8443"},
+				{"accept", "*/*"},
+			},
+		},
+		{
+			name: "connection-specific headers are dropped",
+			input: incoming(2, http.MethodPost, "example.com", "/", http.Header{
+				"Connection": {"X-Hop"}, "X-Hop": {"1"}, "Keep-Alive": {"300"}, "Te": {"trailers, gzip"}, "X-End": {"1"},
+			}),
+			expected: []HeaderField{
+				{":method", "POST"}, {":scheme", "https"}, {":path", "/"}, {":authority", "example.com"},
+				{"te", "trailers"}, {"x-end", "1"},
+			},
+		},
+		{
+			name:  "TE listed in Connection",
+			input: incoming(2, http.MethodPost, "example.com", "/", http.Header{"Connection": {"TE"}, "Te": {"trailers"}}),
+			expected: []HeaderField{
+				{":method", "POST"}, {":scheme", "https"}, {":path", "/"}, {":authority", "example.com"},
+				{"te", "trailers"},
+			},
+		},
+		{
+			name:  "priority lines are joined",
+			input: incoming(2, http.MethodGet, "example.com", "/", http.Header{"Priority": {"u=1", "i"}}),
+			expected: []HeaderField{
+				{":method", "GET"}, {":scheme", "https"}, {":path", "/"}, {":authority", "example.com"},
+				{"priority", "u=1, i"},
+			},
+		},
+		{
+			name:  "malformed priority is dropped",
+			input: incoming(2, http.MethodGet, "example.com", "/", http.Header{"Priority": {"U=1"}}),
+			expected: []HeaderField{
+				{":method", "GET"}, {":scheme", "https"}, {":path", "/"}, {":authority", "example.com"},
+			},
+		},
+		{
+			name:  "cookie crumbs are split",
+			input: incoming(2, http.MethodGet, "example.com", "/", http.Header{"Cookie": {"a=1; b=2", "c=3"}}),
+			expected: []HeaderField{
+				{":method", "GET"}, {":scheme", "https"}, {":path", "/"}, {":authority", "example.com"},
+				{"cookie", "a=1"}, {"cookie", "b=2"}, {"cookie", "c=3"},
+			},
+		},
+		{
+			name:     "CONNECT",
+			input:    incoming(2, http.MethodConnect, "example.com:443", "", nil),
+			expected: []HeaderField{{":method", "CONNECT"}, {":authority", "example.com:443"}},
+		},
+		{
+			name:  "extended CONNECT",
+			input: extendedConnect,
+			expected: []HeaderField{
+				{":method", "CONNECT"}, {":scheme", "https"}, {":path", "/chat"}, {":authority", "example.com"}, {":protocol", "websocket"},
+			},
+		},
+		{
+			name:  "missing :authority",
+			input: incoming(2, http.MethodGet, "", "/", nil),
+			err:   ErrMissingAuthority,
+		},
+		{
+			name:  "wrong version",
+			input: incoming(3, http.MethodGet, "example.com", "/", nil),
+			err:   errors.New("unsupported protocol version: 3"),
+		},
+	}
+
+	for _, tCase := range tTable {
+		out, err := ConvertHTTP2RequestToHTTP3(tCase.input)
+		if tCase.err != nil {
+			if err == nil || err.Error() != tCase.err.Error() {
+				t.Errorf("%s: expected error %v, got %v", tCase.name, tCase.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tCase.name, err)
+			continue
+		}
+		if fields := HeaderFields(out); !reflect.DeepEqual(fields, tCase.expected) {
+			t.Errorf("%s: expected %v, got %v", tCase.name, tCase.expected, fields)
+		}
+		if out.RequestURI != "" {
+			t.Errorf("%s: RequestURI must be cleared for a client request", tCase.name)
+		}
+	}
+
+	if out, _ := ConvertHTTP2RequestToHTTP3(extendedConnect); out.Proto != "websocket" {
+		t.Errorf("expected http3.Transport to find :protocol in Proto, got %q", out.Proto)
+	}
+	if _, ok := extendedConnect.Header[":protocol"]; !ok {
+		t.Errorf("the incoming request must not be modified")
+	}
+}
+
+func TestConvertHTTP3RequestToHTTP2(t *testing.T) {
+	extendedConnect := incoming(3, http.MethodConnect, "example.com", "/chat", nil)
+	extendedConnect.Proto = "websocket"
+
+	tTable := []struct {
+		name     string
+		input    *http.Request
+		expected []HeaderField
+	}{
+		{
+			name:  "GET",
+			input: incoming(3, http.MethodGet, "example.com", "/index.html", http.Header{"Cookie": {"a=1; b=2"}}),
+			expected: []HeaderField{
+				{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"}, {":authority", "example.com"},
+				{"cookie", "a=1"}, {"cookie", "b=2"},
+			},
+		},
+		{
+			name:  "priority",
+			input: incoming(3, http.MethodGet, "example.com", "/", http.Header{"Priority": {"u=0, i=?0, x=1"}}),
+			expected: []HeaderField{
+				{":method", "GET"}, {":scheme", "https"}, {":path", "/"}, {":authority", "example.com"},
+				{"priority", "u=0, i=?0, x=1"},
+			},
+		},
+		{
+			name:     "CONNECT",
+			input:    incoming(3, http.MethodConnect, "example.com:443", "", nil),
+			expected: []HeaderField{{":method", "CONNECT"}, {":authority", "example.com:443"}},
+		},
+		{
+			name:  "extended CONNECT",
+			input: extendedConnect,
+			expected: []HeaderField{
+				{":method", "CONNECT"}, {":scheme", "https"}, {":path", "/chat"}, {":authority", "example.com"}, {":protocol", "websocket"},
+			},
+		},
+	}
+
+	for _, tCase := range tTable {
+		out, err := ConvertHTTP3RequestToHTTP2(tCase.input)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tCase.name, err)
+			continue
+		}
+		if fields := HeaderFields(out); !reflect.DeepEqual(fields, tCase.expected) {
+			t.Errorf("%s: expected %v, got %v", tCase.name, tCase.expected, fields)
+		}
+		if out.ProtoMajor != 2 {
+			t.Errorf("%s: expected ProtoMajor 2, got %d", tCase.name, out.ProtoMajor)
+		}
+	}
+}
+
+func TestConvertResponse(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/3.0",
+		ProtoMajor: 3,
+		Header:     http.Header{"Content-Type": {"text/plain"}, "Connection": {"close"}, "Keep-Alive": {"1"}},
+	}
+	out, err := ConvertHTTP3ResponseToHTTP2(resp)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if out.Proto != "HTTP/2.0" || out.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2.0, got %s", out.Proto)
+	}
+	if !reflect.DeepEqual(out.Header, http.Header{"Content-Type": {"text/plain"}}) {
+		t.Errorf("expected connection-specific headers to be dropped, got %v", out.Header)
+	}
+	if resp.Header.Get("Connection") == "" {
+		t.Errorf("the original response must not be modified")
+	}
+
+	back, err := ConvertHTTP2ResponseToHTTP3(out)
+	if err != nil || back.ProtoMajor != 3 {
+		t.Errorf("expected HTTP/3 response, got %v, %v", back, err)
+	}
+
+	resp.StatusCode = http.StatusSwitchingProtocols
+	if _, err := ConvertHTTP3ResponseToHTTP2(resp); err == nil {
+		t.Errorf("expected 101 to be rejected")
+	}
+}
+
+func TestCookies(t *testing.T) {
+	tTable := []struct {
+		name           string
+		cookies        []string
+		expectedMerged []string
+		expectedSplit  []string
+	}{
+		{name: "one crumb", cookies: []string{"a=1"}, expectedMerged: []string{"a=1"}, expectedSplit: []string{"a=1"}},
+		{name: "one line", cookies: []string{"a=1; b=2"}, expectedMerged: []string{"a=1; b=2"}, expectedSplit: []string{"a=1", "b=2"}},
+		{name: "crumbs", cookies: []string{"a=1", "b=2;c=3"}, expectedMerged: []string{"a=1; b=2;c=3"}, expectedSplit: []string{"a=1", "b=2", "c=3"}},
+		{name: "empty crumbs", cookies: []string{"a=1; ; b=2;"}, expectedMerged: []string{"a=1; ; b=2;"}, expectedSplit: []string{"a=1", "b=2"}},
+	}
+
+	for _, tCase := range tTable {
+		h := http.Header{"Cookie": append([]string(nil), tCase.cookies...)}
+		MergeCookies(h)
+		if !reflect.DeepEqual(h["Cookie"], tCase.expectedMerged) {
+			t.Errorf("%s: expected merged %q, got %q", tCase.name, tCase.expectedMerged, h["Cookie"])
+		}
+		h = http.Header{"Cookie": append([]string(nil), tCase.cookies...)}
+		SplitCookies(h)
+		if !reflect.DeepEqual(h["Cookie"], tCase.expectedSplit) {
+			t.Errorf("%s: expected split %q, got %q", tCase.name, tCase.expectedSplit, h["Cookie"])
+		}
+	}
+}
+
+func TestErrCodes(t *testing.T) {
+	tTable := []struct {
+		h2 http2.ErrCode
+		h3 http3.ErrCode
+	}{
+		{http2.ErrCodeNo, http3.ErrCodeNoError},
+		{http2.ErrCodeProtocol, http3.ErrCodeGeneralProtocolError},
+		{http2.ErrCodeInternal, http3.ErrCodeInternalError},
+		{http2.ErrCodeFrameSize, http3.ErrCodeFrameError},
+		{http2.ErrCodeRefusedStream, http3.ErrCodeRequestRejected},
+		{http2.ErrCodeCancel, http3.ErrCodeRequestCanceled},
+		{http2.ErrCodeCompression, errCodeQPACKDecompressionFailed},
+		{http2.ErrCodeConnect, http3.ErrCodeConnectError},
+		{http2.ErrCodeEnhanceYourCalm, http3.ErrCodeExcessiveLoad},
+		{http2.ErrCodeHTTP11Required, http3.ErrCodeVersionFallback},
+		{http2.ErrCodeSettingsTimeout, http3.ErrCodeMissingSettings},
+		{http2.ErrCodeStreamClosed, http3.ErrCodeStreamCreationError},
+	}
+	for _, tCase := range tTable {
+		if got := H2ToH3ErrCode(tCase.h2); got != tCase.h3 {
+			t.Errorf("H2ToH3ErrCode(%v): expected %v, got %v", tCase.h2, tCase.h3, got)
+		}
+		if got := H3ToH2ErrCode(tCase.h3); got != tCase.h2 {
+			t.Errorf("H3ToH2ErrCode(%v): expected %v, got %v", tCase.h3, tCase.h2, got)
+		}
+	}
+
+	// codes without a counterpart
+	if got := H2ToH3ErrCode(http2.ErrCodeFlowControl); got != http3.ErrCodeExcessiveLoad {
+		t.Errorf("expected FLOW_CONTROL_ERROR to map to H3_EXCESSIVE_LOAD, got %v", got)
+	}
+	if got := H2ToH3ErrCode(0xff); got != http3.ErrCodeInternalError {
+		t.Errorf("expected unknown code to map to H3_INTERNAL_ERROR, got %v", got)
+	}
+	// 0x1f * N + 0x21 is reserved for GREASE
+	if got := H3ToH2ErrCode(0x21); got != http2.ErrCodeInternal {
+		t.Errorf("expected GREASE code to map to INTERNAL_ERROR, got %v", got)
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/grpc"}, "Transfer-Encoding": {"chunked"}},
+		Body:       io.NopCloser(strings.NewReader("hello")),
+		Trailer:    http.Header{"Grpc-Status": {"0"}},
+	}
+	w := httptest.NewRecorder()
+	if err := WriteResponse(w, httptest.NewRequest(http.MethodGet, "/", nil), resp); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	result := w.Result()
+	body, _ := io.ReadAll(result.Body)
+	if string(body) != "hello" {
+		t.Errorf("expected body hello, got %q", body)
+	}
+	if result.Header.Get("Transfer-Encoding") != "" {
+		t.Errorf("expected Transfer-Encoding to be dropped")
+	}
+	if result.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("expected trailer Grpc-Status: 0, got %v", result.Trailer)
+	}
+}
+
+// TestH2ToH3 Forward a request from an h2 server to an h3 server and back
+func TestH2ToH3(t *testing.T) {
+	h3Addr := testutil.StartH3Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte(r.Proto + " " + r.Host + " " + string(body)))
+		w.Header().Set("X-Checksum", "42")
+	}))
+	h3Transport := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer h3Transport.Close()
+
+	h2Server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out, err := ConvertHTTP2RequestToHTTP3(r)
+		if err != nil {
+			t.Errorf("failed to convert request: %v", err)
+			return
+		}
+		out.URL.Host = h3Addr
+		resp, err := h3Transport.RoundTrip(out)
+		if err != nil {
+			t.Errorf("failed to send request over HTTP/3: %v", err)
+			return
+		}
+		defer resp.Body.Close()
+		if err := WriteResponse(w, r, resp); err != nil {
+			t.Errorf("failed to write response: %v", err)
+		}
+	}))
+	h2Server.EnableHTTP2 = true
+	h2Server.StartTLS()
+	defer h2Server.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, h2Server.URL, io.NopCloser(strings.NewReader("ping")))
+	resp, err := h2Server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	u, _ := url.Parse(h2Server.URL)
+	if expected := "HTTP/3.0 " + u.Host + " ping"; string(body) != expected || resp.ProtoMajor != 2 {
+		t.Errorf("expected %s response %q, got %s %q", "HTTP/2.0", expected, resp.Proto, body)
+	}
+	if resp.Trailer.Get("X-Checksum") != "42" {
+		t.Errorf("expected the h3 trailer to reach the h2 client, got %v", resp.Trailer)
+	}
+}
+
+// serveProto Serve handler over HTTP/<major>, returning its URL and a client for it
+func serveProto(t *testing.T, major int, handler http.Handler) (string, *http.Client) {
+	t.Helper()
+	switch major {
+	case 1:
+		server := httptest.NewServer(handler)
+		t.Cleanup(server.Close)
+		return server.URL, server.Client()
+	case 2:
+		server := httptest.NewUnstartedServer(handler)
+		server.EnableHTTP2 = true
+		server.StartTLS()
+		t.Cleanup(server.Close)
+		return server.URL, server.Client()
+	default:
+		return "https://" + testutil.StartH3Server(t, handler), testutil.H3Client(t)
+	}
+}
+
+// TestTrailers Forward a request with trailers between every pair of protocols
+// and check the trailers of both directions arrive
+func TestTrailers(t *testing.T) {
+	tTable := []struct {
+		name       string
+		down, up   int
+		reqTrailer string
+	}{
+		{name: "h1 to h1", down: 1, up: 1, reqTrailer: "7"},
+		{name: "h1 to h2", down: 1, up: 2, reqTrailer: "7"},
+		{name: "h2 to h1", down: 2, up: 1, reqTrailer: "7"},
+		{name: "h2 to h2", down: 2, up: 2, reqTrailer: "7"},
+		// quic-go neither sends nor parses request trailers, only response trailers cross HTTP/3
+		{name: "h1 to h3", down: 1, up: 3},
+		{name: "h2 to h3", down: 2, up: 3},
+		{name: "h3 to h1", down: 3, up: 1},
+		{name: "h3 to h2", down: 3, up: 2},
+		{name: "h3 to h3", down: 3, up: 3},
+	}
+
+	for _, tCase := range tTable {
+		upURL, upClient := serveProto(t, tCase.up, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.ReadAll(r.Body)
+			w.Header().Set("Trailer", "X-Response-Checksum")
+			fmt.Fprintf(w, "trailer=%s te=%s", r.Trailer.Get("X-Request-Checksum"), r.Header.Get("Te"))
+			w.Header().Set("X-Response-Checksum", "42")
+			w.Header().Set(http.TrailerPrefix+"X-Undeclared", "1")
+		}))
+		target, _ := url.Parse(upURL)
+		downURL, downClient := serveProto(t, tCase.down, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			out, err := convertRequest(r, tCase.up, "")
+			if err != nil {
+				t.Errorf("%s: failed to convert request: %v", tCase.name, err)
+				return
+			}
+			out.URL.Scheme, out.URL.Host = target.Scheme, target.Host
+			resp, err := upClient.Transport.RoundTrip(out)
+			if err != nil {
+				t.Errorf("%s: upstream request failed: %v", tCase.name, err)
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			WriteResponse(w, r, resp)
+		}))
+
+		// hide the length of the body, so that HTTP/1.1 sends it chunked
+		req, _ := http.NewRequest(http.MethodPost, downURL, io.NopCloser(strings.NewReader("ping")))
+		req.Header.Set("Te", "trailers")
+		req.Trailer = http.Header{"X-Request-Checksum": {"7"}}
+		resp, err := downClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", tCase.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if expected := "trailer=" + tCase.reqTrailer + " te=trailers"; string(body) != expected {
+			t.Errorf("%s: expected upstream to see %q, got %q", tCase.name, expected, body)
+		}
+		if got := resp.Trailer.Get("X-Response-Checksum"); got != "42" {
+			t.Errorf("%s: expected the declared response trailer, got %v", tCase.name, resp.Trailer)
+		}
+		if got := resp.Trailer.Get("X-Undeclared"); got != "1" {
+			t.Errorf("%s: expected the undeclared response trailer, got %v", tCase.name, resp.Trailer)
+		}
+	}
+}
+
+func TestH3ErrCode(t *testing.T) {
+	tTable := []struct {
+		name string
+		err  error
+		h3   http3.ErrCode
+	}{
+		{"h3 reset", &http3.Error{Remote: true, ErrorCode: http3.ErrCodeExcessiveLoad}, http3.ErrCodeExcessiveLoad},
+		{"h3 connection closed", &http3.Error{ErrorCode: http3.ErrCodeNoError}, http3.ErrCodeNoError},
+		{"h2 RST_STREAM", http2.StreamError{StreamID: 1, Code: http2.ErrCodeRefusedStream}, http3.ErrCodeRequestRejected},
+		{"h2 GOAWAY", http2.GoAwayError{ErrCode: http2.ErrCodeProtocol}, http3.ErrCodeGeneralProtocolError},
+		{"canceled", context.Canceled, http3.ErrCodeRequestCanceled},
+		{"connection lost", io.ErrUnexpectedEOF, http3.ErrCodeInternalError},
+	}
+	for _, tCase := range tTable {
+		err := fmt.Errorf("read body: %w", tCase.err)
+		if got := H3ErrCode(err); got != tCase.h3 {
+			t.Errorf("%s: expected %v, got %v", tCase.name, tCase.h3, got)
+		}
+	}
+}
+
+func TestResetStream(t *testing.T) {
+	// the upstream refused the stream after the response started
+	resetting := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		ResetStream(w, r, fmt.Errorf("read body: %w", http2.StreamError{StreamID: 1, Code: http2.ErrCodeRefusedStream}))
+	})
+	h3Addr := testutil.StartH3Server(t, resetting)
+	h2Server := httptest.NewUnstartedServer(resetting)
+	h2Server.EnableHTTP2 = true
+	if err := ConfigureServer(h2Server.Config); err != nil {
+		t.Fatalf("failed to configure the h2 server: %v", err)
+	}
+	h2Server.StartTLS()
+	defer h2Server.Close()
+	// net/http's own HTTP/2 server can't pick the code
+	plainH2Server := httptest.NewUnstartedServer(resetting)
+	plainH2Server.EnableHTTP2 = true
+	plainH2Server.StartTLS()
+	defer plainH2Server.Close()
+	h2Transport := &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer h2Transport.CloseIdleConnections()
+
+	tTable := []struct {
+		name     string
+		client   *http.Client
+		url      string
+		expected func(err error) bool
+	}{
+		{
+			name:   "h3 stream reset with the mapped code",
+			client: testutil.H3Client(t),
+			url:    "https://" + h3Addr,
+			expected: func(err error) bool {
+				var h3Err *http3.Error
+				return errors.As(err, &h3Err) && h3Err.ErrorCode == http3.ErrCodeRequestRejected
+			},
+		},
+		{
+			name:   "h2 stream reset with the mapped code",
+			client: &http.Client{Transport: h2Transport},
+			url:    h2Server.URL,
+			expected: func(err error) bool {
+				var h2Err http2.StreamError
+				return errors.As(err, &h2Err) && h2Err.Code == http2.ErrCodeRefusedStream
+			},
+		},
+		{
+			name:   "h2 stream of net/http reset with INTERNAL_ERROR",
+			client: &http.Client{Transport: h2Transport},
+			url:    plainH2Server.URL,
+			expected: func(err error) bool {
+				var h2Err http2.StreamError
+				return errors.As(err, &h2Err) && h2Err.Code == http2.ErrCodeInternal
+			},
+		},
+	}
+	for _, tCase := range tTable {
+		// the reset may overtake the response header
+		resp, err := tCase.client.Get(tCase.url)
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if !tCase.expected(err) {
+			t.Errorf("%s: unexpected error %v", tCase.name, err)
+		}
+	}
+}
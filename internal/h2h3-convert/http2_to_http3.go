@@ -1,38 +1,61 @@
 package h2h3_convert
 
 import (
+	"fmt"
+	"net/http"
+
 	"github.com/quic-go/quic-go/http3"
 	"golang.org/x/net/http2"
 )
 
+// errCodeQPACKDecompressionFailed is QPACK_DECOMPRESSION_FAILED, RFC 9204 section 6
+const errCodeQPACKDecompressionFailed http3.ErrCode = 0x200
+
+// See https://datatracker.ietf.org/doc/html/rfc9114#appendix-A.4
+// Codes that have no HTTP/3 counterpart are mapped to the closest one.
 var h2ErrCodeToH3 = map[http2.ErrCode]http3.ErrCode{
 	http2.ErrCodeNo:       http3.ErrCodeNoError,
 	http2.ErrCodeProtocol: http3.ErrCodeGeneralProtocolError,
 	http2.ErrCodeInternal: http3.ErrCodeInternalError,
-	//http2.ErrCodeFlowControl:  http3.ErrCodeExcessiveLoad,
-	//http2.ErrCodeStreamClosed: http3.ErrCodeClosedCriticalStream,
-	http2.ErrCodeFrameSize:     http3.ErrCodeFrameError,
-	http2.ErrCodeRefusedStream: http3.ErrCodeRequestRejected,
-	http2.ErrCodeCancel:        http3.ErrCodeRequestCanceled,
-	//http2.ErrCodeCompression:        http3.ErrCodeMessageError,
-	http2.ErrCodeConnect:         http3.ErrCodeConnectError,
-	http2.ErrCodeEnhanceYourCalm: http3.ErrCodeExcessiveLoad,
-	//http2.ErrCodeInadequateSecurity: http3.ErrCodeConnectError,
-	http2.ErrCodeHTTP11Required: http3.ErrCodeVersionFallback,
+	// QUIC does the flow control, a peer exceeding it is sending too much
+	http2.ErrCodeFlowControl:        http3.ErrCodeExcessiveLoad,
+	http2.ErrCodeSettingsTimeout:    http3.ErrCodeMissingSettings,
+	http2.ErrCodeStreamClosed:       http3.ErrCodeStreamCreationError,
+	http2.ErrCodeFrameSize:          http3.ErrCodeFrameError,
+	http2.ErrCodeRefusedStream:      http3.ErrCodeRequestRejected,
+	http2.ErrCodeCancel:             http3.ErrCodeRequestCanceled,
+	http2.ErrCodeCompression:        errCodeQPACKDecompressionFailed,
+	http2.ErrCodeConnect:            http3.ErrCodeConnectError,
+	http2.ErrCodeEnhanceYourCalm:    http3.ErrCodeExcessiveLoad,
+	http2.ErrCodeInadequateSecurity: http3.ErrCodeGeneralProtocolError,
+	http2.ErrCodeHTTP11Required:     http3.ErrCodeVersionFallback,
+}
+
+// H2ToH3ErrCode Map an HTTP/2 error code to HTTP/3, unknown codes become H3_INTERNAL_ERROR
+func H2ToH3ErrCode(code http2.ErrCode) http3.ErrCode {
+	if h3Code, ok := h2ErrCodeToH3[code]; ok {
+		return h3Code
+	}
+	return http3.ErrCodeInternalError
 }
 
-//func ConvertHTTP2RequestToHTTP3(r *http.Request) (*http.Request, error) {
-//	// Check Protocol Version
-//	if r.ProtoMajor != 2 {
-//		return nil, fmt.Errorf("unsupported protocol version: %d", r.ProtoMajor)
-//	}
-//	// Check Method
-//	// TODO: Check if wanna 0RTT, for now, we just convert it
-//	if r.Method == http.MethodGet {
-//		r.Method = http3.MethodGet0RTT
-//	} else if r.Method == http.MethodHead {
-//		r.Method = http3.MethodHead0RTT
-//	} else if r.Method == http.MethodConnect {
-//		// Establish a tunnel
-//	}
-//}
+// ConvertHTTP2RequestToHTTP3 Convert a request received by an HTTP/2 server into
+// one that can be sent with http3.Transport.
+// The body is streamed, not copied, and the trailers are shared with r so that
+// they are forwarded once r.Body reached EOF.
+func ConvertHTTP2RequestToHTTP3(r *http.Request) (*http.Request, error) {
+	// Check Protocol Version
+	if r.ProtoMajor != 2 {
+		return nil, fmt.Errorf("unsupported protocol version: %d", r.ProtoMajor)
+	}
+	// :protocol of an extended CONNECT, RFC 8441
+	return convertRequest(r, 3, r.Header.Get(":protocol"))
+}
+
+// ConvertHTTP2ResponseToHTTP3 Convert a response received over HTTP/2 into an HTTP/3 response
+func ConvertHTTP2ResponseToHTTP3(resp *http.Response) (*http.Response, error) {
+	if resp.ProtoMajor != 2 {
+		return nil, fmt.Errorf("unsupported protocol version: %d", resp.ProtoMajor)
+	}
+	return convertResponse(resp, 3)
+}
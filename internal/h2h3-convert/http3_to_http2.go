@@ -1,26 +1,67 @@
 package h2h3_convert
 
 import (
+	"fmt"
+	"net/http"
+
 	"github.com/quic-go/quic-go/http3"
 	"golang.org/x/net/http2"
 )
 
+// See https://datatracker.ietf.org/doc/html/rfc9114#appendix-A.4
 var h3ErrCodeToH2 = map[http3.ErrCode]http2.ErrCode{
 	http3.ErrCodeNoError:              http2.ErrCodeNo,
 	http3.ErrCodeGeneralProtocolError: http2.ErrCodeProtocol,
 	http3.ErrCodeInternalError:        http2.ErrCodeInternal,
-	//http3.ErrCodeStreamCreationError:  http2.ErrCodeStreamClosed,
+	http3.ErrCodeStreamCreationError:  http2.ErrCodeStreamClosed,
 	http3.ErrCodeClosedCriticalStream: http2.ErrCodeProtocol,
 	http3.ErrCodeFrameUnexpected:      http2.ErrCodeProtocol,
 	http3.ErrCodeFrameError:           http2.ErrCodeFrameSize,
 	http3.ErrCodeExcessiveLoad:        http2.ErrCodeEnhanceYourCalm,
 	http3.ErrCodeIDError:              http2.ErrCodeProtocol,
 	http3.ErrCodeSettingsError:        http2.ErrCodeProtocol,
-	//http3.ErrCodeMissingSettings:      http2.ErrCodeProtocol,
-	http3.ErrCodeRequestRejected:   http2.ErrCodeRefusedStream,
-	http3.ErrCodeRequestCanceled:   http2.ErrCodeCancel,
-	http3.ErrCodeRequestIncomplete: http2.ErrCodeProtocol,
-	http3.ErrCodeMessageError:      http2.ErrCodeProtocol,
-	http3.ErrCodeConnectError:      http2.ErrCodeConnect,
-	http3.ErrCodeVersionFallback:   http2.ErrCodeHTTP11Required,
+	http3.ErrCodeMissingSettings:      http2.ErrCodeSettingsTimeout,
+	http3.ErrCodeRequestRejected:      http2.ErrCodeRefusedStream,
+	http3.ErrCodeRequestCanceled:      http2.ErrCodeCancel,
+	http3.ErrCodeRequestIncomplete:    http2.ErrCodeProtocol,
+	http3.ErrCodeMessageError:         http2.ErrCodeProtocol,
+	http3.ErrCodeConnectError:         http2.ErrCodeConnect,
+	http3.ErrCodeVersionFallback:      http2.ErrCodeHTTP11Required,
+	// QPACK_DECOMPRESSION_FAILED, QPACK_ENCODER_STREAM_ERROR, QPACK_DECODER_STREAM_ERROR
+	errCodeQPACKDecompressionFailed:     http2.ErrCodeCompression,
+	errCodeQPACKDecompressionFailed + 1: http2.ErrCodeCompression,
+	errCodeQPACKDecompressionFailed + 2: http2.ErrCodeCompression,
+}
+
+// H3ToH2ErrCode Map an HTTP/3 error code to HTTP/2.
+// Unknown and reserved (GREASE) codes become INTERNAL_ERROR.
+func H3ToH2ErrCode(code http3.ErrCode) http2.ErrCode {
+	if h2Code, ok := h3ErrCodeToH2[code]; ok {
+		return h2Code
+	}
+	return http2.ErrCodeInternal
+}
+
+// ConvertHTTP3RequestToHTTP2 Convert a request received by an HTTP/3 server into
+// one that can be sent with http2.Transport.
+// The body is streamed, not copied, and the trailers are shared with r so that
+// they are forwarded once r.Body reached EOF.
+func ConvertHTTP3RequestToHTTP2(r *http.Request) (*http.Request, error) {
+	if r.ProtoMajor != 3 {
+		return nil, fmt.Errorf("unsupported protocol version: %d", r.ProtoMajor)
+	}
+	// http3.Server stores the :protocol of an extended CONNECT in r.Proto
+	var protocol string
+	if r.Method == http.MethodConnect && r.Proto != "HTTP/3.0" {
+		protocol = r.Proto
+	}
+	return convertRequest(r, 2, protocol)
+}
+
+// ConvertHTTP3ResponseToHTTP2 Convert a response received over HTTP/3 into an HTTP/2 response
+func ConvertHTTP3ResponseToHTTP2(resp *http.Response) (*http.Response, error) {
+	if resp.ProtoMajor != 3 {
+		return nil, fmt.Errorf("unsupported protocol version: %d", resp.ProtoMajor)
+	}
+	return convertResponse(resp, 2)
 }
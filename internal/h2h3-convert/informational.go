@@ -0,0 +1,155 @@
+package h2h3_convert
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// ExpectContinueTimeout is how long the body of a request expecting 100
+// Continue is held back when the server doesn't answer, the client may send
+// it anyway, RFC 9110 section 10.1.1
+const ExpectContinueTimeout = time.Second
+
+// errContinueDeclined ends the body the server answered with a final status
+// before asking for it
+var errContinueDeclined = errors.New("server answered before 100 Continue, request body not sent")
+
+// ExpectsContinue Report whether the body of r waits for 100 Continue
+func ExpectsContinue(r *http.Request) bool {
+	return r.Body != nil && r.Body != http.NoBody && httpguts.HeaderValuesContainsToken(r.Header["Expect"], "100-continue")
+}
+
+// ContinueTransport holds back the body of a request expecting 100 Continue
+// until the server sends it, for transports that send the body right away:
+// http3.Transport, http2.Transport without an http.Transport, the relay.
+// The body is sent after ExpectContinueTimeout if the server stays silent. A
+// final response arriving first lets the body through if it is a 2xx, the
+// server may be streaming full duplex, and drops it otherwise, like
+// http2.Transport does.
+type ContinueTransport struct {
+	http.RoundTripper
+}
+
+func (t ContinueTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !ExpectsContinue(req) {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	body := newContinueBody(req.Body)
+	out := req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got100Continue: func() { body.release(nil) },
+	}))
+	out.Body = body
+	resp, err := t.RoundTripper.RoundTrip(out)
+	switch {
+	case err != nil:
+		body.release(err)
+	case resp.StatusCode < http.StatusMultipleChoices:
+		body.release(nil)
+	default:
+		body.release(errContinueDeclined)
+	}
+	return resp, err
+}
+
+// continueBody is a request body whose reads wait until it is released
+type continueBody struct {
+	io.ReadCloser
+	released chan struct{}
+
+	mu    sync.Mutex
+	done  bool
+	err   error // set before released is closed
+	timer *time.Timer
+}
+
+func newContinueBody(body io.ReadCloser) *continueBody {
+	b := &continueBody{ReadCloser: body, released: make(chan struct{})}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.timer = time.AfterFunc(ExpectContinueTimeout, func() { b.release(nil) })
+	return b
+}
+
+// release Let the reads through, or fail them with err
+func (b *continueBody) release(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return
+	}
+	b.done = true
+	b.timer.Stop()
+	b.err = err
+	close(b.released)
+}
+
+func (b *continueBody) Read(p []byte) (int, error) {
+	<-b.released
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// Close Release the reads blocked waiting for 100 Continue, the transport
+// gave up on the body
+func (b *continueBody) Close() error {
+	b.release(net.ErrClosed)
+	return b.ReadCloser.Close()
+}
+
+// RelayInformational Return ctx with a client trace writing the 1xx responses
+// of the request sent with it to w, so that the client receives them ahead of
+// the final response like httputil.ReverseProxy does. w must not be used by
+// another goroutine until the request returns its final response.
+func RelayInformational(ctx context.Context, w http.ResponseWriter) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			h := w.Header()
+			for k, vv := range header {
+				h[k] = append(h[k], vv...)
+			}
+			StripConnectionHeaders(h)
+			w.WriteHeader(code)
+			// unlike the final response, a 1xx response leaves the header map as it is
+			clear(h)
+			return nil
+		},
+	})
+}
+
+// InformationalWriter Return the writer the 1xx responses of the upstream are
+// relayed to for r. HTTP/1.0 clients don't expect them, RFC 9110 section
+// 15.2, they are dropped there.
+func InformationalWriter(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if r.ProtoAtLeast(1, 1) {
+		return w
+	}
+	return &http10Writer{ResponseWriter: w}
+}
+
+// http10Writer drops the 1xx responses of an HTTP/1.0 client
+type http10Writer struct {
+	http.ResponseWriter
+}
+
+func (w *http10Writer) WriteHeader(code int) {
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the writer of the server
+func (w *http10Writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
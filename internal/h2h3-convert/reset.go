@@ -0,0 +1,187 @@
+package h2h3_convert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+// H3ErrCode Find the HTTP/3 error code for a stream that failed with err,
+// err being what reading an HTTP/2 or HTTP/3 response body returned.
+func H3ErrCode(err error) http3.ErrCode {
+	var (
+		h3Err     *http3.Error
+		h2Err     http2.StreamError
+		goAwayErr http2.GoAwayError
+	)
+	switch {
+	case errors.As(err, &h3Err):
+		return h3Err.ErrorCode
+	case errors.As(err, &h2Err):
+		return H2ToH3ErrCode(h2Err.Code)
+	case errors.As(err, &goAwayErr):
+		return H2ToH3ErrCode(goAwayErr.ErrCode)
+	case errors.Is(err, context.Canceled):
+		return http3.ErrCodeRequestCanceled
+	}
+	return http3.ErrCodeInternalError
+}
+
+// ResetStream Abort the response to r written to w because the upstream failed with err.
+// An HTTP/3 stream is reset with the code H3ErrCode maps err to, an HTTP/2
+// stream of a server set up by ConfigureServer with that code mapped back to
+// HTTP/2. Otherwise the handler is aborted with http.ErrAbortHandler, net/http
+// then closes the connection or resets the h2 stream with INTERNAL_ERROR.
+// ResetStream doesn't return on HTTP/2 and HTTP/1.1, so it must be called from
+// the handler goroutine.
+func ResetStream(w http.ResponseWriter, r *http.Request, err error) {
+	for {
+		switch rw := w.(type) {
+		case http3.HTTPStreamer:
+			code := quic.StreamErrorCode(H3ErrCode(err))
+			str := rw.HTTPStream()
+			str.CancelWrite(code)
+			str.CancelRead(code)
+			return
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+			continue
+		}
+		if conn, ok := r.Context().Value(resetConnKey{}).(*resetConn); ok {
+			if id, ok := h2StreamID(w); ok {
+				conn.resetWith(id, H3ToH2ErrCode(H3ErrCode(err)))
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// resetConnKey is the context key of the resetConn serving a request
+type resetConnKey struct{}
+
+// ConfigureServer Serve HTTP/2 on srv with x/net/http2 over connections that
+// let ResetStream choose the RST_STREAM code, net/http's HTTP/2 server always
+// resets an aborted stream with INTERNAL_ERROR
+func ConfigureServer(srv *http.Server) error {
+	h2Server := &http2.Server{}
+	if err := http2.ConfigureServer(srv, h2Server); err != nil {
+		return err
+	}
+	srv.TLSNextProto[http2.NextProtoTLS] = func(hs *http.Server, c *tls.Conn, h http.Handler) {
+		// net/http passes the base context of the connection on the handler,
+		// like http2.ConfigureServer does
+		ctx := context.Background()
+		if bc, ok := h.(interface{ BaseContext() context.Context }); ok {
+			ctx = bc.BaseContext()
+		}
+		conn := &resetConn{Conn: c, codes: map[uint32]http2.ErrCode{}}
+		h2Server.ServeConn(conn, &http2.ServeConnOpts{
+			Context:    context.WithValue(ctx, resetConnKey{}, conn),
+			Handler:    h,
+			BaseConfig: hs,
+		})
+	}
+	return nil
+}
+
+// h2StreamID Return the ID of the x/net/http2 stream w writes to. The server
+// doesn't tell a handler its stream, the ID is read from the response writer.
+func h2StreamID(w http.ResponseWriter) (uint32, bool) {
+	v := reflect.ValueOf(w)
+	for _, field := range []string{"rws", "stream", "id"} {
+		if v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return 0, false
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return 0, false
+		}
+		if v = v.FieldByName(field); !v.IsValid() {
+			return 0, false
+		}
+	}
+	if v.Kind() != reflect.Uint32 {
+		return 0, false
+	}
+	return uint32(v.Uint()), true
+}
+
+// resetConn is the connection of an HTTP/2 server. It follows the frames the
+// server writes and replaces the code of the RST_STREAM frames of the streams
+// ResetStream aborted, the server resets them with INTERNAL_ERROR.
+type resetConn struct {
+	*tls.Conn
+
+	mu     sync.Mutex
+	codes  map[uint32]http2.ErrCode // stream ID -> code of its RST_STREAM
+	header [frameHeaderLen]byte     // header of the frame being written
+	read   int                      // bytes of header written so far
+	left   int                      // bytes of payload still to write
+	code   []byte                   // code written over the payload, nil to keep it
+}
+
+const frameHeaderLen = 9
+
+// resetWith Reset stream id with code instead of INTERNAL_ERROR
+func (c *resetConn) resetWith(id uint32, code http2.ErrCode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.codes[id] = code
+}
+
+func (c *resetConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	out, copied := p, false
+	for i := 0; i < len(p); {
+		if c.read < frameHeaderLen {
+			n := copy(c.header[c.read:], p[i:])
+			c.read += n
+			i += n
+			if c.read == frameHeaderLen {
+				c.startFrame()
+			}
+			continue
+		}
+		n := min(c.left, len(p)-i)
+		if c.code != nil {
+			if !copied {
+				out, copied = bytes.Clone(p), true
+			}
+			copy(out[i:i+n], c.code[len(c.code)-c.left:])
+		}
+		c.left -= n
+		i += n
+		if c.left == 0 {
+			c.read = 0
+		}
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(out)
+}
+
+// startFrame Look at the header of the frame being written, its payload follows
+func (c *resetConn) startFrame() {
+	c.left = int(c.header[0])<<16 | int(c.header[1])<<8 | int(c.header[2])
+	c.code = nil
+	if http2.FrameType(c.header[3]) == http2.FrameRSTStream && c.left == 4 {
+		id := binary.BigEndian.Uint32(c.header[5:]) & (1<<31 - 1)
+		if code, ok := c.codes[id]; ok {
+			delete(c.codes, id)
+			c.code = binary.BigEndian.AppendUint32(nil, uint32(code))
+		}
+	}
+	if c.left == 0 {
+		c.read = 0
+	}
+}
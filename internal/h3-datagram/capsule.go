@@ -0,0 +1,86 @@
+package h3_datagram
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// CapsuleType is the type of a capsule, RFC 9297 section 3.2
+type CapsuleType uint64
+
+// CapsuleTypeDatagram carries an HTTP Datagram on the request stream, RFC 9297 section 3.5
+const CapsuleTypeDatagram CapsuleType = 0x00
+
+// CapsuleProtocolHeader advertises the Capsule Protocol on a request or response
+const CapsuleProtocolHeader = "Capsule-Protocol"
+
+// MaxCapsuleSize bounds the value of a received capsule, so a peer can't make
+// us buffer an arbitrary amount of data
+const MaxCapsuleSize = 1 << 16
+
+// Capsule is a type-length-value on the data stream of a request
+type Capsule struct {
+	Type  CapsuleType
+	Value []byte
+}
+
+// CapsuleReader reads the capsules of a request stream
+type CapsuleReader struct {
+	r *bufio.Reader
+}
+
+// NewCapsuleReader Read capsules from r, the stream of a request using the Capsule Protocol
+func NewCapsuleReader(r io.Reader) *CapsuleReader {
+	return &CapsuleReader{r: bufio.NewReader(r)}
+}
+
+// ReadCapsule Read the next capsule, capsules of unknown types are returned as
+// well, it is up to the caller to drop them. io.EOF means the stream ended
+// cleanly between two capsules, io.ErrUnexpectedEOF that it ended inside one.
+func (c *CapsuleReader) ReadCapsule() (Capsule, error) {
+	// only an EOF before the first byte of a capsule is a clean end
+	if _, err := c.r.Peek(1); err != nil {
+		return Capsule{}, err
+	}
+	capsuleType, err := quicvarint.Read(c.r)
+	if err != nil {
+		return Capsule{}, unexpectedEOF(err)
+	}
+	length, err := quicvarint.Read(c.r)
+	if err != nil {
+		return Capsule{}, unexpectedEOF(err)
+	}
+	if length > MaxCapsuleSize {
+		return Capsule{}, fmt.Errorf("capsule of type %#x too large: %d bytes", capsuleType, length)
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(c.r, value); err != nil {
+		return Capsule{}, unexpectedEOF(err)
+	}
+	return Capsule{Type: CapsuleType(capsuleType), Value: value}, nil
+}
+
+// unexpectedEOF Turn an io.EOF inside a capsule into io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// AppendCapsule Serialise c and append it to b
+func AppendCapsule(b []byte, c Capsule) []byte {
+	b = quicvarint.Append(b, uint64(c.Type))
+	b = quicvarint.Append(b, uint64(len(c.Value)))
+	return append(b, c.Value...)
+}
+
+// WriteCapsule Write c to w in a single Write call, so that concurrent writers
+// that serialise their calls don't interleave capsules
+func WriteCapsule(w io.Writer, c Capsule) error {
+	_, err := w.Write(AppendCapsule(make([]byte, 0, 16+len(c.Value)), c))
+	return err
+}
@@ -0,0 +1,100 @@
+package h3_datagram
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+func TestReadCapsule(t *testing.T) {
+	var stream []byte
+	stream = AppendCapsule(stream, Capsule{Type: CapsuleTypeDatagram, Value: []byte("hello")})
+	stream = AppendCapsule(stream, Capsule{Type: 0x2843, Value: []byte{1, 2, 3}})
+	stream = AppendCapsule(stream, Capsule{Type: CapsuleTypeDatagram})
+
+	r := NewCapsuleReader(bytes.NewReader(stream))
+	for _, expected := range []Capsule{
+		{Type: CapsuleTypeDatagram, Value: []byte("hello")},
+		{Type: 0x2843, Value: []byte{1, 2, 3}},
+		{Type: CapsuleTypeDatagram, Value: []byte{}},
+	} {
+		c, err := r.ReadCapsule()
+		if err != nil || c.Type != expected.Type || !bytes.Equal(c.Value, expected.Value) {
+			t.Errorf("expected %+v, got %+v, %v", expected, c, err)
+		}
+	}
+	if _, err := r.ReadCapsule(); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of the stream, got %v", err)
+	}
+}
+
+func TestReadCapsuleErrors(t *testing.T) {
+	full := AppendCapsule(nil, Capsule{Type: 0x2843, Value: []byte("value")})
+	tTable := []struct {
+		name     string
+		stream   []byte
+		expected error
+	}{
+		{name: "truncated type", stream: full[:1], expected: io.ErrUnexpectedEOF},
+		{name: "missing length", stream: full[:2], expected: io.ErrUnexpectedEOF},
+		{name: "truncated value", stream: full[:len(full)-1], expected: io.ErrUnexpectedEOF},
+		{name: "too large", stream: quicvarint.Append([]byte{0x00}, MaxCapsuleSize+1)},
+	}
+
+	for _, tCase := range tTable {
+		_, err := NewCapsuleReader(bytes.NewReader(tCase.stream)).ReadCapsule()
+		if err == nil || tCase.expected != nil && !errors.Is(err, tCase.expected) {
+			t.Errorf("%s: expected %v, got %v", tCase.name, tCase.expected, err)
+		}
+	}
+}
+
+// pipeStream is a request stream without QUIC datagrams
+type pipeStream struct {
+	net.Conn
+}
+
+func (s pipeStream) SendDatagram([]byte) error { return errors.New("datagrams not negotiated") }
+
+func (s pipeStream) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSession_CapsuleFallback(t *testing.T) {
+	a, b := net.Pipe()
+	var unknown []Capsule
+	sessionA := NewSession(pipeStream{a}, false, nil)
+	sessionB := NewSession(pipeStream{b}, false, func(c Capsule) { unknown = append(unknown, c) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		sessionA.SendCapsule(Capsule{Type: 0x2843, Value: []byte("unknown")})
+		sessionA.SendDatagram([]byte("first"))
+		sessionA.SendDatagram([]byte("second"))
+	}()
+	for _, expected := range []string{"first", "second"} {
+		payload, err := sessionB.ReceiveDatagram(ctx)
+		if err != nil || string(payload) != expected {
+			t.Errorf("expected %q, got %q, %v", expected, payload, err)
+		}
+	}
+	if len(unknown) != 1 || unknown[0].Type != 0x2843 {
+		t.Errorf("expected the unknown capsule to be handed over, got %+v", unknown)
+	}
+
+	a.Close()
+	if _, err := sessionB.ReceiveDatagram(ctx); err != io.EOF {
+		t.Errorf("expected io.EOF once the stream ended, got %v", err)
+	}
+	if err := sessionB.Err(); err != io.EOF {
+		t.Errorf("expected Err to be io.EOF, got %v", err)
+	}
+}
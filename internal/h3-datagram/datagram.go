@@ -0,0 +1,129 @@
+// Package h3_datagram implements HTTP Datagrams and the Capsule Protocol of
+// RFC 9297, the building blocks shared by MASQUE and WebTransport.
+//
+// On an HTTP/3 connection a datagram is carried in a QUIC DATAGRAM frame that
+// starts with the quarter stream ID of the request it belongs to. When the
+// peer didn't negotiate datagrams, they travel as DATAGRAM capsules on the
+// request stream instead.
+package h3_datagram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	"quic-proxy/internal/utils"
+)
+
+// MaxQuarterStreamID is the largest valid quarter stream ID, 2^62-1 divided by 4
+const MaxQuarterStreamID = 1<<60 - 1
+
+// flowQueueLen is the number of received datagrams a flow buffers, the rest are dropped
+const flowQueueLen = 32
+
+var ErrInvalidQuarterStreamID = errors.New("invalid quarter stream ID")
+
+// AppendDatagram Frame payload as an HTTP Datagram of the request stream streamID
+func AppendDatagram(b []byte, streamID quic.StreamID, payload []byte) []byte {
+	b = quicvarint.Append(b, uint64(streamID/4))
+	return append(b, payload...)
+}
+
+// ParseDatagram Split an HTTP Datagram into the request stream it belongs to and its payload
+func ParseDatagram(data []byte) (quic.StreamID, []byte, error) {
+	quarterStreamID, n, err := quicvarint.Parse(data)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", ErrInvalidQuarterStreamID, err)
+	}
+	if quarterStreamID > MaxQuarterStreamID {
+		return 0, nil, fmt.Errorf("%w: %d", ErrInvalidQuarterStreamID, quarterStreamID)
+	}
+	return quic.StreamID(quarterStreamID * 4), data[n:], nil
+}
+
+// Mux dispatches the QUIC datagrams of a connection to the flows of its
+// request streams. It is needed where the QUIC connection is used directly,
+// http3 connections do this themselves for http3.Stream.
+type Mux struct {
+	conn  quic.Connection
+	flows *utils.SafeMap[quic.StreamID, *Flow]
+	done  chan struct{}
+	err   error
+}
+
+// Flow is the datagram flow of one request stream
+type Flow struct {
+	mux      *Mux
+	streamID quic.StreamID
+	queue    chan []byte
+}
+
+// NewMux Start dispatching the datagrams received on conn, conn must have datagrams enabled
+func NewMux(conn quic.Connection) *Mux {
+	m := &Mux{
+		conn:  conn,
+		flows: utils.NewSafeMap[quic.StreamID, *Flow](),
+		done:  make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+// run Receive datagrams until the connection is closed. A malformed quarter
+// stream ID closes the connection with H3_DATAGRAM_ERROR, RFC 9297 section 2.1.
+func (m *Mux) run() {
+	defer close(m.done)
+	for {
+		data, err := m.conn.ReceiveDatagram(context.Background())
+		if err != nil {
+			m.err = err
+			return
+		}
+		streamID, payload, err := ParseDatagram(data)
+		if err != nil {
+			m.conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeDatagramError), err.Error())
+			m.err = err
+			return
+		}
+		// datagrams of unknown streams are dropped, they may belong to a
+		// request that is already gone or not yet seen
+		if flow, ok := m.flows.Get(streamID); ok {
+			select {
+			case flow.queue <- payload:
+			default:
+			}
+		}
+	}
+}
+
+// Flow Register the datagram flow of the request stream streamID
+func (m *Mux) Flow(streamID quic.StreamID) *Flow {
+	flow := &Flow{mux: m, streamID: streamID, queue: make(chan []byte, flowQueueLen)}
+	m.flows.Set(streamID, flow)
+	return flow
+}
+
+// SendDatagram Send payload in a datagram of the flow
+func (f *Flow) SendDatagram(payload []byte) error {
+	return f.mux.conn.SendDatagram(AppendDatagram(make([]byte, 0, 8+len(payload)), f.streamID, payload))
+}
+
+// ReceiveDatagram Wait for the next datagram of the flow
+func (f *Flow) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case payload := <-f.queue:
+		return payload, nil
+	case <-f.mux.done:
+		return nil, f.mux.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close Unregister the flow, its datagrams are dropped from now on
+func (f *Flow) Close() {
+	f.mux.flows.Delete(f.streamID)
+}
@@ -0,0 +1,111 @@
+package h3_datagram
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+	"quic-proxy/internal/testutil"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	tTable := []struct {
+		streamID quic.StreamID
+		payload  string
+		expected []byte
+	}{
+		{streamID: 0, payload: "a", expected: []byte{0x00, 'a'}},
+		{streamID: 4, payload: "", expected: []byte{0x01}},
+		{streamID: 256, payload: "b", expected: []byte{0x40, 0x40, 'b'}},
+	}
+
+	for _, tCase := range tTable {
+		data := AppendDatagram(nil, tCase.streamID, []byte(tCase.payload))
+		if !bytes.Equal(data, tCase.expected) {
+			t.Errorf("AppendDatagram(%d, %q): expected %x, got %x", tCase.streamID, tCase.payload, tCase.expected, data)
+		}
+		streamID, payload, err := ParseDatagram(data)
+		if err != nil || streamID != tCase.streamID || string(payload) != tCase.payload {
+			t.Errorf("ParseDatagram(%x): expected %d %q, got %d %q, %v", data, tCase.streamID, tCase.payload, streamID, payload, err)
+		}
+	}
+
+	for _, data := range [][]byte{nil, {0x40}, quicvarint.Append(nil, MaxQuarterStreamID+1)} {
+		if _, _, err := ParseDatagram(data); !errors.Is(err, ErrInvalidQuarterStreamID) {
+			t.Errorf("ParseDatagram(%x): expected ErrInvalidQuarterStreamID, got %v", data, err)
+		}
+	}
+}
+
+// dialQUIC Connect two QUIC endpoints with datagrams enabled
+func dialQUIC(t *testing.T) (client, server quic.Connection) {
+	t.Helper()
+	tlsConf := testutil.ServerTLSConfig(t)
+	tlsConf.NextProtos = []string{"test"}
+	ln, err := quic.Listen(testutil.ListenUDP(t), tlsConf, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err = quic.DialAddr(ctx, ln.Addr().String(),
+		&tls.Config{InsecureSkipVerify: true, NextProtos: []string{"test"}},
+		&quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { client.CloseWithError(0, "") })
+	server, err = ln.Accept(ctx)
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	return client, server
+}
+
+func TestMux(t *testing.T) {
+	client, server := dialQUIC(t)
+	mux := NewMux(server)
+	flow0, flow4 := mux.Flow(0), mux.Flow(4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// nobody listens on stream 8, its datagram is dropped
+	client.SendDatagram(AppendDatagram(nil, 8, []byte("lost")))
+	client.SendDatagram(AppendDatagram(nil, 4, []byte("four")))
+	client.SendDatagram(AppendDatagram(nil, 0, []byte("zero")))
+	for _, tCase := range []struct {
+		flow     *Flow
+		expected string
+	}{{flow0, "zero"}, {flow4, "four"}} {
+		payload, err := tCase.flow.ReceiveDatagram(ctx)
+		if err != nil || string(payload) != tCase.expected {
+			t.Errorf("flow %d: expected %q, got %q, %v", tCase.flow.streamID, tCase.expected, payload, err)
+		}
+	}
+
+	if err := flow4.SendDatagram([]byte("reply")); err != nil {
+		t.Fatalf("SendDatagram failed: %v", err)
+	}
+	data, err := client.ReceiveDatagram(ctx)
+	if err != nil || !bytes.Equal(data, AppendDatagram(nil, 4, []byte("reply"))) {
+		t.Errorf("expected the reply on stream 4, got %x, %v", data, err)
+	}
+
+	// a malformed quarter stream ID is a connection error
+	client.SendDatagram(quicvarint.Append(nil, MaxQuarterStreamID+1))
+	if _, err := flow0.ReceiveDatagram(ctx); !errors.Is(err, ErrInvalidQuarterStreamID) {
+		t.Errorf("expected ErrInvalidQuarterStreamID, got %v", err)
+	}
+	select {
+	case <-client.Context().Done():
+	case <-ctx.Done():
+		t.Errorf("connection wasn't closed")
+	}
+}
@@ -0,0 +1,149 @@
+package h3_datagram
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Stream is the request stream of an HTTP Datagram flow, http3.Stream and
+// http3.RequestStream implement it
+type Stream interface {
+	io.ReadWriter
+	SendDatagram(b []byte) error
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+}
+
+// Session exchanges HTTP Datagrams over a request stream. With datagrams
+// negotiated they go into QUIC DATAGRAM frames, otherwise into DATAGRAM
+// capsules on the stream. Datagrams are received both ways in either case,
+// RFC 9297 section 3.5 lets the peer choose. The session owns reading the
+// stream, capsules other than DATAGRAM are handed to onCapsule.
+type Session struct {
+	str       Stream
+	datagrams bool
+	onCapsule func(Capsule)
+
+	writeMu sync.Mutex
+	queue   chan []byte
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// NewSession Start reading the capsules of str. datagrams tells whether they
+// were negotiated, see Negotiated. onCapsule may be nil, unknown capsules are
+// then dropped as RFC 9297 section 3.2 demands.
+func NewSession(str Stream, datagrams bool, onCapsule func(Capsule)) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Session{
+		str:       str,
+		datagrams: datagrams,
+		onCapsule: onCapsule,
+		queue:     make(chan []byte, flowQueueLen),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	go s.readCapsules()
+	if datagrams {
+		go s.receiveDatagrams()
+	}
+	return s
+}
+
+// Datagrams reports whether datagrams are sent in QUIC DATAGRAM frames
+func (s *Session) Datagrams() bool {
+	return s.datagrams
+}
+
+// readCapsules Read the stream until it ends, that ends the session
+func (s *Session) readCapsules() {
+	defer close(s.done)
+	defer s.cancel()
+	r := NewCapsuleReader(s.str)
+	for {
+		c, err := r.ReadCapsule()
+		if err != nil {
+			s.err = err
+			return
+		}
+		switch {
+		case c.Type == CapsuleTypeDatagram:
+			s.enqueue(c.Value)
+		case s.onCapsule != nil:
+			s.onCapsule(c)
+		}
+	}
+}
+
+// receiveDatagrams Queue the QUIC datagrams of the stream until the session ends
+func (s *Session) receiveDatagrams() {
+	for {
+		payload, err := s.str.ReceiveDatagram(s.ctx)
+		if err != nil {
+			return
+		}
+		s.enqueue(payload)
+	}
+}
+
+// enqueue Queue a received datagram, it is dropped if the queue is full
+func (s *Session) enqueue(payload []byte) {
+	select {
+	case s.queue <- payload:
+	default:
+	}
+}
+
+// SendDatagram Send payload as an HTTP Datagram
+func (s *Session) SendDatagram(payload []byte) error {
+	if s.datagrams {
+		return s.str.SendDatagram(payload)
+	}
+	return s.SendCapsule(Capsule{Type: CapsuleTypeDatagram, Value: payload})
+}
+
+// SendCapsule Write c to the request stream
+func (s *Session) SendCapsule(c Capsule) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return WriteCapsule(s.str, c)
+}
+
+// ReceiveDatagram Wait for the next HTTP Datagram. Once the stream ended
+// and every queued datagram was returned, it returns io.EOF for a clean end
+// and the error of the stream otherwise.
+func (s *Session) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case payload := <-s.queue:
+		return payload, nil
+	default:
+	}
+	select {
+	case payload := <-s.queue:
+		return payload, nil
+	case <-s.done:
+		return nil, s.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Done is closed when the request stream ended
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session ended, io.EOF if the peer closed the stream,
+// and nil while it is running
+func (s *Session) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
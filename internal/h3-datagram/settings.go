@@ -0,0 +1,71 @@
+package h3_datagram
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// SettingH3Datagram is the SETTINGS_H3_DATAGRAM parameter, RFC 9297 section 2.1.1
+const SettingH3Datagram = 0x33
+
+// Settingser is the side of an HTTP/3 connection that received the SETTINGS of
+// the peer, http3.Connection and *http3.ClientConn implement it
+type Settingser interface {
+	ReceivedSettings() <-chan struct{}
+	Settings() *http3.Settings
+}
+
+// EnableServer Announce SETTINGS_H3_DATAGRAM and enable QUIC datagrams on s,
+// also when it serves a listener created with s.QUICConfig
+func EnableServer(s *http3.Server) {
+	s.EnableDatagrams = true
+	if s.QUICConfig != nil {
+		s.QUICConfig = s.QUICConfig.Clone()
+		s.QUICConfig.EnableDatagrams = true
+	}
+}
+
+// EnableTransport Announce SETTINGS_H3_DATAGRAM and enable QUIC datagrams on t
+func EnableTransport(t *http3.Transport) {
+	t.EnableDatagrams = true
+	if t.QUICConfig != nil {
+		t.QUICConfig = t.QUICConfig.Clone()
+		t.QUICConfig.EnableDatagrams = true
+	}
+}
+
+// Negotiated Wait for the SETTINGS of the peer and report whether HTTP
+// Datagrams can be sent in QUIC DATAGRAM frames: both endpoints sent
+// SETTINGS_H3_DATAGRAM and offered max_datagram_frame_size. enabled tells
+// whether this endpoint did, quic-go only exposes what the peer sent.
+func Negotiated(ctx context.Context, conn Settingser, enabled bool) (bool, error) {
+	if !enabled {
+		return false, nil
+	}
+	select {
+	case <-conn.ReceivedSettings():
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	if !conn.Settings().EnableDatagrams {
+		return false, nil
+	}
+	if c, ok := conn.(interface{ ConnectionState() quic.ConnectionState }); ok {
+		return c.ConnectionState().SupportsDatagrams, nil
+	}
+	return true, nil
+}
+
+// NegotiatedForRequest Negotiated for the connection a request to s arrived
+// on, w is the response writer of the request
+func NegotiatedForRequest(ctx context.Context, s *http3.Server, w http.ResponseWriter) (bool, error) {
+	hijacker, ok := w.(http3.Hijacker)
+	if !ok {
+		return false, errors.New("request didn't arrive over HTTP/3")
+	}
+	return Negotiated(ctx, hijacker.Connection(), s.EnableDatagrams)
+}
@@ -0,0 +1,312 @@
+// Package h3_gateway puts an HTTP/3 listener in front of HTTP/1.1 and h2 backends.
+package h3_gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/forwarding"
+	h1h3server "quic-proxy/internal/h1h3-server"
+	h2h3convert "quic-proxy/internal/h2h3-convert"
+	headerpolicy "quic-proxy/internal/header-policy"
+	"quic-proxy/internal/utils"
+	"quic-proxy/internal/websocket"
+)
+
+// Gateway terminates HTTP/3 and forwards every request to a single backend,
+// streaming the response back. Between HTTP/3 clients and an h2 backend the
+// requests and responses go through the conversions of h2h3convert. A companion TCP listener serves the same
+// handler over HTTP/1.1 and h2 and advertises the h3 endpoint in Alt-Svc.
+type Gateway struct {
+	cfg       *config.GatewayConfig
+	backend   *url.URL
+	forwarder *forwarding.Forwarder
+	policy    *headerpolicy.Policy
+	handler   http.Handler
+	h3Server  *http3.Server
+	tcp       *http.Server
+}
+
+// NewGateway Create a gateway from cfg
+func NewGateway(cfg *config.GatewayConfig) (*Gateway, error) {
+	backend, err := url.Parse(cfg.BackendURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend url %q: %w", cfg.BackendURL, err)
+	}
+	if backend.Scheme != "http" && backend.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported backend scheme: %q", backend.Scheme)
+	}
+	transport, err := backendTransport(cfg, backend)
+	if err != nil {
+		return nil, err
+	}
+	forwarder, err := forwarding.New(cfg.Forwarding)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := headerpolicy.New(cfg.HeaderPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Gateway{cfg: cfg, backend: backend, forwarder: forwarder, policy: policy}
+	proxy := forwardResets(&httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(backend)
+			// keep the Host the client asked for, the backend may serve several
+			pr.Out.Host = pr.In.Host
+			// the backend may answer 425 Too Early to requests that can't be replayed
+			if h1h3server.IsEarlyData(pr.In) {
+				pr.Out.Header.Set("Early-Data", "1")
+			}
+			g.forwarder.Request(pr.Out.Header, pr.In)
+		},
+		Transport: transport,
+		ModifyResponse: func(resp *http.Response) error {
+			g.forwarder.Response(resp)
+			if err := g.policy.Response(resp); err != nil {
+				return err
+			}
+			if resp.ProtoMajor == 2 && isH3(resp.Request) {
+				converted, err := h2h3convert.ConvertHTTP2ResponseToHTTP3(resp)
+				if err != nil {
+					return err
+				}
+				*resp = *converted
+			}
+			return recordUpstreamError(resp)
+		},
+		// stream the response instead of buffering it
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("[Gateway] %s %s to backend failed: %v", r.Method, r.URL, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	})
+	g.handler = policy.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := g.forwarder.CheckLoop(r); err != nil {
+			log.Printf("[Gateway] %v", err)
+			http.Error(w, "Proxy loop detected", http.StatusLoopDetected)
+			return
+		}
+		if websocket.IsWebSocket(r) {
+			g.serveWebSocket(w, r)
+			return
+		}
+		out := r
+		if r.ProtoMajor == 3 && g.cfg.BackendProtocol == "h2" {
+			var err error
+			if out, err = h2h3convert.ConvertHTTP3RequestToHTTP2(r); err != nil {
+				log.Printf("[Gateway] %s %s refused: %v", r.Method, r.URL, err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		// ReverseProxy relays the 1xx responses of the backend
+		proxy.ServeHTTP(h2h3convert.InformationalWriter(w, r), out)
+	}))
+	g.h3Server = h1h3server.NewH3Server(cfg.Http3Addr, g.handler, cfg.EarlyData)
+	policy.ConfigureServer(g.h3Server)
+	if cfg.TCPAddr != "" {
+		g.tcp = &http.Server{
+			Addr:    cfg.TCPAddr,
+			Handler: g.altSvcHandler(g.handler),
+		}
+		// h2 streams are reset with the code of the backend, not INTERNAL_ERROR
+		if err := h2h3convert.ConfigureServer(g.tcp); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// isH3 reports whether r, or the request it was converted from, came in over HTTP/3
+func isH3(r *http.Request) bool {
+	return r.Context().Value(http3.ServerContextKey) != nil
+}
+
+// backendTransport Build the transport used to reach the backend
+func backendTransport(cfg *config.GatewayConfig, backend *url.URL) (http.RoundTripper, error) {
+	tlsConf := &tls.Config{InsecureSkipVerify: cfg.BackendInsecure}
+	switch cfg.BackendProtocol {
+	case "", "h1":
+		return &http.Transport{
+			TLSClientConfig: tlsConf,
+			// an empty, non-nil map disables h2 for https backends
+			TLSNextProto:          map[string]func(string, *tls.Conn) http.RoundTripper{},
+			ExpectContinueTimeout: h2h3convert.ExpectContinueTimeout,
+		}, nil
+	case "h2":
+		// http2.Transport only waits for 100 Continue as part of an http.Transport
+		if backend.Scheme == "https" {
+			return h2h3convert.ContinueTransport{RoundTripper: &http2.Transport{TLSClientConfig: tlsConf}}, nil
+		}
+		// h2c, HTTP/2 with prior knowledge over cleartext TCP
+		return h2h3convert.ContinueTransport{RoundTripper: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported backend protocol: %q", cfg.BackendProtocol)
+	}
+}
+
+// serveWebSocket Bridge a WebSocket of the client, an RFC 9220 extended
+// CONNECT or an RFC 6455 upgrade, to an RFC 6455 upgrade on the backend.
+// The backend is reached over HTTP/1.1 whatever its configured protocol,
+// net/http can't send an extended CONNECT over h2.
+func (g *Gateway) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	u := g.backend.JoinPath(r.URL.Path)
+	// JoinPath leaves the path relative when the backend URL has none
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+	u.RawQuery = r.URL.RawQuery
+	log.Printf("[Gateway] WebSocket %s %s to %s", r.Method, r.URL.Path, u)
+	err := websocket.Proxy(w, r, func(ctx context.Context, header http.Header) (*websocket.Conn, *http.Response, error) {
+		conn, err := g.dialBackend(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		g.forwarder.Request(header, r)
+		ws, resp, err := websocket.DialH1(ctx, conn, u, r.Host, header)
+		if resp != nil {
+			g.forwarder.Response(resp)
+		}
+		return ws, resp, err
+	})
+	if err != nil {
+		log.Printf("[Gateway] WebSocket %s closed: %v", r.URL.Path, err)
+	}
+}
+
+// dialBackend Open a TCP connection to the backend, with TLS for an https backend
+func (g *Gateway) dialBackend(ctx context.Context) (net.Conn, error) {
+	addr := g.backend.Host
+	if g.backend.Port() == "" {
+		addr = net.JoinHostPort(g.backend.Hostname(), map[string]string{"http": "80", "https": "443"}[g.backend.Scheme])
+	}
+	if g.backend.Scheme == "https" {
+		d := &tls.Dialer{Config: &tls.Config{
+			InsecureSkipVerify: g.cfg.BackendInsecure,
+			NextProtos:         []string{"http/1.1"},
+		}}
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// upstreamErrorKey is the context key of the *upstreamError of a request
+type upstreamErrorKey struct{}
+
+// upstreamError remembers why reading the backend response failed
+type upstreamError struct {
+	err error
+}
+
+// upstreamBody records the error ending the backend response body
+type upstreamBody struct {
+	io.ReadCloser
+	upstreamErr *upstreamError
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.upstreamErr.err = err
+	}
+	return n, err
+}
+
+// recordUpstreamError Watch the backend body, so that a reset can be forwarded
+func recordUpstreamError(resp *http.Response) error {
+	if upstreamErr, ok := resp.Request.Context().Value(upstreamErrorKey{}).(*upstreamError); ok {
+		resp.Body = &upstreamBody{ReadCloser: resp.Body, upstreamErr: upstreamErr}
+	}
+	return nil
+}
+
+// forwardResets Reset the client's stream with the error code the backend reset
+// its stream with. When copying the body fails, ReverseProxy aborts the handler
+// under net/http and simply returns under http3, which would end the truncated
+// response like a complete one.
+func forwardResets(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamErr := new(upstreamError)
+		defer func() {
+			p := recover()
+			if p != nil && p != http.ErrAbortHandler {
+				panic(p)
+			}
+			if upstreamErr.err != nil {
+				log.Printf("[Gateway] %s %s: backend stream failed: %v", r.Method, r.URL, upstreamErr.err)
+				h2h3convert.ResetStream(w, r, upstreamErr.err)
+			} else if p != nil {
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), upstreamErrorKey{}, upstreamErr)))
+	})
+}
+
+// altSvcHandler Advertise the h3 listener on responses of the TCP listener
+func (g *Gateway) altSvcHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := g.h3Server.SetQUICHeaders(w.Header()); err != nil {
+			log.Printf("[Gateway] Failed to set Alt-Svc: %v", err)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Handler returns the handler forwarding requests to the backend
+func (g *Gateway) Handler() http.Handler {
+	return g.handler
+}
+
+// ListenAndServe Start the QUIC listener and, if configured, the TCP listener
+func (g *Gateway) ListenAndServe() error {
+	if err := utils.EnsureCertificate(g.cfg.CertPath, g.cfg.KeyPath); err != nil {
+		return err
+	}
+	errCh := make(chan error, 2)
+	if g.tcp != nil {
+		go func() {
+			log.Printf("[Gateway] Starting TCP listener on %s", g.cfg.TCPAddr)
+			errCh <- g.tcp.ListenAndServeTLS(g.cfg.CertPath, g.cfg.KeyPath)
+		}()
+	}
+	go func() {
+		log.Printf("[Gateway] Starting HTTP/3 listener on %s, backend %s (%s)", g.cfg.Http3Addr, g.backend, g.cfg.BackendProtocol)
+		errCh <- g.h3Server.ListenAndServeTLS(g.cfg.CertPath, g.cfg.KeyPath)
+	}()
+	err := <-errCh
+	g.Close()
+	return err
+}
+
+// Close Stop both listeners
+func (g *Gateway) Close() error {
+	var errs []error
+	if g.tcp != nil {
+		errs = append(errs, g.tcp.Close())
+	}
+	errs = append(errs, g.h3Server.Close())
+	return errors.Join(errs...)
+}
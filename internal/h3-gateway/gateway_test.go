@@ -0,0 +1,236 @@
+package h3_gateway
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/http2/hpack"
+	"quic-proxy/internal/config"
+	h1h3server "quic-proxy/internal/h1h3-server"
+	"quic-proxy/internal/testutil"
+)
+
+// startGateway Serve a gateway in front of backendURL over HTTP/3
+func startGateway(t *testing.T, backendURL, backendProtocol string) string {
+	t.Helper()
+	g, err := NewGateway(&config.GatewayConfig{
+		BackendURL:      backendURL,
+		BackendProtocol: backendProtocol,
+		BackendInsecure: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create gateway: %v", err)
+	}
+	return testutil.ServeH3(t, h1h3server.NewH3Server("", g.Handler(), nil))
+}
+
+func echoProto(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	fmt.Fprintf(w, "%s %s %s %s", r.Proto, r.Method, r.Host, body)
+}
+
+func TestGateway(t *testing.T) {
+	h1Backend := httptest.NewServer(http.HandlerFunc(echoProto))
+	defer h1Backend.Close()
+	h2cBackend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(echoProto), &http2.Server{}))
+	defer h2cBackend.Close()
+	h2Backend := httptest.NewUnstartedServer(http.HandlerFunc(echoProto))
+	h2Backend.EnableHTTP2 = true
+	h2Backend.StartTLS()
+	defer h2Backend.Close()
+
+	tTable := []struct {
+		backendURL      string
+		backendProtocol string
+		expectedProto   string
+	}{
+		{backendURL: h1Backend.URL, backendProtocol: "h1", expectedProto: "HTTP/1.1"},
+		{backendURL: h2cBackend.URL, backendProtocol: "h2", expectedProto: "HTTP/2.0"},
+		{backendURL: h2Backend.URL, backendProtocol: "h2", expectedProto: "HTTP/2.0"},
+	}
+
+	client := testutil.H3Client(t)
+	for _, tCase := range tTable {
+		addr := startGateway(t, tCase.backendURL, tCase.backendProtocol)
+
+		resp, err := client.Post("https://"+addr+"/echo", "text/plain", strings.NewReader("ping"))
+		if err != nil {
+			t.Fatalf("request through gateway to %s failed: %v", tCase.backendProtocol, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		expected := fmt.Sprintf("%s POST %s ping", tCase.expectedProto, addr)
+		if resp.ProtoMajor != 3 || string(body) != expected {
+			t.Errorf("expected %s response %q, got %s %q", tCase.backendProtocol, expected, resp.Proto, body)
+		}
+	}
+}
+
+func TestGateway_ConvertsForH2Backend(t *testing.T) {
+	var priorities []string
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		priorities = r.Header.Values("Priority")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		fmt.Fprint(w, r.Proto)
+	}), &http2.Server{}))
+	defer backend.Close()
+	addr := startGateway(t, backend.URL, "h2")
+
+	req, _ := http.NewRequest(http.MethodGet, "https://"+addr+"/", nil)
+	req.Header.Add("Priority", "u=1")
+	req.Header.Add("Priority", "i")
+	resp, err := testutil.H3Client(t).Do(req)
+	if err != nil {
+		t.Fatalf("request through gateway failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("expected the backend to be reached over h2, got %q", body)
+	}
+	// the HTTP/3 request is converted to HTTP/2, the priority signal in one field line
+	if len(priorities) != 1 || priorities[0] != "u=1, i" {
+		t.Errorf("expected one Priority field line u=1, i, got %q", priorities)
+	}
+	if resp.ProtoMajor != 3 || resp.Header.Get("Keep-Alive") != "" {
+		t.Errorf("expected an HTTP/3 response without connection-specific fields, got %s %v", resp.Proto, resp.Header)
+	}
+}
+
+func TestGateway_BackendDown(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(echoProto))
+	backend.Close()
+	addr := startGateway(t, backend.URL, "h1")
+
+	resp, err := testutil.H3Client(t).Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatalf("request through gateway failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected 502 when the backend is down, got %d", resp.StatusCode)
+	}
+}
+
+// serveResettingH2C Serve h2c on a random port, every stream gets a response header
+// and one DATA frame, then it is reset with code
+func serveResettingH2C(t *testing.T, code http2.ErrCode) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		preface := make([]byte, len(http2.ClientPreface))
+		if _, err := io.ReadFull(conn, preface); err != nil {
+			return
+		}
+		framer := http2.NewFramer(conn, conn)
+		framer.WriteSettings()
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch f := frame.(type) {
+			case *http2.SettingsFrame:
+				if !f.IsAck() {
+					framer.WriteSettingsAck()
+				}
+			case *http2.HeadersFrame:
+				var header bytes.Buffer
+				hpack.NewEncoder(&header).WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+				framer.WriteHeaders(http2.HeadersFrameParam{StreamID: f.StreamID, BlockFragment: header.Bytes(), EndHeaders: true})
+				framer.WriteData(f.StreamID, false, []byte("partial"))
+				framer.WriteRSTStream(f.StreamID, code)
+			}
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+func TestGateway_ForwardsBackendReset(t *testing.T) {
+	addr := startGateway(t, serveResettingH2C(t, http2.ErrCodeEnhanceYourCalm), "h2")
+
+	// RESET_STREAM may discard the response before it was delivered, only the code is certain
+	resp, err := testutil.H3Client(t).Get("https://" + addr + "/")
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	var h3Err *http3.Error
+	if !errors.As(err, &h3Err) || h3Err.ErrorCode != http3.ErrCodeExcessiveLoad {
+		t.Errorf("expected the stream to be reset with H3_EXCESSIVE_LOAD, got %v", err)
+	}
+}
+
+func TestGateway_ForwardsBackendResetOverH2(t *testing.T) {
+	g, err := NewGateway(&config.GatewayConfig{
+		TCPAddr:         "127.0.0.1:0",
+		BackendURL:      serveResettingH2C(t, http2.ErrCodeEnhanceYourCalm),
+		BackendProtocol: "h2",
+	})
+	if err != nil {
+		t.Fatalf("failed to create gateway: %v", err)
+	}
+	front := httptest.NewUnstartedServer(nil)
+	front.Config = g.tcp
+	front.EnableHTTP2 = true
+	front.StartTLS()
+	defer front.Close()
+	transport := &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer transport.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: transport}).Get(front.URL)
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	var h2Err http2.StreamError
+	if !errors.As(err, &h2Err) || h2Err.Code != http2.ErrCodeEnhanceYourCalm {
+		t.Errorf("expected the stream to be reset with ENHANCE_YOUR_CALM, got %v", err)
+	}
+}
+
+func TestGateway_ClientCancel(t *testing.T) {
+	canceled := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	defer backend.Close()
+	addr := startGateway(t, backend.URL, "h1")
+
+	resp, err := testutil.H3Client(t).Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatalf("request through gateway failed: %v", err)
+	}
+	io.ReadFull(resp.Body, make([]byte, len("partial")))
+	resp.Body.Close()
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the backend request to be canceled when the client went away")
+	}
+}
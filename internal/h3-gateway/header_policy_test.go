@@ -0,0 +1,72 @@
+package h3_gateway
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/quic-go/quic-go/http3"
+	"quic-proxy/internal/config"
+	h1h3server "quic-proxy/internal/h1h3-server"
+	headerpolicy "quic-proxy/internal/header-policy"
+	"quic-proxy/internal/testutil"
+)
+
+func TestGateway_HeaderPolicy(t *testing.T) {
+	// the response carries an X-Pad of the size asked for
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("pad"))
+		w.Header().Set("X-Pad", strings.Repeat("a", size))
+	}))
+	defer backend.Close()
+	g, err := NewGateway(&config.GatewayConfig{
+		BackendURL:   backend.URL,
+		HeaderPolicy: config.HeaderPolicyConfig{MaxFieldSectionSize: 2048},
+	})
+	if err != nil {
+		t.Fatalf("failed to create gateway: %v", err)
+	}
+	h3Addr := testutil.ServeH3(t, h1h3server.NewH3Server("", g.Handler(), nil))
+	h1 := httptest.NewServer(g.Handler())
+	defer h1.Close()
+
+	// an HTTP/3 client accepting field sections of 1024 bytes
+	transport := &http3.Transport{
+		TLSClientConfig:    &tls.Config{InsecureSkipVerify: true},
+		AdditionalSettings: map[uint64]uint64{headerpolicy.SettingMaxFieldSectionSize: 1024},
+	}
+	defer transport.Close()
+	h3Client := &http.Client{Transport: transport}
+
+	tTable := []struct {
+		name           string
+		client         *http.Client
+		url            string
+		reqPad         int
+		expectedStatus int
+	}{
+		{name: "h1 within the limit", client: h1.Client(), url: h1.URL + "/?pad=1500", expectedStatus: http.StatusOK},
+		{name: "h1 response over the limit", client: h1.Client(), url: h1.URL + "/?pad=3000", expectedStatus: http.StatusBadGateway},
+		{name: "h1 request over the limit", client: h1.Client(), url: h1.URL + "/", reqPad: 3000, expectedStatus: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "h3 within the client limit", client: h3Client, url: "https://" + h3Addr + "/?pad=500", expectedStatus: http.StatusOK},
+		{name: "h3 response over the client limit", client: h3Client, url: "https://" + h3Addr + "/?pad=1500", expectedStatus: http.StatusBadGateway},
+	}
+
+	for _, tCase := range tTable {
+		req, _ := http.NewRequest(http.MethodGet, tCase.url, nil)
+		if tCase.reqPad > 0 {
+			req.Header.Set("X-Pad", strings.Repeat("a", tCase.reqPad))
+		}
+		resp, err := tCase.client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request through gateway failed: %v", tCase.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tCase.expectedStatus {
+			t.Errorf("%s: expected %d, got %d", tCase.name, tCase.expectedStatus, resp.StatusCode)
+		}
+	}
+}
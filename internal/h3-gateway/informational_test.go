@@ -0,0 +1,157 @@
+package h3_gateway
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/testutil"
+)
+
+// earlyHints Send 103 Early Hints, then 100 Continue and echo the body.
+// /refuse answers 413 without asking for the body.
+func earlyHints(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+	w.WriteHeader(http.StatusEarlyHints)
+	if r.URL.Path == "/refuse" {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	// the h2 server doesn't send 100 Continue on its own after a 1xx response
+	w.WriteHeader(http.StatusContinue)
+	body, _ := io.ReadAll(r.Body)
+	w.Write(body)
+}
+
+// startEarlyHintsBackends Return the URLs of an HTTP/1.1 and an h2 backend serving earlyHints
+func startEarlyHintsBackends(t *testing.T) map[string]string {
+	t.Helper()
+	h1Backend := httptest.NewServer(http.HandlerFunc(earlyHints))
+	t.Cleanup(h1Backend.Close)
+	h2Backend := httptest.NewUnstartedServer(http.HandlerFunc(earlyHints))
+	h2Backend.EnableHTTP2 = true
+	h2Backend.StartTLS()
+	t.Cleanup(h2Backend.Close)
+	return map[string]string{"h1": h1Backend.URL, "h2": h2Backend.URL}
+}
+
+// postExpectingContinue Send a POST expecting 100 Continue over a raw
+// HTTP/1.x connection, the body is only sent once 100 Continue arrived, except
+// by an HTTP/1.0 client. It returns the 1xx codes received and the response.
+func postExpectingContinue(t *testing.T, addr, path, proto, body string) ([]int, *http.Response, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "POST %s %s\r\nHost: example.com\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", path, proto, len(body))
+	if proto == "HTTP/1.0" {
+		io.WriteString(conn, body)
+	}
+	br := bufio.NewReader(conn)
+	var codes []int
+	for {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("%s %s: failed to read response: %v", proto, path, err)
+		}
+		if resp.StatusCode >= http.StatusOK {
+			b, _ := io.ReadAll(resp.Body)
+			return codes, resp, string(b)
+		}
+		codes = append(codes, resp.StatusCode)
+		if resp.StatusCode == http.StatusContinue {
+			io.WriteString(conn, body)
+		}
+	}
+}
+
+func TestGateway_Informational(t *testing.T) {
+	tTable := []struct {
+		path           string
+		expectedCodes  []int
+		expectedStatus int
+		expectedBody   string
+	}{
+		{path: "/accept", expectedCodes: []int{http.StatusEarlyHints, http.StatusContinue}, expectedStatus: http.StatusOK, expectedBody: "ping"},
+		{path: "/refuse", expectedCodes: []int{http.StatusEarlyHints}, expectedStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	client := testutil.H3Client(t)
+	for backendProtocol, backendURL := range startEarlyHintsBackends(t) {
+		addr := startGateway(t, backendURL, backendProtocol)
+		for _, tCase := range tTable {
+			var codes []int
+			var link string
+			trace := &httptrace.ClientTrace{
+				Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+					codes = append(codes, code)
+					if code == http.StatusEarlyHints {
+						link = header.Get("Link")
+					}
+					return nil
+				},
+			}
+			req, _ := http.NewRequest(http.MethodPost, "https://"+addr+tCase.path, strings.NewReader("ping"))
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+			req.Header.Set("Expect", "100-continue")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: request through gateway failed: %v", backendProtocol, tCase.path, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if fmt.Sprint(codes) != fmt.Sprint(tCase.expectedCodes) || link == "" {
+				t.Errorf("%s %s: expected informational responses %v with a Link, got %v %q", backendProtocol, tCase.path, tCase.expectedCodes, codes, link)
+			}
+			if resp.StatusCode != tCase.expectedStatus || string(body) != tCase.expectedBody {
+				t.Errorf("%s %s: expected %d %q, got %d %q", backendProtocol, tCase.path, tCase.expectedStatus, tCase.expectedBody, resp.StatusCode, body)
+			}
+		}
+	}
+}
+
+func TestGateway_ExpectContinue(t *testing.T) {
+	tTable := []struct {
+		path           string
+		proto          string
+		expectedCodes  []int
+		expectedStatus int
+		expectedBody   string
+	}{
+		{path: "/accept", proto: "HTTP/1.1", expectedCodes: []int{http.StatusEarlyHints, http.StatusContinue}, expectedStatus: http.StatusOK, expectedBody: "ping"},
+		// the body is never sent, the client would wait for 100 Continue
+		{path: "/refuse", proto: "HTTP/1.1", expectedCodes: []int{http.StatusEarlyHints}, expectedStatus: http.StatusRequestEntityTooLarge},
+		// HTTP/1.0 clients get no informational response
+		{path: "/accept", proto: "HTTP/1.0", expectedStatus: http.StatusOK, expectedBody: "ping"},
+	}
+
+	for backendProtocol, backendURL := range startEarlyHintsBackends(t) {
+		g, err := NewGateway(&config.GatewayConfig{BackendURL: backendURL, BackendProtocol: backendProtocol, BackendInsecure: true})
+		if err != nil {
+			t.Fatalf("failed to create gateway: %v", err)
+		}
+		front := httptest.NewServer(g.Handler())
+		defer front.Close()
+		for _, tCase := range tTable {
+			codes, resp, body := postExpectingContinue(t, front.Listener.Addr().String(), tCase.path, tCase.proto, "ping")
+			if fmt.Sprint(codes) != fmt.Sprint(tCase.expectedCodes) {
+				t.Errorf("%s %s %s: expected informational responses %v, got %v", backendProtocol, tCase.proto, tCase.path, tCase.expectedCodes, codes)
+			}
+			if resp.StatusCode != tCase.expectedStatus || body != tCase.expectedBody {
+				t.Errorf("%s %s %s: expected %d %q, got %d %q", backendProtocol, tCase.proto, tCase.path, tCase.expectedStatus, tCase.expectedBody, resp.StatusCode, body)
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package h3_gateway
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"quic-proxy/internal/config"
+	h1h3server "quic-proxy/internal/h1h3-server"
+	"quic-proxy/internal/testutil"
+)
+
+func TestGateway_Smuggling(t *testing.T) {
+	rec := &testutil.Recorder{}
+	h1Backend := httptest.NewServer(rec)
+	defer h1Backend.Close()
+	h2cBackend := httptest.NewServer(h2c.NewHandler(rec, &http2.Server{}))
+	defer h2cBackend.Close()
+	h2Backend := httptest.NewUnstartedServer(rec)
+	h2Backend.EnableHTTP2 = true
+	h2Backend.StartTLS()
+	defer h2Backend.Close()
+
+	tTable := []struct {
+		name            string
+		backendURL      string
+		backendProtocol string
+	}{
+		{name: "h1", backendURL: h1Backend.URL, backendProtocol: "h1"},
+		{name: "h2", backendURL: h2Backend.URL, backendProtocol: "h2"},
+		{name: "h2c", backendURL: h2cBackend.URL, backendProtocol: "h2"},
+	}
+
+	for _, tCase := range tTable {
+		g, err := NewGateway(&config.GatewayConfig{BackendURL: tCase.backendURL, BackendProtocol: tCase.backendProtocol, BackendInsecure: true})
+		if err != nil {
+			t.Fatalf("failed to create gateway: %v", err)
+		}
+		h1 := httptest.NewServer(g.Handler())
+		defer h1.Close()
+		h3Addr := testutil.ServeH3(t, h1h3server.NewH3Server("", g.Handler(), nil))
+		t.Run(tCase.name, func(t *testing.T) {
+			testutil.RunSmugglingCorpus(t, h1.Listener.Addr().String(), h3Addr, rec)
+		})
+	}
+}
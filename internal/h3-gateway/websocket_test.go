@@ -0,0 +1,113 @@
+package h3_gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"quic-proxy/internal/websocket"
+)
+
+// wsBackend Serve classic WebSockets: /echo echoes a text frame with its
+// path, /drop goes away after the first frame, /private refuses the upgrade
+func wsBackend(t *testing.T) string {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/private" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		conn, err := websocket.Accept(w, r, http.Header{"Sec-Websocket-Protocol": {"chat"}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			f, err := conn.ReadFrame()
+			if err != nil || r.URL.Path == "/drop" {
+				return
+			}
+			if f.Opcode == websocket.OpText {
+				f.Payload = append(f.Payload, " "+r.Proto+" "+r.URL.RequestURI()...)
+			}
+			conn.WriteFrame(f)
+			if f.Opcode == websocket.OpClose {
+				return
+			}
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend.URL
+}
+
+// dialGateway Open a WebSocket to path through the gateway with an extended CONNECT
+func dialGateway(t *testing.T, addr, path string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	qconn, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}}, nil)
+	if err != nil {
+		t.Fatalf("failed to dial gateway: %v", err)
+	}
+	t.Cleanup(func() { qconn.CloseWithError(0, "") })
+	u, _ := url.Parse("https://" + addr + path)
+	return websocket.DialH3(ctx, (&http3.Transport{}).NewClientConn(qconn), u, addr, http.Header{"Sec-Websocket-Protocol": {"chat"}})
+}
+
+func TestGateway_WebSocket(t *testing.T) {
+	addr := startGateway(t, wsBackend(t), "h1")
+
+	conn, resp, err := dialGateway(t, addr, "/echo?room=1")
+	if err != nil {
+		t.Fatalf("extended CONNECT through gateway failed: %v", err)
+	}
+	defer conn.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Sec-WebSocket-Protocol") != "chat" {
+		t.Errorf("expected 200 with the subprotocol of the backend, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	conn.WriteFrame(websocket.Frame{Fin: true, Opcode: websocket.OpText, Payload: []byte("hello")})
+	f, err := conn.ReadFrame()
+	if expected := "hello HTTP/1.1 /echo?room=1"; err != nil || string(f.Payload) != expected {
+		t.Errorf("expected %q, got %q, %v", expected, f.Payload, err)
+	}
+	conn.WriteFrame(websocket.CloseFrame(4001, "done"))
+	f, err = conn.ReadFrame()
+	if code, reason, _ := websocket.ParseClose(f.Payload); err != nil || code != 4001 || reason != "done" {
+		t.Errorf("expected the Close frame to be echoed, got %d %q, %v", code, reason, err)
+	}
+}
+
+func TestGateway_WebSocketBackendGoesAway(t *testing.T) {
+	addr := startGateway(t, wsBackend(t), "h1")
+
+	conn, _, err := dialGateway(t, addr, "/drop")
+	if err != nil {
+		t.Fatalf("extended CONNECT through gateway failed: %v", err)
+	}
+	defer conn.Close()
+	conn.WriteFrame(websocket.Frame{Fin: true, Opcode: websocket.OpText, Payload: []byte("hello")})
+	f, err := conn.ReadFrame()
+	if err != nil || f.Opcode != websocket.OpClose {
+		t.Fatalf("expected a Close frame, got %+v, %v", f, err)
+	}
+	if code, _, _ := websocket.ParseClose(f.Payload); code != websocket.CloseGoingAway {
+		t.Errorf("expected the lost backend connection to become %d, got %d", websocket.CloseGoingAway, code)
+	}
+}
+
+func TestGateway_WebSocketRefused(t *testing.T) {
+	addr := startGateway(t, wsBackend(t), "h1")
+
+	_, resp, err := dialGateway(t, addr, "/private")
+	if !errors.Is(err, websocket.ErrHandshakeRefused) || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the 403 of the backend, got %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+// Package happy_eyeballs races HTTP/3 against TCP/TLS and IPv6 against IPv4,
+// in the spirit of RFC 8305, so that clients keep working on networks where
+// UDP or one of the address families is blocked.
+package happy_eyeballs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"quic-proxy/internal/migration"
+)
+
+const (
+	// DefaultQUICHeadStart is how long the QUIC attempt runs alone before TCP is tried
+	DefaultQUICHeadStart = 300 * time.Millisecond
+	// DefaultFallbackDelay is the "Connection Attempt Delay" between two addresses, RFC 8305 section 5
+	DefaultFallbackDelay = 250 * time.Millisecond
+	// DefaultTimeout bounds a single connection attempt
+	DefaultTimeout = 5 * time.Second
+)
+
+// Dialer establishes QUIC and TCP connections, racing the resolved addresses
+// of a host against each other and returning the first that succeeds.
+type Dialer struct {
+	QUICHeadStart time.Duration
+	FallbackDelay time.Duration
+	Timeout       time.Duration
+	Resolver      *net.Resolver
+	// Control is called with each resolved address of a TCP connection before
+	// it is dialed, like net.Dialer.Control, an error skips the address
+	Control func(network, address string, c syscall.RawConn) error
+	// Conn is the UDP socket of every QUIC connection of the dialer if set,
+	// Conn.Rebind moves them all to a new local address. Each connection has
+	// a socket of its own otherwise. Set it before the first dial.
+	Conn *migration.Conn
+
+	transportOnce sync.Once
+	transport     *quic.Transport
+}
+
+func (d *Dialer) quicHeadStart() time.Duration {
+	if d.QUICHeadStart > 0 {
+		return d.QUICHeadStart
+	}
+	return DefaultQUICHeadStart
+}
+
+func (d *Dialer) fallbackDelay() time.Duration {
+	if d.FallbackDelay > 0 {
+		return d.FallbackDelay
+	}
+	return DefaultFallbackDelay
+}
+
+func (d *Dialer) timeout() time.Duration {
+	if d.Timeout > 0 {
+		return d.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (d *Dialer) resolver() *net.Resolver {
+	if d.Resolver != nil {
+		return d.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// DialTCP Dial a TCP connection, IPv6 and IPv4 addresses are raced by net.Dialer
+// with FallbackDelay as the head start of the preferred family. A host pinned
+// by WithAddrs is dialed at its pinned addresses without another lookup.
+// It has the signature of http.Transport.DialContext.
+func (d *Dialer) DialTCP(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:       d.timeout(),
+		FallbackDelay: d.fallbackDelay(),
+		Resolver:      d.resolver(),
+		Control:       d.Control,
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	if _, ok := PinnedAddrs(ctx, host); !ok {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	ips, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout())
+	defer cancel()
+	return race(ctx, d.fallbackDelay(), ips, func(ctx context.Context, ip net.IP) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+	}, func(conn net.Conn) {
+		conn.Close()
+	})
+}
+
+// DialTLS Dial a TCP connection and complete the TLS handshake on it
+func (d *Dialer) DialTLS(ctx context.Context, addr string, tlsConf *tls.Config) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout())
+	defer cancel()
+	conn, err := d.DialTCP(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return handshakeTLS(ctx, conn, tlsConf)
+}
+
+// handshakeTLS Complete the TLS handshake on conn, which is closed if it fails
+func handshakeTLS(ctx context.Context, conn net.Conn, tlsConf *tls.Config) (*tls.Conn, error) {
+	tlsConn := tls.Client(conn, tlsConf)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// DialQUIC Dial a QUIC connection, racing every resolved address of addr.
+// It has the signature of http3.Transport.Dial.
+func (d *Dialer) DialQUIC(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlyConnection, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout())
+	defer cancel()
+	return race(ctx, d.fallbackDelay(), ips, func(ctx context.Context, ip net.IP) (quic.EarlyConnection, error) {
+		if d.Conn != nil {
+			addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip.String(), port))
+			if err != nil {
+				return nil, err
+			}
+			return d.quicTransport().DialEarly(ctx, addr, tlsConf, quicConf)
+		}
+		return quic.DialAddrEarly(ctx, net.JoinHostPort(ip.String(), port), tlsConf, quicConf)
+	}, func(conn quic.EarlyConnection) {
+		conn.CloseWithError(0, "lost the race")
+	})
+}
+
+// quicTransport Return the transport multiplexing the QUIC connections on Conn
+func (d *Dialer) quicTransport() *quic.Transport {
+	d.transportOnce.Do(func() {
+		d.transport = &quic.Transport{Conn: d.Conn}
+	})
+	return d.transport
+}
+
+// pinKey is the context key of the host pinned by WithAddrs
+type pinKey struct{}
+
+type pin struct {
+	host  string
+	addrs []netip.Addr
+}
+
+// WithAddrs Return a copy of ctx in which host is pinned to addrs: the dials
+// of host under it connect to these addresses instead of looking host up
+// again, so the addresses a caller checked are the ones dialed. With no
+// addrs the dials of host fail.
+func WithAddrs(ctx context.Context, host string, addrs []netip.Addr) context.Context {
+	return context.WithValue(ctx, pinKey{}, pin{host: pinHost(host), addrs: addrs})
+}
+
+// PinnedAddrs Return the addresses host is pinned to in ctx, if it is
+func PinnedAddrs(ctx context.Context, host string) ([]netip.Addr, bool) {
+	p, ok := ctx.Value(pinKey{}).(pin)
+	if !ok || p.host != pinHost(host) {
+		return nil, false
+	}
+	return p.addrs, true
+}
+
+// pinHost Normalize host the way DNS compares names
+func pinHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// resolve Look up host and interleave the address families, starting with the
+// family of the first answer, see RFC 8305 section 4
+func (d *Dialer) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	var addrs []net.IPAddr
+	if pinned, ok := PinnedAddrs(ctx, host); ok {
+		for _, addr := range pinned {
+			addrs = append(addrs, net.IPAddr{IP: addr.AsSlice(), Zone: addr.Zone()})
+		}
+	} else {
+		var err error
+		addrs, err = d.resolver().LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	var first, second []net.IP
+	firstIsV4 := addrs[0].IP.To4() != nil
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == firstIsV4 {
+			first = append(first, addr.IP)
+		} else {
+			second = append(second, addr.IP)
+		}
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			ips = append(ips, first[0])
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			ips = append(ips, second[0])
+			second = second[1:]
+		}
+	}
+	return ips, nil
+}
+
+// race Start dial for every address, each one delay after the previous or as
+// soon as the previous failed, and return the first connection established.
+// Connections that finish after the winner are released with discard.
+func race[T any](ctx context.Context, delay time.Duration, ips []net.IP, dial func(context.Context, net.IP) (T, error), discard func(T)) (T, error) {
+	type result struct {
+		conn T
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, len(ips))
+	var errs []error
+	pending, next := 0, 0
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if next < len(ips) {
+				ip := ips[next]
+				next++
+				pending++
+				go func() {
+					conn, err := dial(ctx, ip)
+					results <- result{conn: conn, err: err}
+				}()
+				timer.Reset(delay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// release the connections of the attempts still running
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.err == nil {
+							discard(late.conn)
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(ips) {
+				// start the next attempt right away
+				timer.Reset(0)
+			} else if pending == 0 {
+				var zero T
+				return zero, errors.Join(errs...)
+			}
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package happy_eyeballs
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"quic-proxy/internal/utils"
+)
+
+// sessionCache is the TLS session cache of the QUIC connections. It remembers
+// which servers issued a session ticket that allows 0-RTT. It isn't shared with
+// TCP, a ticket of a TLS over TCP connection can't resume a QUIC connection.
+type sessionCache struct {
+	tls.ClientSessionCache
+	earlyData *utils.SafeMap[string, bool]
+}
+
+func newSessionCache() *sessionCache {
+	return &sessionCache{
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		earlyData:          utils.NewSafeMap[string, bool](),
+	}
+}
+
+// Put implements tls.ClientSessionCache
+func (c *sessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.ClientSessionCache.Put(sessionKey, cs)
+	if cs == nil {
+		c.earlyData.Delete(sessionKey)
+		return
+	}
+	if _, state, err := cs.ResumptionState(); err == nil && state != nil {
+		c.earlyData.Set(sessionKey, state.EarlyData)
+	}
+}
+
+// allowsEarlyData reports whether there is a ticket of serverName allowing 0-RTT
+func (c *sessionCache) allowsEarlyData(serverName string) bool {
+	ok, _ := c.earlyData.Get(serverName)
+	return ok
+}
+
+// canSendEarly reports whether req may be sent in the 0-RTT data of a new
+// connection to an alternative of origin. Only safe requests without body can be replayed by an
+// attacker without harm, see https://datatracker.ietf.org/doc/html/rfc8470#section-2.1
+func (rt *RoundTripper) canSendEarly(req *http.Request, origin utils.Origin) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	return rt.sessions.allowsEarlyData(rt.serverName(origin))
+}
+
+// earlyRequest Turn h3Req into a request that http3.Transport sends without
+// waiting for the handshake to complete
+func earlyRequest(h3Req *http.Request) *http.Request {
+	early := h3Req.Clone(h3Req.Context())
+	early.Method = http3.MethodGet0RTT
+	if h3Req.Method == http.MethodHead {
+		early.Method = http3.MethodHead0RTT
+	}
+	// tell the origin it may answer 425 Too Early, RFC 8470 section 5.1
+	early.Header.Set("Early-Data", "1")
+	return early
+}
+
+// retryEarly Count the outcome of a request sent in 0-RTT and send h3Req again
+// once the handshake completed if the server refused the early data
+func (rt *RoundTripper) retryEarly(h3Req *http.Request, resp *http.Response, err error) (*http.Response, error) {
+	switch {
+	case errors.Is(err, quic.Err0RTTRejected):
+		// the connection pool closed the connection, it is no use for HTTP/3 any more
+	case err != nil:
+		return nil, err
+	case resp.StatusCode == http.StatusTooEarly:
+		resp.Body.Close()
+	default:
+		rt.EarlyData.Attempted.Add(1)
+		rt.EarlyData.Accepted.Add(1)
+		return resp, nil
+	}
+	rt.EarlyData.Attempted.Add(1)
+	rt.EarlyData.Rejected.Add(1)
+	log.Printf("[HappyEyeballs] 0-RTT request to %s refused, retry after the handshake", h3Req.URL.Host)
+	return rt.manager().RoundTripH3(h3Req, false)
+}
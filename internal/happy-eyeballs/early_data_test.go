@@ -0,0 +1,85 @@
+package happy_eyeballs
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"quic-proxy/internal/metrics"
+	"quic-proxy/internal/testutil"
+	"quic-proxy/internal/utils"
+)
+
+func TestRoundTripper_EarlyData(t *testing.T) {
+	tTable := []struct {
+		name          string
+		method        string
+		tooEarly      bool
+		expectedBody  string
+		expectedStats [3]int64 // attempted, accepted, rejected
+	}{
+		{name: "accepted", method: http.MethodGet, expectedBody: "early=true Early-Data=1", expectedStats: [3]int64{1, 1, 0}},
+		{name: "425 retried", method: http.MethodGet, tooEarly: true, expectedBody: "early=false Early-Data=", expectedStats: [3]int64{1, 0, 1}},
+		{name: "unsafe method", method: http.MethodDelete, expectedBody: "early=false Early-Data=", expectedStats: [3]int64{0, 0, 0}},
+	}
+
+	for _, tCase := range tTable {
+		h3Addr := testutil.StartH3Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			early := !r.TLS.HandshakeComplete
+			if early && tCase.tooEarly {
+				w.WriteHeader(http.StatusTooEarly)
+				return
+			}
+			fmt.Fprintf(w, "early=%t Early-Data=%s", early, r.Header.Get("Early-Data"))
+		}))
+		_, h3Port, _ := net.SplitHostPort(h3Addr)
+		cache := utils.NewAltSvcCache()
+		origin := utils.Origin{Scheme: "https", Host: "127.0.0.1", Port: h3Port}
+		cache.Store(origin, []utils.Service{{ProtocolID: "h3", AltAuthority: utils.AltAuthority{Port: h3Port}}})
+		rt := newTestRoundTripper(cache)
+		rt.EarlyData = new(metrics.EarlyData)
+
+		// the first connection gets a session ticket, the second one resumes it
+		var body string
+		for i := 0; i < 2; i++ {
+			rt.CloseIdleConnections()
+			req, _ := http.NewRequest(tCase.method, "https://"+h3Addr, nil)
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("%s: request %d failed: %v", tCase.name, i, err)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			body = string(b)
+			if resp.ProtoMajor != 3 {
+				t.Fatalf("%s: expected HTTP/3, got %s", tCase.name, resp.Proto)
+			}
+		}
+		rt.Close()
+
+		if body != tCase.expectedBody {
+			t.Errorf("%s: expected %q, got %q", tCase.name, tCase.expectedBody, body)
+		}
+		stats := [3]int64{rt.EarlyData.Attempted.Load(), rt.EarlyData.Accepted.Load(), rt.EarlyData.Rejected.Load()}
+		if stats != tCase.expectedStats {
+			t.Errorf("%s: expected attempted/accepted/rejected %v, got %v", tCase.name, tCase.expectedStats, stats)
+		}
+	}
+}
+
+func TestSessionCache_NotSharedWithTCP(t *testing.T) {
+	rt := newTestRoundTripper(nil)
+	if rt.TLSClientConfig.ClientSessionCache != nil {
+		t.Errorf("expected the TCP TLS config to be left alone")
+	}
+	origin := utils.Origin{Scheme: "https", Host: "example.com", Port: "443"}
+	if cache := rt.quicTLSConfig(origin).ClientSessionCache; cache != rt.sessions {
+		t.Errorf("expected QUIC connections to use the tracking session cache, got %v", cache)
+	}
+	if rt.canSendEarly(&http.Request{Method: http.MethodGet, Body: io.NopCloser(strings.NewReader(""))}, origin) {
+		t.Errorf("expected a request with a body not to be sent in 0-RTT")
+	}
+}
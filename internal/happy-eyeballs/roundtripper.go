@@ -0,0 +1,407 @@
+package happy_eyeballs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/qlog"
+	"quic-proxy/internal/metrics"
+	"quic-proxy/internal/upstream"
+	"quic-proxy/internal/utils"
+)
+
+// RoundTripper sends requests over HTTP/3 when the origin advertised an h3
+// alternative, and over TCP otherwise. The first connection to an alternative
+// races QUIC against TCP/TLS, giving QUIC a head start. A QUIC attempt that
+// loses the race keeps running and is used by later requests once it is ready;
+// one that fails marks the alternative broken in the Alt-Svc cache.
+// Safe requests are sent in 0-RTT when a new QUIC connection can be resumed.
+// Connections of both kinds are pooled per origin by an upstream.Manager.
+type RoundTripper struct {
+	Dialer          *Dialer
+	Cache           *utils.AltSvcCache
+	TLSClientConfig *tls.Config
+	QUICConfig      *quic.Config
+	EarlyData       *metrics.EarlyData
+	// Limits bound the pooled connections, set them before the first request
+	Limits upstream.Limits
+
+	connsOnce sync.Once
+	conns     *upstream.Manager
+	sessions  *sessionCache
+
+	// connections that won (or finished after losing) a race, waiting to be
+	// picked up by the transports. QUIC ones are keyed by quicKey, TCP ones by
+	// the origin they were dialed to.
+	quicConns *utils.SafeMap[string, quic.EarlyConnection]
+	tcpConns  *utils.SafeMap[string, net.Conn]
+}
+
+// NewRoundTripper Create a RoundTripper, nil arguments fall back to defaults
+func NewRoundTripper(dialer *Dialer, cache *utils.AltSvcCache, tlsConf *tls.Config, quicConf *quic.Config) *RoundTripper {
+	if dialer == nil {
+		dialer = &Dialer{}
+	}
+	if cache == nil {
+		cache = utils.DefaultAltSvcCache
+	}
+	if tlsConf == nil {
+		tlsConf = &tls.Config{}
+	}
+	if quicConf == nil {
+		quicConf = &quic.Config{}
+	}
+	rt := &RoundTripper{
+		Dialer:          dialer,
+		Cache:           cache,
+		TLSClientConfig: tlsConf,
+		QUICConfig:      quicConf,
+		EarlyData:       metrics.ClientEarlyData,
+		sessions:        newSessionCache(),
+		quicConns:       utils.NewSafeMap[string, quic.EarlyConnection](),
+		tcpConns:        utils.NewSafeMap[string, net.Conn](),
+	}
+	return rt
+}
+
+// DefaultRoundTripper is shared by every proxy mode, so that they share the
+// upstream connections as well. Upstream certificates are verified, set
+// TLSClientConfig.InsecureSkipVerify before the first request to turn it off
+var DefaultRoundTripper = NewRoundTripper(
+	&Dialer{},
+	utils.DefaultAltSvcCache,
+	&tls.Config{},
+	&quic.Config{
+		Tracer: qlog.DefaultConnectionTracer,
+	},
+)
+
+// manager Return the connection pool, created with Limits on first use
+func (rt *RoundTripper) manager() *upstream.Manager {
+	rt.connsOnce.Do(func() {
+		h3TLSConf := rt.TLSClientConfig.Clone()
+		h3TLSConf.ClientSessionCache = rt.sessions
+		rt.conns = upstream.NewManager(rt.Limits, upstream.Dialers{
+			DialTCP:  rt.dialTCP,
+			DialTLS:  rt.dialTLS,
+			DialQUIC: rt.dialQUIC,
+		}, h3TLSConf, rt.QUICConfig)
+	})
+	return rt.conns
+}
+
+// RoundTrip implements http.RoundTripper
+func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	origin := utils.OriginFromURL(req.URL)
+	// http3.Transport can't send request trailers, such requests stay on TCP
+	if len(req.Trailer) > 0 {
+		return rt.roundTripTCP(req)
+	}
+	if alts := rt.Cache.Lookup(origin, "h3"); len(alts) > 0 && rt.canUpgrade(origin) {
+		alt := alts[0]
+		resp, err := rt.roundTripAlternative(req, origin, alt)
+		if err == nil || !errors.Is(err, errFallback) {
+			return resp, err
+		}
+	}
+	return rt.roundTripTCP(req)
+}
+
+// canUpgrade Report whether requests to origin may move to an alternative.
+// The Alt-Svc of an http origin came in plaintext and anyone on the path could
+// have injected it, its requests only move to an alternative that presents a
+// verified certificate of the origin, RFC 7838 section 2.1 and RFC 8164
+func (rt *RoundTripper) canUpgrade(origin utils.Origin) bool {
+	return origin.Scheme == "https" || !rt.TLSClientConfig.InsecureSkipVerify
+}
+
+// errFallback tells RoundTrip to send the request over TCP instead
+var errFallback = errors.New("fall back to TCP")
+
+// roundTripAlternative Send req over HTTP/3 to alt, racing a TCP connection
+// if there is no QUIC connection to alt yet
+func (rt *RoundTripper) roundTripAlternative(req *http.Request, origin utils.Origin, alt utils.Alternative) (*http.Response, error) {
+	h3Req := h3Request(req, alt)
+	resp, err := rt.manager().RoundTripH3(h3Req, true)
+	if errors.Is(err, http3.ErrNoCachedConn) {
+		// a new connection may carry the request in its 0-RTT data
+		send := h3Req
+		early := rt.canSendEarly(req, origin)
+		if early {
+			send = earlyRequest(h3Req)
+		}
+		if _, ok := rt.quicConns.Get(quicKey(alt.Addr(), rt.serverName(origin))); ok {
+			// a QUIC connection finished in the background
+			resp, err = rt.manager().RoundTripH3(send, false)
+		} else if rt.race(req, origin, alt) {
+			resp, err = rt.manager().RoundTripH3(send, false)
+		} else {
+			return nil, errFallback
+		}
+		if early {
+			resp, err = rt.retryEarly(h3Req, resp, err)
+		}
+	}
+	if err != nil {
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+		log.Printf("[HappyEyeballs] HTTP/3 request to %s (%s) failed: %v", origin, alt.Addr(), err)
+		delay := rt.Cache.MarkBroken(origin, alt)
+		log.Printf("[HappyEyeballs] Marked %s broken for %v", alt.Addr(), delay)
+		// the request body can only be replayed if it was empty
+		if req.Body == nil || req.Body == http.NoBody {
+			return nil, errFallback
+		}
+		return nil, err
+	}
+	rt.Cache.MarkWorking(origin, alt)
+	return resp, nil
+}
+
+// race Race a QUIC connection to alt against a TCP connection to the origin.
+// It reports whether QUIC won. The winning connection is parked for the
+// transport that will pick it up, a TCP connection that lost is closed.
+func (rt *RoundTripper) race(req *http.Request, origin utils.Origin, alt utils.Alternative) bool {
+	quicDone := make(chan error, 1)
+	go func() {
+		// The QUIC attempt outlives the request, so that a connection that
+		// loses the race can still be used by the next one.
+		ctx := context.WithoutCancel(req.Context())
+		tlsConf := rt.quicTLSConfig(origin)
+		conn, err := rt.Dialer.DialQUIC(ctx, alt.Addr(), tlsConf, rt.manager().QUICConfig())
+		if err != nil {
+			delay := rt.Cache.MarkBroken(origin, alt)
+			log.Printf("[HappyEyeballs] QUIC to %s failed, marked broken for %v: %v", alt.Addr(), delay, err)
+		} else {
+			var old quic.EarlyConnection
+			rt.quicConns.Compute(quicKey(alt.Addr(), tlsConf.ServerName), func(c quic.EarlyConnection, _ bool) (quic.EarlyConnection, bool) {
+				old = c
+				return conn, true
+			})
+			if old != nil {
+				old.CloseWithError(0, "")
+			}
+		}
+		quicDone <- err
+	}()
+
+	headStart := time.NewTimer(rt.Dialer.quicHeadStart())
+	defer headStart.Stop()
+	select {
+	case err := <-quicDone:
+		if err == nil {
+			log.Printf("[HappyEyeballs] QUIC to %s won within the head start", alt.Addr())
+			return true
+		}
+		return false
+	case <-headStart.C:
+	case <-req.Context().Done():
+		return false
+	}
+
+	type tcpResult struct {
+		conn net.Conn
+		err  error
+	}
+	tcpDone := make(chan tcpResult, 1)
+	go func() {
+		conn, err := rt.dialOrigin(req.Context(), origin)
+		tcpDone <- tcpResult{conn: conn, err: err}
+	}()
+	select {
+	case err := <-quicDone:
+		if err == nil {
+			log.Printf("[HappyEyeballs] QUIC to %s won the race", alt.Addr())
+			go func() {
+				if res := <-tcpDone; res.err == nil {
+					res.conn.Close()
+				}
+			}()
+			return true
+		}
+		if res := <-tcpDone; res.err == nil {
+			rt.parkTCPConn(origin.String(), res.conn)
+		}
+		return false
+	case res := <-tcpDone:
+		if res.err != nil {
+			// TCP failed, QUIC is the only hope
+			return <-quicDone == nil
+		}
+		log.Printf("[HappyEyeballs] TCP to %s won the race", origin)
+		rt.parkTCPConn(origin.String(), res.conn)
+		return false
+	}
+}
+
+// parkTCPConn Leave conn for the transport, closing the one it replaces
+func (rt *RoundTripper) parkTCPConn(key string, conn net.Conn) {
+	var old net.Conn
+	rt.tcpConns.Compute(key, func(c net.Conn, _ bool) (net.Conn, bool) {
+		old = c
+		return conn, true
+	})
+	if old != nil {
+		old.Close()
+	}
+}
+
+// dialOrigin Dial the origin over TCP, completing the TLS handshake for https
+func (rt *RoundTripper) dialOrigin(ctx context.Context, origin utils.Origin) (net.Conn, error) {
+	addr := net.JoinHostPort(origin.Host, origin.Port)
+	if origin.Scheme != "https" {
+		return rt.dialTracked(ctx, addr, nil)
+	}
+	return rt.dialTracked(ctx, addr, rt.tcpTLSConfig(origin.Host))
+}
+
+// dialTracked Dial a TCP connection counted by the connection pool and
+// complete the TLS handshake on it if tlsConf is set
+func (rt *RoundTripper) dialTracked(ctx context.Context, addr string, tlsConf *tls.Config) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, rt.Dialer.timeout())
+	defer cancel()
+	conn, err := rt.Dialer.DialTCP(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn = rt.manager().Track(conn)
+	if tlsConf == nil {
+		return conn, nil
+	}
+	return handshakeTLS(ctx, conn, tlsConf)
+}
+
+// tcpTLSConfig Build the TLS config of a connection to host over TCP
+func (rt *RoundTripper) tcpTLSConfig(host string) *tls.Config {
+	tlsConf := rt.TLSClientConfig.Clone()
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName = host
+	}
+	tlsConf.NextProtos = []string{"h2", "http/1.1"}
+	return tlsConf
+}
+
+// roundTripTCP Send req over TCP and learn the Alt-Svc of the response
+func (rt *RoundTripper) roundTripTCP(req *http.Request) (*http.Response, error) {
+	resp, err := rt.manager().RoundTripTCP(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := rt.Cache.Update(utils.OriginFromURL(req.URL), resp.Header.Get("Alt-Svc")); err != nil {
+		log.Printf("[HappyEyeballs] Ignore invalid Alt-Svc from %s: %v", req.URL.Host, err)
+	}
+	return resp, nil
+}
+
+func (rt *RoundTripper) dialTCP(ctx context.Context, network, addr string) (net.Conn, error) {
+	if conn, ok := rt.takeTCPConn("http://" + addr); ok {
+		return conn, nil
+	}
+	return rt.dialTracked(ctx, addr, nil)
+}
+
+func (rt *RoundTripper) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	if conn, ok := rt.takeTCPConn("https://" + addr); ok {
+		return conn, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	return rt.dialTracked(ctx, addr, rt.tcpTLSConfig(host))
+}
+
+func (rt *RoundTripper) takeTCPConn(key string) (net.Conn, bool) {
+	var conn net.Conn
+	rt.tcpConns.Compute(key, func(c net.Conn, exists bool) (net.Conn, bool) {
+		conn = c
+		return nil, false
+	})
+	return conn, conn != nil
+}
+
+func (rt *RoundTripper) dialQUIC(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlyConnection, error) {
+	var conn quic.EarlyConnection
+	rt.quicConns.Compute(quicKey(addr, tlsConf.ServerName), func(c quic.EarlyConnection, exists bool) (quic.EarlyConnection, bool) {
+		conn = c
+		return nil, false
+	})
+	if conn != nil && conn.Context().Err() == nil {
+		return conn, nil
+	}
+	return rt.Dialer.DialQUIC(ctx, addr, tlsConf, quicConf)
+}
+
+// quicTLSConfig Build the TLS config of a QUIC connection to an alternative
+// of origin. The alternative must present a certificate of the origin, RFC
+// 7838 section 2.1, or an injected Alt-Svc could send the traffic anywhere.
+func (rt *RoundTripper) quicTLSConfig(origin utils.Origin) *tls.Config {
+	tlsConf := rt.TLSClientConfig.Clone()
+	tlsConf.ServerName = rt.serverName(origin)
+	tlsConf.NextProtos = []string{http3.NextProtoH3}
+	tlsConf.ClientSessionCache = rt.sessions
+	return tlsConf
+}
+
+// serverName Return the name the certificates of origin are verified for
+func (rt *RoundTripper) serverName(origin utils.Origin) string {
+	if rt.TLSClientConfig.ServerName != "" {
+		return rt.TLSClientConfig.ServerName
+	}
+	return origin.Host
+}
+
+// quicKey Return the key of a parked QUIC connection to addr, verified for serverName
+func quicKey(addr, serverName string) string {
+	return serverName + "@" + addr
+}
+
+// CloseIdleConnections closes the idle connections of both kinds
+func (rt *RoundTripper) CloseIdleConnections() {
+	rt.manager().CloseIdleConnections()
+}
+
+// Close Close every connection
+func (rt *RoundTripper) Close() error {
+	for _, addr := range rt.quicConns.Keys() {
+		if conn, ok := rt.quicConns.Get(addr); ok {
+			conn.CloseWithError(0, "")
+		}
+		rt.quicConns.Delete(addr)
+	}
+	return rt.manager().Close()
+}
+
+// h3Request Build the request sent to the h3 alternative, :authority stays the original origin
+func h3Request(req *http.Request, alt utils.Alternative) *http.Request {
+	h3Req := req.Clone(req.Context())
+	h3Req.Body = nopCloser{req.Body}
+	if req.Body == nil || req.Body == http.NoBody {
+		h3Req.Body = req.Body
+	}
+	h3Req.Host = req.Host
+	if h3Req.Host == "" {
+		h3Req.Host = req.URL.Host
+	}
+	h3Req.URL.Scheme = "https"
+	h3Req.URL.Host = alt.Addr()
+	return h3Req
+}
+
+// nopCloser keeps http3.Transport from closing the original body when it fails,
+// the caller may still need it for the TCP fallback
+type nopCloser struct {
+	io.Reader
+}
+
+func (nopCloser) Close() error { return nil }
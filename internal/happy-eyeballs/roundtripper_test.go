@@ -0,0 +1,414 @@
+package happy_eyeballs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"quic-proxy/internal/migration"
+	"quic-proxy/internal/testutil"
+	"quic-proxy/internal/utils"
+)
+
+func newTestRoundTripper(cache *utils.AltSvcCache) *RoundTripper {
+	return NewRoundTripper(
+		&Dialer{QUICHeadStart: 50 * time.Millisecond, Timeout: time.Second},
+		cache,
+		&tls.Config{InsecureSkipVerify: true},
+		nil,
+	)
+}
+
+func get(t *testing.T, rt http.RoundTripper, target string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("request to %s failed: %v", target, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestRoundTripper_UpgradesToH3(t *testing.T) {
+	h3Addr := testutil.StartH3Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "h3 %s", r.Host)
+	}))
+	_, h3Port, _ := net.SplitHostPort(h3Addr)
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%s"`, h3Port))
+		fmt.Fprint(w, "tcp")
+	}))
+	defer origin.Close()
+
+	rt := newTestRoundTripper(utils.NewAltSvcCache())
+	defer rt.Close()
+
+	if resp, body := get(t, rt, origin.URL); resp.ProtoMajor != 1 || body != "tcp" {
+		t.Fatalf("expected the first request over TCP, got %s %q", resp.Proto, body)
+	}
+	// the Alt-Svc learned over TCP moves the next requests to the alternative
+	for i := 0; i < 2; i++ {
+		resp, body := get(t, rt, origin.URL)
+		if resp.ProtoMajor != 3 {
+			t.Fatalf("expected request %d over HTTP/3, got %s %q", i, resp.Proto, body)
+		}
+		u, _ := url.Parse(origin.URL)
+		if body != "h3 "+u.Host {
+			t.Errorf("expected :authority to stay the origin, got %q", body)
+		}
+	}
+}
+
+func TestRoundTripper_Plaintext(t *testing.T) {
+	h3Addr, tlsConf := testutil.StartTrustedH3Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "h3")
+	}))
+	_, h3Port, _ := net.SplitHostPort(h3Addr)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%s"`, h3Port))
+		fmt.Fprint(w, "tcp")
+	}))
+	defer origin.Close()
+
+	tTable := []struct {
+		name     string
+		tlsConf  *tls.Config
+		expected int
+	}{
+		// an Alt-Svc received in plaintext may be injected, RFC 7838 section 2.1
+		{name: "unverified", tlsConf: &tls.Config{InsecureSkipVerify: true}, expected: 1},
+		{name: "verified", tlsConf: tlsConf, expected: 3},
+	}
+	for _, tCase := range tTable {
+		rt := NewRoundTripper(&Dialer{QUICHeadStart: 50 * time.Millisecond, Timeout: time.Second}, utils.NewAltSvcCache(), tCase.tlsConf, nil)
+		get(t, rt, origin.URL)
+		if resp, body := get(t, rt, origin.URL); resp.ProtoMajor != tCase.expected {
+			t.Errorf("%s: expected the second request over HTTP/%d, got %s %q", tCase.name, tCase.expected, resp.Proto, body)
+		}
+		rt.Close()
+	}
+}
+
+func TestRoundTripper_FallsBackToTCP(t *testing.T) {
+	_, deadPort, _ := net.SplitHostPort(testutil.DeadUDPAddr(t))
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%s"`, deadPort))
+		fmt.Fprint(w, "tcp")
+	}))
+	defer origin.Close()
+
+	cache := utils.NewAltSvcCache()
+	rt := newTestRoundTripper(cache)
+	defer rt.Close()
+
+	get(t, rt, origin.URL)
+	u, _ := url.Parse(origin.URL)
+	alts := cache.Lookup(utils.OriginFromURL(u), "h3")
+	if len(alts) != 1 {
+		t.Fatalf("expected the h3 alternative to be cached, got %v", alts)
+	}
+
+	if resp, body := get(t, rt, origin.URL); resp.ProtoMajor != 1 || body != "tcp" {
+		t.Fatalf("expected the request to fall back to TCP, got %s %q", resp.Proto, body)
+	}
+	// the QUIC attempt keeps running after losing the race
+	deadline := time.Now().Add(3 * time.Second)
+	for !cache.IsBroken(utils.OriginFromURL(u), alts[0]) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the unreachable alternative to be marked broken")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRoundTripper_AlternativeServerName(t *testing.T) {
+	serverNames := make(chan string, 4)
+	tlsConf := testutil.ServerTLSConfig(t)
+	tlsConf.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		serverNames <- hello.ServerName
+		return nil, nil
+	}
+	h3Addr := testutil.ServeH3(t, &http3.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		TLSConfig: http3.ConfigureTLSConfig(tlsConf),
+	})
+	_, h3Port, _ := net.SplitHostPort(h3Addr)
+	// nothing listens on the origin, the request can only go to the alternative
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	_, originPort, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	cache := utils.NewAltSvcCache()
+	origin := utils.Origin{Scheme: "https", Host: "localhost", Port: originPort}
+	cache.Store(origin, []utils.Service{{ProtocolID: "h3", AltAuthority: utils.AltAuthority{Host: "127.0.0.1", Port: h3Port}}})
+	rt := newTestRoundTripper(cache)
+	defer rt.Close()
+
+	if resp, _ := get(t, rt, origin.String()+"/"); resp.ProtoMajor != 3 {
+		t.Fatalf("expected the request over HTTP/3, got %s", resp.Proto)
+	}
+	// the alternative must present a certificate of the origin, RFC 7838 section 2.1
+	if name := <-serverNames; name != "localhost" {
+		t.Errorf("expected the alternative to be asked for the origin, got server name %q", name)
+	}
+}
+
+func TestRoundTripper_ClosesLosingTCP(t *testing.T) {
+	h3Addr := testutil.StartH3Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	_, h3Port, _ := net.SplitHostPort(h3Addr)
+	closed := make(chan struct{}, 1)
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// the TLS handshake over TCP finishes well after QUIC
+	origin.TLS = &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		time.Sleep(200 * time.Millisecond)
+		return nil, nil
+	}}
+	origin.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	origin.StartTLS()
+	defer origin.Close()
+
+	cache := utils.NewAltSvcCache()
+	u, _ := url.Parse(origin.URL)
+	cache.Store(utils.OriginFromURL(u), []utils.Service{{ProtocolID: "h3", AltAuthority: utils.AltAuthority{Port: h3Port}}})
+	rt := NewRoundTripper(&Dialer{QUICHeadStart: time.Millisecond, Timeout: time.Second}, cache, &tls.Config{InsecureSkipVerify: true}, nil)
+	defer rt.Close()
+
+	if resp, _ := get(t, rt, origin.URL); resp.ProtoMajor != 3 {
+		t.Fatalf("expected QUIC to win the race, got %s", resp.Proto)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Errorf("expected the TCP connection that lost the race to be closed")
+	}
+	if keys := rt.tcpConns.Keys(); len(keys) != 0 {
+		t.Errorf("expected no TCP connection left parked, got %v", keys)
+	}
+}
+
+// startFollowingH3Server Serve handler over HTTP/3 on a socket following the
+// clients to their new address, the addresses they move to are sent on the channel
+func startFollowingH3Server(t *testing.T, handler http.Handler) (string, <-chan net.Addr) {
+	t.Helper()
+	moved := make(chan net.Addr, 8)
+	follow := migration.Follow(testutil.ListenUDP(t))
+	follow.OnMigrate = func(origin, from, to net.Addr) { moved <- to }
+	tr := &quic.Transport{Conn: follow, ConnectionIDLength: migration.ConnectionIDLength}
+	ln, err := tr.ListenEarly(http3.ConfigureTLSConfig(testutil.ServerTLSConfig(t)), nil)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := &http3.Server{Handler: handler}
+	go server.ServeListener(ln)
+	t.Cleanup(func() {
+		server.Close()
+		tr.Close()
+		follow.Close()
+	})
+	return follow.LocalAddr().String(), moved
+}
+
+func TestRoundTripper_Migration(t *testing.T) {
+	const size = 4 << 20
+	h3Addr, moved := startFollowingH3Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 64<<10)
+		for sent := 0; sent < size; sent += len(chunk) {
+			w.Write(chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	_, h3Port, _ := net.SplitHostPort(h3Addr)
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%s"`, h3Port))
+	}))
+	defer origin.Close()
+
+	conn, err := migration.Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+	conn.DrainTimeout = 500 * time.Millisecond
+	events := make(chan migration.Event, 8)
+	conn.OnEvent = func(e migration.Event) { events <- e }
+	rt := NewRoundTripper(
+		&Dialer{QUICHeadStart: 50 * time.Millisecond, Timeout: time.Second, Conn: conn},
+		utils.NewAltSvcCache(),
+		&tls.Config{InsecureSkipVerify: true},
+		nil,
+	)
+	defer rt.Close()
+	get(t, rt, origin.URL)
+
+	req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 3 {
+		t.Fatalf("expected the download over h3, got %s", resp.Proto)
+	}
+	if _, err := io.CopyN(io.Discard, resp.Body, size/2); err != nil {
+		t.Fatalf("first half of the download failed: %v", err)
+	}
+	from := conn.LocalAddr()
+	if err := conn.Rebind(""); err != nil {
+		t.Fatalf("rebind failed: %v", err)
+	}
+	// the old socket is closed once drained, the rest has to come on the new one
+	time.Sleep(2 * conn.DrainTimeout)
+	rest, err := io.Copy(io.Discard, resp.Body)
+	if err != nil || rest != size/2 {
+		t.Fatalf("expected the other %d bytes after the migration, got %d: %v", size/2, rest, err)
+	}
+
+	expected := []migration.EventType{migration.Rebound, migration.PathValidated}
+	for _, eventType := range expected {
+		select {
+		case e := <-events:
+			if e.Type != eventType {
+				t.Errorf("expected event %d, got %s", eventType, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event %d", eventType)
+		}
+	}
+	select {
+	case to := <-moved:
+		if to.String() == from.String() || to.String() != conn.LocalAddr().String() {
+			t.Errorf("expected the server to follow the client from %s to %s, got %s", from, conn.LocalAddr(), to)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the server didn't follow the client")
+	}
+
+	// the connection keeps serving requests from the new address
+	opened := rt.manager().H3Stats.Opened.Load()
+	if resp, _ := get(t, rt, origin.URL); resp.ProtoMajor != 3 {
+		t.Errorf("expected the next request over h3, got %s", resp.Proto)
+	}
+	if n := rt.manager().H3Stats.Opened.Load() - opened; n != 0 {
+		t.Errorf("expected the migrated connection to be reused, %d opened", n)
+	}
+}
+
+func TestRace(t *testing.T) {
+	ips := []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")}
+	errRefused := errors.New("refused")
+
+	tTable := []struct {
+		name     string
+		delays   map[string]time.Duration
+		failures map[string]bool
+		expected string
+	}{
+		{
+			name:     "first address wins",
+			delays:   map[string]time.Duration{"::1": 0, "127.0.0.1": 0, "127.0.0.2": 0},
+			expected: "::1",
+		},
+		{
+			name:     "slow first address loses",
+			delays:   map[string]time.Duration{"::1": time.Second, "127.0.0.1": 0, "127.0.0.2": time.Second},
+			expected: "127.0.0.1",
+		},
+		{
+			name:     "failure starts the next attempt",
+			failures: map[string]bool{"::1": true, "127.0.0.1": true},
+			expected: "127.0.0.2",
+		},
+	}
+
+	for _, tCase := range tTable {
+		start := time.Now()
+		winner, err := race(context.Background(), 100*time.Millisecond, ips, func(ctx context.Context, ip net.IP) (string, error) {
+			if tCase.failures[ip.String()] {
+				return "", errRefused
+			}
+			select {
+			case <-time.After(tCase.delays[ip.String()]):
+				return ip.String(), nil
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}, func(string) {})
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tCase.name, err)
+		}
+		if winner != tCase.expected {
+			t.Errorf("%s: expected %s to win, got %s", tCase.name, tCase.expected, winner)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("%s: race took %v", tCase.name, elapsed)
+		}
+	}
+
+	_, err := race(context.Background(), time.Millisecond, ips, func(context.Context, net.IP) (string, error) {
+		return "", errRefused
+	}, func(string) {})
+	if !errors.Is(err, errRefused) {
+		t.Errorf("expected every failure to be reported, got %v", err)
+	}
+}
+
+func TestDialer_PinnedAddrs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	// the name doesn't resolve, only the pinned addresses are dialed
+	host := "pinned.invalid"
+
+	tTable := []struct {
+		name   string
+		addrs  []netip.Addr
+		dialed bool
+	}{
+		{name: "pinned address", addrs: []netip.Addr{netip.MustParseAddr("127.0.0.1")}, dialed: true},
+		{name: "no address", addrs: nil, dialed: false},
+	}
+	dialer := &Dialer{Timeout: time.Second}
+	for _, tCase := range tTable {
+		ctx := WithAddrs(context.Background(), "PINNED.invalid.", tCase.addrs)
+		conn, err := dialer.DialTCP(ctx, "tcp", net.JoinHostPort(host, port))
+		if tCase.dialed != (err == nil) {
+			t.Errorf("%s: expected dialed %v, got %v", tCase.name, tCase.dialed, err)
+		}
+		if err == nil {
+			if conn.RemoteAddr().String() != ln.Addr().String() {
+				t.Errorf("%s: expected %s, dialed %s", tCase.name, ln.Addr(), conn.RemoteAddr())
+			}
+			conn.Close()
+		}
+	}
+}
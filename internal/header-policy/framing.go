@@ -0,0 +1,117 @@
+package header_policy
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// checkFraming Refuse the requests the next hop could frame differently than
+// the server that received them, the root of request smuggling: a method or
+// an authority that would break the HTTP/1.1 request line or Host, and a
+// Content-Length disagreeing with the body. None of it can be repaired, the
+// strictness of the policy doesn't matter here.
+func checkFraming(r *http.Request) error {
+	if !validMethod(r.Method) {
+		return malformed(":method", "%q is not a token", r.Method)
+	}
+	if !httpguts.ValidHostHeader(r.Host) {
+		return malformed(":authority", "%q is not a valid authority", r.Host)
+	}
+	return checkContentLength(r.Header, r.ContentLength)
+}
+
+// validMethod reports whether method is a token, RFC 9110 section 9.1
+func validMethod(method string) bool {
+	return method != "" && strings.IndexFunc(method, func(c rune) bool { return !httpguts.IsTokenRune(c) }) < 0
+}
+
+// checkContentLength Check that the Content-Length of h is one decimal length
+// agreeing with the length the message was framed with, -1 when unknown.
+// net/http already drops it next to Transfer-Encoding: chunked.
+func checkContentLength(h http.Header, length int64) error {
+	values := h["Content-Length"]
+	if len(values) == 0 {
+		return nil
+	}
+	if len(values) > 1 {
+		return malformed("Content-Length", "appears %d times", len(values))
+	}
+	n, err := strconv.ParseUint(values[0], 10, 63)
+	if err != nil {
+		return malformed("Content-Length", "%q is not a length", values[0])
+	}
+	if length >= 0 && int64(n) != length {
+		return malformed("Content-Length", "%d contradicts the body length %d", n, length)
+	}
+	return nil
+}
+
+// bodyAllowed reports whether resp may have a body whose length Content-Length gives
+func bodyAllowed(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return false
+	}
+	return resp.StatusCode >= http.StatusOK && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+}
+
+// limitBody Hold the body of a message to its Content-Length
+func limitBody(body io.ReadCloser, length int64) io.ReadCloser {
+	if length <= 0 || body == nil || body == http.NoBody {
+		return body
+	}
+	return &lengthBody{ReadCloser: body, remaining: length}
+}
+
+// lengthBody fails the reads of a body carrying more or less than its
+// Content-Length. net/http enforces it over HTTP/1.1 and h2, http3 only
+// notices the extra DATA once the declared bytes were read: a transport would
+// have sent the next hop a body looking complete. The last bytes are held back
+// until the body is known to end there.
+type lengthBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error // the error every read returns once set
+}
+
+func (b *lengthBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	switch {
+	case err == io.EOF && b.remaining > 0:
+		err = malformed("Content-Length", "exceeds the body by %d bytes", b.remaining)
+	case err == nil && b.remaining == 0:
+		err = b.checkEnd()
+	}
+	if err != nil {
+		b.err = err
+		if err != io.EOF {
+			// the next hop must not get a body it would take for complete
+			return 0, err
+		}
+	}
+	return n, err
+}
+
+// checkEnd Wait for the end of the body once its Content-Length was read
+func (b *lengthBody) checkEnd() error {
+	var probe [1]byte
+	for {
+		n, err := b.ReadCloser.Read(probe[:])
+		if n > 0 {
+			return malformed("Content-Length", "is shorter than the body")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Package header_policy applies the header rules of RFC 9110 section 5, RFC
+// 9113 section 8.2 and RFC 9114 section 4.2 to the messages a proxy translates
+// between HTTP/1.1, HTTP/2 and HTTP/3: valid field names and values, no
+// connection-specific fields in HTTP/2 and HTTP/3, one Cookie line, Host
+// agreeing with :authority, and field sections within the size the peer
+// accepts. Whether a message breaking a rule is repaired or refused depends on
+// the strictness of the policy.
+package header_policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http/httpguts"
+	"quic-proxy/internal/config"
+	h2h3convert "quic-proxy/internal/h2h3-convert"
+	h3datagram "quic-proxy/internal/h3-datagram"
+)
+
+// SettingMaxFieldSectionSize is the SETTINGS_MAX_FIELD_SECTION_SIZE parameter,
+// RFC 9114 section 7.2.4.1
+const SettingMaxFieldSectionSize = 0x6
+
+var (
+	// ErrMalformed is wrapped by the errors of messages breaking a header rule
+	ErrMalformed = errors.New("malformed header section")
+	// ErrTooLarge is wrapped by the errors of field sections exceeding a limit
+	ErrTooLarge = errors.New("header section too large")
+)
+
+// Error explains why a message can't be translated
+type Error struct {
+	// Err is ErrMalformed or ErrTooLarge
+	Err error
+	// Field is the name of the field at fault, empty for the whole section
+	Field  string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%v: %s", e.Err, e.Reason)
+	}
+	return fmt.Sprintf("%v: %s %s", e.Err, e.Field, e.Reason)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func malformed(field, format string, args ...any) error {
+	return &Error{Err: ErrMalformed, Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Status Return the status answering a request refused with err
+func Status(err error) int {
+	if errors.Is(err, ErrTooLarge) {
+		return http.StatusRequestHeaderFieldsTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// Strictness tells what happens to a message breaking a rule
+type Strictness int
+
+const (
+	// Standard refuses the messages RFC 9113 and RFC 9114 call malformed and
+	// repairs the others
+	Standard Strictness = iota
+	// Lenient repairs what it can: the invalid fields are dropped, and so are
+	// the connection-specific fields and a Host contradicting :authority
+	Lenient
+	// Strict also refuses the messages that would need repairing, field values
+	// with leading or trailing whitespace
+	Strict
+)
+
+// Default is used by the proxy modes that have no header policy config of their own
+var Default = mustNew(config.HeaderPolicyConfig{})
+
+// Policy checks and normalizes the header sections of one proxy
+type Policy struct {
+	Strictness Strictness
+	// MaxFieldSectionSize bounds the field sections forwarded, 0 leaves it to
+	// the SETTINGS of the peer
+	MaxFieldSectionSize uint64
+}
+
+// New Create a policy from cfg
+func New(cfg config.HeaderPolicyConfig) (*Policy, error) {
+	p := &Policy{MaxFieldSectionSize: cfg.MaxFieldSectionSize}
+	switch cfg.Strictness {
+	case "", "standard":
+		p.Strictness = Standard
+	case "lenient":
+		p.Strictness = Lenient
+	case "strict":
+		p.Strictness = Strict
+	default:
+		return nil, fmt.Errorf("invalid header policy strictness %q: lenient, standard or strict", cfg.Strictness)
+	}
+	return p, nil
+}
+
+func mustNew(cfg config.HeaderPolicyConfig) *Policy {
+	p, err := New(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// ConfigureServer Announce the field section limit of the policy in the
+// SETTINGS of s, and make s enforce it on the requests it receives
+func (p *Policy) ConfigureServer(s *http3.Server) {
+	if p.MaxFieldSectionSize == 0 {
+		return
+	}
+	settings := make(map[uint64]uint64, len(s.AdditionalSettings)+1)
+	for id, v := range s.AdditionalSettings {
+		settings[id] = v
+	}
+	settings[SettingMaxFieldSectionSize] = p.MaxFieldSectionSize
+	s.AdditionalSettings = settings
+	s.MaxHeaderBytes = int(p.MaxFieldSectionSize)
+}
+
+// Request Check the header of r, a request received over HTTP/r.ProtoMajor,
+// and normalize it in place so that it can be forwarded over any version:
+// valid fields only, one Cookie line and the authority in r.Host alone.
+// The connection-specific fields of HTTP/1.1 requests are left to the
+// forwarder, an upgrade needs them. Requests the next hop could frame
+// differently are refused and the body is held to its Content-Length.
+func (p *Policy) Request(r *http.Request) error {
+	if err := checkFraming(r); err != nil {
+		return err
+	}
+	if err := p.checkFields(r.Header, r.ProtoMajor); err != nil {
+		return err
+	}
+	if err := p.checkHost(r); err != nil {
+		return err
+	}
+	h2h3convert.MergeCookies(r.Header)
+	if err := CheckSize(h2h3convert.HeaderFields(r), p.MaxFieldSectionSize); err != nil {
+		return err
+	}
+	r.Body = limitBody(r.Body, r.ContentLength)
+	return nil
+}
+
+// Response Check the header of resp, received over HTTP/resp.ProtoMajor, and
+// normalize it in place. The field section must fit within the limit of the
+// policy and the one the client announced for the request Handler passed on.
+// Like for requests, the body is held to its Content-Length.
+func (p *Policy) Response(resp *http.Response) error {
+	if bodyAllowed(resp) {
+		if err := checkContentLength(resp.Header, resp.ContentLength); err != nil {
+			return err
+		}
+		resp.Body = limitBody(resp.Body, resp.ContentLength)
+	}
+	if err := p.checkFields(resp.Header, resp.ProtoMajor); err != nil {
+		return err
+	}
+	limit := p.MaxFieldSectionSize
+	if resp.Request != nil {
+		if peer, ok := resp.Request.Context().Value(clientLimitKey{}).(uint64); ok && (limit == 0 || peer < limit) {
+			limit = peer
+		}
+	}
+	return CheckSize(h2h3convert.ResponseFields(resp.StatusCode, resp.Header), limit)
+}
+
+// clientLimitKey is the context key of the field section size the client of a
+// request accepts
+type clientLimitKey struct{}
+
+// Handler Refuse the requests breaking the policy, answering with the reason,
+// and remember for Response the field section size the client accepts, which
+// an HTTP/3 client announces in its SETTINGS
+func (p *Policy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := p.Request(r); err != nil {
+			log.Printf("[HeaderPolicy] Refuse %s %s: %v", r.Method, r.URL, err)
+			http.Error(w, err.Error(), Status(err))
+			return
+		}
+		if limit := clientLimit(w); limit > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), clientLimitKey{}, limit))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientLimit Return the field section limit of the HTTP/3 client w answers,
+// 0 if there is none. The writers wrapping the one of http3 are unwrapped.
+func clientLimit(w http.ResponseWriter) uint64 {
+	for {
+		if hijacker, ok := w.(http3.Hijacker); ok {
+			return PeerLimit(hijacker.Connection())
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return 0
+		}
+		w = u.Unwrap()
+	}
+}
+
+// PeerLimit Return the SETTINGS_MAX_FIELD_SECTION_SIZE of the peer of conn,
+// 0 if it didn't send one or its SETTINGS didn't arrive yet
+func PeerLimit(conn h3datagram.Settingser) uint64 {
+	select {
+	case <-conn.ReceivedSettings():
+	default:
+		return 0
+	}
+	return conn.Settings().Other[SettingMaxFieldSectionSize]
+}
+
+// CheckSize Return an ErrTooLarge error if fields exceed limit, 0 is no limit
+func CheckSize(fields []h2h3convert.HeaderField, limit uint64) error {
+	if size := h2h3convert.FieldSectionSize(fields); limit > 0 && size > limit {
+		return &Error{Err: ErrTooLarge, Reason: fmt.Sprintf("%d bytes, the limit is %d", size, limit)}
+	}
+	return nil
+}
+
+// checkFields Check the fields of h, received over HTTP/major, and repair
+// them in place: values are trimmed, invalid fields dropped when lenient
+func (p *Policy) checkFields(h http.Header, major int) error {
+	if major >= 2 {
+		if name := h2h3convert.ConnectionSpecific(h); name != "" {
+			if p.Strictness != Lenient {
+				return malformed(name, "is connection-specific, HTTP/%d doesn't allow it", major)
+			}
+			h2h3convert.StripConnectionHeaders(h)
+		}
+	}
+	for name, values := range h {
+		// the pseudo-header fields servers leave in the header, :protocol
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+		if !httpguts.ValidHeaderFieldName(name) {
+			if p.Strictness != Lenient {
+				return malformed(fmt.Sprintf("%q", name), "is not a valid field name")
+			}
+			delete(h, name)
+			continue
+		}
+		kept := values[:0]
+		for _, v := range values {
+			trimmed := strings.Trim(v, " \t")
+			if !httpguts.ValidHeaderFieldValue(trimmed) {
+				if p.Strictness != Lenient {
+					return malformed(name, "has a value with control characters")
+				}
+				continue
+			}
+			if trimmed != v && p.Strictness == Strict {
+				return malformed(name, "has a value with leading or trailing whitespace")
+			}
+			kept = append(kept, trimmed)
+		}
+		if len(kept) == 0 {
+			delete(h, name)
+		} else {
+			h[name] = kept
+		}
+	}
+	return nil
+}
+
+// checkHost Keep the authority of r in r.Host alone, which becomes Host over
+// HTTP/1.1 and :authority over HTTP/2 and HTTP/3. A Host field next to
+// :authority must agree with it, RFC 9113 section 8.3.1 and RFC 9114 section
+// 4.3.1, net/http already moved the Host of HTTP/1.1 requests to r.Host.
+func (p *Policy) checkHost(r *http.Request) error {
+	hosts := r.Header.Values("Host")
+	r.Header.Del("Host")
+	for _, host := range hosts {
+		if !strings.EqualFold(host, r.Host) && p.Strictness != Lenient {
+			return malformed("Host", "%q contradicts :authority %q", host, r.Host)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package header_policy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"quic-proxy/internal/config"
+	h2h3convert "quic-proxy/internal/h2h3-convert"
+)
+
+func TestNew(t *testing.T) {
+	tTable := []struct {
+		strictness string
+		expected   Strictness
+		err        bool
+	}{
+		{strictness: "", expected: Standard},
+		{strictness: "standard", expected: Standard},
+		{strictness: "lenient", expected: Lenient},
+		{strictness: "strict", expected: Strict},
+		{strictness: "paranoid", err: true},
+	}
+
+	for _, tCase := range tTable {
+		p, err := New(config.HeaderPolicyConfig{Strictness: tCase.strictness})
+		if tCase.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", tCase.strictness)
+			}
+			continue
+		}
+		if err != nil || p.Strictness != tCase.expected {
+			t.Errorf("%q: expected strictness %v, got %v, %v", tCase.strictness, tCase.expected, p, err)
+		}
+	}
+}
+
+func TestPolicy_Request(t *testing.T) {
+	tTable := []struct {
+		name         string
+		strictness   Strictness
+		major        int
+		header       http.Header
+		expected     http.Header
+		expectedHost string
+		err          error
+	}{
+		{
+			name:     "cookie crumbs are merged",
+			major:    3,
+			header:   http.Header{"Cookie": {"a=1", "b=2"}},
+			expected: http.Header{"Cookie": {"a=1; b=2"}},
+		},
+		{
+			name:     "values are trimmed",
+			major:    1,
+			header:   http.Header{"Accept": {" */*\t"}},
+			expected: http.Header{"Accept": {"*/*"}},
+		},
+		{
+			name:       "strict refuses whitespace",
+			strictness: Strict,
+			major:      1,
+			header:     http.Header{"Accept": {" */*"}},
+			err:        ErrMalformed,
+		},
+		{
+			name:   "control characters",
+			major:  2,
+			header: http.Header{"X-Evil": {"a\x00b"}},
+			err:    ErrMalformed,
+		},
+		{
+			name:       "lenient drops control characters",
+			strictness: Lenient,
+			major:      2,
+			header:     http.Header{"X-Evil": {"a\rb"}, "X-Ok": {"1"}},
+			expected:   http.Header{"X-Ok": {"1"}},
+		},
+		{
+			name:   "invalid name",
+			major:  3,
+			header: http.Header{"X Evil": {"1"}},
+			err:    ErrMalformed,
+		},
+		{
+			name:   "connection-specific field over HTTP/3",
+			major:  3,
+			header: http.Header{"Transfer-Encoding": {"chunked"}},
+			err:    ErrMalformed,
+		},
+		{
+			name:   "TE other than trailers over HTTP/2",
+			major:  2,
+			header: http.Header{"Te": {"gzip"}},
+			err:    ErrMalformed,
+		},
+		{
+			name:       "lenient strips connection-specific fields",
+			strictness: Lenient,
+			major:      3,
+			header:     http.Header{"Connection": {"X-Hop"}, "X-Hop": {"1"}, "X-End": {"1"}},
+			expected:   http.Header{"X-End": {"1"}},
+		},
+		{
+			name:     "HTTP/1.1 keeps them for the forwarder",
+			major:    1,
+			header:   http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}},
+			expected: http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}},
+		},
+		{
+			name:         "Host agreeing with :authority",
+			major:        3,
+			header:       http.Header{"Host": {"Example.com"}},
+			expected:     http.Header{},
+			expectedHost: "example.com",
+		},
+		{
+			name:   "Host contradicting :authority",
+			major:  3,
+			header: http.Header{"Host": {"evil.example"}},
+			err:    ErrMalformed,
+		},
+		{
+			name:         "lenient keeps :authority",
+			strictness:   Lenient,
+			major:        2,
+			header:       http.Header{"Host": {"evil.example"}},
+			expected:     http.Header{},
+			expectedHost: "example.com",
+		},
+		{
+			name:   "too large",
+			major:  3,
+			header: http.Header{"X-Big": {strings.Repeat("a", 1024)}},
+			err:    ErrTooLarge,
+		},
+	}
+
+	for _, tCase := range tTable {
+		p := &Policy{Strictness: tCase.strictness, MaxFieldSectionSize: 1024}
+		r := &http.Request{
+			Method:     http.MethodGet,
+			URL:        &url.URL{Path: "/"},
+			Host:       "example.com",
+			ProtoMajor: tCase.major,
+			Header:     tCase.header,
+		}
+		err := p.Request(r)
+		if tCase.err != nil {
+			if !errors.Is(err, tCase.err) {
+				t.Errorf("%s: expected %v, got %v", tCase.name, tCase.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tCase.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(r.Header, tCase.expected) {
+			t.Errorf("%s: expected header %v, got %v", tCase.name, tCase.expected, r.Header)
+		}
+		if tCase.expectedHost != "" && r.Host != tCase.expectedHost {
+			t.Errorf("%s: expected host %q, got %q", tCase.name, tCase.expectedHost, r.Host)
+		}
+	}
+}
+
+func TestPolicy_Response(t *testing.T) {
+	tTable := []struct {
+		name        string
+		major       int
+		header      http.Header
+		clientLimit uint64
+		err         error
+	}{
+		{name: "within the limits", major: 2, header: http.Header{"Content-Type": {"text/plain"}}},
+		{name: "connection-specific field over HTTP/2", major: 2, header: http.Header{"Keep-Alive": {"300"}}, err: ErrMalformed},
+		{name: "HTTP/1.1 connection-specific field", major: 1, header: http.Header{"Keep-Alive": {"300"}}},
+		{name: "over the policy limit", major: 1, header: http.Header{"X-Big": {strings.Repeat("a", 2048)}}, err: ErrTooLarge},
+		{name: "over the client limit", major: 1, header: http.Header{"X-Big": {strings.Repeat("a", 512)}}, clientLimit: 256, err: ErrTooLarge},
+	}
+
+	p := &Policy{MaxFieldSectionSize: 1024}
+	for _, tCase := range tTable {
+		ctx := context.Background()
+		if tCase.clientLimit > 0 {
+			ctx = context.WithValue(ctx, clientLimitKey{}, tCase.clientLimit)
+		}
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://example.com/", nil)
+		resp := &http.Response{StatusCode: http.StatusOK, ProtoMajor: tCase.major, Header: tCase.header, Request: req}
+		if err := p.Response(resp); !errors.Is(err, tCase.err) {
+			t.Errorf("%s: expected %v, got %v", tCase.name, tCase.err, err)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	tTable := []struct {
+		err            error
+		expected       string
+		expectedStatus int
+	}{
+		{err: malformed("Host", "%q contradicts :authority %q", "a", "b"), expected: `malformed header section: Host "a" contradicts :authority "b"`, expectedStatus: http.StatusBadRequest},
+		{err: CheckSize([]h2h3convert.HeaderField{{Name: "a", Value: "b"}}, 16), expected: "header section too large: 34 bytes, the limit is 16", expectedStatus: http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for _, tCase := range tTable {
+		if tCase.err.Error() != tCase.expected || Status(tCase.err) != tCase.expectedStatus {
+			t.Errorf("expected %d %q, got %d %q", tCase.expectedStatus, tCase.expected, Status(tCase.err), tCase.err)
+		}
+	}
+}
+
+func TestPolicy_Framing(t *testing.T) {
+	tTable := []struct {
+		name          string
+		method        string
+		host          string
+		contentLength []string
+		body          string
+		length        int64
+		err           bool
+		bodyErr       bool
+	}{
+		{name: "well framed", method: http.MethodPost, host: "example.com:443", contentLength: []string{"5"}, body: "hello", length: 5},
+		{name: "no Content-Length", method: http.MethodPost, host: "example.com", body: "hello", length: -1},
+		{name: "CRLF in the method", method: "GET / HTTP/1.1\r\nHost: evil.example\r\n\r\nGET", host: "example.com", err: true},
+		{name: "space in the method", method: "GET /", host: "example.com", err: true},
+		{name: "CRLF in the authority", method: http.MethodGet, host: "example.com\r\nX-Evil: 1", err: true},
+		{name: "Content-Length twice", method: http.MethodPost, host: "example.com", contentLength: []string{"5", "5"}, body: "hello", length: 5, err: true},
+		{name: "signed Content-Length", method: http.MethodPost, host: "example.com", contentLength: []string{"+5"}, body: "hello", length: 5, err: true},
+		{name: "Content-Length contradicting the length", method: http.MethodPost, host: "example.com", contentLength: []string{"3"}, body: "hello", length: 5, err: true},
+		{name: "body shorter than Content-Length", method: http.MethodPost, host: "example.com", contentLength: []string{"10"}, body: "hello", length: 10, bodyErr: true},
+		{name: "body longer than Content-Length", method: http.MethodPost, host: "example.com", contentLength: []string{"3"}, body: "hello", length: 3, bodyErr: true},
+	}
+
+	for _, tCase := range tTable {
+		r := &http.Request{
+			Method:        tCase.method,
+			URL:           &url.URL{Path: "/"},
+			Host:          tCase.host,
+			ProtoMajor:    3,
+			Header:        http.Header{},
+			Body:          io.NopCloser(strings.NewReader(tCase.body)),
+			ContentLength: tCase.length,
+		}
+		if tCase.contentLength != nil {
+			r.Header["Content-Length"] = tCase.contentLength
+		}
+		// the strictness doesn't matter
+		err := (&Policy{Strictness: Lenient}).Request(r)
+		if tCase.err {
+			if !errors.Is(err, ErrMalformed) {
+				t.Errorf("%s: expected %v, got %v", tCase.name, ErrMalformed, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tCase.name, err)
+			continue
+		}
+		body, err := io.ReadAll(r.Body)
+		if tCase.bodyErr {
+			if !errors.Is(err, ErrMalformed) || int64(len(body)) > tCase.length {
+				t.Errorf("%s: expected %v after at most %d bytes, got %v after %q", tCase.name, ErrMalformed, tCase.length, err, body)
+			}
+			continue
+		}
+		if err != nil || string(body) != tCase.body {
+			t.Errorf("%s: expected body %q, got %q, %v", tCase.name, tCase.body, body, err)
+		}
+	}
+}
+
+func TestPolicy_ResponseFraming(t *testing.T) {
+	tTable := []struct {
+		name    string
+		method  string
+		status  int
+		length  int64
+		header  string
+		body    string
+		err     bool
+		bodyErr bool
+	}{
+		{name: "well framed", method: http.MethodGet, status: http.StatusOK, length: 5, header: "5", body: "hello"},
+		{name: "contradicting Content-Length", method: http.MethodGet, status: http.StatusOK, length: 5, header: "6", body: "hello", err: true},
+		{name: "body shorter than Content-Length", method: http.MethodGet, status: http.StatusOK, length: 6, header: "6", body: "hello", bodyErr: true},
+		{name: "HEAD has no body", method: http.MethodHead, status: http.StatusOK, length: 1234, header: "1234"},
+		{name: "304 has no body", method: http.MethodGet, status: http.StatusNotModified, header: "1234"},
+	}
+
+	for _, tCase := range tTable {
+		req, _ := http.NewRequest(tCase.method, "https://example.com/", nil)
+		resp := &http.Response{
+			StatusCode:    tCase.status,
+			ProtoMajor:    3,
+			Header:        http.Header{"Content-Length": {tCase.header}},
+			Body:          io.NopCloser(strings.NewReader(tCase.body)),
+			ContentLength: tCase.length,
+			Request:       req,
+		}
+		err := Default.Response(resp)
+		if tCase.err {
+			if !errors.Is(err, ErrMalformed) {
+				t.Errorf("%s: expected %v, got %v", tCase.name, ErrMalformed, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tCase.name, err)
+			continue
+		}
+		if _, err := io.ReadAll(resp.Body); errors.Is(err, ErrMalformed) != tCase.bodyErr {
+			t.Errorf("%s: unexpected body error %v", tCase.name, err)
+		}
+	}
+}
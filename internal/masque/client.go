@@ -0,0 +1,134 @@
+package masque
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/utils"
+)
+
+// DefaultIdleTimeout closes the tunnel of a local peer that went quiet,
+// the minimum UDP mapping timeout of RFC 4787 section 4.3
+const DefaultIdleTimeout = 2 * time.Minute
+
+// Client exposes a local UDP port and tunnels it to a fixed target through a
+// MASQUE proxy. Every local peer gets its own CONNECT-UDP request on a shared
+// QUIC connection, the replies of the target go back to the peer they belong to.
+type Client struct {
+	IdleTimeout time.Duration
+
+	cfg      *config.MasqueClientConfig
+	proxyURL string
+	proxy    *Conn
+	sessions *utils.SafeMap[string, *session]
+}
+
+// session is the CONNECT-UDP request stream of a local peer
+type session struct {
+	tunnel *UDPTunnel
+	idle   *time.Timer
+}
+
+// NewClient Create a MASQUE client from cfg
+func NewClient(cfg *config.MasqueClientConfig) (*Client, error) {
+	template, err := ParseTemplate(cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+	u, err := template.Expand(cfg.TargetAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", cfg.TargetAddr, err)
+	}
+	return &Client{
+		IdleTimeout: DefaultIdleTimeout,
+		cfg:         cfg,
+		proxyURL:    u.String(),
+		proxy:       NewConn(template, cfg.Insecure),
+		sessions:    utils.NewSafeMap[string, *session](),
+	}, nil
+}
+
+// ListenAndServe Listen on the local UDP address and tunnel what arrives there
+func (c *Client) ListenAndServe() error {
+	pc, err := net.ListenPacket("udp", c.cfg.LocalAddr)
+	if err != nil {
+		return err
+	}
+	log.Printf("[Masque] Tunnelling %s to %s through %s", pc.LocalAddr(), c.cfg.TargetAddr, c.proxyURL)
+	return c.Serve(pc)
+}
+
+// Serve Tunnel the datagrams received on pc until reading from pc fails
+func (c *Client) Serve(pc net.PacketConn) error {
+	defer c.Close()
+	buf := make([]byte, maxUDPPayload)
+	for {
+		n, peer, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		s, err := c.session(pc, peer)
+		if err != nil {
+			log.Printf("[Masque] Failed to open a tunnel for %s: %v", peer, err)
+			continue
+		}
+		s.idle.Reset(c.IdleTimeout)
+		if err := s.tunnel.Send(buf[:n]); err != nil && !isPacketError(err) {
+			log.Printf("[Masque] Tunnel of %s failed: %v", peer, err)
+			s.close()
+		}
+	}
+}
+
+// session Return the tunnel of peer, opening it on first use
+func (c *Client) session(pc net.PacketConn, peer net.Addr) (*session, error) {
+	key := peer.String()
+	if s, ok := c.sessions.Get(key); ok {
+		return s, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tunnel, err := c.proxy.ConnectUDP(ctx, c.cfg.TargetAddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{tunnel: tunnel}
+	s.idle = time.AfterFunc(c.IdleTimeout, s.close)
+	c.sessions.Set(key, s)
+
+	go func() {
+		defer c.sessions.Delete(key)
+		defer s.close()
+		for {
+			payload, err := tunnel.Receive(context.Background())
+			if err != nil {
+				return
+			}
+			s.idle.Reset(c.IdleTimeout)
+			if _, err := pc.WriteTo(payload, peer); err != nil {
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+// close Ending the request stream makes the proxy close its UDP socket
+func (s *session) close() {
+	s.idle.Stop()
+	s.tunnel.Close()
+}
+
+// Close Close every tunnel and the connection to the proxy
+func (c *Client) Close() error {
+	for _, key := range c.sessions.Keys() {
+		if s, ok := c.sessions.Get(key); ok {
+			s.close()
+		}
+	}
+	return c.proxy.Close()
+}
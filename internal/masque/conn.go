@@ -0,0 +1,170 @@
+package masque
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/qlog"
+	h3datagram "quic-proxy/internal/h3-datagram"
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+	"quic-proxy/internal/tunnel"
+)
+
+// Conn is the HTTP/3 connection to a MASQUE proxy, dialed on first use and
+// again once it closed. UDP flows are opened on it with CONNECT-UDP, TCP
+// tunnels with CONNECT, so they all share one QUIC connection.
+type Conn struct {
+	template *Template
+	addr     string
+	dialer   *happyeyeballs.Dialer
+	tlsConf  *tls.Config
+
+	mu        sync.Mutex
+	conn      *http3.ClientConn
+	qconn     quic.EarlyConnection
+	datagrams bool
+}
+
+// NewConn Create the connection to the proxy of template, it is dialed on first use
+func NewConn(template *Template, insecure bool) *Conn {
+	addr := template.host
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.Trim(addr, "[]")
+		addr = net.JoinHostPort(host, "443")
+	}
+	return &Conn{
+		template: template,
+		addr:     addr,
+		dialer:   &happyeyeballs.Dialer{},
+		tlsConf: &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: insecure,
+			NextProtos:         []string{http3.NextProtoH3},
+		},
+	}
+}
+
+// UDPTunnel is a CONNECT-UDP request, its HTTP Datagrams carry the UDP
+// payloads exchanged with one target
+type UDPTunnel struct {
+	str      http3.RequestStream
+	datagram *h3datagram.Session
+}
+
+// Send Send payload to the target
+func (t *UDPTunnel) Send(payload []byte) error {
+	return sendUDP(t.datagram, payload)
+}
+
+// Receive Wait for the next payload from the target
+func (t *UDPTunnel) Receive(ctx context.Context) ([]byte, error) {
+	return receiveUDP(ctx, t.datagram)
+}
+
+// Close Ending the request stream makes the proxy close its UDP socket
+func (t *UDPTunnel) Close() {
+	t.str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	t.str.Close()
+}
+
+// ConnectUDP Send a CONNECT-UDP request for target, a host:port, and wait
+// for the proxy to accept it
+func (c *Conn) ConnectUDP(ctx context.Context, target string) (*UDPTunnel, error) {
+	u, err := c.template.Expand(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	cc, datagrams, err := c.clientConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	str, err := cc.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Proto:  ProtocolConnectUDP,
+		Host:   u.Host,
+		URL:    u,
+		Header: http.Header{h3datagram.CapsuleProtocolHeader: {"?1"}},
+	}
+	if err := str.SendRequestHeader(req); err != nil {
+		return nil, err
+	}
+	resp, err := str.ReadResponse()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		str.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT-UDP to %s: %s", target, resp.Status)
+	}
+	return &UDPTunnel{str: str, datagram: h3datagram.NewSession(str, datagrams, nil)}, nil
+}
+
+// ConnectTCP Open a TCP tunnel to target, a host:port, with a CONNECT request
+func (c *Conn) ConnectTCP(ctx context.Context, target string) (tunnel.Conn, error) {
+	cc, _, err := c.clientConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	str, err := tunnel.Connect(ctx, cc, target)
+	if err != nil {
+		return nil, err
+	}
+	return tunnel.NewStreamConn(str), nil
+}
+
+// clientConn Return the HTTP/3 connection to the proxy, dialing a new one if
+// there is none or it was closed. It also reports whether the payloads can go
+// in QUIC datagrams.
+func (c *Conn) clientConn(ctx context.Context) (*http3.ClientConn, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.qconn != nil && c.qconn.Context().Err() == nil {
+		return c.conn, c.datagrams, nil
+	}
+	qconn, err := c.dialer.DialQUIC(ctx, c.addr, c.tlsConf, &quic.Config{
+		EnableDatagrams: true,
+		Tracer:          qlog.DefaultConnectionTracer,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	transport := &http3.Transport{}
+	h3datagram.EnableTransport(transport)
+	conn := transport.NewClientConn(qconn)
+	// a proxy without HTTP/3 datagrams still gets the payloads in DATAGRAM capsules
+	datagrams, err := h3datagram.Negotiated(ctx, conn, transport.EnableDatagrams)
+	if err != nil {
+		qconn.CloseWithError(0, "")
+		return nil, false, err
+	}
+	if !conn.Settings().EnableExtendedConnect {
+		qconn.CloseWithError(0, "")
+		return nil, false, errors.New("proxy doesn't support extended CONNECT")
+	}
+	c.conn, c.qconn, c.datagrams = conn, qconn, datagrams
+	return conn, datagrams, nil
+}
+
+// Close Close the connection to the proxy and every tunnel on it
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.qconn != nil {
+		return c.qconn.CloseWithError(0, "")
+	}
+	return nil
+}
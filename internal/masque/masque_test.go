@@ -0,0 +1,234 @@
+package masque
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/testutil"
+	"quic-proxy/internal/tunnel"
+)
+
+// startEchoServer Echo every UDP datagram back to its sender
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	conn := testutil.ListenUDP(t)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxUDPPayload)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// startMasque Start a MASQUE proxy and a client tunnelling to target, return
+// the local address of the client. Without datagrams the proxy doesn't
+// negotiate HTTP/3 datagrams, the payloads then travel in capsules.
+func startMasque(t *testing.T, target string, datagrams bool) string {
+	t.Helper()
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		t.Fatalf("invalid target %s: %v", target, err)
+	}
+	server, err := NewServer(&config.MasqueServerConfig{
+		AllowedUDPPorts:     []int{addr.Port},
+		AllowPrivateTargets: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if !datagrams {
+		server.h3Server.EnableDatagrams = false
+		server.h3Server.QUICConfig.EnableDatagrams = false
+	}
+	proxyAddr := testutil.ServeH3(t, server.h3Server)
+
+	client, err := NewClient(&config.MasqueClientConfig{
+		Template:   "https://" + proxyAddr + "/.well-known/masque/udp/{target_host}/{target_port}/",
+		TargetAddr: target,
+		Insecure:   true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	local := testutil.ListenUDP(t)
+	go client.Serve(local)
+	t.Cleanup(func() { local.Close() })
+	return local.LocalAddr().String()
+}
+
+func TestConnectUDP(t *testing.T) {
+	for _, datagrams := range []bool{true, false} {
+		local := startMasque(t, startEchoServer(t), datagrams)
+
+		// every peer gets its own tunnel, the replies must not get mixed up
+		for i := 0; i < 3; i++ {
+			peer, err := net.Dial("udp", local)
+			if err != nil {
+				t.Fatalf("failed to dial %s: %v", local, err)
+			}
+			defer peer.Close()
+			for j := 0; j < 2; j++ {
+				msg := fmt.Sprintf("ping %d-%d", i, j)
+				peer.Write([]byte(msg))
+				peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+				buf := make([]byte, maxUDPPayload)
+				n, err := peer.Read(buf)
+				if err != nil {
+					t.Fatalf("datagrams %t, peer %d: no echo for %q: %v", datagrams, i, msg, err)
+				}
+				if string(buf[:n]) != msg {
+					t.Errorf("datagrams %t, peer %d: expected %q, got %q", datagrams, i, msg, buf[:n])
+				}
+			}
+		}
+	}
+}
+
+func TestServer_RejectsOtherRequests(t *testing.T) {
+	server, err := NewServer(&config.MasqueServerConfig{})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	addr := testutil.ServeH3(t, server.h3Server)
+
+	resp, err := testutil.H3Client(t).Get("https://" + addr + "/.well-known/masque/udp/127.0.0.1/53/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for a GET, got %d", resp.StatusCode)
+	}
+}
+
+func TestServer_ConnectTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("tcp"))
+		conn.Close()
+	}()
+	server, err := NewServer(&config.MasqueServerConfig{
+		AllowedConnectPorts: []int{ln.Addr().(*net.TCPAddr).Port},
+		AllowPrivateTargets: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	addr := testutil.ServeH3(t, server.h3Server)
+	dialer, err := tunnel.NewH3Dialer("https://"+addr, true)
+	if err != nil {
+		t.Fatalf("failed to create dialer: %v", err)
+	}
+	defer dialer.Close()
+
+	conn, err := dialer.Dial(context.Background(), ln.Addr().String())
+	if err != nil {
+		t.Fatalf("CONNECT failed: %v", err)
+	}
+	defer conn.Close()
+	data, err := io.ReadAll(conn)
+	if err != nil || string(data) != "tcp" {
+		t.Errorf("expected tcp from the tunnel, got %q, %v", data, err)
+	}
+}
+
+func TestServer_RefusesTargets(t *testing.T) {
+	echo := startEchoServer(t)
+	_, portStr, _ := net.SplitHostPort(echo)
+	echoPort, _ := strconv.Atoi(portStr)
+
+	tTable := []struct {
+		name   string
+		cfg    config.MasqueServerConfig
+		target string
+		status string // empty when the target must be reached
+	}{
+		{"loopback refused by default", config.MasqueServerConfig{AllowedUDPPorts: []int{echoPort}}, echo, "403"},
+		{"port outside the allowlist", config.MasqueServerConfig{AllowPrivateTargets: true}, echo, "403"},
+		{"default ports only", config.MasqueServerConfig{AllowPrivateTargets: true}, "127.0.0.1:53", ""},
+		{"private range", config.MasqueServerConfig{}, "10.0.0.1:443", "403"},
+		{"link-local", config.MasqueServerConfig{}, "169.254.169.254:53", "403"},
+		{"unspecified", config.MasqueServerConfig{}, "0.0.0.0:443", "403"},
+		{"shared address space", config.MasqueServerConfig{}, "100.64.0.1:443", "403"},
+		{"ipv6 loopback", config.MasqueServerConfig{}, "[::1]:443", "403"},
+		{"ipv6 unique local", config.MasqueServerConfig{}, "[fd00::1]:443", "403"},
+		{"mapped loopback", config.MasqueServerConfig{}, "[::ffff:127.0.0.1]:443", "403"},
+	}
+	for _, tCase := range tTable {
+		server, err := NewServer(&tCase.cfg)
+		if err != nil {
+			t.Fatalf("failed to create server: %v", err)
+		}
+		addr := testutil.ServeH3(t, server.h3Server)
+		template, err := ParseTemplate("https://" + addr + "/.well-known/masque/udp/{target_host}/{target_port}/")
+		if err != nil {
+			t.Fatalf("invalid template: %v", err)
+		}
+		conn := NewConn(template, true)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		tunnel, err := conn.ConnectUDP(ctx, tCase.target)
+		cancel()
+		switch {
+		case tCase.status == "" && err != nil:
+			t.Errorf("%s: CONNECT-UDP to %s failed: %v", tCase.name, tCase.target, err)
+		case tCase.status == "":
+			tunnel.Close()
+		case err == nil:
+			tunnel.Close()
+			t.Errorf("%s: CONNECT-UDP to %s wasn't refused", tCase.name, tCase.target)
+		case !strings.Contains(err.Error(), tCase.status):
+			t.Errorf("%s: expected %s for %s, got %v", tCase.name, tCase.status, tCase.target, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestServer_RefusesTCPTargets(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	server, err := NewServer(&config.MasqueServerConfig{AllowedConnectPorts: []int{ln.Addr().(*net.TCPAddr).Port}})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	addr := testutil.ServeH3(t, server.h3Server)
+	dialer, err := tunnel.NewH3Dialer("https://"+addr, true)
+	if err != nil {
+		t.Fatalf("failed to create dialer: %v", err)
+	}
+	defer dialer.Close()
+
+	// CONNECT follows the address policy of CONNECT-UDP
+	conn, err := dialer.Dial(context.Background(), ln.Addr().String())
+	if err == nil {
+		conn.Close()
+		t.Fatalf("CONNECT to %s wasn't refused", ln.Addr())
+	}
+	if !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected 403 for %s, got %v", ln.Addr(), err)
+	}
+}
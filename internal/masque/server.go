@@ -0,0 +1,228 @@
+package masque
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	"quic-proxy/internal/config"
+	h1h3server "quic-proxy/internal/h1h3-server"
+	h3datagram "quic-proxy/internal/h3-datagram"
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+	"quic-proxy/internal/tunnel"
+	"quic-proxy/internal/utils"
+)
+
+// ProtocolConnectUDP is the :protocol of a CONNECT-UDP request
+const ProtocolConnectUDP = "connect-udp"
+
+// contextIDUDP is the Context ID of HTTP Datagrams carrying a UDP payload
+const contextIDUDP = 0
+
+// maxUDPPayload is the largest UDP payload that is relayed
+const maxUDPPayload = 1500
+
+// Server accepts CONNECT-UDP requests over HTTP/3 and relays the HTTP Datagrams
+// of each request to its target over UDP
+type Server struct {
+	cfg      *config.MasqueServerConfig
+	template *Template
+	h3Server *http3.Server
+	// tunnels answers the CONNECT requests without :protocol, TCP tunnels
+	tunnels *tunnel.Handler
+}
+
+// NewServer Create a MASQUE server from cfg
+func NewServer(cfg *config.MasqueServerConfig) (*Server, error) {
+	raw := cfg.Template
+	if raw == "" {
+		raw = DefaultTemplate
+	}
+	template, err := ParseTemplate(raw)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{cfg: cfg, template: template}
+	// CONNECT enforces the address policy of CONNECT-UDP
+	dialer := &happyeyeballs.Dialer{}
+	if !cfg.AllowPrivateTargets {
+		dialer.Control = tunnel.PublicOnly
+	}
+	s.tunnels = &tunnel.Handler{
+		AllowedPorts: cfg.AllowedConnectPorts,
+		Dial:         tunnel.DialTCP(dialer),
+		Name:         "[Masque]",
+	}
+	// CONNECT is never accepted in early data, a replayed request would open a
+	// second tunnel, so 0-RTT stays off
+	s.h3Server = h1h3server.NewH3Server(cfg.Http3Addr, s, nil)
+	h3datagram.EnableServer(s.h3Server)
+	return s, nil
+}
+
+// ServeHTTP handles a CONNECT-UDP request, or a CONNECT request opening a TCP tunnel
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect && r.Proto == "HTTP/3.0" {
+		s.tunnels.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != http.MethodConnect || r.Proto != ProtocolConnectUDP {
+		http.Error(w, "only CONNECT and CONNECT-UDP are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	target, err := s.template.Match(r.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	addr, err := s.resolveTarget(r.Context(), target)
+	if err != nil {
+		var dnsErr *net.DNSError
+		switch {
+		case errors.Is(err, ErrTargetNotAllowed):
+			log.Printf("[Masque] CONNECT-UDP %s from %s refused: %v", target, r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.As(err, &dnsErr):
+			log.Printf("[Masque] Failed to resolve %s: %v", target, err)
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		log.Printf("[Masque] Failed to reach %s: %v", target, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	// without HTTP/3 datagrams the payloads travel in DATAGRAM capsules
+	datagrams, err := h3datagram.NegotiatedForRequest(r.Context(), s.h3Server, w)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set(h3datagram.CapsuleProtocolHeader, "?1")
+	w.WriteHeader(http.StatusOK)
+	str := w.(http3.HTTPStreamer).HTTPStream()
+	defer str.Close()
+
+	log.Printf("[Masque] Proxying UDP from %s to %s, datagrams: %t", r.RemoteAddr, target, datagrams)
+	if err := relay(h3datagram.NewSession(str, datagrams, nil), conn); err != nil {
+		log.Printf("[Masque] Proxying to %s stopped: %v", target, err)
+	}
+}
+
+// relay Copy HTTP Datagrams of the session to conn and back until the request stream ends
+func relay(session *h3datagram.Session, conn net.Conn) error {
+	errCh := make(chan error, 2)
+	go func() {
+		for {
+			payload, err := receiveUDP(context.Background(), session)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if _, err := conn.Write(payload); err != nil && !isPacketError(err) {
+				errCh <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxUDPPayload)
+		for {
+			n, err := conn.Read(buf)
+			if isPacketError(err) {
+				continue
+			}
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if err := sendUDP(session, buf[:n]); err != nil && !isPacketError(err) {
+				errCh <- err
+				return
+			}
+		}
+	}()
+	err := <-errCh
+	conn.Close()
+	if errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// isPacketError reports whether err only concerns a single packet, UDP is
+// unreliable anyway: the target wasn't listening (ICMP port unreachable) or
+// the payload didn't fit into a QUIC datagram
+func isPacketError(err error) bool {
+	var tooLarge *quic.DatagramTooLargeError
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.As(err, &tooLarge)
+}
+
+// receiveUDP Wait for the next HTTP Datagram carrying a UDP payload, datagrams
+// with an unknown Context ID are dropped, RFC 9298 section 4
+func receiveUDP(ctx context.Context, session *h3datagram.Session) ([]byte, error) {
+	for {
+		data, err := session.ReceiveDatagram(ctx)
+		if err != nil {
+			return nil, err
+		}
+		contextID, n, err := quicvarint.Parse(data)
+		if err != nil {
+			continue
+		}
+		if contextID == contextIDUDP {
+			return data[n:], nil
+		}
+	}
+}
+
+// sendUDP Send payload as an HTTP Datagram with the UDP Context ID
+func sendUDP(session *h3datagram.Session, payload []byte) error {
+	data := make([]byte, 0, 1+len(payload))
+	data = quicvarint.Append(data, contextIDUDP)
+	return session.SendDatagram(append(data, payload...))
+}
+
+// ListenAndServe Start the QUIC listener
+func (s *Server) ListenAndServe() error {
+	if err := utils.EnsureCertificate(s.cfg.CertPath, s.cfg.KeyPath); err != nil {
+		return err
+	}
+	log.Printf("[Masque] Starting MASQUE proxy on %s, template %s", s.cfg.Http3Addr, s.template)
+	if err := s.h3Server.ListenAndServeTLS(s.cfg.CertPath, s.cfg.KeyPath); err != nil {
+		return fmt.Errorf("masque proxy stopped: %w", err)
+	}
+	return nil
+}
+
+// Serve Serve the QUIC connections arriving on conn, with the certificate of the config
+func (s *Server) Serve(conn net.PacketConn) error {
+	if s.h3Server.TLSConfig == nil {
+		cert, err := tls.LoadX509KeyPair(s.cfg.CertPath, s.cfg.KeyPath)
+		if err != nil {
+			return err
+		}
+		s.h3Server.TLSConfig = http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	return s.h3Server.Serve(conn)
+}
+
+// Close Stop the listener
+func (s *Server) Close() error {
+	return s.h3Server.Close()
+}
@@ -0,0 +1,54 @@
+package masque
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+
+	"quic-proxy/internal/tunnel"
+)
+
+// DefaultAllowedUDPPorts are the ports a CONNECT-UDP may reach when none are
+// configured, DNS and QUIC
+var DefaultAllowedUDPPorts = []int{53, 443}
+
+// ErrTargetNotAllowed is shared with the TCP tunnels, both enforce the same policy
+var ErrTargetNotAllowed = tunnel.ErrTargetNotAllowed
+
+// resolveTarget Check the host:port target of a CONNECT-UDP request and
+// return the address to send to. The port must be allowed, and unless the
+// config allows private targets the address mustn't be loopback, link-local,
+// private, multicast or reserved, as for the TCP tunnels. The name is
+// resolved once, the address checked is the one dialed, a second lookup
+// could answer differently.
+func (s *Server) resolveTarget(ctx context.Context, target string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	allowed := s.cfg.AllowedUDPPorts
+	if len(allowed) == 0 {
+		allowed = DefaultAllowedUDPPorts
+	}
+	if !slices.Contains(allowed, port) {
+		return nil, fmt.Errorf("%w: port %d", ErrTargetNotAllowed, port)
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if s.cfg.AllowPrivateTargets || tunnel.IsPublic(ip) {
+			return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s resolves to %v", ErrTargetNotAllowed, host, ips)
+}
@@ -0,0 +1,126 @@
+// Package masque proxies UDP over HTTP/3 with CONNECT-UDP, RFC 9298.
+// The server relays the HTTP Datagrams of every request to its target, the
+// client tunnels the datagrams received on a local UDP port.
+package masque
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultTemplate is the default URI template of RFC 9298 section 3,
+// {host} stands for the authority of the proxy
+const DefaultTemplate = "https://{host}/.well-known/masque/udp/{target_host}/{target_port}/"
+
+const (
+	varTargetHost = "{target_host}"
+	varTargetPort = "{target_port}"
+)
+
+var ErrTemplateMismatch = errors.New("request doesn't match the URI template")
+
+// Template is a URI template of RFC 9298 section 2. Only the variables
+// target_host and target_port are expanded, as path segments or query values.
+type Template struct {
+	raw      string
+	host     string
+	segments []string
+	query    url.Values
+}
+
+// ParseTemplate Parse a URI template, both variables must appear
+func ParseTemplate(raw string) (*Template, error) {
+	rest, ok := strings.CutPrefix(raw, "https://")
+	if !ok {
+		return nil, fmt.Errorf("URI template must be https: %q", raw)
+	}
+	host, pathQuery, ok := strings.Cut(rest, "/")
+	if !ok {
+		return nil, fmt.Errorf("URI template has no path: %q", raw)
+	}
+	if !strings.Contains(raw, varTargetHost) || !strings.Contains(raw, varTargetPort) {
+		return nil, fmt.Errorf("URI template must contain %s and %s: %q", varTargetHost, varTargetPort, raw)
+	}
+	path, rawQuery, _ := strings.Cut(pathQuery, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URI template query: %w", err)
+	}
+	return &Template{
+		raw:      raw,
+		host:     host,
+		segments: strings.Split("/"+path, "/"),
+		query:    query,
+	}, nil
+}
+
+// String returns the template as it was parsed
+func (t *Template) String() string {
+	return t.raw
+}
+
+// Expand Build the request URL for target, a host:port
+func (t *Template) Expand(target string) (*url.URL, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	r := strings.NewReplacer(varTargetHost, percentEncode(host), varTargetPort, percentEncode(port))
+	return url.Parse(r.Replace(t.raw))
+}
+
+// Match Extract the target from the URL of a request, it is returned as host:port
+func (t *Template) Match(u *url.URL) (string, error) {
+	vars := map[string]string{}
+	segments := strings.Split(u.EscapedPath(), "/")
+	if len(segments) != len(t.segments) {
+		return "", ErrTemplateMismatch
+	}
+	for i, segment := range t.segments {
+		if segment == varTargetHost || segment == varTargetPort {
+			value, err := url.PathUnescape(segments[i])
+			if err != nil {
+				return "", err
+			}
+			vars[segment] = value
+		} else if segment != segments[i] {
+			return "", ErrTemplateMismatch
+		}
+	}
+	query := u.Query()
+	for key, values := range t.query {
+		for _, value := range values {
+			if value == varTargetHost || value == varTargetPort {
+				vars[value] = query.Get(key)
+			}
+		}
+	}
+
+	host, port := vars[varTargetHost], vars[varTargetPort]
+	if host == "" {
+		return "", errors.New("missing target_host")
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return "", fmt.Errorf("invalid target_port: %q", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// percentEncode Encode everything but the unreserved characters, as the simple
+// string expansion of RFC 6570 does. The colons of an IPv6 address become %3A.
+func percentEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,69 @@
+package masque
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestTemplate(t *testing.T) {
+	tTable := []struct {
+		template    string
+		target      string
+		expectedURL string
+	}{
+		{
+			template:    "https://proxy.example:4433/.well-known/masque/udp/{target_host}/{target_port}/",
+			target:      "192.0.2.6:443",
+			expectedURL: "https://proxy.example:4433/.well-known/masque/udp/192.0.2.6/443/",
+		},
+		{
+			template:    "https://proxy.example/.well-known/masque/udp/{target_host}/{target_port}/",
+			target:      "[2001:db8::42]:53",
+			expectedURL: "https://proxy.example/.well-known/masque/udp/2001%3Adb8%3A%3A42/53/",
+		},
+		{
+			template:    "https://proxy.example/masque?h={target_host}&p={target_port}",
+			target:      "dns.example:53",
+			expectedURL: "https://proxy.example/masque?h=dns.example&p=53",
+		},
+	}
+
+	for _, tCase := range tTable {
+		template, err := ParseTemplate(tCase.template)
+		if err != nil {
+			t.Fatalf("ParseTemplate(%q) failed: %v", tCase.template, err)
+		}
+		u, err := template.Expand(tCase.target)
+		if err != nil || u.String() != tCase.expectedURL {
+			t.Errorf("Expand(%q): expected %s, got %v, %v", tCase.target, tCase.expectedURL, u, err)
+			continue
+		}
+		if target, err := template.Match(u); err != nil || target != tCase.target {
+			t.Errorf("Match(%s): expected %s, got %q, %v", u, tCase.target, target, err)
+		}
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	for _, raw := range []string{
+		"http://proxy.example/{target_host}/{target_port}/",
+		"https://proxy.example/{target_host}/",
+		"https://proxy.example",
+	} {
+		if _, err := ParseTemplate(raw); err == nil {
+			t.Errorf("ParseTemplate(%q): expected an error", raw)
+		}
+	}
+
+	template, _ := ParseTemplate(DefaultTemplate)
+	for _, path := range []string{
+		"/.well-known/masque/udp/192.0.2.6/443",
+		"/.well-known/masque/tcp/192.0.2.6/443/",
+		"/.well-known/masque/udp/192.0.2.6/0/",
+		"/.well-known/masque/udp/192.0.2.6/http/",
+	} {
+		if target, err := template.Match(&url.URL{Path: path}); err == nil {
+			t.Errorf("Match(%s): expected an error, got %s", path, target)
+		}
+	}
+}
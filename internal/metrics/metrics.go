@@ -0,0 +1,150 @@
+// Package metrics holds the counters of the proxies and servers. They are
+// published with expvar and served as JSON by Handler, usually at /debug/vars.
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// EarlyData counts requests sent or received in 0-RTT
+type EarlyData struct {
+	Attempted atomic.Int64
+	Accepted  atomic.Int64
+	// Rejected counts 425 Too Early responses and 0-RTT rejected by TLS
+	Rejected atomic.Int64
+}
+
+// AcceptanceRate returns the share of the 0-RTT attempts that were accepted
+func (e *EarlyData) AcceptanceRate() float64 {
+	attempted := e.Attempted.Load()
+	if attempted == 0 {
+		return 0
+	}
+	return float64(e.Accepted.Load()) / float64(attempted)
+}
+
+// String implements expvar.Var
+func (e *EarlyData) String() string {
+	b, _ := json.Marshal(map[string]any{
+		"attempted":       e.Attempted.Load(),
+		"accepted":        e.Accepted.Load(),
+		"rejected":        e.Rejected.Load(),
+		"acceptance_rate": e.AcceptanceRate(),
+	})
+	return string(b)
+}
+
+// Upstream counts the connections of the upstream connection manager for one
+// transport, Opened and Closed show the churn
+type Upstream struct {
+	Opened   atomic.Int64
+	Closed   atomic.Int64
+	Requests atomic.Int64
+	// Reused counts requests sent on a connection that already carried one
+	Reused atomic.Int64
+	// StreamLimited counts connections opened because the peer's stream limit
+	// was reached on all the others
+	StreamLimited atomic.Int64
+}
+
+// ReuseRate returns the share of the requests sent on a reused connection
+func (u *Upstream) ReuseRate() float64 {
+	requests := u.Requests.Load()
+	if requests == 0 {
+		return 0
+	}
+	return float64(u.Reused.Load()) / float64(requests)
+}
+
+// String implements expvar.Var
+func (u *Upstream) String() string {
+	b, _ := json.Marshal(map[string]any{
+		"opened":         u.Opened.Load(),
+		"closed":         u.Closed.Load(),
+		"open":           u.Opened.Load() - u.Closed.Load(),
+		"requests":       u.Requests.Load(),
+		"reused":         u.Reused.Load(),
+		"reuse_rate":     u.ReuseRate(),
+		"stream_limited": u.StreamLimited.Load(),
+	})
+	return string(b)
+}
+
+// Forward counts the tunnels of one port forward and the bytes they carried,
+// the bytes are added while the tunnels are open. The tunnels of a UDP
+// forward are its flows, one per source address.
+type Forward struct {
+	Opened atomic.Int64
+	Closed atomic.Int64
+	// Failed counts connections whose target couldn't be reached
+	Failed    atomic.Int64
+	BytesUp   atomic.Int64 // from the listening side to the target
+	BytesDown atomic.Int64 // from the target back
+	// StreamFallback counts the UDP packets too large for a datagram, sent on
+	// the stream of their flow instead
+	StreamFallback atomic.Int64
+}
+
+// String implements expvar.Var
+func (f *Forward) String() string {
+	b, _ := json.Marshal(map[string]any{
+		"opened":     f.Opened.Load(),
+		"closed":     f.Closed.Load(),
+		"open":       f.Opened.Load() - f.Closed.Load(),
+		"failed":     f.Failed.Load(),
+		"bytes_up":   f.BytesUp.Load(),
+		"bytes_down": f.BytesDown.Load(),
+		// only UDP forwards fall back
+		"stream_fallback": f.StreamFallback.Load(),
+	})
+	return string(b)
+}
+
+var (
+	// Forwards holds the counters of each port forward by name
+	Forwards   = new(expvar.Map)
+	forwardsMu sync.Mutex
+)
+
+// ForwardCounters Return the counters of the port forward name, created on first use
+func ForwardCounters(name string) *Forward {
+	forwardsMu.Lock()
+	defer forwardsMu.Unlock()
+	if f, ok := Forwards.Get(name).(*Forward); ok {
+		return f
+	}
+	f := new(Forward)
+	Forwards.Set(name, f)
+	return f
+}
+
+var (
+	// UpstreamTCP counts the TCP/TLS connections to upstream, HTTP/1.1 and h2
+	UpstreamTCP = new(Upstream)
+	// UpstreamH3 counts the QUIC connections to upstream
+	UpstreamH3 = new(Upstream)
+)
+
+var (
+	// ClientEarlyData counts the upstream requests sent in 0-RTT
+	ClientEarlyData = new(EarlyData)
+	// ServerEarlyData counts the requests the HTTP/3 server received in 0-RTT
+	ServerEarlyData = new(EarlyData)
+)
+
+func init() {
+	expvar.Publish("client_early_data", ClientEarlyData)
+	expvar.Publish("server_early_data", ServerEarlyData)
+	expvar.Publish("upstream_tcp", UpstreamTCP)
+	expvar.Publish("upstream_h3", UpstreamH3)
+	expvar.Publish("forwards", Forwards)
+}
+
+// Handler serves every published metric as JSON
+func Handler() http.Handler {
+	return expvar.Handler()
+}
@@ -0,0 +1,367 @@
+// Package migration keeps QUIC connections alive when the local address of
+// the client changes, a Wi-Fi to cellular handover or a NAT rebinding for
+// instance. quic-go doesn't migrate connections itself yet, so both ends work
+// below it: the client's Conn moves to a new UDP socket while the connection
+// keeps going, and the server's FollowConn notices the connection IDs of a
+// client arriving from a new address, validates it and sends there from then on.
+package migration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"quic-proxy/internal/utils"
+)
+
+// DefaultDrainTimeout is how long the previous socket is still read after a
+// rebind, packets the peer sent before it learnt the new address land there
+const DefaultDrainTimeout = 5 * time.Second
+
+// EventType tells what happened to the path of a Conn
+type EventType int
+
+const (
+	// Rebound the Conn moved to a new socket
+	Rebound EventType = iota
+	// PathValidated the peer answered on the new socket
+	PathValidated
+	// PathUnanswered nothing came back on the new socket before the drain
+	// timeout, PathValidated may still follow if the peer only had nothing to say
+	PathUnanswered
+)
+
+// Event is a change of the path of a Conn
+type Event struct {
+	Type     EventType
+	From, To net.Addr
+	// Elapsed is the time from the rebind to the event
+	Elapsed time.Duration
+}
+
+func (e Event) String() string {
+	switch e.Type {
+	case Rebound:
+		return fmt.Sprintf("rebound from %s to %s", e.From, e.To)
+	case PathValidated:
+		return fmt.Sprintf("path via %s validated after %v", e.To, e.Elapsed.Round(time.Millisecond))
+	case PathUnanswered:
+		return fmt.Sprintf("no answer on path via %s yet after %v", e.To, e.Elapsed.Round(time.Millisecond))
+	default:
+		return fmt.Sprintf("unknown event %d", e.Type)
+	}
+}
+
+// packet is a datagram read from one of the sockets
+type packet struct {
+	data []byte
+	addr net.Addr
+	err  error
+}
+
+// Conn is the UDP socket of QUIC client connections, given to a
+// quic.Transport. Rebind moves it to a new socket without the transport
+// noticing: reads come from every socket still open, writes go out of the
+// current one. The path challenges of a FollowConn are answered on the
+// socket they arrive on.
+type Conn struct {
+	// DrainTimeout replaces DefaultDrainTimeout if set
+	DrainTimeout time.Duration
+	// OnEvent is told about rebinds and path validation, they are logged if nil
+	OnEvent func(Event)
+
+	network string
+	laddr   *net.UDPAddr
+	packets chan packet
+	closed  chan struct{}
+
+	mu         sync.Mutex
+	sock       *net.UDPConn
+	socks      map[*net.UDPConn]struct{}
+	last       []byte
+	lastAddr   net.Addr
+	validating *net.UDPConn
+	reboundAt  time.Time
+	readBuf    int
+	writeBuf   int
+	deadline   time.Time
+	deadlineCh chan struct{}
+	closeOnce  sync.Once
+}
+
+// Listen Open a Conn on a UDP socket bound to laddr, like net.ListenPacket
+func Listen(network, laddr string) (*Conn, error) {
+	addr, err := net.ResolveUDPAddr(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	sock, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		network:    network,
+		laddr:      addr,
+		packets:    make(chan packet, 64),
+		closed:     make(chan struct{}),
+		sock:       sock,
+		socks:      map[*net.UDPConn]struct{}{sock: {}},
+		deadlineCh: make(chan struct{}),
+	}
+	go c.read(sock)
+	return c, nil
+}
+
+// read Pass the packets of sock on to ReadFrom until sock is closed
+func (c *Conn) read(sock *net.UDPConn) {
+	for {
+		buf := make([]byte, 2048)
+		n, addr, err := sock.ReadFrom(buf)
+		c.mu.Lock()
+		_, open := c.socks[sock]
+		current := sock == c.sock
+		if err == nil && sock == c.validating {
+			c.validating = nil
+			c.emit(Event{Type: PathValidated, To: sock.LocalAddr(), Elapsed: time.Since(c.reboundAt)})
+		}
+		c.mu.Unlock()
+		if err != nil {
+			// a drained socket goes away quietly, only the current one fails the Conn
+			if !open || !current {
+				return
+			}
+			select {
+			case c.packets <- packet{err: err}:
+			case <-c.closed:
+			}
+			return
+		}
+		if n == probeLength && buf[0] == probeChallenge {
+			// a FollowConn validating this path, the answer must leave from where it came
+			buf[0] = probeResponse
+			sock.WriteTo(buf[:n], addr)
+			continue
+		}
+		select {
+		case c.packets <- packet{data: buf[:n], addr: addr}:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// emit Report an event, c.mu is held
+func (c *Conn) emit(e Event) {
+	if c.OnEvent != nil {
+		c.OnEvent(e)
+		return
+	}
+	log.Printf("[Migration] %s", e)
+}
+
+// ReadFrom Return the next packet received on any socket of the Conn
+func (c *Conn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, deadlineCh := c.deadline, c.deadlineCh
+		c.mu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		n, addr, err := c.receive(p, timeout, deadlineCh)
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != errDeadlineMoved {
+			return n, addr, err
+		}
+	}
+}
+
+// errDeadlineMoved tells ReadFrom to wait again with the new deadline
+var errDeadlineMoved = errors.New("read deadline moved")
+
+// receive Wait for a packet until timeout or until the deadline moves
+func (c *Conn) receive(p []byte, timeout <-chan time.Time, deadlineCh chan struct{}) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.packets:
+		if pkt.err != nil {
+			return 0, nil, pkt.err
+		}
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-deadlineCh:
+		return 0, nil, errDeadlineMoved
+	}
+}
+
+// WriteTo Send p to addr from the current socket
+func (c *Conn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	sock := c.sock
+	c.last = append(c.last[:0], p...)
+	c.lastAddr = addr
+	c.mu.Unlock()
+	return sock.WriteTo(p, addr)
+}
+
+// Rebind Move the Conn to a new socket bound to laddr, the address it was
+// opened with but any port if laddr is empty. The last packet written is sent
+// again from the new socket so that the peer learns the new address without
+// waiting for the next one. The previous socket is still read for the drain
+// timeout.
+func (c *Conn) Rebind(laddr string) error {
+	addr := &net.UDPAddr{IP: c.laddr.IP, Zone: c.laddr.Zone}
+	if laddr != "" {
+		var err error
+		if addr, err = net.ResolveUDPAddr(c.network, laddr); err != nil {
+			return err
+		}
+	}
+	sock, err := net.ListenUDP(c.network, addr)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	select {
+	case <-c.closed:
+		c.mu.Unlock()
+		sock.Close()
+		return net.ErrClosed
+	default:
+	}
+	if c.readBuf > 0 {
+		sock.SetReadBuffer(c.readBuf)
+	}
+	if c.writeBuf > 0 {
+		sock.SetWriteBuffer(c.writeBuf)
+	}
+	old := c.sock
+	c.sock = sock
+	c.socks[sock] = struct{}{}
+	c.validating = sock
+	c.reboundAt = time.Now()
+	last, lastAddr := append([]byte(nil), c.last...), c.lastAddr
+	c.emit(Event{Type: Rebound, From: old.LocalAddr(), To: sock.LocalAddr()})
+	c.mu.Unlock()
+
+	go c.read(sock)
+	if lastAddr != nil {
+		sock.WriteTo(last, lastAddr)
+	}
+	drain := c.DrainTimeout
+	if drain <= 0 {
+		drain = DefaultDrainTimeout
+	}
+	time.AfterFunc(drain, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.socks, old)
+		old.Close()
+		if c.validating == sock {
+			c.emit(Event{Type: PathUnanswered, To: sock.LocalAddr(), Elapsed: time.Since(c.reboundAt)})
+		}
+	})
+	return nil
+}
+
+// Watch Rebind whenever the addresses of the local interfaces change, until
+// ctx is done
+func (c *Conn) Watch(ctx context.Context, interval time.Duration) {
+	utils.WatchInterfaces(ctx, interval, func() {
+		log.Printf("[Migration] Network changed, rebinding %s", c.LocalAddr())
+		if err := c.Rebind(""); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("[Migration] Rebind failed: %v", err)
+		}
+	})
+}
+
+// RebindHandler Rebind c on POST, to the address of the addr query parameter
+// if given, so that an operator can move the connections on demand
+func RebindHandler(c *Conn) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST to rebind", http.StatusMethodNotAllowed)
+			return
+		}
+		from := c.LocalAddr()
+		if err := c.Rebind(r.URL.Query().Get("addr")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "rebound from %s to %s\n", from, c.LocalAddr())
+	})
+}
+
+// Close Close every socket of the Conn
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		close(c.closed)
+		for sock := range c.socks {
+			sock.Close()
+		}
+		c.socks = nil
+	})
+	return nil
+}
+
+// LocalAddr Return the address of the current socket
+func (c *Conn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sock.LocalAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline Wake up the pending ReadFrom calls so they wait until t
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	close(c.deadlineCh)
+	c.deadlineCh = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline Writes to a UDP socket don't block, there is nothing to do
+func (c *Conn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// SetReadBuffer Size the receive buffer of the current and future sockets
+func (c *Conn) SetReadBuffer(bytes int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readBuf = bytes
+	return c.sock.SetReadBuffer(bytes)
+}
+
+// SetWriteBuffer Size the send buffer of the current and future sockets
+func (c *Conn) SetWriteBuffer(bytes int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeBuf = bytes
+	return c.sock.SetWriteBuffer(bytes)
+}
@@ -0,0 +1,269 @@
+package migration
+
+import (
+	"bytes"
+	"crypto/rand"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnectionIDLength is the length of the connection IDs a server using
+// FollowConn must choose, set it as quic.Transport.ConnectionIDLength. Short
+// header packets don't carry the length, FollowConn needs to know it.
+const ConnectionIDLength = 8
+
+// followIdleTimeout drops the clients FollowConn hasn't heard of for longer,
+// more than any connection stays idle
+const followIdleTimeout = 5 * time.Minute
+
+const (
+	// probeTimeout gives up validating a new address that didn't answer, the
+	// next packet from there starts over
+	probeTimeout = 3 * time.Second
+	// probeInterval spaces the challenges sent to a new address
+	probeInterval = 100 * time.Millisecond
+	// maxProbes bounds the challenges sent to an address per validation, what
+	// the server sends to an unvalidated address stays small
+	maxProbes = 3
+)
+
+// A path probe is a type byte and 8 random bytes, like the data of
+// PATH_CHALLENGE. The type byte has neither the header form nor the fixed bit
+// of QUIC (RFC 9000 section 17), a QUIC stack drops it.
+const (
+	probeChallenge byte = 0x01
+	probeResponse  byte = 0x02
+	probeLength         = 1 + 8
+)
+
+// path is one client socket as the server sees it. origin is the address the
+// client first came from, quic-go keeps using it. current is where it is now,
+// candidate where it seems to have moved while that is validated.
+type path struct {
+	origin, current net.Addr
+	seen            time.Time
+	candidate       *candidate
+}
+
+// candidate is a new address of a client being validated
+type candidate struct {
+	addr      net.Addr
+	challenge [probeLength - 1]byte
+	started   time.Time
+	probed    time.Time
+	probes    int
+}
+
+// FollowConn is the UDP socket of a QUIC server, given to a quic.Transport,
+// that follows clients to a new address. quic-go v0.49 neither moves nor
+// validates the path of a client, FollowConn does it below it: quic-go keeps
+// seeing the packets come from the first address of the client, and what it
+// sends there goes to the address the client was last validated at.
+//
+// A packet for a known connection ID arriving from a new address doesn't move
+// its client, the path is validated first as in RFC 9000 section 8.2: a
+// challenge is sent to the new address, the client moves once the challenge
+// comes back from there. Until then packets keep going to the previous
+// address. Conn answers the challenges, other clients stay where they were
+// validated. Following is opt-in, wrap the socket with Follow only when the
+// clients use Conn.
+type FollowConn struct {
+	net.PacketConn
+	// OnMigrate is told when a client moves, it is logged if nil
+	OnMigrate func(origin, from, to net.Addr)
+
+	mu  sync.Mutex
+	ids map[string]*path // connection ID -> client
+	// origins maps the address reported to quic-go to its client. The key is
+	// the very net.Addr ReadFrom returned, compared by identity: a new client
+	// at an address another one moved away from gets its own.
+	origins    map[net.Addr]*path
+	current    map[string]*path // current address -> client
+	candidates map[string]*path // address being validated -> client
+	gcAt       time.Time
+}
+
+// Follow Wrap the socket of a server so that its clients can move
+func Follow(conn net.PacketConn) *FollowConn {
+	return &FollowConn{
+		PacketConn: conn,
+		ids:        make(map[string]*path),
+		origins:    make(map[net.Addr]*path),
+		current:    make(map[string]*path),
+		candidates: make(map[string]*path),
+		gcAt:       time.Now().Add(followIdleTimeout),
+	}
+}
+
+// ReadFrom Read a packet and report it as coming from the first address of
+// its client. The answers to the challenges are consumed here.
+func (c *FollowConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		if n == probeLength && p[0] == probeResponse {
+			c.validate(p[1:n], addr)
+			continue
+		}
+		id, ok := connectionID(p[:n])
+		if !ok {
+			return n, addr, nil
+		}
+		origin, probe := c.observe(id, addr)
+		if probe != nil {
+			c.PacketConn.WriteTo(probe, addr)
+		}
+		return n, origin, nil
+	}
+}
+
+// observe Find the client of a packet for connection ID id received from
+// addr and return the address to report. A known client at a new address
+// is challenged there, the returned probe is to be sent to addr.
+func (c *FollowConn) observe(id string, addr net.Addr) (net.Addr, []byte) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.After(c.gcAt) {
+		c.gc(now)
+	}
+	key := addr.String()
+	client := c.ids[id]
+	if client == nil {
+		// a new connection ID, of a new client or of one we already know at this address
+		client = c.current[key]
+		if client == nil {
+			client = &path{origin: addr, current: addr}
+			c.origins[addr] = client
+			c.current[key] = client
+		}
+		c.ids[id] = client
+	}
+	client.seen = now
+	if client.current.String() == key {
+		return client.origin, nil
+	}
+	return client.origin, c.challenge(client, addr, now)
+}
+
+// challenge Return the probe to send to the new address addr of client, nil
+// if it was probed enough for now. A candidate left unanswered gives way to
+// the next one. c.mu is held.
+func (c *FollowConn) challenge(client *path, addr net.Addr, now time.Time) []byte {
+	cand := client.candidate
+	if cand == nil || now.Sub(cand.started) > probeTimeout {
+		if cand != nil && c.candidates[cand.addr.String()] == client {
+			delete(c.candidates, cand.addr.String())
+		}
+		cand = &candidate{addr: addr, started: now}
+		if _, err := rand.Read(cand.challenge[:]); err != nil {
+			client.candidate = nil
+			return nil
+		}
+		client.candidate = cand
+		c.candidates[addr.String()] = client
+	}
+	if cand.addr.String() != addr.String() || cand.probes >= maxProbes || now.Sub(cand.probed) < probeInterval {
+		return nil
+	}
+	cand.probes++
+	cand.probed = now
+	return append([]byte{probeChallenge}, cand.challenge[:]...)
+}
+
+// validate Move the client whose challenge data came back from addr there
+func (c *FollowConn) validate(data []byte, addr net.Addr) {
+	key := addr.String()
+	c.mu.Lock()
+	client := c.candidates[key]
+	if client == nil || client.candidate == nil || !bytes.Equal(client.candidate.challenge[:], data) {
+		c.mu.Unlock()
+		return
+	}
+	from := client.current
+	client.candidate = nil
+	delete(c.candidates, key)
+	if c.current[from.String()] == client {
+		delete(c.current, from.String())
+	}
+	client.current = addr
+	c.current[key] = client
+	onMigrate := c.OnMigrate
+	c.mu.Unlock()
+	if onMigrate != nil {
+		onMigrate(client.origin, from, addr)
+	} else {
+		log.Printf("[Migration] Client %s moved from %s to %s", client.origin, from, addr)
+	}
+}
+
+// WriteTo Send p to where the client first seen at addr is now
+func (c *FollowConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	if client := c.origins[addr]; client != nil {
+		addr = client.current
+	}
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// SetReadBuffer Size the receive buffer of the socket, if it can be
+func (c *FollowConn) SetReadBuffer(bytes int) error {
+	if conn, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return conn.SetReadBuffer(bytes)
+	}
+	return nil
+}
+
+// SetWriteBuffer Size the send buffer of the socket, if it can be
+func (c *FollowConn) SetWriteBuffer(bytes int) error {
+	if conn, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return conn.SetWriteBuffer(bytes)
+	}
+	return nil
+}
+
+// gc Forget the clients that have been quiet for too long, c.mu is held
+func (c *FollowConn) gc(now time.Time) {
+	c.gcAt = now.Add(followIdleTimeout)
+	for id, client := range c.ids {
+		if now.Sub(client.seen) > followIdleTimeout {
+			delete(c.ids, id)
+			delete(c.origins, client.origin)
+			if c.current[client.current.String()] == client {
+				delete(c.current, client.current.String())
+			}
+			if client.candidate != nil && c.candidates[client.candidate.addr.String()] == client {
+				delete(c.candidates, client.candidate.addr.String())
+			}
+		}
+	}
+}
+
+// connectionID Return the destination connection ID of a QUIC packet
+// (RFC 9000 section 17), the first one of a datagram is enough
+func connectionID(b []byte) (string, bool) {
+	if len(b) == 0 {
+		return "", false
+	}
+	if b[0]&0x80 == 0 {
+		// short header: flags, then the connection ID of the server's length
+		if len(b) < 1+ConnectionIDLength {
+			return "", false
+		}
+		return string(b[1 : 1+ConnectionIDLength]), true
+	}
+	// long header: flags, version, then the length of the connection ID
+	if len(b) < 6 {
+		return "", false
+	}
+	l := int(b[5])
+	if l == 0 || len(b) < 6+l {
+		return "", false
+	}
+	return string(b[6 : 6+l]), true
+}
@@ -0,0 +1,233 @@
+package migration
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"quic-proxy/internal/testutil"
+)
+
+// startEchoServer Serve QUIC streams echoing what they receive, on a FollowConn
+func startEchoServer(t *testing.T) (*FollowConn, net.Addr) {
+	t.Helper()
+	follow := Follow(testutil.ListenUDP(t))
+	tr := &quic.Transport{Conn: follow, ConnectionIDLength: ConnectionIDLength}
+	tlsConf := testutil.ServerTLSConfig(t)
+	tlsConf.NextProtos = []string{"echo"}
+	ln, err := tr.Listen(tlsConf, nil)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		tr.Close()
+		follow.Close()
+	})
+	go func() {
+		for {
+			qconn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					str, err := qconn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go io.Copy(str, str)
+				}
+			}()
+		}
+	}()
+	return follow, follow.LocalAddr()
+}
+
+func echo(t *testing.T, str quic.Stream, msg string) {
+	t.Helper()
+	str.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := str.Write([]byte(msg)); err != nil {
+		t.Fatalf("write %q: %v", msg, err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(str, buf); err != nil {
+		t.Fatalf("read %q: %v", msg, err)
+	}
+	if string(buf) != msg {
+		t.Errorf("echo = %q, want %q", buf, msg)
+	}
+}
+
+func TestConn_Rebind(t *testing.T) {
+	follow, serverAddr := startEchoServer(t)
+	var mu sync.Mutex
+	var moves [][2]string
+	follow.OnMigrate = func(origin, from, to net.Addr) {
+		mu.Lock()
+		defer mu.Unlock()
+		moves = append(moves, [2]string{from.String(), to.String()})
+	}
+
+	conn, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+	conn.DrainTimeout = 200 * time.Millisecond
+	events := make(chan Event, 10)
+	conn.OnEvent = func(e Event) { events <- e }
+
+	tr := &quic.Transport{Conn: conn}
+	defer tr.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	qconn, err := tr.Dial(ctx, serverAddr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"echo"}}, nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer qconn.CloseWithError(0, "")
+	str, err := qconn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	echo(t, str, "before the move")
+
+	from := conn.LocalAddr().String()
+	if err := conn.Rebind(""); err != nil {
+		t.Fatalf("failed to rebind: %v", err)
+	}
+	to := conn.LocalAddr().String()
+	if to == from {
+		t.Fatalf("rebind kept address %s", from)
+	}
+	echo(t, str, "right after the move")
+
+	// the old socket is closed after the drain timeout, the stream must not care
+	time.Sleep(300 * time.Millisecond)
+	echo(t, str, "after the old socket is gone")
+
+	mu.Lock()
+	if len(moves) != 1 || moves[0] != [2]string{from, to} {
+		t.Errorf("server saw moves %v, want %s -> %s", moves, from, to)
+	}
+	mu.Unlock()
+
+	var types []EventType
+	for len(events) > 0 {
+		types = append(types, (<-events).Type)
+	}
+	if len(types) != 2 || types[0] != Rebound || types[1] != PathValidated {
+		t.Errorf("events = %v, want rebound then path validated", types)
+	}
+}
+
+func TestConnectionID(t *testing.T) {
+	type tCase struct {
+		name   string
+		packet []byte
+		id     string
+		ok     bool
+	}
+	type tTable []tCase
+	table := tTable{
+		{"short header", []byte{0x40, 1, 2, 3, 4, 5, 6, 7, 8, 9}, "\x01\x02\x03\x04\x05\x06\x07\x08", true},
+		{"short header too short", []byte{0x40, 1, 2}, "", false},
+		{"long header", []byte{0xc0, 0, 0, 0, 1, 4, 9, 8, 7, 6, 0}, "\x09\x08\x07\x06", true},
+		{"long header truncated", []byte{0xc0, 0, 0, 0, 1, 4, 9}, "", false},
+		{"empty", nil, "", false},
+	}
+	for _, c := range table {
+		id, ok := connectionID(c.packet)
+		if id != c.id || ok != c.ok {
+			t.Errorf("%s: connectionID = %q, %v, want %q, %v", c.name, id, ok, c.id, c.ok)
+		}
+	}
+}
+
+// shortPacket Return a short header packet for connection ID id
+func shortPacket(id byte) []byte {
+	return []byte{0x40, id, id, id, id, id, id, id, id, 0xff}
+}
+
+// readFrom Read the next packet of follow and the address it was reported from
+func readFrom(t *testing.T, follow *FollowConn) net.Addr {
+	t.Helper()
+	follow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	_, addr, err := follow.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return addr
+}
+
+// receive Read the next datagram on conn, nil if none arrives in time
+func receive(conn net.PacketConn) []byte {
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, 64)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+func TestFollowConn_ValidatesPath(t *testing.T) {
+	follow := Follow(testutil.ListenUDP(t))
+	defer follow.Close()
+	var moves []string
+	follow.OnMigrate = func(origin, from, to net.Addr) { moves = append(moves, to.String()) }
+	client, spoofer := testutil.ListenUDP(t), testutil.ListenUDP(t)
+	defer client.Close()
+	defer spoofer.Close()
+
+	client.WriteTo(shortPacket(1), follow.LocalAddr())
+	origin := readFrom(t, follow)
+	if origin.String() != client.LocalAddr().String() {
+		t.Fatalf("expected the packet from %s, got %s", client.LocalAddr(), origin)
+	}
+
+	// a copy of the packet from another address is challenged there, the client doesn't move yet
+	spoofer.WriteTo(shortPacket(1), follow.LocalAddr())
+	if addr := readFrom(t, follow); addr != origin {
+		t.Errorf("expected the copy reported from %s, got %s", origin, addr)
+	}
+	challenge := receive(spoofer)
+	if len(challenge) != probeLength || challenge[0] != probeChallenge {
+		t.Fatalf("expected a challenge at the new address, got %x", challenge)
+	}
+	follow.WriteTo([]byte("to the client"), origin)
+	if got := receive(client); string(got) != "to the client" {
+		t.Errorf("expected the client to get the packets before validation, got %q", got)
+	}
+
+	// a wrong answer is ignored, the right one moves the client
+	wrong := append([]byte{probeResponse}, make([]byte, probeLength-1)...)
+	spoofer.WriteTo(wrong, follow.LocalAddr())
+	answer := append([]byte{probeResponse}, challenge[1:]...)
+	spoofer.WriteTo(answer, follow.LocalAddr())
+	client.WriteTo(shortPacket(2), follow.LocalAddr())
+	newcomer := readFrom(t, follow)
+	if len(moves) != 1 || moves[0] != spoofer.LocalAddr().String() {
+		t.Fatalf("expected one move to %s, got %v", spoofer.LocalAddr(), moves)
+	}
+
+	// the previous address is free, a new client there isn't mistaken for the one that left
+	if newcomer == origin {
+		t.Fatalf("expected a new client at %s to be reported apart", newcomer)
+	}
+	follow.WriteTo([]byte("to the moved client"), origin)
+	if got := receive(spoofer); string(got) != "to the moved client" {
+		t.Errorf("expected the moved client to get its packets, got %q", got)
+	}
+	follow.WriteTo([]byte("to the newcomer"), newcomer)
+	if got := receive(client); string(got) != "to the newcomer" {
+		t.Errorf("expected the newcomer to get its packets, got %q", got)
+	}
+}
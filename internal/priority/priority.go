@@ -0,0 +1,176 @@
+// Package priority implements the Extensible Prioritization Scheme of RFC 9218
+// for the HTTP/3 servers: the Priority header of requests and responses is
+// parsed, and Handler schedules the response data of the streams of each
+// connection by urgency.
+//
+// PRIORITY_UPDATE frames (RFC 9218 section 7) are deferred, a client
+// reprioritizing a request in flight has no effect yet. quic-go v0.49 stops
+// reading the control stream after SETTINGS and doesn't tell a handler the ID
+// of its request stream, the element the frame refers to, so supporting it
+// waits for quic-go to expose both. HTTP/2 clients may still send the PRIORITY
+// frames of RFC 7540, net/http doesn't hand them to handlers either. Until
+// then the Priority header is the only signal the proxies can see and forward.
+package priority
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultUrgency is the urgency of requests without a priority signal
+	DefaultUrgency = 3
+	// MaxUrgency is the lowest urgency, 0 is the highest
+	MaxUrgency = 7
+)
+
+// Priority is the urgency and incremental parameters of a request
+type Priority struct {
+	// Urgency from 0, the most urgent, to MaxUrgency
+	Urgency int
+	// Incremental responses are useful piece by piece, they share the
+	// bandwidth with the other incremental responses of the same urgency
+	Incremental bool
+}
+
+// Default is the priority of requests without a priority signal
+var Default = Priority{Urgency: DefaultUrgency}
+
+// ErrInvalid is returned for a Priority field that isn't a Structured Field
+// dictionary, it is ignored as a whole
+var ErrInvalid = errors.New("invalid priority field")
+
+// Parse Parse a Priority field value, the parameters it lacks keep their default
+func Parse(value string) (Priority, error) {
+	return Default.Update(value)
+}
+
+// Update Return p with the parameters present in value replacing its own.
+// Unknown parameters and values of the wrong type or out of range are
+// ignored, RFC 9218 section 4. A malformed value leaves p as it is.
+func (p Priority) Update(value string) (Priority, error) {
+	members, err := splitDictionary(value)
+	if err != nil {
+		return p, err
+	}
+	for _, member := range members {
+		key, item, _ := strings.Cut(member, "=")
+		switch key {
+		case "u":
+			if u, err := strconv.Atoi(item); err == nil && u >= 0 && u <= MaxUrgency {
+				p.Urgency = u
+			}
+		case "i":
+			switch item {
+			case "", "?1":
+				p.Incremental = true
+			case "?0":
+				p.Incremental = false
+			}
+		}
+	}
+	return p, nil
+}
+
+// String Serialize p as a Priority field value, empty for the default
+func (p Priority) String() string {
+	var params []string
+	if p.Urgency != DefaultUrgency {
+		params = append(params, fmt.Sprintf("u=%d", p.Urgency))
+	}
+	if p.Incremental {
+		params = append(params, "i")
+	}
+	return strings.Join(params, ", ")
+}
+
+// FromHeader Return the priority signalled in h, the default if there is
+// none or it is malformed
+func FromHeader(h http.Header) Priority {
+	values := h.Values("Priority")
+	if len(values) == 0 {
+		return Default
+	}
+	p, err := Parse(strings.Join(values, ","))
+	if err != nil {
+		return Default
+	}
+	return p
+}
+
+// splitDictionary Split a Structured Field dictionary, RFC 8941 section 3.2,
+// into its members as key or key=bare-item, without their parameters. Values
+// the priority parameters never take, strings and inner lists, are kept
+// whole so that their commas don't split them.
+func splitDictionary(value string) ([]string, error) {
+	var members []string
+	rest := strings.TrimLeft(value, " \t")
+	for rest != "" {
+		end := memberEnd(rest)
+		if end < 0 {
+			return nil, ErrInvalid
+		}
+		member := strings.TrimRight(rest[:end], " \t")
+		rest = rest[end:]
+		if rest != "" {
+			// skip the comma and the whitespace around the next member
+			rest = strings.TrimLeft(rest[1:], " \t")
+			if rest == "" {
+				return nil, ErrInvalid
+			}
+		}
+		// parameters of the member are not part of the scheme
+		if i := strings.IndexByte(member, ';'); i >= 0 && !strings.ContainsAny(member[:i], "\"(") {
+			member = member[:i]
+		}
+		key, _, _ := strings.Cut(member, "=")
+		if !validKey(key) {
+			return nil, ErrInvalid
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// memberEnd Return the index of the comma ending the first member of s, or
+// len(s), -1 if a string or an inner list isn't closed
+func memberEnd(s string) int {
+	inString, depth := false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case inString && c == '\\':
+			i++
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			return i
+		}
+	}
+	if inString || depth != 0 {
+		return -1
+	}
+	return len(s)
+}
+
+// validKey Report whether key is a Structured Field key: lcalpha or "*"
+// first, then lcalpha, digits, "_", "-", "." or "*"
+func validKey(key string) bool {
+	if key == "" || !(key[0] == '*' || key[0] >= 'a' && key[0] <= 'z') {
+		return false
+	}
+	for i := 1; i < len(key); i++ {
+		c := key[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("_-.*", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
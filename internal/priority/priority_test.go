@@ -0,0 +1,104 @@
+package priority
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tTable := []struct {
+		value    string
+		expected Priority
+		err      error
+	}{
+		{value: "", expected: Default},
+		{value: "u=5", expected: Priority{Urgency: 5}},
+		{value: "i", expected: Priority{Urgency: DefaultUrgency, Incremental: true}},
+		{value: "u=0, i", expected: Priority{Urgency: 0, Incremental: true}},
+		{value: "u=1,i=?1", expected: Priority{Urgency: 1, Incremental: true}},
+		{value: "i=?0, u=7", expected: Priority{Urgency: 7}},
+		// the last occurrence of a key wins
+		{value: "u=1, u=6", expected: Priority{Urgency: 6}},
+		// parameters of a member are ignored
+		{value: "u=2;x=1, i;y", expected: Priority{Urgency: 2, Incremental: true}},
+		// unknown keys and values of the wrong type or out of range are ignored
+		{value: `u=8, i=1, x="a, b", y=(1 2)`, expected: Default},
+		{value: "u=1.5, i=?2", expected: Default},
+		{value: "U=1", err: ErrInvalid},
+		{value: "u=1,", err: ErrInvalid},
+		{value: `x="open`, err: ErrInvalid},
+		{value: "x=(1 2", err: ErrInvalid},
+	}
+
+	for _, tCase := range tTable {
+		p, err := Parse(tCase.value)
+		if tCase.err != nil {
+			if !errors.Is(err, tCase.err) {
+				t.Errorf("Parse(%q): expected error %v, got %v", tCase.value, tCase.err, err)
+			}
+			continue
+		}
+		if err != nil || p != tCase.expected {
+			t.Errorf("Parse(%q) = %+v, %v, expected %+v", tCase.value, p, err, tCase.expected)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	base := Priority{Urgency: 1, Incremental: true}
+	tTable := []struct {
+		value    string
+		expected Priority
+	}{
+		{value: "", expected: base},
+		{value: "u=4", expected: Priority{Urgency: 4, Incremental: true}},
+		{value: "i=?0", expected: Priority{Urgency: 1}},
+		{value: "u=9", expected: base},
+		{value: "Invalid", expected: base},
+	}
+
+	for _, tCase := range tTable {
+		if p, _ := base.Update(tCase.value); p != tCase.expected {
+			t.Errorf("Update(%q) = %+v, expected %+v", tCase.value, p, tCase.expected)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tTable := []struct {
+		p        Priority
+		expected string
+	}{
+		{p: Default, expected: ""},
+		{p: Priority{Urgency: 5, Incremental: true}, expected: "u=5, i"},
+		{p: Priority{Urgency: DefaultUrgency, Incremental: true}, expected: "i"},
+		{p: Priority{Urgency: 0}, expected: "u=0"},
+	}
+
+	for _, tCase := range tTable {
+		if got := tCase.p.String(); got != tCase.expected {
+			t.Errorf("%+v.String() = %q, expected %q", tCase.p, got, tCase.expected)
+		}
+		if p, err := Parse(tCase.p.String()); err != nil || p != tCase.p {
+			t.Errorf("%q doesn't parse back to %+v: %+v, %v", tCase.p.String(), tCase.p, p, err)
+		}
+	}
+}
+
+func TestFromHeader(t *testing.T) {
+	tTable := []struct {
+		header   http.Header
+		expected Priority
+	}{
+		{header: http.Header{}, expected: Default},
+		{header: http.Header{"Priority": {"u=1", "i"}}, expected: Priority{Urgency: 1, Incremental: true}},
+		{header: http.Header{"Priority": {"u=1", "?"}}, expected: Default},
+	}
+
+	for _, tCase := range tTable {
+		if p := FromHeader(tCase.header); p != tCase.expected {
+			t.Errorf("FromHeader(%v) = %+v, expected %+v", tCase.header, p, tCase.expected)
+		}
+	}
+}
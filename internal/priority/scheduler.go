@@ -0,0 +1,264 @@
+package priority
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// chunkSize is how much of a response is written at once, a more urgent
+	// response waits for at most one chunk of each stream writing
+	chunkSize = 16 << 10
+	// linger is how long a stream that just wrote still holds back the less
+	// urgent ones, so that a handler writing in a loop keeps its turn
+	linger = 5 * time.Millisecond
+)
+
+// schedulers holds the scheduler of each HTTP/3 connection with requests in flight
+var schedulers = struct {
+	sync.Mutex
+	m map[http3.Connection]*scheduler
+}{m: make(map[http3.Connection]*scheduler)}
+
+// Handler Schedule the response data of the HTTP/3 requests of each
+// connection by priority, RFC 9218 section 10: a response is only written
+// while no more urgent one has data to send, non-incremental responses of
+// the same urgency one after the other in the order the requests arrived,
+// incremental ones together. The priority of a request is updated with the
+// Priority header of its response. Other requests, and CONNECT streams that
+// carry tunnels rather than responses, are served unchanged.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := w.(interface{ Connection() http3.Connection })
+		if !ok || r.Method == http.MethodConnect {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sched := acquireScheduler(c.Connection())
+		defer releaseScheduler(c.Connection(), sched)
+		s := sched.add(FromHeader(r.Header))
+		defer sched.remove(s)
+		next.ServeHTTP(&responseWriter{ResponseWriter: w, ctx: r.Context(), sched: sched, s: s}, r)
+	})
+}
+
+// acquireScheduler Return the scheduler of conn, created for its first request
+func acquireScheduler(conn http3.Connection) *scheduler {
+	schedulers.Lock()
+	defer schedulers.Unlock()
+	sched := schedulers.m[conn]
+	if sched == nil {
+		sched = &scheduler{streams: make(map[*stream]struct{})}
+		sched.cond = sync.NewCond(&sched.mu)
+		schedulers.m[conn] = sched
+	}
+	sched.refs++
+	return sched
+}
+
+// releaseScheduler Forget the scheduler of conn once its last request is done
+func releaseScheduler(conn http3.Connection, sched *scheduler) {
+	schedulers.Lock()
+	defer schedulers.Unlock()
+	if sched.refs--; sched.refs == 0 {
+		delete(schedulers.m, conn)
+	}
+}
+
+// scheduler orders the writes of the responses of one connection
+type scheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	refs    int // requests in flight, guarded by schedulers
+	seq     uint64
+	streams map[*stream]struct{}
+}
+
+// stream is the response of one request
+type stream struct {
+	prio Priority
+	// seq orders the requests as they arrived, standing in for the stream
+	// ID quic-go doesn't tell without taking the stream over
+	seq       uint64
+	waiting   bool
+	writing   bool
+	lastWrite time.Time
+	// lingering wakes the streams s holds back once it stopped lingering,
+	// re-armed by every write
+	lingering *time.Timer
+}
+
+// active Report whether s has data to send, or just sent some and is likely
+// to send more
+func (s *stream) active(now time.Time) bool {
+	return s.waiting || s.writing || !s.lastWrite.IsZero() && now.Sub(s.lastWrite) < linger
+}
+
+// precedes Report whether s goes before other
+func (s *stream) precedes(other *stream) bool {
+	if s.prio.Urgency != other.prio.Urgency {
+		return s.prio.Urgency < other.prio.Urgency
+	}
+	if s.prio.Incremental {
+		return false
+	}
+	return other.prio.Incremental || s.seq < other.seq
+}
+
+func (sc *scheduler) add(prio Priority) *stream {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.seq++
+	s := &stream{prio: prio, seq: sc.seq}
+	sc.streams[s] = struct{}{}
+	return s
+}
+
+func (sc *scheduler) remove(s *stream) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delete(sc.streams, s)
+	if s.lingering != nil {
+		s.lingering.Stop()
+	}
+	sc.cond.Broadcast()
+}
+
+// setPriority Change the priority of s, the more urgent streams may go first
+func (sc *scheduler) setPriority(s *stream, prio Priority) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	s.prio = prio
+	sc.cond.Broadcast()
+}
+
+// eligible Report whether s may write, sc.mu is held
+func (sc *scheduler) eligible(s *stream) bool {
+	now := time.Now()
+	for other := range sc.streams {
+		if other != s && other.active(now) && other.precedes(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// acquire Wait until s may write or ctx is done
+func (sc *scheduler) acquire(ctx context.Context, s *stream) error {
+	stop := context.AfterFunc(ctx, func() {
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		sc.cond.Broadcast()
+	})
+	defer stop()
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	s.waiting = true
+	for !sc.eligible(s) {
+		if err := ctx.Err(); err != nil {
+			s.waiting = false
+			return err
+		}
+		sc.cond.Wait()
+	}
+	s.waiting, s.writing = false, true
+	return nil
+}
+
+// release End a write of s. The streams it holds back are woken again once it
+// stopped lingering.
+func (sc *scheduler) release(s *stream) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	s.writing = false
+	s.lastWrite = time.Now()
+	sc.cond.Broadcast()
+	if s.lingering == nil {
+		s.lingering = time.AfterFunc(linger, sc.wake)
+	} else {
+		s.lingering.Reset(linger)
+	}
+}
+
+// wake Let the waiting streams check again whether they may write
+func (sc *scheduler) wake() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.cond.Broadcast()
+}
+
+// responseWriter writes the response of a stream when the scheduler lets it
+type responseWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	sched       *scheduler
+	s           *stream
+	wroteHeader bool
+}
+
+// WriteHeader Apply the Priority header of the response before sending it
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= http.StatusOK {
+		w.wroteHeader = true
+		if values := w.Header().Values("Priority"); len(values) > 0 {
+			w.sched.mu.Lock()
+			prio := w.s.prio
+			w.sched.mu.Unlock()
+			if updated, err := prio.Update(joinValues(values)); err == nil && updated != prio {
+				w.sched.setPriority(w.s, updated)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), chunkSize)]
+		if err := w.sched.acquire(w.ctx, w.s); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		w.sched.release(w.s)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Flush Send the buffered data when the scheduler lets the stream write
+func (w *responseWriter) Flush() {
+	if err := w.sched.acquire(w.ctx, w.s); err != nil {
+		return
+	}
+	defer w.sched.release(w.s)
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the http3 response writer
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// joinValues Join the lines of a header field into one value
+func joinValues(values []string) string {
+	if len(values) == 1 {
+		return values[0]
+	}
+	joined := values[0]
+	for _, v := range values[1:] {
+		joined += "," + v
+	}
+	return joined
+}
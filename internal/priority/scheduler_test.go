@@ -0,0 +1,181 @@
+package priority
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"quic-proxy/internal/testutil"
+)
+
+const responseSize = 4 << 20
+
+// startScheduledServer Serve responses of responseSize bytes over HTTP/3,
+// scheduled by Handler. The response priority is taken from the u query
+// parameter, the request priority from its header.
+func startScheduledServer(t *testing.T) string {
+	t.Helper()
+	chunk := make([]byte, 16<<10)
+	return testutil.ServeH3(t, &http3.Server{Handler: Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u := r.URL.Query().Get("u"); u != "" {
+			w.Header().Set("Priority", "u="+u)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(responseSize))
+		for written := 0; written < responseSize; written += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))})
+}
+
+// fetch Send a request with the priority header, the time its body was
+// read is sent on done. started is closed once the response started.
+func fetch(t *testing.T, client *http.Client, url, prio string, started chan<- struct{}, done chan<- string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Errorf("failed to create request: %v", err)
+		return
+	}
+	if prio != "" {
+		req.Header.Set("Priority", prio)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Errorf("request with priority %q failed: %v", prio, err)
+		close(started)
+		return
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Errorf("response with priority %q failed: %v", prio, err)
+	}
+	close(started)
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil || n != responseSize-1 {
+		t.Errorf("response with priority %q: read %d bytes, %v", prio, n+1, err)
+	}
+	done <- prio
+}
+
+func TestHandler_Urgency(t *testing.T) {
+	tTable := []struct {
+		name     string
+		requests []string // sent in this order, each once the previous one started
+		query    []string
+		expected []string // order the responses finish in
+	}{
+		{
+			name:     "more urgent first",
+			requests: []string{"u=5", "u=3", "u=1"},
+			query:    []string{"", "", ""},
+			expected: []string{"u=1", "u=3", "u=5"},
+		},
+		{
+			name:     "default urgency before the background",
+			requests: []string{"u=7", ""},
+			query:    []string{"", ""},
+			expected: []string{"", "u=7"},
+		},
+		{
+			name:     "response priority",
+			requests: []string{"u=1", "u=4"},
+			query:    []string{"6", ""},
+			expected: []string{"u=4", "u=1"},
+		},
+	}
+
+	for _, tCase := range tTable {
+		addr := startScheduledServer(t)
+		client := testutil.H3Client(t)
+		done := make(chan string, len(tCase.requests))
+		var wg sync.WaitGroup
+		for i, prio := range tCase.requests {
+			started := make(chan struct{})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fetch(t, client, "https://"+addr+"/?u="+tCase.query[i], prio, started, done)
+			}()
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: response with priority %q didn't start", tCase.name, prio)
+			}
+		}
+		wg.Wait()
+		close(done)
+		var finished []string
+		for prio := range done {
+			finished = append(finished, prio)
+		}
+		if len(finished) != len(tCase.expected) {
+			t.Errorf("%s: expected %d responses, got %v", tCase.name, len(tCase.expected), finished)
+			continue
+		}
+		for i := range finished {
+			if finished[i] != tCase.expected[i] {
+				t.Errorf("%s: expected responses to finish in order %q, got %q", tCase.name, tCase.expected, finished)
+				break
+			}
+		}
+	}
+}
+
+func TestPrecedes(t *testing.T) {
+	tTable := []struct {
+		name     string
+		s, other stream
+		expected bool
+	}{
+		{name: "more urgent", s: stream{prio: Priority{Urgency: 1}, seq: 2}, other: stream{prio: Priority{Urgency: 2}, seq: 1}, expected: true},
+		{name: "less urgent", s: stream{prio: Priority{Urgency: 2}, seq: 1}, other: stream{prio: Priority{Urgency: 1}, seq: 2}, expected: false},
+		{name: "earlier request", s: stream{prio: Default, seq: 1}, other: stream{prio: Default, seq: 2}, expected: true},
+		{name: "later request", s: stream{prio: Default, seq: 2}, other: stream{prio: Default, seq: 1}, expected: false},
+		{name: "before incremental", s: stream{prio: Default, seq: 2}, other: stream{prio: Priority{Urgency: DefaultUrgency, Incremental: true}, seq: 1}, expected: true},
+		{name: "incremental peers share", s: stream{prio: Priority{Urgency: 3, Incremental: true}, seq: 1}, other: stream{prio: Priority{Urgency: 3, Incremental: true}, seq: 2}, expected: false},
+	}
+
+	for _, tCase := range tTable {
+		if got := tCase.s.precedes(&tCase.other); got != tCase.expected {
+			t.Errorf("%s: expected precedes %v, got %v", tCase.name, tCase.expected, got)
+		}
+	}
+}
+
+func TestScheduler_Linger(t *testing.T) {
+	sched := &scheduler{streams: make(map[*stream]struct{})}
+	sched.cond = sync.NewCond(&sched.mu)
+	urgent := sched.add(Priority{Urgency: 0})
+	background := sched.add(Default)
+
+	// every write re-arms the same timer of the stream
+	var timer *time.Timer
+	for i := 0; i < 100; i++ {
+		if err := sched.acquire(context.Background(), urgent); err != nil {
+			t.Fatalf("acquire failed: %v", err)
+		}
+		sched.release(urgent)
+		if i == 0 {
+			timer = urgent.lingering
+		} else if urgent.lingering != timer {
+			t.Fatalf("write %d armed another timer", i)
+		}
+	}
+
+	// the less urgent stream waits for the urgent one to stop lingering, the timer wakes it
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := sched.acquire(ctx, background); err != nil {
+		t.Fatalf("the less urgent stream wasn't woken: %v", err)
+	}
+	sched.release(background)
+	sched.remove(urgent)
+	sched.remove(background)
+}
@@ -0,0 +1,93 @@
+package h1h3
+
+import (
+	"bufio"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"golang.org/x/net/http2"
+
+	h2h3convert "quic-proxy/internal/h2h3-convert"
+)
+
+// mitmHandshakeTimeout 隧道内 TLS 握手的超时
+const mitmHandshakeTimeout = 10 * time.Second
+
+// serveMitm 终止 CONNECT 隧道 req 的 TLS，证书由 tlsConfig 为目标签发。
+// 协商出 h2 时由 HTTP/2 服务端读取请求，每个流都经 filterRequest 检查后
+// 由 upstream 转发；goproxy 自带的 MITM 会把 HTTP/2 帧原样转发给目标，
+// 绕过头部策略。协商出 HTTP/1.1 时拒绝第一个请求
+func serveMitm(client net.Conn, req *http.Request, ctx *goproxy.ProxyCtx, tlsConfig func(string, *goproxy.ProxyCtx) (*tls.Config, error), upstream http.RoundTripper) {
+	defer client.Close()
+	if _, err := client.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+		return
+	}
+	conf, err := tlsConfig(req.URL.Host, ctx)
+	if err != nil {
+		log.Printf("[PROXY] Failed to sign a certificate for %s: %v", req.URL.Host, err)
+		return
+	}
+	conf.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	conn := tls.Server(client, conf)
+	conn.SetDeadline(time.Now().Add(mitmHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		log.Printf("[PROXY] TLS handshake with %s for %s failed: %v", req.RemoteAddr, req.URL.Host, err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	if conn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		r, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		log.Printf("req.ProtoMajor: %d", r.ProtoMajor)
+		resp := goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, "HTTP/2 Required")
+		resp.Close = true
+		resp.Write(conn)
+		return
+	}
+	(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: mitmHandler(req.RemoteAddr, upstream)})
+}
+
+// mitmHandler 转发隧道内的 HTTP/2 请求，remoteAddr 是发起 CONNECT 的客户端地址。
+// 请求按 HTTP/3 转换后交给 upstream，上游以 HTTP/3 应答时响应再转换回 HTTP/2
+func mitmHandler(remoteAddr string, upstream http.RoundTripper) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = remoteAddr
+		r.URL.Scheme = "https"
+		r.URL.Host = r.Host
+		resp := filterRequest(r)
+		if resp == nil {
+			out, err := h2h3convert.ConvertHTTP2RequestToHTTP3(r)
+			if err != nil {
+				log.Printf("[PROXY] %s %s refused: %v", r.Method, r.URL, err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			upstreamResp, err := upstream.RoundTrip(out)
+			if err != nil {
+				log.Printf("[PROXY] %s %s to upstream failed: %v", r.Method, r.URL, err)
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			resp = filterResponse(upstreamResp, r)
+			if resp.ProtoMajor == 3 {
+				converted, err := h2h3convert.ConvertHTTP3ResponseToHTTP2(resp)
+				if err != nil {
+					resp.Body.Close()
+					log.Printf("[PROXY] %s %s: %v", r.Method, r.URL, err)
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				resp = converted
+			}
+		}
+		defer resp.Body.Close()
+		h2h3convert.WriteResponse(w, r, resp)
+	})
+}
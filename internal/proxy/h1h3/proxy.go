@@ -1,29 +1,50 @@
 package h1h3
 
 import (
+	"context"
 	"crypto/tls"
 	"github.com/elazarl/goproxy"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"time"
+
+	"quic-proxy/internal/forwarding"
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+	headerpolicy "quic-proxy/internal/header-policy"
+	"quic-proxy/internal/utils"
 )
 
-func HttpsProxy(verbose *bool, addr *string) {
+func HttpsProxy(verbose *bool, addr *string, insecure bool) {
 	// 生成 CA 证书
 	cert, err := tls.LoadX509KeyPair("cert.pem", "key.pem")
 	if err != nil {
 		log.Fatalf("Failed to load certificate: %v", err)
 	}
-	customCaMitm := &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(&cert)}
-	customCaMitmHttp := &goproxy.ConnectAction{Action: goproxy.ConnectHTTPMitm, TLSConfig: goproxy.TLSConfigFromCA(&cert)}
+	// 默认校验上游证书，insecure 仅用于测试
+	happyeyeballs.DefaultRoundTripper.TLSClientConfig.InsecureSkipVerify = insecure
+	// 上游请求走共享的连接池，而不是 goproxy 默认的 http.Transport
+	proxy := NewHttpsProxy(cert, happyeyeballs.DefaultRoundTripper)
+	go utils.DefaultAltSvcCache.WatchNetwork(context.Background(), 5*time.Second)
+	proxy.Verbose = *verbose
+	log.Fatal(http.ListenAndServe(*addr, proxy))
+}
+
+// NewHttpsProxy 创建以 cert 为 CA 的 MITM 代理，请求经 upstream 发往上游。
+// CONNECT 隧道由 serveMitm 终止 TLS，只有隧道内的 HTTP/2 请求会经头部策略
+// 检查后转发；HTTP/1.x 请求由 goproxy 自己的解析器读取，在头部策略之前就被拒绝，
+// 不会到达上游
+func NewHttpsProxy(cert tls.Certificate, upstream http.RoundTripper) *goproxy.ProxyHttpServer {
+	tlsConfig := goproxy.TLSConfigFromCA(&cert)
+	customCaMitm := &goproxy.ConnectAction{Action: goproxy.ConnectHijack, Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+		serveMitm(client, req, ctx, tlsConfig, upstream)
+	}}
+	customCaMitmHttp := &goproxy.ConnectAction{Action: goproxy.ConnectHTTPMitm, TLSConfig: tlsConfig}
 
 	var customAlwaysMitm goproxy.FuncHttpsHandler = func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-		if ctx.Req.ProtoMajor != 2 {
-			log.Printf("req.ProtoMajor: %d", ctx.Req.ProtoMajor)
-			return nil, host
-		}
 		if ctx.Req.Method == "CONNECT" {
-			// CONNECT 请求，即 HTTPS 代理
+			// CONNECT 请求，即 HTTPS 代理。CONNECT 本身经 HTTP/1.1 到达，隧道内要求 HTTP/2
 			log.Printf("HTTPS CONNECT request intercepted: %s", host)
 			return customCaMitm, host // 使用 MITM
 		} else {
@@ -33,7 +54,6 @@ func HttpsProxy(verbose *bool, addr *string) {
 		}
 	}
 	proxy := goproxy.NewProxyHttpServer()
-	proxy.AllowHTTP2 = true
 	proxy.OnRequest().HandleConnect(customAlwaysMitm)
 	//	⚠️ Note we returned a nil value as the response. If the returned response is not nil, goproxy will discard the request and send the specified response to the client.
 	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
@@ -46,9 +66,49 @@ func HttpsProxy(verbose *bool, addr *string) {
 			log.Printf("req.ProtoMajor: %d", req.ProtoMajor)
 			return nil, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "HTTP/2 Required")
 		}
+		if resp := filterRequest(req); resp != nil {
+			return nil, resp
+		}
 
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+			return upstream.RoundTrip(req)
+		})
 		return req, nil
 	})
-	proxy.Verbose = *verbose
-	log.Fatal(http.ListenAndServe(*addr, proxy))
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		// goproxy.NewResponse 生成的响应没有协议版本，不是从上游收到的
+		if resp != nil && resp.ProtoMajor > 0 && ctx.Req != nil {
+			return filterResponse(resp, ctx.Req)
+		}
+		return resp
+	})
+	return proxy
+}
+
+// filterRequest 检查转发环路与头部策略并添加转发头部，拒绝时返回给客户端的响应
+func filterRequest(req *http.Request) *http.Response {
+	if err := forwarding.Default.CheckLoop(req); err != nil {
+		log.Printf("[PROXY] %v", err)
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusLoopDetected, "Proxy loop detected")
+	}
+	if err := headerpolicy.Default.Request(req); err != nil {
+		log.Printf("[PROXY] %s %s refused: %v", req.Method, req.URL, err)
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, headerpolicy.Status(err), err.Error())
+	}
+	forwarding.Default.Request(req.Header, req)
+	return nil
+}
+
+// filterResponse 检查上游对 req 的响应，并记录上游的 Alt-Svc，供后续请求选择 h3 备用服务
+func filterResponse(resp *http.Response, req *http.Request) *http.Response {
+	forwarding.Default.Response(resp)
+	if err := headerpolicy.Default.Response(resp); err != nil {
+		log.Printf("[PROXY] Invalid response to %s %s: %v", req.Method, req.URL, err)
+		resp.Body.Close()
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, "Invalid response from target server")
+	}
+	if err := utils.DefaultAltSvcCache.Update(utils.OriginFromURL(req.URL), resp.Header.Get("Alt-Svc")); err != nil {
+		log.Printf("Ignore invalid Alt-Svc from %s: %v", req.URL.Host, err)
+	}
+	return resp
 }
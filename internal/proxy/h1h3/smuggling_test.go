@@ -0,0 +1,139 @@
+package h1h3
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"quic-proxy/internal/testutil"
+)
+
+// startMitm Start the MITM proxy in front of a backend recording the requests
+// it gets, whichever host they are for, and return the proxy address
+func startMitm(t *testing.T) (string, *testutil.Recorder) {
+	t.Helper()
+	rec := &testutil.Recorder{}
+	backend := httptest.NewTLSServer(rec)
+	t.Cleanup(backend.Close)
+	certPath, keyPath := testutil.GenerateCert(t)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %v", err)
+	}
+	upstream := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, backend.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	t.Cleanup(upstream.CloseIdleConnections)
+	proxy := httptest.NewServer(NewHttpsProxy(cert, upstream))
+	t.Cleanup(proxy.Close)
+	return proxy.Listener.Addr().String(), rec
+}
+
+// dialMitm Open a CONNECT tunnel to SmugglingHost through the proxy at addr
+// and finish the TLS handshake with the proxy, offering protocol
+func dialMitm(t testing.TB, addr, protocol string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial the proxy: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	target := testutil.SmugglingHost + ":443"
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		conn.Close()
+		t.Fatalf("CONNECT failed: %v %v", resp, err)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: testutil.SmugglingHost, NextProtos: []string{protocol}})
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		t.Fatalf("TLS handshake through the tunnel failed: %v", err)
+	}
+	return tlsConn
+}
+
+func TestHttpsProxy_Smuggling(t *testing.T) {
+	addr, rec := startMitm(t)
+	// the MITM reads each h2 stream itself, the header policy decides whether it is forwarded
+	testutil.RunH2SmugglingCases(t, testutil.SmugglingCorpus, func(t testing.TB) net.Conn {
+		return dialMitm(t, addr, http2.NextProtoTLS)
+	}, rec)
+}
+
+func TestHttpsProxy_RequiresHTTP2(t *testing.T) {
+	addr, rec := startMitm(t)
+	conn := dialMitm(t, addr, "http/1.1")
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", testutil.SmugglingHost)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read the response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected HTTP/1.1 in the tunnel to be refused with 403, got %d", resp.StatusCode)
+	}
+	if got := rec.Take(); len(got) > 0 {
+		t.Errorf("expected nothing to reach the backend, got %q", got)
+	}
+}
+
+func TestHttpsProxy_ConvertsToH3(t *testing.T) {
+	var priorities []string
+	backend := testutil.ServeH3(t, &http3.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		priorities = r.Header.Values("Priority")
+		w.Write([]byte(r.Proto))
+	})})
+	certPath, keyPath := testutil.GenerateCert(t)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %v", err)
+	}
+	upstream := &http3.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		Dial: func(ctx context.Context, _ string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlyConnection, error) {
+			return quic.DialAddrEarly(ctx, backend, tlsConf, quicConf)
+		},
+	}
+	defer upstream.Close()
+	proxy := httptest.NewServer(NewHttpsProxy(cert, upstream))
+	defer proxy.Close()
+
+	conn := dialMitm(t, proxy.Listener.Addr().String(), http2.NextProtoTLS)
+	defer conn.Close()
+	cc, err := (&http2.Transport{}).NewClientConn(conn)
+	if err != nil {
+		t.Fatalf("failed to start h2 in the tunnel: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://"+testutil.SmugglingHost+"/", nil)
+	req.Header.Add("Priority", "u=1")
+	req.Header.Add("Priority", "i")
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("request through the tunnel failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	// the h2 request goes upstream as HTTP/3, the answer comes back over h2
+	if resp.ProtoMajor != 2 || string(body) != "HTTP/3.0" {
+		t.Errorf("expected an h2 response relaying HTTP/3, got %s %q", resp.Proto, body)
+	}
+	if len(priorities) != 1 || priorities[0] != "u=1, i" {
+		t.Errorf("expected one Priority field line u=1, i, got %q", priorities)
+	}
+}
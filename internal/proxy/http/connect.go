@@ -0,0 +1,62 @@
+package http
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"quic-proxy/internal/config"
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+	"quic-proxy/internal/routing"
+	"quic-proxy/internal/tunnel"
+)
+
+// connect 处理 CONNECT 请求，默认直接以 TCP 连接目标，只允许 443 端口和公网地址
+var connect = &tunnel.Handler{
+	Dial: tunnel.DialTCP(&happyeyeballs.Dialer{Control: tunnel.PublicOnly}),
+	Name: "[PROXY]",
+}
+
+// ConfigureConnect 按配置设置 CONNECT 隧道：允许的端口和地址，以及是否经上游 quic-proxy 的 QUIC 流转发。
+// 需在开始服务之前调用
+func ConfigureConnect(cfg config.ConnectConfig) error {
+	dialer := &happyeyeballs.Dialer{}
+	if !cfg.AllowPrivateTargets {
+		// 检查的是解析后实际连接的地址
+		dialer.Control = tunnel.PublicOnly
+	}
+	handler := &tunnel.Handler{
+		AllowedPorts: cfg.AllowedPorts,
+		Dial:         tunnel.DialTCP(dialer),
+		Name:         "[PROXY]",
+	}
+	if cfg.UpstreamURL != "" {
+		dialer, err := tunnel.NewH3Dialer(cfg.UpstreamURL, cfg.Insecure)
+		if err != nil {
+			return err
+		}
+		// 所有隧道共用一条到上游的 QUIC 连接，每条隧道是一个请求流
+		handler.Dial = dialer.Dial
+		log.Printf("[PROXY] CONNECT tunnels go through %s over HTTP/3", cfg.UpstreamURL)
+	}
+	connect = handler
+	return nil
+}
+
+// handleConnect 建立 CONNECT 隧道，客户端连接被接管后双向转发字节，直到两端都关闭。
+// 有路由规则匹配时按规则连接目标，否则按 CONNECT 配置直连或经上游 quic-proxy
+func handleConnect(w http.ResponseWriter, req *http.Request, rule *routing.Rule) {
+	if rule == nil {
+		connect.ServeHTTP(w, req)
+		return
+	}
+	handler := *connect
+	handler.Dial = func(ctx context.Context, target string) (tunnel.Conn, error) {
+		conn, err := rule.DialContext(ctx, "tcp", target)
+		if err != nil {
+			return nil, err
+		}
+		return tunnel.NewNetConn(conn, nil), nil
+	}
+	handler.ServeHTTP(w, req)
+}
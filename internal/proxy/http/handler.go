@@ -1,10 +1,17 @@
 package http
 
 import (
-	"io"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+
+	"quic-proxy/internal/forwarding"
+	h2h3convert "quic-proxy/internal/h2h3-convert"
+	headerpolicy "quic-proxy/internal/header-policy"
+	"quic-proxy/internal/routing"
+	"quic-proxy/internal/websocket"
 )
 
 // HandleRequestAndRedirect 处理客户端请求并转发
@@ -19,36 +26,117 @@ func HandleRequestAndRedirect(w http.ResponseWriter, req *http.Request) {
 		targetURL, _ = url.Parse("http://" + req.Host + req.RequestURI)
 	}
 
-	proxyReq, err := http.NewRequest(req.Method, targetURL.String(), req.Body)
+	// 请求已经经过本代理，说明代理之间形成了环路
+	if err := forwarding.Default.CheckLoop(req); err != nil {
+		http.Error(w, "Proxy loop detected", http.StatusLoopDetected)
+		log.Printf("[PROXY] %v", err)
+		return
+	}
+
+	// 头部不合规（非法字段、Host 与 :authority 不一致、头部块过大）的请求按头部策略修正或拒绝
+	if err := headerpolicy.Default.Request(req); err != nil {
+		http.Error(w, err.Error(), headerpolicy.Status(err))
+		log.Printf("[PROXY] %s %s refused: %v", req.Method, targetURL, err)
+		return
+	}
+
+	// 按路由规则选择直连、上级代理或拒绝，没有规则匹配时走默认方式。
+	// 目标只解析一次，之后直连时连接的就是匹配规则时的地址
+	req, rule, err := matchRoute(req, targetURL)
+	if err != nil {
+		http.Error(w, "Failed to resolve target", http.StatusBadGateway)
+		log.Printf("[PROXY] %s %s: %v", req.Method, targetURL, err)
+		return
+	}
+	if rule != nil && rule.Action == routing.ActionReject {
+		http.Error(w, "Rejected by routing rule "+rule.Name, http.StatusForbidden)
+		log.Printf("[PROXY] %s %s rejected by routing rule %s", req.Method, targetURL, rule.Name)
+		return
+	}
+
+	// CONNECT 不转发请求，而是建立到目标的隧道
+	if req.Method == http.MethodConnect {
+		handleConnect(w, req, rule)
+		return
+	}
+
+	// WebSocket 不经过普通的请求转发，两端之间逐帧桥接
+	if websocket.IsWebSocket(req) {
+		handleWebSocket(w, req, targetURL, rule)
+		return
+	}
+
+	// 客户端断开时请求的 context 被取消，上游的 HTTP/3 流随之以 H3_REQUEST_CANCELLED 取消。
+	// 上游的 1xx 响应（100 Continue、103 Early Hints）在最终响应之前按顺序转发给客户端，
+	// 带 Expect: 100-continue 的请求体等上游回复 100 Continue 后才发出
+	ctx := h2h3convert.RelayInformational(req.Context(), h2h3convert.InformationalWriter(w, req))
+	proxyReq, err := http.NewRequestWithContext(ctx, req.Method, targetURL.String(), req.Body)
 	if err != nil {
 		http.Error(w, "Failed to create request", http.StatusInternalServerError)
 		log.Printf("Error creating request: %v", err)
 		return
 	}
 
-	// 3. 拷贝请求头
+	// 3. 拷贝请求头，去掉逐跳头部，追加 Via、Forwarded 与 X-Forwarded-*
 	copyHeader(proxyReq.Header, req.Header)
+	forwarding.Default.Request(proxyReq.Header, req)
+	proxyReq.ContentLength = req.ContentLength
+	// 共享 Trailer，客户端的 trailer 在请求体读完后才到达，随后由上游连接发出
+	proxyReq.Trailer = req.Trailer
 
-	// 4. 发送请求到目标服务器
-	client := &http.Client{Transport: &http.Transport{Proxy: nil}}
-	resp, err := client.Do(proxyReq)
+	// 4. 发送请求到目标服务器，已知 h3 备用服务的 origin 会自动升级到 HTTP/3
+	resp, err := roundTrip(proxyReq, rule)
 	if err != nil {
-		http.Error(w, "Failed to reach target server", http.StatusBadGateway)
+		// 超过上游 SETTINGS_MAX_FIELD_SECTION_SIZE 的请求头无法发出
+		if errors.Is(err, headerpolicy.ErrTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestHeaderFieldsTooLarge)
+		} else {
+			http.Error(w, "Failed to reach target server", http.StatusBadGateway)
+		}
 		log.Printf("Error forwarding request: %v", err)
 		return
 	}
 	defer resp.Body.Close()
+	forwarding.Default.Response(resp)
+	if err := headerpolicy.Default.Response(resp); err != nil {
+		http.Error(w, "Invalid response from target server", http.StatusBadGateway)
+		log.Printf("[PROXY] %s %s: %v", req.Method, targetURL, err)
+		return
+	}
 
 	// 5. 拷贝响应头和响应体，返回给客户端
-	copyHeader(w.Header(), resp.Header)
-	// 测试一下 Alt-svc的标头自定义
-	w.Header().Add("Alt-Svc", "quic=\":443\"")
+	// 标注上游实际使用的协议，客户端与代理之间仍为 HTTP/1.1
+	w.Header().Set("X-Upstream-Proto", resp.Proto)
 	// 关闭 HTTP 的长连接
 	// w.Header().Set("Connection", "close")
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	// 上游流被重置时 WriteResponse 会中止本次处理并关闭客户端连接，不会返回
+	if err := h2h3convert.WriteResponse(w, req, resp); err != nil {
+		log.Printf("[PROXY] Client went away, cancel upstream: %v", err)
+		return
+	}
 
-	log.Printf("[PROXY] Response sent back to client with status: %d", resp.StatusCode)
+	log.Printf("[PROXY] Response sent back to client with status: %d, upstream protocol: %s", resp.StatusCode, resp.Proto)
+}
+
+// matchRoute 按路由规则匹配请求的目标，CONNECT 按隧道的目标匹配。
+// 返回的请求的 context 固定了目标解析到的地址，解析失败时返回原请求和错误
+func matchRoute(req *http.Request, targetURL *url.URL) (*http.Request, *routing.Rule, error) {
+	host := targetURL.Hostname()
+	if req.Method == http.MethodConnect {
+		host = req.Host
+		if h, _, err := net.SplitHostPort(req.Host); err == nil {
+			host = h
+		}
+	}
+	ctx, err := routing.Default.Resolve(req.Context(), host)
+	if err != nil {
+		return req, nil, err
+	}
+	req = req.WithContext(ctx)
+	if req.Method == http.MethodConnect {
+		return req, routing.Default.MatchConnect(ctx, req.Host), nil
+	}
+	return req, routing.Default.MatchURL(ctx, targetURL), nil
 }
 
 // copyHeader 拷贝 HTTP 头信息
@@ -0,0 +1,371 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/forwarding"
+	h1h3server "quic-proxy/internal/h1h3-server"
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+	"quic-proxy/internal/routing"
+	"quic-proxy/internal/testutil"
+	"quic-proxy/internal/tunnel"
+	"quic-proxy/internal/utils"
+)
+
+// startProxy Serve the proxy, upstream requests to the returned target are sent
+// over HTTP/3 to h3Handler. Those that stay on TCP get "tcp" with their
+// trailers echoed.
+func startProxy(t *testing.T, h3Handler http.Handler) (client *http.Client, target string) {
+	t.Helper()
+	// the Alt-Svc of an http origin is only followed to a verified alternative
+	h3Addr, tlsConf := testutil.StartTrustedH3Server(t, h3Handler)
+	_, h3Port, _ := net.SplitHostPort(h3Addr)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		for k := range r.Trailer {
+			w.Header().Add("Trailer", k)
+		}
+		w.Write([]byte("tcp"))
+		for k, vv := range r.Trailer {
+			w.Header()[k] = vv
+		}
+	}))
+	t.Cleanup(origin.Close)
+
+	cache := utils.NewAltSvcCache()
+	originURL, _ := url.Parse(origin.URL)
+	cache.Store(utils.OriginFromURL(originURL), []utils.Service{
+		{ProtocolID: "h3", AltAuthority: utils.AltAuthority{Port: h3Port}},
+	})
+	defaultUpstream := upstream
+	upstream = happyeyeballs.NewRoundTripper(&happyeyeballs.Dialer{}, cache, tlsConf, nil)
+	t.Cleanup(func() {
+		upstream.Close()
+		upstream = defaultUpstream
+	})
+
+	proxy := httptest.NewServer(http.HandlerFunc(HandleRequestAndRedirect))
+	t.Cleanup(proxy.Close)
+	proxyURL, _ := url.Parse(proxy.URL)
+	transport := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}, origin.URL
+}
+
+func TestHandleRequestAndRedirect_ClientGoesAway(t *testing.T) {
+	upstreamErr := make(chan error, 1)
+	client, target := startProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// keep streaming until the proxy cancels the stream
+		for {
+			if _, err := w.Write([]byte("chunk")); err != nil {
+				upstreamErr <- err
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatalf("request through proxy failed: %v", err)
+	}
+	if resp.ProtoMajor != 1 || resp.Header.Get("X-Upstream-Proto") != "HTTP/3.0" {
+		t.Fatalf("expected an HTTP/3 upstream, got %s", resp.Header.Get("X-Upstream-Proto"))
+	}
+	io.ReadFull(resp.Body, make([]byte, len("chunk")))
+	// closing an unfinished HTTP/1.1 body closes the connection
+	resp.Body.Close()
+
+	select {
+	case err := <-upstreamErr:
+		var h3Err *http3.Error
+		if !errors.As(err, &h3Err) || h3Err.ErrorCode != http3.ErrCodeRequestCanceled {
+			t.Errorf("expected the upstream stream to be canceled with H3_REQUEST_CANCELLED, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the upstream stream to be canceled when the client went away")
+	}
+}
+
+func TestHandleRequestAndRedirect_UpstreamReset(t *testing.T) {
+	client, target := startProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		w.(http3.HTTPStreamer).HTTPStream().CancelWrite(quic.StreamErrorCode(http3.ErrCodeInternalError))
+	}))
+
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatalf("request through proxy failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected the client connection to be closed mid-body, got %v", err)
+	}
+	if string(body) != "partial" {
+		t.Errorf("expected the data received before the reset, got %q", body)
+	}
+}
+
+func TestHandleRequestAndRedirect_Trailers(t *testing.T) {
+	client, target := startProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("h3"))
+		w.Header().Set("X-Checksum", "42")
+	}))
+
+	tTable := []struct {
+		name          string
+		reqTrailer    http.Header
+		expectedProto string
+		expected      string
+	}{
+		{name: "response trailers over HTTP/3", expectedProto: "HTTP/3.0", expected: "42"},
+		// http3.Transport can't send request trailers
+		{name: "request trailers stay on TCP", reqTrailer: http.Header{"X-Checksum": {"7"}}, expectedProto: "HTTP/1.1", expected: "7"},
+	}
+	for _, tCase := range tTable {
+		req, _ := http.NewRequest(http.MethodPost, target, io.NopCloser(strings.NewReader("ping")))
+		req.Trailer = tCase.reqTrailer
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request through proxy failed: %v", tCase.name, err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if proto := resp.Header.Get("X-Upstream-Proto"); proto != tCase.expectedProto {
+			t.Errorf("%s: expected an %s upstream, got %s", tCase.name, tCase.expectedProto, proto)
+		}
+		if got := resp.Trailer.Get("X-Checksum"); got != tCase.expected {
+			t.Errorf("%s: expected trailer X-Checksum %q, got %v", tCase.name, tCase.expected, resp.Trailer)
+		}
+	}
+}
+
+func TestHandleRequestAndRedirect_Forwarding(t *testing.T) {
+	client, target := startProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Via") + "|" + r.Header.Get("X-Forwarded-For")))
+	}))
+	name := forwarding.Default.Name
+
+	tTable := []struct {
+		name           string
+		via            string
+		expectedStatus int
+		expectedBody   string
+		expectedVia    string
+	}{
+		{name: "forwarded", expectedStatus: http.StatusOK, expectedBody: "1.1 " + name + "|127.0.0.1", expectedVia: "3 " + name},
+		{name: "loop", via: "1.1 other, 1.1 " + name, expectedStatus: http.StatusLoopDetected},
+	}
+	for _, tCase := range tTable {
+		req, _ := http.NewRequest(http.MethodGet, target, nil)
+		if tCase.via != "" {
+			req.Header.Set("Via", tCase.via)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request through proxy failed: %v", tCase.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tCase.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", tCase.name, tCase.expectedStatus, resp.StatusCode)
+			continue
+		}
+		if tCase.expectedBody != "" && string(body) != tCase.expectedBody {
+			t.Errorf("%s: expected upstream to see %q, got %q", tCase.name, tCase.expectedBody, body)
+		}
+		if via := resp.Header.Get("Via"); via != tCase.expectedVia && tCase.expectedVia != "" {
+			t.Errorf("%s: expected response Via %q, got %q", tCase.name, tCase.expectedVia, via)
+		}
+		// the proxy has no alternative of its own to advertise
+		if altSvc := resp.Header.Values("Alt-Svc"); len(altSvc) > 0 {
+			t.Errorf("%s: expected no Alt-Svc, got %q", tCase.name, altSvc)
+		}
+	}
+}
+
+func TestHandleRequestAndRedirect_Connect(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tunnelled"))
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+	originPort, _ := strconv.Atoi(originURL.Port())
+	// the remote quic-proxy at the end of the QUIC stream
+	remoteAddr := testutil.ServeH3(t, &http3.Server{Handler: &tunnel.Handler{
+		AllowedPorts: []int{originPort},
+		Dial:         tunnel.DialTCP(&happyeyeballs.Dialer{}),
+	}})
+	proxy := httptest.NewServer(http.HandlerFunc(HandleRequestAndRedirect))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	defaultConnect := connect
+	defer func() { connect = defaultConnect }()
+
+	tTable := []struct {
+		name     string
+		cfg      config.ConnectConfig
+		expected int
+	}{
+		{name: "port not allowed", cfg: config.ConnectConfig{}, expected: http.StatusForbidden},
+		{name: "loopback not allowed", cfg: config.ConnectConfig{AllowedPorts: []int{originPort}}, expected: http.StatusForbidden},
+		{name: "direct", cfg: config.ConnectConfig{AllowedPorts: []int{originPort}, AllowPrivateTargets: true}, expected: http.StatusOK},
+		{name: "over HTTP/3", cfg: config.ConnectConfig{
+			AllowedPorts: []int{originPort}, UpstreamURL: "https://" + remoteAddr, Insecure: true,
+		}, expected: http.StatusOK},
+	}
+	for _, tCase := range tTable {
+		if err := ConfigureConnect(tCase.cfg); err != nil {
+			t.Fatalf("%s: failed to configure: %v", tCase.name, err)
+		}
+		transport := origin.Client().Transport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyURL(proxyURL)
+		var connectStatus int
+		transport.OnProxyConnectResponse = func(_ context.Context, _ *url.URL, _ *http.Request, resp *http.Response) error {
+			connectStatus = resp.StatusCode
+			return nil
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(origin.URL)
+		if connectStatus != tCase.expected {
+			t.Errorf("%s: expected CONNECT status %d, got %d", tCase.name, tCase.expected, connectStatus)
+		}
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "tunnelled" {
+				t.Errorf("%s: expected tunnelled, got %q", tCase.name, body)
+			}
+		}
+		transport.CloseIdleConnections()
+	}
+}
+
+func TestHandleRequestAndRedirect_Routing(t *testing.T) {
+	client, target := startProxy(t, http.NotFoundHandler())
+	var parentSaw string
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parentSaw = r.RequestURI
+		w.Write([]byte("parent"))
+	}))
+	defer parent.Close()
+	targetURL, _ := url.Parse(target)
+	router, err := routing.New(config.RoutingConfig{Rules: []config.RouteRuleConfig{
+		{Name: "blocked", Hosts: []string{"blocked.example"}, Action: "reject"},
+		{Name: "origin", CIDRs: []string{targetURL.Hostname()}, Action: "http", Proxy: parent.URL},
+	}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defaultRouter := routing.Default
+	routing.Default = router
+	defer func() {
+		routing.Default = defaultRouter
+		router.Close()
+	}()
+
+	tTable := []struct {
+		name     string
+		url      string
+		status   int
+		expected string
+	}{
+		{name: "rejected", url: "http://blocked.example/", status: http.StatusForbidden, expected: "Rejected by routing rule blocked\n"},
+		{name: "through the parent", url: target + "/x", status: http.StatusOK, expected: "parent"},
+	}
+	for _, tCase := range tTable {
+		resp, err := client.Get(tCase.url)
+		if err != nil {
+			t.Fatalf("%s: request through proxy failed: %v", tCase.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tCase.status || string(body) != tCase.expected {
+			t.Errorf("%s: expected %d %q, got %d %q", tCase.name, tCase.status, tCase.expected, resp.StatusCode, body)
+		}
+	}
+	if parentSaw != target+"/x" {
+		t.Errorf("expected the parent to get %s/x in absolute-form, got %q", target, parentSaw)
+	}
+}
+
+func TestHandleRequestAndRedirect_Informational(t *testing.T) {
+	client, target := startProxy(t, h1h3server.ContinueHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		if r.URL.Path == "/refuse" {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		// reading the body sends 100 Continue
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})))
+	// the client would wait longer than the test for 100 Continue
+	client.Transport.(*http.Transport).ExpectContinueTimeout = time.Minute
+
+	tTable := []struct {
+		path           string
+		expectedCodes  []int
+		expectedStatus int
+		expectedBody   string
+	}{
+		{path: "/accept", expectedCodes: []int{http.StatusEarlyHints, http.StatusContinue}, expectedStatus: http.StatusOK, expectedBody: "ping"},
+		{path: "/refuse", expectedCodes: []int{http.StatusEarlyHints}, expectedStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tCase := range tTable {
+		var codes []int
+		var link string
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				codes = append(codes, code)
+				if code == http.StatusEarlyHints {
+					link = header.Get("Link")
+				}
+				return nil
+			},
+		}
+		ctx, cancel := context.WithTimeout(httptrace.WithClientTrace(context.Background(), trace), 5*time.Second)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, target+tCase.path, strings.NewReader("ping"))
+		req.Header.Set("Expect", "100-continue")
+		resp, err := client.Do(req)
+		if err != nil {
+			cancel()
+			t.Fatalf("%s: request through proxy failed: %v", tCase.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		cancel()
+		if proto := resp.Header.Get("X-Upstream-Proto"); proto != "HTTP/3.0" {
+			t.Errorf("%s: expected an HTTP/3.0 upstream, got %s", tCase.path, proto)
+		}
+		if fmt.Sprint(codes) != fmt.Sprint(tCase.expectedCodes) || link == "" {
+			t.Errorf("%s: expected informational responses %v with a Link, got %v %q", tCase.path, tCase.expectedCodes, codes, link)
+		}
+		if resp.StatusCode != tCase.expectedStatus || string(body) != tCase.expectedBody {
+			t.Errorf("%s: expected %d %q, got %d %q", tCase.path, tCase.expectedStatus, tCase.expectedBody, resp.StatusCode, body)
+		}
+	}
+}
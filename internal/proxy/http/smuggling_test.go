@@ -0,0 +1,41 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/routing"
+	"quic-proxy/internal/testutil"
+)
+
+func TestHandleRequestAndRedirect_Smuggling(t *testing.T) {
+	rec := &testutil.Recorder{}
+	backend := httptest.NewServer(rec)
+	defer backend.Close()
+	// the requests to SmugglingHost reach the backend as their parent proxy
+	router, err := routing.New(config.RoutingConfig{Rules: []config.RouteRuleConfig{
+		{Name: "backend", Hosts: []string{testutil.SmugglingHost}, Action: "http", Proxy: backend.URL},
+	}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defaultRouter := routing.Default
+	routing.Default = router
+	defer func() {
+		routing.Default = defaultRouter
+		router.Close()
+	}()
+	proxy := httptest.NewServer(http.HandlerFunc(HandleRequestAndRedirect))
+	defer proxy.Close()
+	addr := proxy.Listener.Addr().String()
+
+	// the proxy only listens over HTTP/1.x
+	t.Run("absolute form", func(t *testing.T) {
+		testutil.RunSmugglingCases(t, testutil.ProxyForm(testutil.SmugglingCorpus, "http"), addr, "", rec)
+	})
+	t.Run("origin form", func(t *testing.T) {
+		testutil.RunSmugglingCorpus(t, addr, "", rec)
+	})
+}
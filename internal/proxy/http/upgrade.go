@@ -0,0 +1,23 @@
+package http
+
+import (
+	"net/http"
+
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+	"quic-proxy/internal/routing"
+)
+
+// upstream 所有上游请求共用的 RoundTripper，与其他代理模式共享连接池：
+// 已知 h3 备用服务的 origin 走 HTTP/3（首次连接与 TCP 竞速），否则走 TCP
+var upstream = happyeyeballs.DefaultRoundTripper
+
+// roundTrip 将请求发往上游，QUIC 不可用时自动降级到 TCP。
+// 路由规则指定上级代理时，请求经该代理发出
+func roundTrip(proxyReq *http.Request, rule *routing.Rule) (*http.Response, error) {
+	if rule != nil {
+		if rt := rule.RoundTripper(); rt != nil {
+			return rt.RoundTrip(proxyReq)
+		}
+	}
+	return upstream.RoundTrip(proxyReq)
+}
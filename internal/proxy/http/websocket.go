@@ -0,0 +1,120 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"quic-proxy/internal/forwarding"
+	"quic-proxy/internal/routing"
+	"quic-proxy/internal/utils"
+	"quic-proxy/internal/websocket"
+)
+
+// handleWebSocket 转发 WebSocket 请求，客户端一侧可以是 HTTP/1.1 Upgrade 或 HTTP/3 扩展 CONNECT。
+// 已知 h3 备用服务的 origin 通过 RFC 9220 扩展 CONNECT 建立上游，失败时回退到 RFC 6455 Upgrade。
+// 路由规则指定上级代理时，经该代理以 RFC 6455 Upgrade 建立上游
+func handleWebSocket(w http.ResponseWriter, req *http.Request, targetURL *url.URL, rule *routing.Rule) {
+	// 经过代理的 ws/wss 地址按 http/https 处理
+	target := *targetURL
+	switch target.Scheme {
+	case "ws":
+		target.Scheme = "http"
+	case "wss":
+		target.Scheme = "https"
+	}
+	origin := utils.OriginFromURL(&target)
+
+	// 每个 WebSocket 独占一条 QUIC 连接，WebSocket 结束时关闭
+	var qconn quic.EarlyConnection
+	defer func() {
+		if qconn != nil {
+			qconn.CloseWithError(0, "")
+		}
+	}()
+	err := websocket.Proxy(w, req, forwardWebSocket(req, func(ctx context.Context, header http.Header) (*websocket.Conn, *http.Response, error) {
+		if rule != nil {
+			return dialWebSocketH1(ctx, origin, &target, header, rule.DialContext)
+		}
+		if alts := upstream.Cache.Lookup(origin, "h3"); len(alts) > 0 {
+			var conn *websocket.Conn
+			var resp *http.Response
+			var err error
+			qconn, err = dialQUIC(ctx, alts[0])
+			if err == nil {
+				u := target
+				u.Host = alts[0].Addr()
+				conn, resp, err = websocket.DialH3(ctx, (&http3.Transport{}).NewClientConn(qconn), &u, target.Host, header)
+			}
+			if err == nil || resp != nil {
+				upstream.Cache.MarkWorking(origin, alts[0])
+				return conn, resp, err
+			}
+			log.Printf("[PROXY] WebSocket over HTTP/3 to %s failed, fall back to TCP: %v", origin, err)
+			upstream.Cache.MarkBroken(origin, alts[0])
+		}
+		return dialWebSocketH1(ctx, origin, &target, header, nil)
+	}))
+	if err != nil {
+		log.Printf("[PROXY] WebSocket to %s closed: %v", &target, err)
+	}
+}
+
+// forwardWebSocket 在握手请求与响应上追加本代理的 Via 和 Forwarded 等头部
+func forwardWebSocket(req *http.Request, dial websocket.DialFunc) websocket.DialFunc {
+	return func(ctx context.Context, header http.Header) (*websocket.Conn, *http.Response, error) {
+		forwarding.Default.Request(header, req)
+		conn, resp, err := dial(ctx, header)
+		if resp != nil {
+			forwarding.Default.Response(resp)
+		}
+		return conn, resp, err
+	}
+}
+
+// dialQUIC 连接 h3 备用服务，TLS 配置与上游 RoundTripper 一致
+func dialQUIC(ctx context.Context, alt utils.Alternative) (quic.EarlyConnection, error) {
+	tlsConf := upstream.TLSClientConfig.Clone()
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName = alt.Host
+	}
+	tlsConf.NextProtos = []string{http3.NextProtoH3}
+	return upstream.Dialer.DialQUIC(ctx, alt.Addr(), tlsConf, upstream.QUICConfig)
+}
+
+// dialWebSocketH1 通过 RFC 6455 Upgrade 建立上游 WebSocket，dial 为空时直连 origin
+func dialWebSocketH1(ctx context.Context, origin utils.Origin, target *url.URL, header http.Header,
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)) (*websocket.Conn, *http.Response, error) {
+	addr := net.JoinHostPort(origin.Host, origin.Port)
+	var conn net.Conn
+	var err error
+	tlsConf := upstream.TLSClientConfig.Clone()
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName = origin.Host
+	}
+	tlsConf.NextProtos = []string{"http/1.1"}
+	switch {
+	case dial != nil:
+		conn, err = dial(ctx, "tcp", addr)
+		if err == nil && origin.Scheme == "https" {
+			tlsConn := tls.Client(conn, tlsConf)
+			if err = tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+			}
+			conn = tlsConn
+		}
+	case origin.Scheme == "https":
+		conn, err = upstream.Dialer.DialTLS(ctx, addr, tlsConf)
+	default:
+		conn, err = upstream.Dialer.DialTCP(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return websocket.DialH1(ctx, conn, target, target.Host, header)
+}
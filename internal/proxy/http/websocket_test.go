@@ -0,0 +1,61 @@
+package http
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"quic-proxy/internal/websocket"
+)
+
+func TestHandleRequestAndRedirect_WebSocket(t *testing.T) {
+	client, target := startProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			f, err := conn.ReadFrame()
+			if err != nil {
+				return
+			}
+			if f.Opcode == websocket.OpText {
+				f.Payload = append(f.Payload, " "+r.Proto+" "+r.Method...)
+			}
+			conn.WriteFrame(f)
+			if f.Opcode == websocket.OpClose {
+				return
+			}
+		}
+	}))
+	proxyURL, _ := client.Transport.(*http.Transport).Proxy(nil)
+	targetURL, _ := url.Parse(target + "/chat")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	// a classic RFC 6455 upgrade becomes an extended CONNECT to the h3 upstream
+	ws, _, err := websocket.DialH1(ctx, conn, targetURL, targetURL.Host, nil)
+	if err != nil {
+		t.Fatalf("upgrade through proxy failed: %v", err)
+	}
+	defer ws.Close()
+
+	ws.WriteFrame(websocket.Frame{Fin: true, Opcode: websocket.OpText, Payload: []byte("hello")})
+	f, err := ws.ReadFrame()
+	if expected := "hello websocket CONNECT"; err != nil || string(f.Payload) != expected {
+		t.Errorf("expected %q, got %q, %v", expected, f.Payload, err)
+	}
+	ws.WriteFrame(websocket.CloseFrame(websocket.CloseNormal, ""))
+	f, err = ws.ReadFrame()
+	if code, _, _ := websocket.ParseClose(f.Payload); err != nil || code != websocket.CloseNormal {
+		t.Errorf("expected the Close frame to be echoed, got %d, %v", code, err)
+	}
+}
@@ -0,0 +1,225 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"quic-proxy/internal/config"
+	h2h3convert "quic-proxy/internal/h2h3-convert"
+)
+
+// Agent exposes local services on the relay. It keeps a connection to the
+// relay up and serves the requests the relay sends over it.
+type Agent struct {
+	cfg       *config.RelayAgentConfig
+	tlsConf   *tls.Config
+	quicConf  *quic.Config
+	services  map[string]*url.URL // by hostname
+	hostnames []string
+	transport http.RoundTripper
+}
+
+// NewAgent Create the agent of cfg, the URLs of its services are checked right away
+func NewAgent(cfg *config.RelayAgentConfig) (*Agent, error) {
+	if len(cfg.Services) == 0 {
+		return nil, errors.New("no service to expose")
+	}
+	a := &Agent{
+		cfg: cfg,
+		tlsConf: &tls.Config{
+			ServerName:         cfg.ServerName,
+			InsecureSkipVerify: cfg.Insecure,
+			NextProtos:         []string{NextProto},
+		},
+		quicConf: quicConfig(cfg.KeepAlive),
+		services: make(map[string]*url.URL),
+		transport: &http.Transport{
+			MaxIdleConnsPerHost: 16,
+			// the body of a request expecting 100 Continue waits for the service
+			ExpectContinueTimeout: h2h3convert.ExpectContinueTimeout,
+		},
+	}
+	for host, rawURL := range cfg.Services {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: invalid url %q: %w", host, rawURL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("service %s: unsupported scheme %q", host, u.Scheme)
+		}
+		host = normalizeHost(host)
+		a.services[host] = u
+		a.hostnames = append(a.hostnames, host)
+	}
+	sort.Strings(a.hostnames)
+	return a, nil
+}
+
+// Run Keep a connection to the relay up until ctx is done. A lost connection
+// is dialed again with exponential backoff. Run fails if the relay refuses
+// the token or the hostnames.
+func (a *Agent) Run(ctx context.Context) error {
+	backoff := minBackoff
+	for {
+		qconn, err := a.connect(ctx)
+		if err != nil {
+			if errors.Is(err, errRejected) {
+				return err
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("[Relay] Connecting to %s failed, retrying in %v: %v", a.cfg.RelayAddr, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil
+			}
+			backoff = min(2*backoff, maxBackoff)
+			continue
+		}
+		backoff = minBackoff
+		log.Printf("[Relay] Serving %v on %s", a.hostnames, qconn.RemoteAddr())
+		go a.acceptStreams(qconn)
+		select {
+		case <-qconn.Context().Done():
+			log.Printf("[Relay] Connection to %s lost: %v", a.cfg.RelayAddr, context.Cause(qconn.Context()))
+		case <-ctx.Done():
+			qconn.CloseWithError(0, "")
+			return nil
+		}
+	}
+}
+
+// connect Dial the relay and register the hostnames of the services
+func (a *Agent) connect(ctx context.Context) (quic.Connection, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, registerTimeout)
+	defer cancel()
+	qconn, err := quic.DialAddr(dialCtx, a.cfg.RelayAddr, a.tlsConf, a.quicConf)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.register(dialCtx, qconn); err != nil {
+		qconn.CloseWithError(0, "")
+		return nil, err
+	}
+	return qconn, nil
+}
+
+// register Send the registration on the first stream and read the answer.
+// The stream stays open for the life of the connection.
+func (a *Agent) register(ctx context.Context, qconn quic.Connection) error {
+	str, err := qconn.OpenStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(str).Encode(registration{Token: a.cfg.Token, Hostnames: a.hostnames}); err != nil {
+		return err
+	}
+	str.SetReadDeadline(time.Now().Add(registerTimeout))
+	defer str.SetReadDeadline(time.Time{})
+	var ans answer
+	if err := json.NewDecoder(io.LimitReader(str, maxRegistration)).Decode(&ans); err != nil {
+		var appErr *quic.ApplicationError
+		if errors.As(err, &appErr) && appErr.Remote && appErr.ErrorCode == errorCodeRejected {
+			return fmt.Errorf("%w: %s", errRejected, appErr.ErrorMessage)
+		}
+		return err
+	}
+	if ans.Error != "" {
+		return fmt.Errorf("%w: %s", errRejected, ans.Error)
+	}
+	return nil
+}
+
+// acceptStreams Serve the requests of the relay until the connection is lost
+func (a *Agent) acceptStreams(qconn quic.Connection) {
+	for {
+		str, err := qconn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go a.serveStream(str)
+	}
+}
+
+// serveStream Send the request on str to its service and write the response
+// back, a 502 if the service can't be reached
+func (a *Agent) serveStream(str quic.Stream) {
+	defer str.Close()
+	req, err := http.ReadRequest(bufio.NewReader(str))
+	if err != nil {
+		str.CancelRead(0)
+		str.CancelWrite(0)
+		return
+	}
+	host := normalizeHost(req.Host)
+	service := a.services[host]
+	if service == nil {
+		writeError(str, http.StatusNotFound, fmt.Sprintf("no service for %s", host))
+		return
+	}
+	// the request is canceled once the relay gives up on the response, the
+	// 1xx responses of the service go to the relay before it
+	out := req.WithContext(httptrace.WithClientTrace(str.Context(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			return writeInformational(str, code, http.Header(header))
+		},
+	}))
+	out.RequestURI = ""
+	out.URL.Scheme = service.Scheme
+	out.URL.Host = service.Host
+	out.URL.Path = strings.TrimSuffix(service.Path, "/") + req.URL.Path
+	out.URL.RawPath = ""
+	resp, err := a.transport.RoundTrip(out)
+	if err != nil {
+		log.Printf("[Relay] %s %s to %s failed: %v", req.Method, req.URL.Path, service, err)
+		writeError(str, http.StatusBadGateway, "service unreachable")
+		return
+	}
+	defer resp.Body.Close()
+	// keep the trailers of a response of unknown length
+	if resp.ContentLength < 0 {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	if err := resp.Write(str); err != nil && !errors.Is(err, net.ErrClosed) {
+		str.CancelWrite(0)
+	}
+}
+
+// writeInformational Send a 1xx response ahead of the response of a request
+func writeInformational(str quic.Stream, code int, header http.Header) error {
+	bw := bufio.NewWriter(str)
+	fmt.Fprintf(bw, "HTTP/1.1 %03d %s\r\n", code, http.StatusText(code))
+	header.Write(bw)
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+// writeError Answer a request with status and a text message
+func writeError(str quic.Stream, status int, msg string) {
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(msg + "\n")),
+		ContentLength: int64(len(msg) + 1),
+	}
+	resp.Write(str)
+}
@@ -0,0 +1,112 @@
+// Package relay exposes HTTP services behind NAT on a public relay, like
+// ngrok. An agent next to the services dials out to the relay over QUIC and
+// registers the hostnames it serves, the relay then routes the requests its
+// public HTTP/1.1, h2 and h3 listeners receive for those hostnames back over
+// the connection of the agent.
+//
+// The agent opens the first stream of the connection to register, it sends a
+// JSON registration, the token and the hostnames, and the relay answers with
+// a JSON answer, an error if it refused the registration. The hostnames stay
+// registered as long as the connection lives. Each request is then a stream
+// the relay opens, carrying the request and its response in HTTP/1.1 wire
+// format, the 1xx responses of the service included. The agent ends the
+// stream after the response.
+package relay
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/qlog"
+)
+
+// NextProto is the ALPN of the connections between agents and the relay
+const NextProto = "quic-proxy-relay"
+
+const (
+	// registerTimeout bounds the registration of an agent once connected
+	registerTimeout = 10 * time.Second
+	// defaultKeepAlive is the keep-alive period of agents when none is configured
+	defaultKeepAlive = 10 * time.Second
+	// maxRegistration bounds the size of a registration
+	maxRegistration = 64 << 10
+	// max1xxResponses bounds the informational responses before a response
+	max1xxResponses = 5
+
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// errorCodeRejected closes the connection of an agent whose registration was refused
+const errorCodeRejected quic.ApplicationErrorCode = 0x1
+
+// errRejected is the error of an agent the relay refused, retrying won't help
+var errRejected = errors.New("relay refused registration")
+
+// registration is the first message of an agent
+type registration struct {
+	Token     string   `json:"token"`
+	Hostnames []string `json:"hostnames"`
+}
+
+// answer is the reply of the relay to a registration
+type answer struct {
+	Error string `json:"error,omitempty"`
+}
+
+// normalizeHost Return the hostname of a Host header or a registration,
+// lower case and without port or trailing dot
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// matchHostname Report whether pattern allows host. "*" allows any host and
+// "*.example.com" the subdomains of example.com, at any depth.
+func matchHostname(pattern, host string) bool {
+	pattern = normalizeHost(pattern)
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	default:
+		return pattern == host
+	}
+}
+
+// lookupToken Return the hostname patterns of token, comparing it with every
+// configured token in constant time
+func lookupToken(tokens map[string][]string, token string) ([]string, bool) {
+	var (
+		patterns []string
+		found    bool
+	)
+	for t, p := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			patterns, found = p, true
+		}
+	}
+	return patterns, found
+}
+
+// quicConfig Return the QUIC config of the connections of agents, keep-alives
+// every keepAlive seconds. Only the relay opens streams after registration.
+func quicConfig(keepAlive int) *quic.Config {
+	period := time.Duration(keepAlive) * time.Second
+	if period <= 0 {
+		period = defaultKeepAlive
+	}
+	return &quic.Config{
+		KeepAlivePeriod:    period,
+		MaxIdleTimeout:     3 * period,
+		MaxIncomingStreams: 1 << 12,
+		Tracer:             qlog.DefaultConnectionTracer,
+	}
+}
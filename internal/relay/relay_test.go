@@ -0,0 +1,334 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"quic-proxy/internal/config"
+	h1h3server "quic-proxy/internal/h1h3-server"
+	"quic-proxy/internal/testutil"
+)
+
+// startRelay Start a relay accepting agents on a random port, it returns the
+// relay and the address of its agent listener
+func startRelay(t *testing.T, tokens map[string][]string) (*Server, string) {
+	t.Helper()
+	certPath, keyPath := testutil.GenerateCert(t)
+	s, err := NewServer(&config.RelayServerConfig{CertPath: certPath, KeyPath: keyPath, Tokens: tokens})
+	if err != nil {
+		t.Fatalf("failed to create relay: %v", err)
+	}
+	conn := testutil.ListenUDP(t)
+	go s.ServeAgents(conn)
+	t.Cleanup(func() {
+		s.Close()
+		conn.Close()
+	})
+	return s, conn.LocalAddr().String()
+}
+
+// startAgent Run an agent of services until the test ends, its error is sent on the channel
+func startAgent(t *testing.T, relayAddr, token string, services map[string]string) (context.CancelFunc, <-chan error) {
+	t.Helper()
+	a, err := NewAgent(&config.RelayAgentConfig{RelayAddr: relayAddr, Insecure: true, Token: token, Services: services})
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- a.Run(ctx) }()
+	t.Cleanup(cancel)
+	return cancel, errCh
+}
+
+// waitRegistered Wait for the relay to route host to an agent
+func waitRegistered(t *testing.T, s *Server, host string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.agentFor(host) == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was not registered", host)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startService Serve an HTTP service answering with its name, the host and the request body
+func startService(t *testing.T, name string) string {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s %s", name, r.Method, r.Host, body)
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+// post Send a POST for host to a public listener of the relay
+func post(t *testing.T, client *http.Client, addr, host, body string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, addr+"/echo", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Host = host
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request for %s failed: %v", host, err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(b)
+}
+
+func TestRelay(t *testing.T) {
+	s, relayAddr := startRelay(t, map[string][]string{"secret": {"*.example.com"}})
+	startAgent(t, relayAddr, "secret", map[string]string{
+		"app.example.com": startService(t, "app"),
+		"api.example.com": startService(t, "api"),
+	})
+	waitRegistered(t, s, "app.example.com")
+
+	h1 := httptest.NewServer(s.Handler())
+	defer h1.Close()
+	h2 := httptest.NewUnstartedServer(s.Handler())
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	h3Addr := testutil.ServeH3(t, h1h3server.NewH3Server("", s.Handler(), nil))
+
+	tTable := []struct {
+		client        *http.Client
+		addr          string
+		expectedProto int
+	}{
+		{client: h1.Client(), addr: h1.URL, expectedProto: 1},
+		{client: h2.Client(), addr: h2.URL, expectedProto: 2},
+		{client: testutil.H3Client(t), addr: "https://" + h3Addr, expectedProto: 3},
+	}
+
+	for _, tCase := range tTable {
+		for _, name := range []string{"app", "api"} {
+			host := name + ".example.com"
+			resp, body := post(t, tCase.client, tCase.addr, host, "ping")
+			expected := fmt.Sprintf("%s POST %s ping", name, host)
+			if resp.ProtoMajor != tCase.expectedProto || body != expected {
+				t.Errorf("expected HTTP/%d response %q, got %s %q", tCase.expectedProto, expected, resp.Proto, body)
+			}
+		}
+	}
+}
+
+func TestRelay_Rejected(t *testing.T) {
+	s, relayAddr := startRelay(t, map[string][]string{
+		"secret": {"app.example.com"},
+		"other":  {"*"},
+	})
+	startAgent(t, relayAddr, "other", map[string]string{"taken.example.com": startService(t, "taken")})
+	waitRegistered(t, s, "taken.example.com")
+
+	tTable := []struct {
+		token    string
+		host     string
+		expected string
+	}{
+		{token: "wrong", host: "app.example.com", expected: "invalid token"},
+		{token: "secret", host: "api.example.com", expected: "may not register"},
+		{token: "secret", host: "taken.example.com", expected: "may not register"},
+		{token: "other", host: "app.example.com", expected: ""},
+	}
+
+	for _, tCase := range tTable {
+		_, errCh := startAgent(t, relayAddr, tCase.token, map[string]string{tCase.host: "http://127.0.0.1:1"})
+		if tCase.expected == "" {
+			waitRegistered(t, s, tCase.host)
+			continue
+		}
+		select {
+		case err := <-errCh:
+			if err == nil || !strings.Contains(err.Error(), tCase.expected) {
+				t.Errorf("expected agent with token %q for %s to be refused with %q, got %v", tCase.token, tCase.host, tCase.expected, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("agent with token %q for %s was not refused", tCase.token, tCase.host)
+		}
+	}
+}
+
+func TestRelay_Conflict(t *testing.T) {
+	s, relayAddr := startRelay(t, map[string][]string{"one": {"*"}, "two": {"*"}})
+	startAgent(t, relayAddr, "one", map[string]string{"app.example.com": startService(t, "one")})
+	waitRegistered(t, s, "app.example.com")
+
+	_, errCh := startAgent(t, relayAddr, "two", map[string]string{"app.example.com": startService(t, "two")})
+	select {
+	case err := <-errCh:
+		if err == nil || !strings.Contains(err.Error(), "served by another agent") {
+			t.Errorf("expected agent with another token to be refused, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("agent with another token was not refused")
+	}
+}
+
+func TestRelay_AgentGone(t *testing.T) {
+	s, relayAddr := startRelay(t, map[string][]string{"secret": {"*"}})
+	stop, errCh := startAgent(t, relayAddr, "secret", map[string]string{"app.example.com": startService(t, "app")})
+	waitRegistered(t, s, "app.example.com")
+	h1 := httptest.NewServer(s.Handler())
+	defer h1.Close()
+
+	if resp, body := post(t, h1.Client(), h1.URL, "app.example.com", "ping"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 while the agent is connected, got %d %q", resp.StatusCode, body)
+	}
+	stop()
+	<-errCh
+
+	tTable := []string{"app.example.com", "unknown.example.com"}
+	for _, host := range tTable {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			resp, _ := post(t, h1.Client(), h1.URL, host, "ping")
+			if resp.StatusCode == http.StatusBadGateway {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("expected 502 for %s without agent, got %d", host, resp.StatusCode)
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestRelay_ServiceDown(t *testing.T) {
+	s, relayAddr := startRelay(t, map[string][]string{"secret": {"*"}})
+	startAgent(t, relayAddr, "secret", map[string]string{"app.example.com": "http://127.0.0.1:1"})
+	waitRegistered(t, s, "app.example.com")
+	h1 := httptest.NewServer(s.Handler())
+	defer h1.Close()
+
+	if resp, _ := post(t, h1.Client(), h1.URL, "app.example.com", "ping"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected 502 when the service is down, got %d", resp.StatusCode)
+	}
+}
+
+// readTracker records whether a request body was read
+type readTracker struct {
+	io.Reader
+	read atomic.Bool
+}
+
+func (r *readTracker) Read(p []byte) (int, error) {
+	r.read.Store(true)
+	return r.Reader.Read(p)
+}
+
+func TestRelay_Informational(t *testing.T) {
+	s, relayAddr := startRelay(t, map[string][]string{"secret": {"*"}})
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		if r.URL.Path == "/refuse" {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		// reading the body sends 100 Continue
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer service.Close()
+	startAgent(t, relayAddr, "secret", map[string]string{"app.example.com": service.URL})
+	waitRegistered(t, s, "app.example.com")
+	h1 := httptest.NewServer(s.Handler())
+	defer h1.Close()
+	// a client that would wait longer than the test for 100 Continue
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: time.Minute}}
+	defer client.CloseIdleConnections()
+
+	tTable := []struct {
+		path           string
+		expectedCodes  []int
+		expectedStatus int
+		expectedRead   bool
+	}{
+		{path: "/accept", expectedCodes: []int{http.StatusEarlyHints, http.StatusContinue}, expectedStatus: http.StatusOK, expectedRead: true},
+		{path: "/refuse", expectedCodes: []int{http.StatusEarlyHints}, expectedStatus: http.StatusRequestEntityTooLarge, expectedRead: false},
+	}
+
+	for _, tCase := range tTable {
+		var codes []int
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				codes = append(codes, code)
+				return nil
+			},
+		}
+		body := &readTracker{Reader: strings.NewReader("ping")}
+		req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodPost, h1.URL+tCase.path, body)
+		req.ContentLength = 4
+		req.Host = "app.example.com"
+		req.Header.Set("Expect", "100-continue")
+		ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			cancel()
+			t.Fatalf("%s: request through relay failed: %v", tCase.path, err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		cancel()
+		if fmt.Sprint(codes) != fmt.Sprint(tCase.expectedCodes) {
+			t.Errorf("%s: expected informational responses %v, got %v", tCase.path, tCase.expectedCodes, codes)
+		}
+		if resp.StatusCode != tCase.expectedStatus || body.read.Load() != tCase.expectedRead {
+			t.Errorf("%s: expected %d with body sent %v, got %d with body sent %v", tCase.path, tCase.expectedStatus, tCase.expectedRead, resp.StatusCode, body.read.Load())
+		}
+	}
+}
+
+func TestRelay_Smuggling(t *testing.T) {
+	rec := &testutil.Recorder{}
+	service := httptest.NewServer(rec)
+	defer service.Close()
+	s, relayAddr := startRelay(t, map[string][]string{"secret": {testutil.SmugglingHost}})
+	startAgent(t, relayAddr, "secret", map[string]string{testutil.SmugglingHost: service.URL})
+	waitRegistered(t, s, testutil.SmugglingHost)
+
+	h1 := httptest.NewServer(s.Handler())
+	defer h1.Close()
+	h3Addr := testutil.ServeH3(t, h1h3server.NewH3Server("", s.Handler(), nil))
+	testutil.RunSmugglingCorpus(t, h1.Listener.Addr().String(), h3Addr, rec)
+}
+
+func TestMatchHostname(t *testing.T) {
+	tTable := []struct {
+		pattern  string
+		host     string
+		expected bool
+	}{
+		{pattern: "*", host: "app.example.com", expected: true},
+		{pattern: "app.example.com", host: "app.example.com", expected: true},
+		{pattern: "App.Example.com.", host: "app.example.com", expected: true},
+		{pattern: "app.example.com", host: "api.example.com", expected: false},
+		{pattern: "*.example.com", host: "app.example.com", expected: true},
+		{pattern: "*.example.com", host: "a.b.example.com", expected: true},
+		{pattern: "*.example.com", host: "example.com", expected: false},
+		{pattern: "*.example.com", host: "badexample.com", expected: false},
+	}
+
+	for _, tCase := range tTable {
+		if got := matchHostname(tCase.pattern, tCase.host); got != tCase.expected {
+			t.Errorf("matchHostname(%q, %q) = %v, expected %v", tCase.pattern, tCase.host, got, tCase.expected)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/textproto"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/qlog"
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/forwarding"
+	h1h3server "quic-proxy/internal/h1h3-server"
+	h2h3convert "quic-proxy/internal/h2h3-convert"
+	headerpolicy "quic-proxy/internal/header-policy"
+	"quic-proxy/internal/utils"
+)
+
+// Server is the relay. It accepts the connections of agents on one UDP
+// address and serves their hostnames on public HTTP/1.1, h2 and h3 listeners.
+// Requests for a hostname no agent is connected for get a 502.
+type Server struct {
+	cfg       *config.RelayServerConfig
+	tlsConf   *tls.Config
+	forwarder *forwarding.Forwarder
+	policy    *headerpolicy.Policy
+	handler   http.Handler
+	h3Server  *http3.Server
+	tcp       *http.Server
+
+	mu        sync.Mutex
+	agents    map[string]*agent // by hostname
+	transport *quic.Transport
+	ln        *quic.Listener
+}
+
+// agent is the connection of a registered agent
+type agent struct {
+	qconn quic.Connection
+	token string
+}
+
+// NewServer Create the relay of cfg, its certificate is generated if it
+// doesn't exist yet
+func NewServer(cfg *config.RelayServerConfig) (*Server, error) {
+	if err := utils.EnsureCertificate(cfg.CertPath, cfg.KeyPath); err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertPath, cfg.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	forwarder, err := forwarding.New(cfg.Forwarding)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := headerpolicy.New(cfg.HeaderPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		cfg: cfg,
+		tlsConf: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{NextProto},
+		},
+		forwarder: forwarder,
+		policy:    policy,
+		agents:    make(map[string]*agent),
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = pr.In.Host
+			pr.Out.Host = pr.In.Host
+			s.forwarder.Request(pr.Out.Header, pr.In)
+		},
+		// the agent doesn't ask for the body, the service does through it
+		Transport: h2h3convert.ContinueTransport{RoundTripper: s},
+		ModifyResponse: func(resp *http.Response) error {
+			s.forwarder.Response(resp)
+			return s.policy.Response(resp)
+		},
+		// stream the response instead of buffering it
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("[Relay] %s %s for %s failed: %v", r.Method, r.URL, r.Host, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	s.handler = policy.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.forwarder.CheckLoop(r); err != nil {
+			log.Printf("[Relay] %v", err)
+			http.Error(w, "Proxy loop detected", http.StatusLoopDetected)
+			return
+		}
+		// ReverseProxy relays the 1xx responses of the service
+		proxy.ServeHTTP(h2h3convert.InformationalWriter(w, r), r)
+	}))
+	s.h3Server = h1h3server.NewH3Server(cfg.Http3Addr, s.handler, nil)
+	policy.ConfigureServer(s.h3Server)
+	if cfg.TCPAddr != "" {
+		s.tcp = &http.Server{
+			Addr:    cfg.TCPAddr,
+			Handler: s.altSvcHandler(s.handler),
+		}
+	}
+	return s, nil
+}
+
+// altSvcHandler Advertise the h3 listener on responses of the TCP listener
+func (s *Server) altSvcHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.h3Server.SetQUICHeaders(w.Header()); err != nil {
+			log.Printf("[Relay] Failed to set Alt-Svc: %v", err)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Handler returns the handler routing public requests to the agents
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// ListenAndServe Start the agent listener and the public listeners
+func (s *Server) ListenAndServe() error {
+	errCh := make(chan error, 3)
+	go func() {
+		conn, err := net.ListenPacket("udp", s.cfg.AgentAddr)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+		errCh <- s.ServeAgents(conn)
+	}()
+	if s.tcp != nil {
+		go func() {
+			log.Printf("[Relay] Starting TCP listener on %s", s.cfg.TCPAddr)
+			errCh <- s.tcp.ListenAndServeTLS(s.cfg.CertPath, s.cfg.KeyPath)
+		}()
+	}
+	go func() {
+		log.Printf("[Relay] Starting HTTP/3 listener on %s", s.cfg.Http3Addr)
+		errCh <- s.h3Server.ListenAndServeTLS(s.cfg.CertPath, s.cfg.KeyPath)
+	}()
+	err := <-errCh
+	s.Close()
+	return err
+}
+
+// ServeAgents Accept the agents connecting on conn until the relay is closed
+func (s *Server) ServeAgents(conn net.PacketConn) error {
+	tr := &quic.Transport{Conn: conn}
+	// only the registration stream is opened by agents
+	ln, err := tr.Listen(s.tlsConf, &quic.Config{MaxIncomingStreams: 1, Tracer: qlog.DefaultConnectionTracer})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.transport, s.ln = tr, ln
+	s.mu.Unlock()
+	log.Printf("[Relay] Accepting agents on %s", conn.LocalAddr())
+	for {
+		qconn, err := ln.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serveAgent(qconn)
+	}
+}
+
+// Close Stop the listeners and disconnect the agents
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for host, a := range s.agents {
+		a.qconn.CloseWithError(0, "relay closed")
+		delete(s.agents, host)
+	}
+	var errs []error
+	if s.tcp != nil {
+		errs = append(errs, s.tcp.Close())
+	}
+	errs = append(errs, s.h3Server.Close())
+	if s.transport != nil {
+		s.ln.Close()
+		errs = append(errs, s.transport.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// serveAgent Register the hostnames of an agent, they are served until its
+// connection is lost
+func (s *Server) serveAgent(qconn quic.Connection) {
+	peer := qconn.RemoteAddr()
+	ctx, cancel := context.WithTimeout(qconn.Context(), registerTimeout)
+	defer cancel()
+	str, err := qconn.AcceptStream(ctx)
+	if err != nil {
+		qconn.CloseWithError(errorCodeRejected, "no registration")
+		return
+	}
+	str.SetReadDeadline(time.Now().Add(registerTimeout))
+	var reg registration
+	err = json.NewDecoder(io.LimitReader(str, maxRegistration)).Decode(&reg)
+	str.SetReadDeadline(time.Time{})
+	if err == nil {
+		err = s.register(qconn, reg)
+	}
+	var ans answer
+	if err != nil {
+		ans.Error = err.Error()
+	}
+	if werr := json.NewEncoder(str).Encode(ans); err != nil || werr != nil {
+		if err != nil {
+			log.Printf("[Relay] Agent %s refused: %v", peer, err)
+			// give the agent the time to read the answer and close
+			select {
+			case <-qconn.Context().Done():
+			case <-ctx.Done():
+			}
+		}
+		s.unregister(qconn)
+		qconn.CloseWithError(errorCodeRejected, ans.Error)
+		return
+	}
+	log.Printf("[Relay] Agent %s serves %v", peer, reg.Hostnames)
+
+	<-qconn.Context().Done()
+	s.unregister(qconn)
+	log.Printf("[Relay] Agent %s disconnected: %v", peer, context.Cause(qconn.Context()))
+}
+
+// register Route the hostnames of reg to qconn if its token allows them. An
+// agent with the same token replaces the one serving a hostname, it is
+// reconnecting before the relay noticed its old connection died.
+func (s *Server) register(qconn quic.Connection, reg registration) error {
+	patterns, ok := lookupToken(s.cfg.Tokens, reg.Token)
+	if !ok {
+		return errors.New("invalid token")
+	}
+	if len(reg.Hostnames) == 0 {
+		return errors.New("no hostname to register")
+	}
+	hosts := make([]string, 0, len(reg.Hostnames))
+	for _, h := range reg.Hostnames {
+		host := normalizeHost(h)
+		allowed := false
+		for _, pattern := range patterns {
+			if matchHostname(pattern, host) {
+				allowed = true
+				break
+			}
+		}
+		if host == "" || !allowed {
+			return fmt.Errorf("token may not register %q", h)
+		}
+		hosts = append(hosts, host)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, host := range hosts {
+		if a := s.agents[host]; a != nil && a.token != reg.Token && a.qconn.Context().Err() == nil {
+			return fmt.Errorf("%s is served by another agent", host)
+		}
+	}
+	for _, host := range hosts {
+		s.agents[host] = &agent{qconn: qconn, token: reg.Token}
+	}
+	return nil
+}
+
+// unregister Remove the hostnames routed to qconn
+func (s *Server) unregister(qconn quic.Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for host, a := range s.agents {
+		if a.qconn == qconn {
+			delete(s.agents, host)
+		}
+	}
+}
+
+// agentFor Return the connection of the agent serving host, nil if none is connected
+func (s *Server) agentFor(host string) quic.Connection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.agents[normalizeHost(host)]
+	if a == nil || a.qconn.Context().Err() != nil {
+		return nil
+	}
+	return a.qconn
+}
+
+// RoundTrip implements http.RoundTripper, sending req on a new stream to the
+// agent serving its host
+func (s *Server) RoundTrip(req *http.Request) (*http.Response, error) {
+	qconn := s.agentFor(req.Host)
+	if qconn == nil {
+		return nil, fmt.Errorf("no agent serves %s", normalizeHost(req.Host))
+	}
+	str, err := qconn.OpenStreamSync(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(req.Context(), func() {
+		str.CancelRead(0)
+		str.CancelWrite(0)
+	})
+	// the body is written while the response is read, the agent may answer first
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		if err := req.Write(str); err != nil {
+			str.CancelWrite(0)
+			return
+		}
+		str.Close()
+	}()
+	resp, err := readResponse(bufio.NewReader(str), req)
+	if err != nil {
+		stop()
+		str.CancelRead(0)
+		str.CancelWrite(0)
+		return nil, fmt.Errorf("agent %s: %w", qconn.RemoteAddr(), err)
+	}
+	resp.Body = &streamBody{ReadCloser: resp.Body, str: str, stop: stop, written: written}
+	return resp, nil
+}
+
+// readResponse Read the response to req, passing the 1xx responses before it
+// to the client trace of req like http.Transport does
+func readResponse(br *bufio.Reader, req *http.Request) (*http.Response, error) {
+	trace := httptrace.ContextClientTrace(req.Context())
+	for num1xx := 0; ; num1xx++ {
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return nil, err
+		}
+		code := resp.StatusCode
+		if code < 100 || code > 199 || code == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+		if num1xx == max1xxResponses {
+			return nil, errors.New("too many 1xx informational responses")
+		}
+		if trace != nil && trace.Got1xxResponse != nil {
+			if err := trace.Got1xxResponse(code, textproto.MIMEHeader(resp.Header)); err != nil {
+				return nil, err
+			}
+		}
+		if code == http.StatusContinue && trace != nil && trace.Got100Continue != nil {
+			trace.Got100Continue()
+		}
+	}
+}
+
+// streamBody ends the stream of a request with its response body
+type streamBody struct {
+	io.ReadCloser
+	str     quic.Stream
+	stop    func() bool
+	written chan struct{}
+}
+
+func (b *streamBody) Close() error {
+	b.stop()
+	b.str.CancelRead(0)
+	select {
+	case <-b.written:
+	default:
+		// the agent answered without reading the whole request body
+		b.str.CancelWrite(0)
+	}
+	return b.ReadCloser.Close()
+}
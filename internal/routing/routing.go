@@ -0,0 +1,251 @@
+// Package routing picks, for each destination, how a proxy reaches it: direct,
+// through a parent HTTP or SOCKS5 proxy, through another quic-proxy over
+// HTTP/3 CONNECT, or not at all. Rules match on host globs, CIDRs, ports and
+// schemes and are tried in order, the first one that matches wins.
+package routing
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"quic-proxy/internal/config"
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+)
+
+// Action tells what to do with a request matching a rule
+type Action string
+
+const (
+	ActionDirect Action = "direct"
+	ActionHTTP   Action = "http"
+	ActionSOCKS5 Action = "socks5"
+	ActionMasque Action = "masque"
+	ActionReject Action = "reject"
+)
+
+// SchemeConnect is the scheme CONNECT tunnels are matched with, the protocol
+// inside the tunnel is unknown
+const SchemeConnect = "connect"
+
+// ResolveTTL is how long the addresses a name resolved to are reused, the
+// resolver of Go doesn't tell the TTL of the records
+const ResolveTTL = 30 * time.Second
+
+// maxLookups bounds the cache of the resolved names
+const maxLookups = 4096
+
+var ErrRejected = errors.New("rejected by routing rule")
+
+// Default has no rules, every request goes the default way of its proxy
+var Default = &Router{}
+
+// Router matches destinations against its rules
+type Router struct {
+	rules    []*Rule
+	resolver *net.Resolver
+	// cidrs is set if a rule matches addresses, names are only resolved then
+	cidrs bool
+
+	mu      sync.Mutex
+	lookups map[string]lookup
+}
+
+// lookup is a cached answer of the resolver
+type lookup struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// New Create a router from cfg. tlsConf verifies the origins reached through
+// a parent proxy, nil for the defaults.
+func New(cfg config.RoutingConfig, tlsConf *tls.Config) (*Router, error) {
+	r := &Router{resolver: net.DefaultResolver}
+	for i, ruleCfg := range cfg.Rules {
+		rule, err := newRule(ruleCfg, tlsConf)
+		if err != nil {
+			name := ruleCfg.Name
+			if name == "" {
+				name = "#" + strconv.Itoa(i+1)
+			}
+			return nil, fmt.Errorf("invalid routing rule %s: %w", name, err)
+		}
+		if rule.Name == "" {
+			rule.Name = "#" + strconv.Itoa(i+1)
+		}
+		r.rules = append(r.rules, rule)
+		r.cidrs = r.cidrs || len(rule.cidrs) > 0
+	}
+	return r, nil
+}
+
+// Resolve Look up host for the rules with CIDRs and pin its addresses in the
+// returned context, see happyeyeballs.WithAddrs. The request is matched and
+// then dialed with these addresses, a second lookup can't send it elsewhere.
+// The answers are cached for ResolveTTL. A name that doesn't exist resolves
+// to no address, it matches no CIDR and can't be dialed directly.
+func (r *Router) Resolve(ctx context.Context, host string) (context.Context, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if !r.cidrs || r.resolver == nil {
+		return ctx, nil
+	}
+	if _, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return ctx, nil
+	}
+	r.mu.Lock()
+	cached, ok := r.lookups[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return happyeyeballs.WithAddrs(ctx, host, cached.addrs), nil
+	}
+	ips, err := r.resolver.LookupNetIP(ctx, "ip", host)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return nil, fmt.Errorf("resolve %s: %w", host, err)
+	}
+	addrs := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.Unmap().WithZone(""))
+	}
+	r.mu.Lock()
+	if len(r.lookups) >= maxLookups {
+		clear(r.lookups)
+	}
+	if r.lookups == nil {
+		r.lookups = make(map[string]lookup)
+	}
+	r.lookups[host] = lookup{addrs: addrs, expires: time.Now().Add(ResolveTTL)}
+	r.mu.Unlock()
+	return happyeyeballs.WithAddrs(ctx, host, addrs), nil
+}
+
+// Match Return the first rule matching scheme://host:port, nil if none does.
+// A host name matches the rules with CIDRs by the addresses Resolve pinned
+// in ctx, an unresolved name matches none of them.
+func (r *Router) Match(ctx context.Context, scheme, host string, port int) *Rule {
+	d := destination{scheme: strings.ToLower(scheme), host: strings.ToLower(strings.TrimSuffix(host, ".")), port: port}
+	if addr, err := netip.ParseAddr(strings.Trim(d.host, "[]")); err == nil {
+		d.addrs = []netip.Addr{addr.Unmap().WithZone("")}
+	} else if addrs, ok := happyeyeballs.PinnedAddrs(ctx, d.host); ok {
+		d.addrs = addrs
+	}
+	for _, rule := range r.rules {
+		if rule.match(&d) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// MatchURL Match the destination of a request, the port defaults to the one of the scheme
+func (r *Router) MatchURL(ctx context.Context, u *url.URL) *Rule {
+	port, _ := strconv.Atoi(u.Port())
+	if port == 0 {
+		switch strings.ToLower(u.Scheme) {
+		case "http", "ws":
+			port = 80
+		case "https", "wss":
+			port = 443
+		}
+	}
+	return r.Match(ctx, u.Scheme, u.Hostname(), port)
+}
+
+// MatchConnect Match the host:port target of a CONNECT tunnel
+func (r *Router) MatchConnect(ctx context.Context, target string) *Rule {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	port, _ := strconv.Atoi(portStr)
+	return r.Match(ctx, SchemeConnect, host, port)
+}
+
+// Rules Return the rules in the order they are tried
+func (r *Router) Rules() []*Rule {
+	return r.rules
+}
+
+// Close Close the connections to the upstream proxies
+func (r *Router) Close() error {
+	var errs []error
+	for _, rule := range r.rules {
+		errs = append(errs, rule.close())
+	}
+	return errors.Join(errs...)
+}
+
+// destination is what rules are matched against
+type destination struct {
+	scheme string
+	host   string
+	port   int
+	addrs  []netip.Addr
+}
+
+// match reports whether d satisfies every condition of the rule
+func (rule *Rule) match(d *destination) bool {
+	if len(rule.schemes) > 0 && !slices.Contains(rule.schemes, d.scheme) {
+		return false
+	}
+	if len(rule.ports) > 0 && !slices.Contains(rule.ports, d.port) {
+		return false
+	}
+	if len(rule.hosts) > 0 && !slices.ContainsFunc(rule.hosts, func(pattern string) bool {
+		ok, _ := path.Match(pattern, d.host)
+		return ok
+	}) {
+		return false
+	}
+	if len(rule.cidrs) > 0 {
+		if !slices.ContainsFunc(rule.cidrs, func(prefix netip.Prefix) bool {
+			return slices.ContainsFunc(d.addrs, prefix.Contains)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// String Describe the rule the way test-route prints it
+func (rule *Rule) String() string {
+	var conds []string
+	if len(rule.hosts) > 0 {
+		conds = append(conds, "hosts="+strings.Join(rule.hosts, ","))
+	}
+	if len(rule.cidrs) > 0 {
+		cidrs := make([]string, len(rule.cidrs))
+		for i, prefix := range rule.cidrs {
+			cidrs[i] = prefix.String()
+		}
+		conds = append(conds, "cidrs="+strings.Join(cidrs, ","))
+	}
+	if len(rule.ports) > 0 {
+		ports := make([]string, len(rule.ports))
+		for i, port := range rule.ports {
+			ports[i] = strconv.Itoa(port)
+		}
+		conds = append(conds, "ports="+strings.Join(ports, ","))
+	}
+	if len(rule.schemes) > 0 {
+		conds = append(conds, "schemes="+strings.Join(rule.schemes, ","))
+	}
+	if len(conds) == 0 {
+		conds = append(conds, "any destination")
+	}
+	s := fmt.Sprintf("%s: %s -> %s", rule.Name, strings.Join(conds, " "), rule.Action)
+	if rule.Proxy != nil {
+		s += " " + rule.Proxy.Redacted()
+	}
+	return s
+}
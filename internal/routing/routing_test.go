@@ -0,0 +1,226 @@
+package routing
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"quic-proxy/internal/config"
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+	"quic-proxy/internal/testutil"
+	"quic-proxy/internal/tunnel"
+)
+
+func TestRouter_Match(t *testing.T) {
+	router, err := New(config.RoutingConfig{Rules: []config.RouteRuleConfig{
+		{Name: "ads", Hosts: []string{"*.ads.example", "ads.example"}, Action: "reject"},
+		{Name: "lan", CIDRs: []string{"10.0.0.0/8", "fd00::/8"}, Action: "direct"},
+		{Name: "tunnels", Schemes: []string{"connect"}, Ports: []int{22}, Action: "socks5", Proxy: "socks5://127.0.0.1:1080"},
+		{Name: "web", Schemes: []string{"HTTP"}, Ports: []int{80, 8080}, Action: "http", Proxy: "http://parent:3128"},
+	}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	router.resolver = nil
+
+	tTable := []struct {
+		name     string
+		target   string
+		expected string
+	}{
+		{name: "glob", target: "https://cdn.ADS.example/x", expected: "ads"},
+		{name: "glob base domain", target: "http://ads.example./", expected: "ads"},
+		{name: "glob needs a subdomain", target: "http://badads.example/", expected: "web"},
+		{name: "IPv4 in CIDR", target: "https://10.1.2.3/", expected: "lan"},
+		{name: "IPv6 in CIDR", target: "https://[fd00::1]:8443/", expected: "lan"},
+		{name: "unresolved name matches no CIDR", target: "https://lan.example/", expected: ""},
+		{name: "scheme and default port", target: "http://example.com/", expected: "web"},
+		{name: "scheme and explicit port", target: "http://example.com:8080/", expected: "web"},
+		{name: "port not listed", target: "http://example.com:8081/", expected: ""},
+		{name: "CONNECT", target: "example.com:22", expected: "tunnels"},
+		{name: "CONNECT other port", target: "example.com:443", expected: ""},
+	}
+	for _, tCase := range tTable {
+		var rule *Rule
+		if u, err := url.Parse(tCase.target); err == nil && u.Host != "" {
+			rule = router.MatchURL(context.Background(), u)
+		} else {
+			rule = router.MatchConnect(context.Background(), tCase.target)
+		}
+		name := ""
+		if rule != nil {
+			name = rule.Name
+		}
+		if name != tCase.expected {
+			t.Errorf("%s: expected rule %q, got %q", tCase.name, tCase.expected, name)
+		}
+	}
+}
+
+func TestRouter_Resolve(t *testing.T) {
+	router, err := New(config.RoutingConfig{Rules: []config.RouteRuleConfig{
+		{Name: "lan", CIDRs: []string{"10.0.0.0/8"}, Action: "reject"},
+		{Name: "loopback", CIDRs: []string{"127.0.0.0/8"}, Action: "direct"},
+	}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// a cached answer is reused, the rules and the dial see the same addresses
+	router.lookups = map[string]lookup{
+		"cached.example": {addrs: []netip.Addr{netip.MustParseAddr("10.1.2.3")}, expires: time.Now().Add(time.Minute)},
+	}
+
+	tTable := []struct {
+		name     string
+		host     string
+		expected string
+		pinned   string
+	}{
+		{name: "resolved name", host: "localhost", expected: "loopback", pinned: "127.0.0.1"},
+		{name: "cached name", host: "Cached.Example.", expected: "lan", pinned: "10.1.2.3"},
+		{name: "address", host: "10.0.0.1", expected: "lan"},
+	}
+	for _, tCase := range tTable {
+		ctx, err := router.Resolve(context.Background(), tCase.host)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tCase.name, err)
+		}
+		name := ""
+		if rule := router.Match(ctx, "https", tCase.host, 443); rule != nil {
+			name = rule.Name
+		}
+		if name != tCase.expected {
+			t.Errorf("%s: expected rule %q, got %q", tCase.name, tCase.expected, name)
+		}
+		addrs, ok := happyeyeballs.PinnedAddrs(ctx, tCase.host)
+		if tCase.pinned == "" && ok {
+			t.Errorf("%s: expected nothing pinned, got %v", tCase.name, addrs)
+		}
+		if tCase.pinned != "" && !slices.Contains(addrs, netip.MustParseAddr(tCase.pinned)) {
+			t.Errorf("%s: expected %s pinned, got %v", tCase.name, tCase.pinned, addrs)
+		}
+	}
+	if _, ok := router.lookups["localhost"]; !ok {
+		t.Errorf("expected the answer for localhost to be cached")
+	}
+}
+
+func TestNew(t *testing.T) {
+	tTable := []struct {
+		name string
+		rule config.RouteRuleConfig
+	}{
+		{name: "unknown action", rule: config.RouteRuleConfig{Action: "forward"}},
+		{name: "bad glob", rule: config.RouteRuleConfig{Hosts: []string{"[a-"}, Action: "direct"}},
+		{name: "bad CIDR", rule: config.RouteRuleConfig{CIDRs: []string{"10.0.0.0/40"}, Action: "direct"}},
+		{name: "bad port", rule: config.RouteRuleConfig{Ports: []int{70000}, Action: "direct"}},
+		{name: "proxy missing", rule: config.RouteRuleConfig{Action: "http"}},
+		{name: "proxy of another kind", rule: config.RouteRuleConfig{Action: "masque", Proxy: "socks5://127.0.0.1:1080"}},
+		{name: "proxy on direct", rule: config.RouteRuleConfig{Action: "direct", Proxy: "http://127.0.0.1:3128"}},
+	}
+	for _, tCase := range tTable {
+		if _, err := New(config.RoutingConfig{Rules: []config.RouteRuleConfig{tCase.rule}}, nil); err == nil {
+			t.Errorf("%s: expected an error", tCase.name)
+		}
+	}
+}
+
+func TestRule_DialContext(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+	connect := &tunnel.Handler{AllowedPorts: []int{echoPort}, Dial: tunnel.DialTCP(&happyeyeballs.Dialer{})}
+	parent := httptest.NewServer(connect)
+	defer parent.Close()
+	quicProxy := testutil.ServeH3(t, &http3.Server{Handler: connect})
+
+	tTable := []struct {
+		name string
+		rule config.RouteRuleConfig
+	}{
+		{name: "direct", rule: config.RouteRuleConfig{Action: "direct"}},
+		{name: "parent HTTP proxy", rule: config.RouteRuleConfig{Action: "http", Proxy: parent.URL}},
+		{name: "quic-proxy over HTTP/3", rule: config.RouteRuleConfig{Action: "masque", Proxy: "https://" + quicProxy, Insecure: true}},
+	}
+	for _, tCase := range tTable {
+		router, err := New(config.RoutingConfig{Rules: []config.RouteRuleConfig{tCase.rule}}, nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tCase.name, err)
+		}
+		conn, err := router.Rules()[0].DialContext(context.Background(), "tcp", echo.Addr().String())
+		if err != nil {
+			t.Errorf("%s: failed to dial: %v", tCase.name, err)
+			router.Close()
+			continue
+		}
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("%s: expected ping back, got %q, %v", tCase.name, buf, err)
+		}
+		conn.Close()
+		router.Close()
+	}
+}
+
+func TestRule_RoundTripper(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+	var proxied string
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a parent proxy gets the absolute-form target
+		proxied = r.RequestURI
+		resp, err := http.DefaultTransport.RoundTrip(r.Clone(r.Context()))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		io.Copy(w, resp.Body)
+	}))
+	defer parent.Close()
+
+	router, err := New(config.RoutingConfig{Rules: []config.RouteRuleConfig{{Action: "http", Proxy: parent.URL}}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer router.Close()
+	req, _ := http.NewRequest(http.MethodGet, origin.URL+"/path", nil)
+	resp, err := router.Rules()[0].RoundTripper().RoundTrip(req)
+	if err != nil {
+		t.Fatalf("request through parent failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "origin" || proxied != origin.URL+"/path" {
+		t.Errorf("expected origin through the parent for %s, got %q for %q", origin.URL+"/path", body, proxied)
+	}
+	if router.Rules()[0].Name != "#1" {
+		t.Errorf("expected the rule to be named after its position, got %q", router.Rules()[0].Name)
+	}
+}
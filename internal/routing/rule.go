@@ -0,0 +1,293 @@
+package routing
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"quic-proxy/internal/config"
+	h2h3convert "quic-proxy/internal/h2h3-convert"
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+	"quic-proxy/internal/tunnel"
+)
+
+// Rule is one routing rule and the way to reach what it matches
+type Rule struct {
+	Name   string
+	Action Action
+	// Proxy is the upstream proxy of the http, socks5 and masque actions
+	Proxy *url.URL
+
+	hosts   []string
+	cidrs   []netip.Prefix
+	ports   []int
+	schemes []string
+
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+	transport *http.Transport
+	h3        *tunnel.H3Dialer
+}
+
+// newRule Validate cfg and prepare the dialer of its action
+func newRule(cfg config.RouteRuleConfig, tlsConf *tls.Config) (*Rule, error) {
+	rule := &Rule{Name: cfg.Name, Action: Action(strings.ToLower(cfg.Action))}
+	for _, host := range cfg.Hosts {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q", host)
+		}
+		rule.hosts = append(rule.hosts, host)
+	}
+	for _, s := range cfg.CIDRs {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", s, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		rule.cidrs = append(rule.cidrs, prefix.Masked())
+	}
+	for _, port := range cfg.Ports {
+		if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %d", port)
+		}
+		rule.ports = append(rule.ports, port)
+	}
+	for _, scheme := range cfg.Schemes {
+		rule.schemes = append(rule.schemes, strings.ToLower(scheme))
+	}
+
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", cfg.Proxy, err)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q: no host", cfg.Proxy)
+		}
+		rule.Proxy = u
+	}
+	if tlsConf == nil {
+		tlsConf = &tls.Config{}
+	}
+	dialer := &happyeyeballs.Dialer{}
+
+	switch rule.Action {
+	case ActionDirect:
+		rule.dial = dialer.DialTCP
+	case ActionReject:
+		rule.dial = func(context.Context, string, string) (net.Conn, error) {
+			return nil, fmt.Errorf("%w %s", ErrRejected, rule.Name)
+		}
+	case ActionHTTP:
+		if err := rule.requireProxy("http", "https"); err != nil {
+			return nil, err
+		}
+		rule.dial = rule.dialHTTPProxy(dialer, cfg.Insecure)
+		// requests are sent to the parent in absolute-form, https ones through a CONNECT
+		rule.transport = newTransport(tlsConf)
+		rule.transport.Proxy = http.ProxyURL(rule.Proxy)
+		rule.transport.DialContext = dialer.DialTCP
+		// the transport only dials TLS itself for an https parent
+		if rule.Proxy.Scheme == "https" {
+			rule.transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return rule.dialProxyTLS(ctx, dialer, cfg.Insecure)
+			}
+		}
+	case ActionSOCKS5:
+		if err := rule.requireProxy("socks5", "socks5h"); err != nil {
+			return nil, err
+		}
+		var auth *proxy.Auth
+		if rule.Proxy.User != nil {
+			password, _ := rule.Proxy.User.Password()
+			auth = &proxy.Auth{User: rule.Proxy.User.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", proxyAddr(rule.Proxy), auth, contextDialer(dialer.DialTCP))
+		if err != nil {
+			return nil, err
+		}
+		rule.dial = socks.(proxy.ContextDialer).DialContext
+		rule.transport = newTransport(tlsConf)
+		rule.transport.DialContext = rule.dial
+	case ActionMasque:
+		if err := rule.requireProxy("https"); err != nil {
+			return nil, err
+		}
+		h3, err := tunnel.NewH3Dialer(rule.Proxy.String(), cfg.Insecure)
+		if err != nil {
+			return nil, err
+		}
+		rule.h3 = h3
+		rule.dial = h3.DialContext
+		rule.transport = newTransport(tlsConf)
+		rule.transport.DialContext = rule.dial
+	default:
+		return nil, fmt.Errorf("unknown action %q", cfg.Action)
+	}
+	if rule.Proxy != nil && rule.transport == nil {
+		return nil, fmt.Errorf("action %s takes no proxy", rule.Action)
+	}
+	return rule, nil
+}
+
+// requireProxy Check that the rule has a proxy with one of schemes
+func (rule *Rule) requireProxy(schemes ...string) error {
+	if rule.Proxy == nil {
+		return fmt.Errorf("action %s needs a proxy", rule.Action)
+	}
+	for _, scheme := range schemes {
+		if rule.Proxy.Scheme == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("action %s needs a %s proxy, got %s", rule.Action, strings.Join(schemes, " or "), rule.Proxy.Scheme)
+}
+
+// newTransport Create the transport sending requests through the rule's proxy
+func newTransport(tlsConf *tls.Config) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig:   tlsConf.Clone(),
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   90 * time.Second,
+		// requests expecting 100 Continue hold their body until the origin asks for it
+		ExpectContinueTimeout: h2h3convert.ExpectContinueTimeout,
+	}
+}
+
+// DialContext Open a TCP connection to addr the way the rule says
+func (rule *Rule) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return rule.dial(ctx, network, addr)
+}
+
+// RoundTripper Return the transport sending requests through the rule's
+// proxy, nil for the direct and reject actions
+func (rule *Rule) RoundTripper() http.RoundTripper {
+	if rule.transport == nil {
+		return nil
+	}
+	return rule.transport
+}
+
+// close Close the idle connections to the proxy of the rule
+func (rule *Rule) close() error {
+	if rule.transport != nil {
+		rule.transport.CloseIdleConnections()
+	}
+	if rule.h3 != nil {
+		return rule.h3.Close()
+	}
+	return nil
+}
+
+// dialProxyTLS Open a TLS connection to an https parent proxy
+func (rule *Rule) dialProxyTLS(ctx context.Context, dialer *happyeyeballs.Dialer, insecure bool) (net.Conn, error) {
+	return dialer.DialTLS(ctx, proxyAddr(rule.Proxy), &tls.Config{
+		ServerName:         rule.Proxy.Hostname(),
+		InsecureSkipVerify: insecure,
+		NextProtos:         []string{"http/1.1"},
+	})
+}
+
+// dialHTTPProxy Return a dial function opening tunnels through the parent
+// HTTP proxy with CONNECT
+func (rule *Rule) dialHTTPProxy(dialer *happyeyeballs.Dialer, insecure bool) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if rule.Proxy.Scheme == "https" {
+			conn, err = rule.dialProxyTLS(ctx, dialer, insecure)
+		} else {
+			conn, err = dialer.DialTCP(ctx, "tcp", proxyAddr(rule.Proxy))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+			defer conn.SetDeadline(time.Time{})
+		}
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: http.Header{},
+		}
+		if user := rule.Proxy.User; user != nil {
+			password, _ := user.Password()
+			req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", rule.Proxy.Host, addr, resp.Status)
+		}
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+}
+
+// proxyAddr Return host:port of a proxy URL, the port defaults to the one of its scheme
+func proxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(u.Hostname(), "1080")
+	default:
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+}
+
+// bufferedConn reads the bytes the parent proxy sent after its response first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite Pass the half-close of a tunnel on to the parent proxy
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// contextDialer adapts a dial function to proxy.ContextDialer
+type contextDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
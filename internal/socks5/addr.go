@@ -0,0 +1,105 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// address types of RFC 1928 section 5
+const (
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// readAddr Read ATYP ADDR PORT and return it as host:port
+func readAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case atypDomain:
+		domain, err := readString(r)
+		if err != nil {
+			return "", err
+		}
+		if domain == "" {
+			return "", fmt.Errorf("empty domain name")
+		}
+		host = domain
+	default:
+		return "", fmt.Errorf("%w: %d", errAddressNotSupported, atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendAddr Append ATYP ADDR PORT for addr, a host:port
+func appendAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, atypIPv4), ip4...)
+		} else {
+			b = append(append(b, atypIPv6), ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain name too long: %q", host)
+		}
+		b = append(append(b, atypDomain, byte(len(host))), host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readString Read a length-prefixed string, as domain names and credentials are sent
+func readString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	s := make([]byte, n[0])
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// writeReply Write VER REP RSV ATYP BND.ADDR BND.PORT, bind may be nil when
+// there is no address to tell
+func writeReply(w io.Writer, rep byte, bind net.Addr) error {
+	addr := "0.0.0.0:0"
+	if bind != nil {
+		addr = bind.String()
+	}
+	b, err := appendAddr([]byte{version5, rep, 0x00}, addr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,422 @@
+// Package socks5 is a SOCKS5 server, RFC 1928, with the username/password
+// authentication of RFC 1929. The tunnels of CONNECT and the UDP flows of
+// UDP ASSOCIATE are opened by dial functions; NewServer carries them over a
+// single QUIC connection to a remote quic-proxy, TCP on request streams and
+// UDP in HTTP Datagrams.
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/masque"
+	"quic-proxy/internal/tunnel"
+)
+
+const (
+	version5        = 0x05
+	versionPassword = 0x01
+
+	methodNone         = 0x00
+	methodPassword     = 0x02
+	methodNoAcceptable = 0xff
+
+	cmdConnect      = 0x01
+	cmdBind         = 0x02
+	cmdUDPAssociate = 0x03
+
+	repSucceeded           = 0x00
+	repGeneralFailure      = 0x01
+	repHostUnreachable     = 0x04
+	repCommandNotSupported = 0x07
+	repAddressNotSupported = 0x08
+)
+
+// dialTimeout bounds the opening of a tunnel or a UDP flow
+const dialTimeout = 10 * time.Second
+
+// maxUDPPayload is the largest UDP payload that is relayed
+const maxUDPPayload = 1500
+
+var errAddressNotSupported = errors.New("address type not supported")
+
+// PacketTunnel carries the UDP payloads exchanged with one target
+type PacketTunnel interface {
+	Send(payload []byte) error
+	Receive(ctx context.Context) ([]byte, error)
+	Close()
+}
+
+// Server answers SOCKS5 clients
+type Server struct {
+	// Users maps user names to passwords, without users no authentication is asked
+	Users map[string]string
+	// DialTCP opens the tunnel of a CONNECT to target, a host:port
+	DialTCP func(ctx context.Context, target string) (tunnel.Conn, error)
+	// DialUDP opens the flow of a UDP ASSOCIATE to target, a host:port
+	DialUDP func(ctx context.Context, target string) (PacketTunnel, error)
+	// Name prefixes the log lines
+	Name string
+
+	cfg  *config.Socks5Config
+	peer *masque.Conn
+}
+
+// NewServer Create a SOCKS5 server from cfg, its tunnels and UDP flows share
+// one QUIC connection to the quic-proxy of cfg.Template
+func NewServer(cfg *config.Socks5Config) (*Server, error) {
+	template, err := masque.ParseTemplate(cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+	peer := masque.NewConn(template, cfg.Insecure)
+	return &Server{
+		Users:   cfg.Users,
+		DialTCP: peer.ConnectTCP,
+		DialUDP: func(ctx context.Context, target string) (PacketTunnel, error) {
+			return peer.ConnectUDP(ctx, target)
+		},
+		Name: "[SOCKS5]",
+		cfg:  cfg,
+		peer: peer,
+	}, nil
+}
+
+// ListenAndServe Listen on the address of the config and serve the clients
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s Listening on %s, tunnelling through %s", s.Name, ln.Addr(), s.cfg.Template)
+	return s.Serve(ln)
+}
+
+// Serve Serve the clients accepted on ln until accepting fails
+func (s *Server) Serve(ln net.Listener) error {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close Close the connection to the peer
+func (s *Server) Close() error {
+	if s.peer != nil {
+		return s.peer.Close()
+	}
+	return nil
+}
+
+// serveConn Negotiate the method, then run the command of the client
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	br := bufio.NewReader(conn)
+	if err := s.negotiate(br, conn); err != nil {
+		log.Printf("%s Handshake with %s failed: %v", s.Name, conn.RemoteAddr(), err)
+		return
+	}
+
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	var head [3]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return
+	}
+	if head[0] != version5 {
+		log.Printf("%s Invalid request version %d from %s", s.Name, head[0], conn.RemoteAddr())
+		return
+	}
+	target, err := readAddr(br)
+	if err != nil {
+		rep := byte(repGeneralFailure)
+		if errors.Is(err, errAddressNotSupported) {
+			rep = repAddressNotSupported
+		}
+		writeReply(conn, rep, nil)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch head[1] {
+	case cmdConnect:
+		s.connect(conn, br, target)
+	case cmdUDPAssociate:
+		s.associate(conn, br, target)
+	default:
+		writeReply(conn, repCommandNotSupported, nil)
+	}
+}
+
+// negotiate Pick the authentication method and run it
+func (s *Server) negotiate(br *bufio.Reader, conn net.Conn) error {
+	// VER NMETHODS METHODS
+	var head [2]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return err
+	}
+	if head[0] != version5 {
+		return fmt.Errorf("unsupported version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return err
+	}
+	want := byte(methodNone)
+	if len(s.Users) > 0 {
+		want = methodPassword
+	}
+	for _, m := range methods {
+		if m == want {
+			if _, err := conn.Write([]byte{version5, want}); err != nil {
+				return err
+			}
+			if want == methodPassword {
+				return s.authenticate(br, conn)
+			}
+			return nil
+		}
+	}
+	conn.Write([]byte{version5, methodNoAcceptable})
+	return errors.New("no acceptable authentication method")
+}
+
+// authenticate Check the user name and password of RFC 1929
+func (s *Server) authenticate(br *bufio.Reader, conn net.Conn) error {
+	// VER ULEN UNAME PLEN PASSWD
+	ver, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	if ver != versionPassword {
+		return fmt.Errorf("unsupported authentication version %d", ver)
+	}
+	user, err := readString(br)
+	if err != nil {
+		return err
+	}
+	password, err := readString(br)
+	if err != nil {
+		return err
+	}
+	expected, ok := s.Users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		conn.Write([]byte{versionPassword, 0x01})
+		return fmt.Errorf("authentication of user %q failed", user)
+	}
+	_, err = conn.Write([]byte{versionPassword, 0x00})
+	return err
+}
+
+// connect Open the tunnel to target and relay it until both sides closed
+func (s *Server) connect(conn net.Conn, br *bufio.Reader, target string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	up, err := s.DialTCP(ctx, target)
+	cancel()
+	if err != nil {
+		log.Printf("%s CONNECT %s from %s failed: %v", s.Name, target, conn.RemoteAddr(), err)
+		writeReply(conn, repHostUnreachable, nil)
+		return
+	}
+	if err := writeReply(conn, repSucceeded, nil); err != nil {
+		up.Close()
+		return
+	}
+	stats, err := tunnel.Relay(tunnel.NewNetConn(conn, br), up)
+	if err != nil {
+		log.Printf("%s Tunnel %s to %s failed after %v, %d bytes up, %d bytes down: %v",
+			s.Name, conn.RemoteAddr(), target, stats.Duration.Round(time.Millisecond), stats.Up, stats.Down, err)
+		return
+	}
+	log.Printf("%s Tunnel %s to %s closed after %v, %d bytes up, %d bytes down",
+		s.Name, conn.RemoteAddr(), target, stats.Duration.Round(time.Millisecond), stats.Up, stats.Down)
+}
+
+// association relays the UDP packets of one client, it lasts as long as the
+// TCP connection of its UDP ASSOCIATE
+type association struct {
+	server *Server
+	pc     net.PacketConn
+	// client is where the packets come from, set by the first one unless the
+	// request announced it
+	clientIP   net.IP
+	clientPort int
+	client     atomic.Pointer[net.UDPAddr]
+
+	mu    sync.Mutex
+	flows map[string]PacketTunnel
+
+	// failed keeps the targets that couldn't be reached, until when they aren't tried again
+	failed map[string]time.Time
+
+	ctx      context.Context
+	up, down atomic.Int64
+}
+
+// associate Bind a UDP port for the client and relay its packets until the
+// TCP connection closes. announced is the address the client said it would
+// send from, its zero parts are unknown.
+func (s *Server) associate(conn net.Conn, br *bufio.Reader, announced string) {
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		log.Printf("%s UDP ASSOCIATE from %s failed: %v", s.Name, conn.RemoteAddr(), err)
+		writeReply(conn, repGeneralFailure, nil)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &association{
+		server:   s,
+		pc:       pc,
+		clientIP: conn.RemoteAddr().(*net.TCPAddr).IP,
+		flows:    map[string]PacketTunnel{},
+		failed:   map[string]time.Time{},
+		ctx:      ctx,
+	}
+	if host, port, err := net.SplitHostPort(announced); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			a.clientIP = ip
+		}
+		a.clientPort, _ = strconv.Atoi(port)
+	}
+	if err := writeReply(conn, repSucceeded, pc.LocalAddr()); err != nil {
+		cancel()
+		pc.Close()
+		return
+	}
+
+	start := time.Now()
+	go a.serve()
+	// the association ends with the TCP connection, RFC 1928 section 7
+	io.Copy(io.Discard, br)
+	cancel()
+	pc.Close()
+	a.mu.Lock()
+	for _, flow := range a.flows {
+		flow.Close()
+	}
+	a.mu.Unlock()
+	log.Printf("%s UDP association of %s closed after %v, %d packets up, %d packets down",
+		s.Name, conn.RemoteAddr(), time.Since(start).Round(time.Millisecond), a.up.Load(), a.down.Load())
+}
+
+// serve Forward the packets of the client to their targets
+func (a *association) serve() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := a.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		from := addr.(*net.UDPAddr)
+		if !a.accepts(from) {
+			continue
+		}
+		// RSV RSV FRAG ATYP DST.ADDR DST.PORT DATA, fragments are dropped
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		target, err := readAddr(r)
+		if err != nil {
+			continue
+		}
+		payload := buf[n-r.Len() : n]
+		if len(payload) > maxUDPPayload {
+			continue
+		}
+		flow, err := a.flow(target)
+		if err != nil {
+			continue
+		}
+		if err := flow.Send(payload); err == nil {
+			a.up.Add(1)
+		}
+	}
+}
+
+// accepts reports whether a packet from addr belongs to the client, the
+// first one fixes the port if it wasn't announced
+func (a *association) accepts(addr *net.UDPAddr) bool {
+	if client := a.client.Load(); client != nil {
+		return client.IP.Equal(addr.IP) && client.Port == addr.Port
+	}
+	if !a.clientIP.Equal(addr.IP) || (a.clientPort != 0 && a.clientPort != addr.Port) {
+		return false
+	}
+	a.client.Store(addr)
+	return true
+}
+
+// flow Return the flow to target, opening it on first use. A target that
+// couldn't be reached isn't tried again for a second.
+func (a *association) flow(target string) (PacketTunnel, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if flow, ok := a.flows[target]; ok {
+		return flow, nil
+	}
+	if until, ok := a.failed[target]; ok && time.Now().Before(until) {
+		return nil, errors.New("target unreachable")
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, dialTimeout)
+	defer cancel()
+	flow, err := a.server.DialUDP(ctx, target)
+	if err != nil {
+		log.Printf("%s UDP flow to %s failed: %v", a.server.Name, target, err)
+		a.failed[target] = time.Now().Add(time.Second)
+		return nil, err
+	}
+	a.flows[target] = flow
+	go a.receive(target, flow)
+	return flow, nil
+}
+
+// receive Send the payloads of target back to the client, with the SOCKS
+// UDP header naming target
+func (a *association) receive(target string, flow PacketTunnel) {
+	header := []byte{0, 0, 0}
+	header, err := appendAddr(header, target)
+	if err != nil {
+		return
+	}
+	defer func() {
+		a.mu.Lock()
+		if a.flows[target] == flow {
+			delete(a.flows, target)
+		}
+		a.mu.Unlock()
+		flow.Close()
+	}()
+	for {
+		payload, err := flow.Receive(a.ctx)
+		if err != nil {
+			return
+		}
+		client := a.client.Load()
+		if client == nil {
+			continue
+		}
+		packet := append(header[:len(header):len(header)], payload...)
+		if _, err := a.pc.WriteTo(packet, client); err != nil {
+			return
+		}
+		a.down.Add(1)
+	}
+}
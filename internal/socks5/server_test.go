@@ -0,0 +1,184 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"quic-proxy/internal/config"
+	"quic-proxy/internal/masque"
+	"quic-proxy/internal/testutil"
+)
+
+// startPeer Start the remote quic-proxy, a MASQUE proxy allowing CONNECT to
+// tcpPort and CONNECT-UDP to udpPort on loopback, and a SOCKS5 server
+// tunnelling through it. Return the SOCKS5 address.
+func startPeer(t *testing.T, tcpPort, udpPort int, users map[string]string) string {
+	t.Helper()
+	certPath, keyPath := testutil.GenerateCert(t)
+	peer, err := masque.NewServer(&config.MasqueServerConfig{
+		AllowedConnectPorts: []int{tcpPort},
+		AllowedUDPPorts:     []int{udpPort},
+		AllowPrivateTargets: true,
+		CertPath:            certPath,
+		KeyPath:             keyPath,
+	})
+	if err != nil {
+		t.Fatalf("failed to create peer: %v", err)
+	}
+	pc := testutil.ListenUDP(t)
+	go peer.Serve(pc)
+	t.Cleanup(func() {
+		peer.Close()
+		pc.Close()
+	})
+
+	server, err := NewServer(&config.Socks5Config{
+		Users:    users,
+		Template: "https://" + pc.LocalAddr().String() + "/.well-known/masque/udp/{target_host}/{target_port}/",
+		Insecure: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() {
+		ln.Close()
+		server.Close()
+	})
+	return ln.Addr().String()
+}
+
+func TestServer_Connect(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+	addr := startPeer(t, echoPort, 53, map[string]string{"alice": "secret"})
+
+	tTable := []struct {
+		name   string
+		auth   *proxy.Auth
+		target string
+		ok     bool
+	}{
+		{name: "authenticated", auth: &proxy.Auth{User: "alice", Password: "secret"}, target: echo.Addr().String(), ok: true},
+		{name: "domain target", auth: &proxy.Auth{User: "alice", Password: "secret"}, target: "localhost:" + strconv.Itoa(echoPort), ok: true},
+		{name: "wrong password", auth: &proxy.Auth{User: "alice", Password: "guess"}, target: echo.Addr().String()},
+		{name: "no credentials", target: echo.Addr().String()},
+		{name: "port refused by the peer", auth: &proxy.Auth{User: "alice", Password: "secret"}, target: "127.0.0.1:" + strconv.Itoa(echoPort+1)},
+	}
+	for _, tCase := range tTable {
+		dialer, _ := proxy.SOCKS5("tcp", addr, tCase.auth, proxy.Direct)
+		conn, err := dialer.Dial("tcp", tCase.target)
+		if (err == nil) != tCase.ok {
+			t.Errorf("%s: expected success %t, got %v", tCase.name, tCase.ok, err)
+		}
+		if err != nil {
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("hello"))
+		conn.(*net.TCPConn).CloseWrite()
+		data, err := io.ReadAll(conn)
+		if err != nil || string(data) != "hello" {
+			t.Errorf("%s: expected hello echoed, got %q, %v", tCase.name, data, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestServer_UDPAssociate(t *testing.T) {
+	echo := testutil.ListenUDP(t)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, maxUDPPayload)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	addr := startPeer(t, 443, echo.LocalAddr().(*net.UDPAddr).Port, nil)
+
+	ctrl, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer ctrl.Close()
+	ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(ctrl)
+	ctrl.Write([]byte{version5, 1, methodNone})
+	if reply := readN(t, br, 2); !bytes.Equal(reply, []byte{version5, methodNone}) {
+		t.Fatalf("unexpected method selection %v", reply)
+	}
+	request, _ := appendAddr([]byte{version5, cmdUDPAssociate, 0}, "0.0.0.0:0")
+	ctrl.Write(request)
+	if reply := readN(t, br, 3); reply[1] != repSucceeded {
+		t.Fatalf("UDP ASSOCIATE refused: %v", reply)
+	}
+	relay, err := readAddr(br)
+	if err != nil {
+		t.Fatalf("invalid relay address: %v", err)
+	}
+
+	client, err := net.Dial("udp", relay)
+	if err != nil {
+		t.Fatalf("failed to dial relay: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	header, _ := appendAddr([]byte{0, 0, 0}, echo.LocalAddr().String())
+	for _, msg := range []string{"one", "two"} {
+		client.Write(append(header, msg...))
+		buf := make([]byte, maxUDPPayload)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("no echo for %q: %v", msg, err)
+		}
+		if !bytes.Equal(buf[:n], append(header, msg...)) {
+			t.Errorf("expected %q from %s, got %v", msg, echo.LocalAddr(), buf[:n])
+		}
+	}
+
+	// a fragment is dropped
+	client.Write(append([]byte{0, 0, 1}, append(header[3:], "frag"...)...))
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := client.Read(make([]byte, maxUDPPayload)); err == nil {
+		t.Errorf("expected the fragment to be dropped, got %d bytes back", n)
+	}
+}
+
+func readN(t *testing.T, r io.Reader, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	return b
+}
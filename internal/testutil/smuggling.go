@@ -0,0 +1,416 @@
+package testutil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/qpack"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// SmugglingHost is the authority of the requests of SmugglingCorpus
+const SmugglingHost = "example.com"
+
+// SmugglingCase is a request the server receiving it and the next hop could
+// frame differently. It is sent as is over HTTP/1.x when H1 is set, as an
+// HTTP/3 request made of H3Fields and the H3Data frames otherwise, or as the
+// HTTP/2 request made of the same fields and DATA frames.
+type SmugglingCase struct {
+	Name     string
+	H1       string
+	H3Fields []qpack.HeaderField
+	H3Data   []string
+	// Expected is the request the backend gets, as Recorder writes it, "" when
+	// the request must be refused
+	Expected string
+}
+
+// h3Request Return the fields of an HTTP/3 request to SmugglingHost followed by extra
+func h3Request(method string, extra ...qpack.HeaderField) []qpack.HeaderField {
+	return append([]qpack.HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: SmugglingHost},
+		{Name: ":path", Value: "/"},
+	}, extra...)
+}
+
+// SmugglingCorpus holds known request smuggling payloads. The HTTP/1.x ones
+// close the connection so that whatever the server doesn't take for the body
+// is never read as a request of its own.
+var SmugglingCorpus = []SmugglingCase{
+	{
+		Name:     "h1 CL.TE",
+		H1:       "POST / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nContent-Length: 40\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: x\r\n\r\n",
+		Expected: `POST / ""`,
+	},
+	{
+		Name:     "h1 TE.CL",
+		H1:       "POST / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nTransfer-Encoding: chunked\r\nContent-Length: 4\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+		Expected: `POST / "hello"`,
+	},
+	{
+		Name: "h1 TE.TE",
+		H1:   "POST / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: x\r\nContent-Length: 5\r\n\r\nhello",
+	},
+	{
+		Name: "h1 obfuscated Transfer-Encoding",
+		H1:   "POST / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nTransfer-Encoding: xchunked\r\nContent-Length: 5\r\n\r\nhello",
+	},
+	{
+		Name: "h1 space before the colon",
+		H1:   "POST / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nTransfer-Encoding : chunked\r\nContent-Length: 5\r\n\r\nhello",
+	},
+	{
+		Name: "h1 differing Content-Lengths",
+		H1:   "POST / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nContent-Length: 5\r\nContent-Length: 4\r\n\r\nhello",
+	},
+	{
+		Name: "h1 signed Content-Length",
+		H1:   "POST / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nContent-Length: +5\r\n\r\nhello",
+	},
+	{
+		Name:     "h1 HTTP/1.0 with Transfer-Encoding",
+		H1:       "POST / HTTP/1.0\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\nhello",
+		Expected: `POST / "hello"`,
+	},
+	{
+		Name: "h1 NUL in a value",
+		H1:   "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nX-Evil: a\x00b\r\n\r\n",
+	},
+	{
+		Name: "h1 chunk size overflow",
+		H1:   "POST / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nTransfer-Encoding: chunked\r\n\r\nfffffffffffffffff\r\nhello\r\n0\r\n\r\n",
+	},
+	{
+		Name:     "h3 well framed",
+		H3Fields: h3Request(http.MethodPost, qpack.HeaderField{Name: "content-length", Value: "5"}),
+		H3Data:   []string{"hel", "lo"},
+		Expected: `POST / "hello"`,
+	},
+	{
+		Name:     "h3 chunked body carried as data",
+		H3Fields: h3Request(http.MethodPost, qpack.HeaderField{Name: "content-length", Value: "40"}),
+		H3Data:   []string{"0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: x\r\n\r\n"},
+		Expected: `POST / "0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: x\r\n\r\n"`,
+	},
+	{
+		Name:     "h3 CRLF in a value",
+		H3Fields: h3Request(http.MethodGet, qpack.HeaderField{Name: "x-evil", Value: "a\r\n\r\nGET /smuggled HTTP/1.1"}),
+	},
+	{
+		Name:     "h3 CRLF in the method",
+		H3Fields: h3Request("GET /smuggled HTTP/1.1\r\nHost: x\r\n\r\nGET"),
+	},
+	{
+		Name:     "h3 request line in the method",
+		H3Fields: h3Request("GET /smuggled HTTP/1.1\tGET"),
+	},
+	{
+		Name:     "h3 upper-case field name",
+		H3Fields: h3Request(http.MethodGet, qpack.HeaderField{Name: "Transfer-Encoding", Value: "chunked"}),
+	},
+	{
+		Name: "h3 CRLF in the authority",
+		H3Fields: []qpack.HeaderField{
+			{Name: ":method", Value: http.MethodGet},
+			{Name: ":scheme", Value: "https"},
+			{Name: ":authority", Value: "example.com\r\n\r\nGET /smuggled HTTP/1.1"},
+			{Name: ":path", Value: "/"},
+		},
+	},
+	{
+		Name:     "h3 Transfer-Encoding",
+		H3Fields: h3Request(http.MethodPost, qpack.HeaderField{Name: "transfer-encoding", Value: "chunked"}),
+		H3Data:   []string{"5\r\nhello\r\n0\r\n\r\n"},
+	},
+	{
+		Name:     "h3 DATA shorter than content-length",
+		H3Fields: h3Request(http.MethodPost, qpack.HeaderField{Name: "content-length", Value: "10"}),
+		H3Data:   []string{"hello"},
+	},
+	{
+		Name:     "h3 DATA longer than content-length",
+		H3Fields: h3Request(http.MethodPost, qpack.HeaderField{Name: "content-length", Value: "3"}),
+		H3Data:   []string{"hello"},
+	},
+	{
+		Name: "h3 differing content-lengths",
+		H3Fields: h3Request(http.MethodPost,
+			qpack.HeaderField{Name: "content-length", Value: "5"},
+			qpack.HeaderField{Name: "content-length", Value: "3"},
+		),
+		H3Data: []string{"hello"},
+	},
+	{
+		Name:     "h3 signed content-length",
+		H3Fields: h3Request(http.MethodPost, qpack.HeaderField{Name: "content-length", Value: "+5"}),
+		H3Data:   []string{"hello"},
+	},
+}
+
+// Recorder is a backend recording the requests whose body it read in full
+type Recorder struct {
+	mu  sync.Mutex
+	got []string
+}
+
+func (rec *Recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rec.mu.Lock()
+	rec.got = append(rec.got, fmt.Sprintf("%s %s %q", r.Method, r.URL.Path, body))
+	rec.mu.Unlock()
+}
+
+// Take Return the requests recorded so far and forget them
+func (rec *Recorder) Take() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	got := rec.got
+	rec.got = nil
+	return got
+}
+
+// RunSmugglingCorpus Send SmugglingCorpus to the HTTP/1.x listener at h1Addr
+// and the HTTP/3 one at h3Addr of a server forwarding to rec. Each request
+// must reach rec as expected, or be refused without reaching it.
+func RunSmugglingCorpus(t *testing.T, h1Addr, h3Addr string, rec *Recorder) {
+	t.Helper()
+	RunSmugglingCases(t, SmugglingCorpus, h1Addr, h3Addr, rec)
+}
+
+// RunSmugglingCases Send cases like RunSmugglingCorpus, those of a protocol
+// whose address is empty are skipped
+func RunSmugglingCases(t *testing.T, cases []SmugglingCase, h1Addr, h3Addr string, rec *Recorder) {
+	t.Helper()
+	for _, tCase := range cases {
+		var status int
+		switch {
+		case tCase.H1 != "" && h1Addr != "":
+			status = SendH1(t, h1Addr, tCase.H1)
+		case tCase.H1 == "" && h3Addr != "":
+			status = SendH3(t, h3Addr, tCase.H3Fields, tCase.H3Data)
+		default:
+			continue
+		}
+		checkSmuggling(t, tCase, status, rec)
+	}
+}
+
+// RunH2SmugglingCases Send the HTTP/3 cases of cases as HTTP/2 requests made
+// of the same fields and data, each over a connection dial returned after the
+// TLS handshake. The HTTP/1.x cases are skipped.
+func RunH2SmugglingCases(t *testing.T, cases []SmugglingCase, dial func(t testing.TB) net.Conn, rec *Recorder) {
+	t.Helper()
+	for _, tCase := range cases {
+		if tCase.H1 != "" {
+			continue
+		}
+		conn := dial(t)
+		status := SendH2(t, conn, tCase.H3Fields, tCase.H3Data)
+		conn.Close()
+		checkSmuggling(t, tCase, status, rec)
+	}
+}
+
+// checkSmuggling Check that the backend received what tCase expects after the
+// response status was received
+func checkSmuggling(t *testing.T, tCase SmugglingCase, status int, rec *Recorder) {
+	t.Helper()
+	got := rec.Take()
+	if tCase.Expected == "" {
+		if len(got) > 0 || status >= http.StatusOK && status < http.StatusBadRequest {
+			t.Errorf("%s: expected the request to be refused, got %d and the backend received %q", tCase.Name, status, got)
+		}
+		return
+	}
+	if status != http.StatusOK || len(got) != 1 || got[0] != tCase.Expected {
+		t.Errorf("%s: expected 200 and the backend to receive %q, got %d and %q", tCase.Name, tCase.Expected, status, got)
+	}
+}
+
+// ProxyForm Return the HTTP/1.x cases of the corpus with their request target
+// in absolute form, scheme://SmugglingHost/, as a forward proxy receives them
+func ProxyForm(cases []SmugglingCase, scheme string) []SmugglingCase {
+	var proxied []SmugglingCase
+	for _, tCase := range cases {
+		if tCase.H1 == "" {
+			continue
+		}
+		tCase.H1 = strings.Replace(tCase.H1, " / ", " "+scheme+"://"+SmugglingHost+"/ ", 1)
+		proxied = append(proxied, tCase)
+	}
+	return proxied
+}
+
+// SendH1 Write raw to addr and return the status of the response, 0 if the
+// connection ended without one
+func SendH1(t testing.TB, addr, raw string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatalf("failed to write the request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return 0
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// SendH3 Send an HTTP/3 request made of fields, encoded without any check,
+// and one DATA frame per element of data to addr. It returns the status of
+// the response, 0 if the stream or the connection was closed without one.
+func SendH3(t testing.TB, addr string, fields []qpack.HeaderField, data []string) int {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}}, nil)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", addr, err)
+	}
+	defer conn.CloseWithError(0, "")
+	// the control stream, with empty SETTINGS
+	control, err := conn.OpenUniStream()
+	if err != nil {
+		t.Fatalf("failed to open the control stream: %v", err)
+	}
+	control.Write([]byte{0x0, 0x4, 0x0})
+
+	str, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("failed to open a request stream: %v", err)
+	}
+	str.SetDeadline(time.Now().Add(5 * time.Second))
+	var block bytes.Buffer
+	enc := qpack.NewEncoder(&block)
+	for _, f := range fields {
+		enc.WriteField(f)
+	}
+	frames := appendFrame(nil, 0x1, block.Bytes())
+	for _, d := range data {
+		frames = appendFrame(frames, 0x0, []byte(d))
+	}
+	str.Write(frames)
+	str.Close()
+
+	// the response HEADERS frame
+	r := quicvarint.NewReader(str)
+	for {
+		typ, err := quicvarint.Read(r)
+		if err != nil {
+			return 0
+		}
+		length, err := quicvarint.Read(r)
+		if err != nil {
+			return 0
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return 0
+		}
+		if typ != 0x1 {
+			continue
+		}
+		headers, err := qpack.NewDecoder(nil).DecodeFull(payload)
+		if err != nil {
+			t.Fatalf("failed to decode the response: %v", err)
+		}
+		for _, f := range headers {
+			if f.Name != ":status" {
+				continue
+			}
+			status, err := strconv.Atoi(f.Value)
+			if err != nil {
+				t.Fatalf("invalid status %q", f.Value)
+			}
+			if status >= http.StatusOK {
+				return status
+			}
+		}
+	}
+}
+
+// SendH2 Send an HTTP/2 request made of fields, encoded without any check,
+// and one DATA frame per element of data over conn. It returns the status of
+// the response, 0 if the stream or the connection was closed without one.
+func SendH2(t testing.TB, conn net.Conn, fields []qpack.HeaderField, data []string) int {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		t.Fatalf("failed to write the preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	framer.WriteSettings()
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	for _, f := range fields {
+		enc.WriteField(hpack.HeaderField{Name: f.Name, Value: f.Value})
+	}
+	framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: block.Bytes(),
+		EndStream:     len(data) == 0,
+		EndHeaders:    true,
+	})
+	for i, d := range data {
+		framer.WriteData(1, i == len(data)-1, []byte(d))
+	}
+
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return 0
+		}
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				framer.WriteSettingsAck()
+			}
+		case *http2.MetaHeadersFrame:
+			status, err := strconv.Atoi(f.PseudoValue("status"))
+			if err != nil {
+				t.Fatalf("invalid status %q", f.PseudoValue("status"))
+			}
+			if status >= http.StatusOK {
+				return status
+			}
+		case *http2.RSTStreamFrame, *http2.GoAwayFrame:
+			return 0
+		}
+	}
+}
+
+// appendFrame Append an HTTP/3 frame of type typ to b
+func appendFrame(b []byte, typ uint64, payload []byte) []byte {
+	b = quicvarint.Append(b, typ)
+	b = quicvarint.Append(b, uint64(len(payload)))
+	return append(b, payload...)
+}
@@ -0,0 +1,102 @@
+// Package testutil holds helpers shared by the tests of several packages.
+package testutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/quic-go/quic-go/http3"
+	"quic-proxy/internal/utils"
+)
+
+// GenerateCert Generate a self-signed certificate for localhost in a temp dir
+func GenerateCert(t testing.TB) (certPath, keyPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	certGenerator := *utils.DefaultTLSCertificateGenerator
+	certGenerator.CertPath = filepath.Join(dir, "cert.pem")
+	certGenerator.KeyPath = filepath.Join(dir, "key.pem")
+	if err := certGenerator.Generate(); err != nil {
+		t.Fatalf("failed to generate certificate: %v", err)
+	}
+	return certGenerator.CertPath, certGenerator.KeyPath
+}
+
+// ServerTLSConfig Return a TLS config serving a fresh self-signed certificate
+func ServerTLSConfig(t testing.TB) *tls.Config {
+	t.Helper()
+	certPath, keyPath := GenerateCert(t)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+// ListenUDP Listen on a random loopback UDP port
+func ListenUDP(t testing.TB) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	return conn
+}
+
+// ServeH3 Serve server on a random loopback port and return its address.
+// The server is closed when the test ends.
+func ServeH3(t testing.TB, server *http3.Server) string {
+	t.Helper()
+	if server.TLSConfig == nil {
+		server.TLSConfig = http3.ConfigureTLSConfig(ServerTLSConfig(t))
+	}
+	conn := ListenUDP(t)
+	go server.Serve(conn)
+	t.Cleanup(func() {
+		server.Close()
+		conn.Close()
+	})
+	return conn.LocalAddr().String()
+}
+
+// StartH3Server Serve handler over HTTP/3 on a random loopback port
+func StartH3Server(t testing.TB, handler http.Handler) string {
+	t.Helper()
+	return ServeH3(t, &http3.Server{Handler: handler})
+}
+
+// StartTrustedH3Server Serve handler over HTTP/3 on a random loopback port and
+// return a client TLS config verifying its certificate
+func StartTrustedH3Server(t testing.TB, handler http.Handler) (string, *tls.Config) {
+	t.Helper()
+	tlsConf := ServerTLSConfig(t)
+	leaf, err := x509.ParseCertificate(tlsConf.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	addr := ServeH3(t, &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(tlsConf)})
+	return addr, &tls.Config{RootCAs: roots}
+}
+
+// DeadUDPAddr Return a loopback UDP address nobody listens on
+func DeadUDPAddr(t testing.TB) string {
+	t.Helper()
+	conn := ListenUDP(t)
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+// H3Client Return an HTTP/3 client trusting any certificate
+func H3Client(t testing.TB) *http.Client {
+	t.Helper()
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	t.Cleanup(func() { transport.Close() })
+	return &http.Client{Transport: transport}
+}
@@ -0,0 +1,183 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/qlog"
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+)
+
+// DialTCP Dial the target of a CONNECT directly over TCP. Set the Control of
+// dialer to PublicOnly to keep the tunnels off private addresses.
+func DialTCP(dialer *happyeyeballs.Dialer) func(ctx context.Context, target string) (Conn, error) {
+	return func(ctx context.Context, target string) (Conn, error) {
+		conn, err := dialer.DialTCP(ctx, "tcp", target)
+		if err != nil {
+			return nil, err
+		}
+		return NewNetConn(conn, nil), nil
+	}
+}
+
+// H3Dialer reaches the target of a CONNECT through another proxy, with a
+// CONNECT request over HTTP/3. The tunnels share one QUIC connection to the
+// proxy, each of them is a request stream.
+type H3Dialer struct {
+	proxyAddr string
+	dialer    *happyeyeballs.Dialer
+	tlsConf   *tls.Config
+
+	mu    sync.Mutex
+	conn  *http3.ClientConn
+	qconn quic.EarlyConnection
+}
+
+// NewH3Dialer Create a dialer tunnelling through the proxy at proxyURL, an https URL
+func NewH3Dialer(proxyURL string, insecure bool) (*H3Dialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url %q: %w", proxyURL, err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %q: an https URL with a host is required", proxyURL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "443")
+	}
+	return &H3Dialer{
+		proxyAddr: addr,
+		dialer:    &happyeyeballs.Dialer{},
+		tlsConf: &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: insecure,
+			NextProtos:         []string{http3.NextProtoH3},
+		},
+	}, nil
+}
+
+// Dial Open a tunnel to target through the proxy. If the proxy refuses the
+// CONNECT, the error tells its status.
+func (d *H3Dialer) Dial(ctx context.Context, target string) (Conn, error) {
+	str, _, err := d.dial(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamConn(str), nil
+}
+
+// DialContext Like Dial, the tunnel is returned as a net.Conn, for an
+// http.Transport for instance. Only TCP can be tunnelled.
+func (d *H3Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("network %s can't be tunnelled", network)
+	}
+	str, qconn, err := d.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &streamNetConn{
+		streamConn: streamConn{str},
+		local:      qconn.LocalAddr(),
+		remote:     qconn.RemoteAddr(),
+	}, nil
+}
+
+// dial Send a CONNECT for target on the connection to the proxy
+func (d *H3Dialer) dial(ctx context.Context, target string) (http3.RequestStream, quic.EarlyConnection, error) {
+	cc, qconn, err := d.clientConn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	str, err := Connect(ctx, cc, target)
+	if err != nil {
+		return nil, nil, fmt.Errorf("proxy %s: %w", d.proxyAddr, err)
+	}
+	return str, qconn, nil
+}
+
+// Connect Send a CONNECT request for target on cc and wait for the proxy to
+// accept it, the request stream then carries the tunnel
+func Connect(ctx context.Context, cc *http3.ClientConn, target string) (http3.RequestStream, error) {
+	str, err := cc.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// authority-form, only :method and :authority are sent
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Host:   target,
+		URL:    &url.URL{Host: target},
+		Header: http.Header{},
+	}
+	if err := str.SendRequestHeader(req); err != nil {
+		str.Close()
+		return nil, err
+	}
+	resp, err := str.ReadResponse()
+	if err != nil {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		str.Close()
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		str.Close()
+		return nil, fmt.Errorf("CONNECT to %s refused: %s", target, resp.Status)
+	}
+	return str, nil
+}
+
+// clientConn Return the HTTP/3 connection to the proxy, dialing a new one if
+// there is none or it was closed
+func (d *H3Dialer) clientConn(ctx context.Context) (*http3.ClientConn, quic.EarlyConnection, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.qconn != nil && d.qconn.Context().Err() == nil {
+		return d.conn, d.qconn, nil
+	}
+	qconn, err := d.dialer.DialQUIC(ctx, d.proxyAddr, d.tlsConf, &quic.Config{
+		Tracer: qlog.DefaultConnectionTracer,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	d.qconn = qconn
+	d.conn = (&http3.Transport{}).NewClientConn(qconn)
+	return d.conn, qconn, nil
+}
+
+// streamNetConn is a tunnel over a request stream seen as a net.Conn, its
+// addresses are those of the QUIC connection to the proxy
+type streamNetConn struct {
+	streamConn
+	local, remote net.Addr
+}
+
+func (c *streamNetConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *streamNetConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Close Close the connection to the proxy and every tunnel on it
+func (d *H3Dialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.qconn != nil {
+		return d.qconn.CloseWithError(0, "")
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"syscall"
+)
+
+var ErrTargetNotAllowed = errors.New("this target is not allowed")
+
+// reservedPrefixes are the ranges net/netip doesn't classify that a proxy
+// mustn't reach either
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // this network, RFC 791
+	netip.MustParsePrefix("100.64.0.0/10"), // shared address space, RFC 6598
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments, RFC 6890
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking, RFC 2544
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved, the broadcast address included
+}
+
+// IsPublic reports whether ip is a global unicast address outside the private
+// and reserved ranges
+func IsPublic(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// PublicOnly Refuse to connect to an address that isn't public, see IsPublic.
+// It has the signature of net.Dialer.Control, which runs once the name is
+// resolved, so the address checked is the one dialed and a second lookup
+// can't answer differently.
+func PublicOnly(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !IsPublic(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrTargetNotAllowed, address)
+	}
+	return nil
+}
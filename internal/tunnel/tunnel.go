@@ -0,0 +1,268 @@
+// Package tunnel answers CONNECT requests (RFC 9110 section 9.3.6) with a
+// bidirectional byte relay. The client side may be HTTP/1.1, whose connection
+// is hijacked, HTTP/2 or HTTP/3, whose request stream carries the bytes. The
+// target is dialed over TCP, or reached through a CONNECT request to another
+// proxy over HTTP/3, so that the tunnel rides a QUIC stream.
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// DefaultAllowedPorts are the ports a CONNECT may reach when none are configured
+var DefaultAllowedPorts = []int{443}
+
+var ErrPortNotAllowed = errors.New("CONNECT to this port is not allowed")
+
+// Conn is one side of a tunnel. CloseWrite ends the bytes sent to the peer
+// while the bytes of the peer keep flowing, Close ends both directions.
+type Conn interface {
+	io.ReadWriteCloser
+	CloseWrite() error
+}
+
+// Stats describes a tunnel once it is closed
+type Stats struct {
+	Up       int64 // bytes from the client to the target
+	Down     int64 // bytes from the target to the client
+	Duration time.Duration
+}
+
+// Relay Copy bytes between down and up until both sent EOF or one direction
+// failed. The EOF of one side is passed on as a half-close, so that the other
+// side can still answer. Both sides are closed when Relay returns.
+func Relay(down, up Conn) (Stats, error) {
+	start := time.Now()
+	var stats Stats
+	upErr := make(chan error, 1)
+	go func() {
+		var err error
+		stats.Up, err = copyHalf(up, down)
+		upErr <- err
+	}()
+	var err error
+	stats.Down, err = copyHalf(down, up)
+	if err != nil {
+		// unblock the other direction
+		down.Close()
+		up.Close()
+	}
+	if err2 := <-upErr; err == nil {
+		err = err2
+	}
+	down.Close()
+	up.Close()
+	stats.Duration = time.Since(start)
+	return stats, err
+}
+
+// copyHalf Copy src to dst up to EOF, then half-close dst
+func copyHalf(dst, src Conn) (int64, error) {
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		src.Close()
+		dst.Close()
+		return n, err
+	}
+	return n, dst.CloseWrite()
+}
+
+// netConn is a TCP or TLS connection, bytes already buffered by the HTTP
+// server are read first
+type netConn struct {
+	net.Conn
+	r io.Reader
+}
+
+// NewNetConn Wrap conn as a tunnel side. r reads the bytes of conn, if the
+// HTTP server already buffered some of them. Without CloseWrite on conn, the
+// half-close is dropped.
+func NewNetConn(conn net.Conn, r io.Reader) Conn {
+	if r == nil {
+		r = conn
+	}
+	return &netConn{Conn: conn, r: r}
+}
+
+func (c *netConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *netConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// streamConn is a QUIC stream carrying the bytes of a tunnel, for instance
+// the request stream of an HTTP/3 CONNECT whose DATA frames hold them
+type streamConn struct {
+	quic.Stream
+}
+
+// NewStreamConn Wrap a QUIC stream, like the request stream of an HTTP/3
+// CONNECT, as a tunnel side
+func NewStreamConn(str quic.Stream) Conn {
+	return streamConn{str}
+}
+
+// CloseWrite Closing a QUIC stream only closes its send direction
+func (c streamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+func (c streamConn) Close() error {
+	c.Stream.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	return c.Stream.Close()
+}
+
+// responseConn is the request stream of an HTTP/2 CONNECT, written through
+// the ResponseWriter. HTTP/2 ends the stream when the handler returns, so the
+// half-close is dropped.
+type responseConn struct {
+	io.ReadCloser
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (c *responseConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+func (c *responseConn) CloseWrite() error {
+	return nil
+}
+
+// Handler answers CONNECT requests, dialing their target with Dial
+type Handler struct {
+	// AllowedPorts may be reached, DefaultAllowedPorts if empty
+	AllowedPorts []int
+	Dial         func(ctx context.Context, target string) (Conn, error)
+	// Name prefixes the log lines, like [PROXY]
+	Name string
+}
+
+// CheckTarget Validate the authority-form target of a CONNECT, host:port
+func (h *Handler) CheckTarget(target string) error {
+	_, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+	allowed := h.AllowedPorts
+	if len(allowed) == 0 {
+		allowed = DefaultAllowedPorts
+	}
+	if !slices.Contains(allowed, port) {
+		return fmt.Errorf("%w: %d", ErrPortNotAllowed, port)
+	}
+	return nil
+}
+
+// ServeHTTP Open the tunnel of a CONNECT request and relay it until it is closed
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.Host
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.CheckTarget(target); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrPortNotAllowed) {
+			status = http.StatusForbidden
+		}
+		log.Printf("%s CONNECT %s from %s refused: %v", h.Name, target, r.RemoteAddr, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	up, err := h.Dial(r.Context(), target)
+	if errors.Is(err, ErrTargetNotAllowed) {
+		log.Printf("%s CONNECT %s from %s refused: %v", h.Name, target, r.RemoteAddr, err)
+		http.Error(w, "CONNECT to this target is not allowed", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("%s CONNECT %s failed: %v", h.Name, target, err)
+		http.Error(w, "Failed to reach target", http.StatusBadGateway)
+		return
+	}
+	down, err := accept(w, r)
+	if err != nil {
+		up.Close()
+		log.Printf("%s CONNECT %s from %s failed: %v", h.Name, target, r.RemoteAddr, err)
+		return
+	}
+	stats, err := Relay(down, up)
+	if err != nil && !IsClosedError(err) {
+		log.Printf("%s Tunnel %s to %s failed after %v, %d bytes up, %d bytes down: %v",
+			h.Name, r.RemoteAddr, target, stats.Duration.Round(time.Millisecond), stats.Up, stats.Down, err)
+		return
+	}
+	log.Printf("%s Tunnel %s to %s closed after %v, %d bytes up, %d bytes down",
+		h.Name, r.RemoteAddr, target, stats.Duration.Round(time.Millisecond), stats.Up, stats.Down)
+}
+
+// accept Answer the CONNECT with 200 and return the client side of the tunnel
+func accept(w http.ResponseWriter, r *http.Request) (Conn, error) {
+	switch r.ProtoMajor {
+	case 1:
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, "connection can't be hijacked", http.StatusInternalServerError)
+			return nil, err
+		}
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return NewNetConn(conn, brw.Reader), nil
+	case 3:
+		streamer, ok := w.(http3.HTTPStreamer)
+		if !ok {
+			http.Error(w, "HTTP/3 stream can't be taken over", http.StatusInternalServerError)
+			return nil, errors.New("HTTP/3 stream can't be taken over")
+		}
+		w.WriteHeader(http.StatusOK)
+		return NewStreamConn(streamer.HTTPStream()), nil
+	default:
+		rc := http.NewResponseController(w)
+		if err := rc.EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return nil, err
+		}
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return nil, err
+		}
+		return &responseConn{ReadCloser: r.Body, w: w, rc: rc}, nil
+	}
+}
+
+// IsClosedError reports whether err only tells that a side went away
+func IsClosedError(err error) bool {
+	var h3Err *http3.Error
+	var streamErr *quic.StreamError
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ENOTCONN) ||
+		errors.As(err, &h3Err) || errors.As(err, &streamErr)
+}
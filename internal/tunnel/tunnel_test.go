@@ -0,0 +1,158 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+	"quic-proxy/internal/testutil"
+)
+
+// startEchoServer Echo the bytes of every TCP connection, then half-close it
+// once the client half-closed. Return the address and the port.
+func startEchoServer(t *testing.T) (string, int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	return ln.Addr().String(), ln.Addr().(*net.TCPAddr).Port
+}
+
+// roundTripHalfClose Write msg, half-close and read what comes back up to EOF
+func roundTripHalfClose(t *testing.T, conn Conn, msg string) string {
+	t.Helper()
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatalf("failed to half-close: %v", err)
+	}
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	return string(data)
+}
+
+func TestHandler_HTTP1(t *testing.T) {
+	echoAddr, echoPort := startEchoServer(t)
+	handler := &Handler{AllowedPorts: []int{echoPort}, Dial: DialTCP(&happyeyeballs.Dialer{}), Name: "[Test]"}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	tTable := []struct {
+		name     string
+		target   string
+		expected int
+	}{
+		{name: "allowed port", target: echoAddr, expected: http.StatusOK},
+		{name: "port not allowed", target: "127.0.0.1:" + strconv.Itoa(echoPort+1), expected: http.StatusForbidden},
+		{name: "no port", target: "127.0.0.1", expected: http.StatusBadRequest},
+	}
+	for _, tCase := range tTable {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial proxy: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "CONNECT "+tCase.target+" HTTP/1.1\r\nHost: "+tCase.target+"\r\n\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			t.Fatalf("%s: failed to read response: %v", tCase.name, err)
+		}
+		if resp.StatusCode != tCase.expected {
+			t.Errorf("%s: expected status %d, got %d", tCase.name, tCase.expected, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusOK {
+			// the echo server only answers EOF once our half-close went through the tunnel
+			if got := roundTripHalfClose(t, NewNetConn(conn, br), "hello"); got != "hello" {
+				t.Errorf("%s: expected hello, got %q", tCase.name, got)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestH3Dialer(t *testing.T) {
+	echoAddr, echoPort := startEchoServer(t)
+	proxyAddr := testutil.ServeH3(t, &http3.Server{
+		Handler: &Handler{AllowedPorts: []int{echoPort}, Dial: DialTCP(&happyeyeballs.Dialer{}), Name: "[Test]"},
+	})
+	dialer, err := NewH3Dialer("https://"+proxyAddr, true)
+	if err != nil {
+		t.Fatalf("failed to create dialer: %v", err)
+	}
+	defer dialer.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// two tunnels share the QUIC connection
+	for _, msg := range []string{"hello", strings.Repeat("x", 100000)} {
+		conn, err := dialer.Dial(ctx, echoAddr)
+		if err != nil {
+			t.Fatalf("failed to dial through proxy: %v", err)
+		}
+		if got := roundTripHalfClose(t, conn, msg); got != msg {
+			t.Errorf("expected %d bytes echoed, got %d", len(msg), len(got))
+		}
+		conn.Close()
+	}
+
+	_, err = dialer.Dial(ctx, "127.0.0.1:"+strconv.Itoa(echoPort+1))
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected the proxy to refuse with 403, got %v", err)
+	}
+}
+
+func TestPublicOnly(t *testing.T) {
+	tTable := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.215.14:443", true},
+		{"[2606:4700::1111]:443", true},
+		{"127.0.0.1:443", false},
+		{"10.0.0.1:443", false},
+		{"169.254.169.254:80", false},
+		{"100.64.0.1:443", false},
+		{"0.0.0.0:443", false},
+		{"[::1]:443", false},
+		{"[fd00::1]:443", false},
+		{"[::ffff:127.0.0.1]:443", false},
+	}
+	for _, tCase := range tTable {
+		err := PublicOnly("tcp4", tCase.address, nil)
+		if tCase.allowed && err != nil {
+			t.Errorf("%s: expected to be allowed, got %v", tCase.address, err)
+		}
+		if !tCase.allowed && !errors.Is(err, ErrTargetNotAllowed) {
+			t.Errorf("%s: expected ErrTargetNotAllowed, got %v", tCase.address, err)
+		}
+	}
+}
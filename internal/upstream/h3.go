@@ -0,0 +1,347 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	h2h3convert "quic-proxy/internal/h2h3-convert"
+	headerpolicy "quic-proxy/internal/header-policy"
+)
+
+var errManagerClosed = errors.New("upstream connection manager closed")
+
+// h3Key identifies the connections a request may use: the address dialed and
+// the name the certificate was verified for. A request sent to an alternative
+// service needs a certificate for its origin, RFC 7838 section 2.1.
+type h3Key struct {
+	addr       string
+	serverName string
+}
+
+// h3Conn is a pooled HTTP/3 connection
+type h3Conn struct {
+	key   h3Key
+	qconn quic.EarlyConnection
+	cc    *http3.ClientConn
+	limit *streamLimit
+
+	// guarded by the mutex of the pool
+	opened   int64 // request streams opened so far
+	inflight int   // requests whose response isn't done yet
+	idle     *time.Timer
+}
+
+// streamsLeft Return how many more request streams the peer allows, it is
+// optimistic while the limit isn't known yet
+func (c *h3Conn) streamsLeft() int64 {
+	if c.limit == nil || c.limit.maxBidi.Load() == 0 {
+		return 1
+	}
+	return c.limit.maxBidi.Load() - c.opened
+}
+
+// h3Pool shares HTTP/3 connections between requests, keyed by the address
+// dialed and the server name
+type h3Pool struct {
+	m         *Manager
+	dial      func(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlyConnection, error)
+	tlsConf   *tls.Config
+	transport *http3.Transport // only creates the client connections
+
+	mu      sync.Mutex
+	conns   map[h3Key][]*h3Conn
+	dialing map[h3Key]int
+	// changed is closed and replaced whenever a connection is added, removed or released
+	changed chan struct{}
+	closed  bool
+}
+
+func newH3Pool(m *Manager, dial func(context.Context, string, *tls.Config, *quic.Config) (quic.EarlyConnection, error), tlsConf *tls.Config) *h3Pool {
+	if tlsConf == nil {
+		tlsConf = &tls.Config{}
+	}
+	return &h3Pool{
+		m:         m,
+		dial:      dial,
+		tlsConf:   tlsConf,
+		transport: &http3.Transport{},
+		conns:     make(map[h3Key][]*h3Conn),
+		dialing:   make(map[h3Key]int),
+		changed:   make(chan struct{}),
+	}
+}
+
+// notify Wake up the requests waiting for a connection, called with mu held
+func (p *h3Pool) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// roundTrip Send req on a connection with streams left, the response body
+// releases the connection when it is done
+func (p *h3Pool) roundTrip(req *http.Request, onlyCached bool) (*http.Response, error) {
+	if req.URL == nil || req.URL.Scheme != "https" || req.URL.Host == "" {
+		return nil, fmt.Errorf("upstream: HTTP/3 needs an https URL with a host: %v", req.URL)
+	}
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), "443")
+	}
+	c, reused, err := p.acquire(req.Context(), h3Key{addr: addr, serverName: serverName(req)}, onlyCached)
+	if err != nil {
+		return nil, err
+	}
+	// the peer refuses field sections above its SETTINGS_MAX_FIELD_SECTION_SIZE
+	if err := headerpolicy.CheckSize(h2h3convert.HeaderFields(req), headerpolicy.PeerLimit(c.cc)); err != nil {
+		p.release(c)
+		return nil, err
+	}
+	if len(req.Header["Cookie"]) > 0 {
+		// a RoundTripper mustn't modify the request
+		req = req.WithContext(req.Context())
+		req.Header = req.Header.Clone()
+		h2h3convert.SplitCookies(req.Header)
+	}
+	p.m.H3Stats.Requests.Add(1)
+	if reused {
+		p.m.H3Stats.Reused.Add(1)
+	}
+	// http3.ClientConn sends the body right away, even if the request expects 100 Continue
+	resp, err := h2h3convert.ContinueTransport{RoundTripper: c.cc}.RoundTrip(req)
+	if err != nil {
+		p.release(c)
+		if errors.Is(err, quic.Err0RTTRejected) {
+			// the streams opened in 0-RTT are gone, the control stream included
+			c.qconn.CloseWithError(0, "")
+		}
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { p.release(c) }}
+	return resp, nil
+}
+
+// acquire Pick the least busy connection of key with streams left. If there
+// is none, another connection is dialed unless the origin reached its
+// limit, then the least busy connection waits for the peer to allow streams.
+func (p *h3Pool) acquire(ctx context.Context, key h3Key, onlyCached bool) (*h3Conn, bool, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, false, errManagerClosed
+		}
+		conns := p.conns[key]
+		var best, leastBusy *h3Conn
+		for _, c := range conns {
+			if c.qconn.Context().Err() != nil {
+				// closed, the watcher is about to remove it
+				continue
+			}
+			if c.streamsLeft() > 0 && (best == nil || c.inflight < best.inflight) {
+				best = c
+			}
+			if leastBusy == nil || c.inflight < leastBusy.inflight {
+				leastBusy = c
+			}
+		}
+		if best != nil {
+			reused := best.opened > 0
+			p.reserve(best)
+			p.mu.Unlock()
+			return best, reused, nil
+		}
+		if onlyCached && leastBusy == nil && p.dialing[key] == 0 {
+			p.mu.Unlock()
+			return nil, false, http3.ErrNoCachedConn
+		}
+		if len(conns)+p.dialing[key] < p.m.Limits.maxConns() {
+			p.dialing[key]++
+			p.mu.Unlock()
+			c, err := p.connect(ctx, key)
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.dialing[key]--
+			p.notify()
+			if err != nil {
+				return nil, false, err
+			}
+			if p.closed {
+				c.qconn.CloseWithError(0, "")
+				return nil, false, errManagerClosed
+			}
+			if len(p.conns[key]) > 0 {
+				p.m.H3Stats.StreamLimited.Add(1)
+			}
+			p.conns[key] = append(p.conns[key], c)
+			p.reserve(c)
+			return c, false, nil
+		}
+		if leastBusy != nil {
+			p.reserve(leastBusy)
+			p.mu.Unlock()
+			return leastBusy, true, nil
+		}
+		// the origin is at its limit with connections still being dialed
+		changed := p.changed
+		p.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// connect Dial a connection of key and start watching it
+func (p *h3Pool) connect(ctx context.Context, key h3Key) (*h3Conn, error) {
+	tlsConf := p.tlsConf.Clone()
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName = key.serverName
+	}
+	tlsConf.NextProtos = []string{http3.NextProtoH3}
+	qconn, err := p.dial(ctx, key.addr, tlsConf, p.m.quicConf)
+	if err != nil {
+		return nil, err
+	}
+	p.m.H3Stats.Opened.Add(1)
+	c := &h3Conn{
+		key:   key,
+		qconn: qconn,
+		cc:    p.transport.NewClientConn(qconn),
+		limit: p.m.streamLimitOf(qconn),
+	}
+	go func() {
+		<-qconn.Context().Done()
+		p.remove(c)
+		p.m.H3Stats.Closed.Add(1)
+	}()
+	return c, nil
+}
+
+// serverName Return the name the certificate of the server of req must be
+// valid for, the host of its authority
+func serverName(req *http.Request) string {
+	if req.Host == "" {
+		return req.URL.Hostname()
+	}
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		return host
+	}
+	return strings.Trim(req.Host, "[]")
+}
+
+// reserve Count a request on c, called with mu held
+func (p *h3Pool) reserve(c *h3Conn) {
+	c.opened++
+	c.inflight++
+	if c.idle != nil {
+		c.idle.Stop()
+		c.idle = nil
+	}
+}
+
+// release End a request on c. A connection left idle is closed after the
+// idle timeout, or right away if its origin already keeps enough idle ones.
+func (p *h3Pool) release(c *h3Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c.inflight--
+	p.notify()
+	if c.inflight > 0 {
+		return
+	}
+	idle := 0
+	for _, other := range p.conns[c.key] {
+		if other.inflight == 0 {
+			idle++
+		}
+	}
+	if idle > p.m.Limits.maxIdleConns() {
+		go c.qconn.CloseWithError(0, "")
+		return
+	}
+	c.idle = time.AfterFunc(p.m.Limits.idleTimeout(), func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if c.inflight == 0 {
+			c.qconn.CloseWithError(0, "")
+		}
+	})
+}
+
+// remove Forget a closed connection
+func (p *h3Pool) remove(c *h3Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.conns[c.key]
+	for i, other := range conns {
+		if other == c {
+			p.conns[c.key] = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(p.conns[c.key]) == 0 {
+		delete(p.conns, c.key)
+	}
+	if c.idle != nil {
+		c.idle.Stop()
+	}
+	p.notify()
+}
+
+// closeIdle Close the connections without requests
+func (p *h3Pool) closeIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conns := range p.conns {
+		for _, c := range conns {
+			if c.inflight == 0 {
+				c.qconn.CloseWithError(0, "")
+			}
+		}
+	}
+}
+
+// close Close every connection and refuse new requests
+func (p *h3Pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, conns := range p.conns {
+		for _, c := range conns {
+			c.qconn.CloseWithError(0, "")
+		}
+	}
+	p.notify()
+}
+
+// releasingBody releases the connection of a response once its body was read
+// to the end or closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+func (b *releasingBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
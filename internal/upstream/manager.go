@@ -0,0 +1,169 @@
+// Package upstream pools the connections of the proxies to upstream servers:
+// TCP/TLS connections carrying HTTP/1.1 or h2, and QUIC connections carrying
+// HTTP/3. Connections are limited per origin and closed once idle for too
+// long. The QUIC streams the peer allows are tracked, so that an origin whose
+// HTTP/3 connections ran out of streams gets another connection instead of
+// queueing requests behind the busy ones.
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	h2h3convert "quic-proxy/internal/h2h3-convert"
+	"quic-proxy/internal/metrics"
+	"quic-proxy/internal/utils"
+)
+
+const (
+	// DefaultMaxConnsPerOrigin bounds the connections to an origin, per transport
+	DefaultMaxConnsPerOrigin = 16
+	// DefaultMaxIdleConnsPerOrigin is how many idle connections of an origin are kept
+	DefaultMaxIdleConnsPerOrigin = 4
+	// DefaultIdleTimeout closes a connection that carried no request for that long
+	DefaultIdleTimeout = 90 * time.Second
+)
+
+// Limits bound the connections of every origin, zero values fall back to the defaults
+type Limits struct {
+	MaxConnsPerOrigin     int
+	MaxIdleConnsPerOrigin int
+	IdleTimeout           time.Duration
+}
+
+func (l Limits) maxConns() int {
+	if l.MaxConnsPerOrigin > 0 {
+		return l.MaxConnsPerOrigin
+	}
+	return DefaultMaxConnsPerOrigin
+}
+
+func (l Limits) maxIdleConns() int {
+	if l.MaxIdleConnsPerOrigin > 0 {
+		return l.MaxIdleConnsPerOrigin
+	}
+	return DefaultMaxIdleConnsPerOrigin
+}
+
+func (l Limits) idleTimeout() time.Duration {
+	if l.IdleTimeout > 0 {
+		return l.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+// Dialers establish the connections, the manager only pools them. DialTCP
+// and DialTLS have the signatures of http.Transport, DialQUIC the one of
+// http3.Transport.Dial. DialTCP and DialTLS hand their connections to Track
+// so that the churn of TCP connections is counted.
+type Dialers struct {
+	DialTCP  func(ctx context.Context, network, addr string) (net.Conn, error)
+	DialTLS  func(ctx context.Context, network, addr string) (net.Conn, error)
+	DialQUIC func(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlyConnection, error)
+}
+
+// Manager pools the upstream connections of one client. h2 connections are
+// shared by net/http, which opens another one once the peer's
+// SETTINGS_MAX_CONCURRENT_STREAMS is reached; HTTP/3 connections are shared
+// by the manager itself.
+type Manager struct {
+	Limits   Limits
+	TCPStats *metrics.Upstream
+	H3Stats  *metrics.Upstream
+
+	tcp      *http.Transport
+	h3       *h3Pool
+	quicConf *quic.Config
+	// streamLimits of the QUIC connections, filled in by their tracers
+	streamLimits *utils.SafeMap[quic.ConnectionTracingID, *streamLimit]
+}
+
+// NewManager Create a manager dialing with dialers. tlsConf is the base of the
+// TLS config of the QUIC connections, DialTLS does the TLS handshakes over TCP.
+func NewManager(limits Limits, dialers Dialers, tlsConf *tls.Config, quicConf *quic.Config) *Manager {
+	m := &Manager{
+		Limits:   limits,
+		TCPStats: metrics.UpstreamTCP,
+		H3Stats:  metrics.UpstreamH3,
+
+		streamLimits: utils.NewSafeMap[quic.ConnectionTracingID, *streamLimit](),
+	}
+	m.tcp = &http.Transport{
+		DialContext:         dialers.DialTCP,
+		DialTLSContext:      dialers.DialTLS,
+		ForceAttemptHTTP2:   true,
+		MaxConnsPerHost:     limits.maxConns(),
+		MaxIdleConnsPerHost: limits.maxIdleConns(),
+		IdleConnTimeout:     limits.idleTimeout(),
+		// requests expecting 100 Continue hold their body until the origin asks for it
+		ExpectContinueTimeout: h2h3convert.ExpectContinueTimeout,
+	}
+	m.quicConf = m.traceStreamLimits(quicConf)
+	m.h3 = newH3Pool(m, dialers.DialQUIC, tlsConf)
+	return m
+}
+
+// QUICConfig Return the config every QUIC connection handed to the manager
+// must be dialed with, it learns the stream limits of the peer
+func (m *Manager) QUICConfig() *quic.Config {
+	return m.quicConf
+}
+
+// Track Count conn as an upstream TCP connection until it is closed. TLS
+// connections must be tracked below the TLS layer, net/http needs the *tls.Conn.
+func (m *Manager) Track(conn net.Conn) net.Conn {
+	m.TCPStats.Opened.Add(1)
+	return &trackedConn{Conn: conn, stats: m.TCPStats}
+}
+
+// trackedConn counts its Close once
+type trackedConn struct {
+	net.Conn
+	stats *metrics.Upstream
+	once  sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.stats.Closed.Add(1) })
+	return c.Conn.Close()
+}
+
+// RoundTripTCP Send req over a pooled TCP/TLS connection
+func (m *Manager) RoundTripTCP(req *http.Request) (*http.Response, error) {
+	m.TCPStats.Requests.Add(1)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				m.TCPStats.Reused.Add(1)
+			}
+		},
+	}
+	return m.tcp.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// RoundTripH3 Send req over a pooled HTTP/3 connection to the host of its
+// URL, whose certificate must be valid for the authority of req: the URL may
+// point to an alternative service of the origin. With onlyCached it fails with http3.ErrNoCachedConn instead of
+// dialing the first connection to the host.
+func (m *Manager) RoundTripH3(req *http.Request, onlyCached bool) (*http.Response, error) {
+	return m.h3.roundTrip(req, onlyCached)
+}
+
+// CloseIdleConnections Close the connections that carry no request
+func (m *Manager) CloseIdleConnections() {
+	m.tcp.CloseIdleConnections()
+	m.h3.closeIdle()
+}
+
+// Close Close every connection, the manager can't be used afterwards
+func (m *Manager) Close() error {
+	m.tcp.CloseIdleConnections()
+	m.h3.close()
+	return nil
+}
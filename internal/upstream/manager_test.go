@@ -0,0 +1,221 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	headerpolicy "quic-proxy/internal/header-policy"
+	"quic-proxy/internal/metrics"
+	"quic-proxy/internal/testutil"
+)
+
+func newTestManager(limits Limits) *Manager {
+	var m *Manager
+	m = NewManager(limits, Dialers{
+		DialTCP: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return m.Track(conn), nil
+		},
+		DialQUIC: func(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlyConnection, error) {
+			return quic.DialAddrEarly(ctx, addr, tlsConf, quicConf)
+		},
+	}, &tls.Config{InsecureSkipVerify: true}, nil)
+	m.TCPStats = new(metrics.Upstream)
+	m.H3Stats = new(metrics.Upstream)
+	return m
+}
+
+func get(t *testing.T, roundTrip func(*http.Request) (*http.Response, error), target string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	resp, err := roundTrip(req)
+	if err != nil {
+		t.Fatalf("request to %s failed: %v", target, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func TestManager_Reuse(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h3Addr := testutil.StartH3Server(t, handler)
+	tcpServer := httptest.NewServer(handler)
+	defer tcpServer.Close()
+
+	m := newTestManager(Limits{})
+	defer m.Close()
+	for i := 0; i < 3; i++ {
+		get(t, m.RoundTripTCP, tcpServer.URL)
+		get(t, func(req *http.Request) (*http.Response, error) { return m.RoundTripH3(req, false) }, "https://"+h3Addr)
+	}
+
+	tTable := []struct {
+		name     string
+		stats    *metrics.Upstream
+		expected [3]int64 // opened, requests, reused
+	}{
+		{name: "tcp", stats: m.TCPStats, expected: [3]int64{1, 3, 2}},
+		{name: "h3", stats: m.H3Stats, expected: [3]int64{1, 3, 2}},
+	}
+	for _, tCase := range tTable {
+		got := [3]int64{tCase.stats.Opened.Load(), tCase.stats.Requests.Load(), tCase.stats.Reused.Load()}
+		if got != tCase.expected {
+			t.Errorf("%s: expected opened/requests/reused %v, got %v", tCase.name, tCase.expected, got)
+		}
+	}
+}
+
+func TestManager_H3StreamLimit(t *testing.T) {
+	tTable := []struct {
+		name           string
+		maxConns       int
+		expectedOpened int64
+	}{
+		{name: "extra connection", maxConns: 0, expectedOpened: 2},
+		{name: "origin at its limit", maxConns: 1, expectedOpened: 1},
+	}
+
+	for _, tCase := range tTable {
+		release := make(chan struct{})
+		h3Addr := testutil.ServeH3(t, &http3.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				<-release
+			}),
+			// a single request stream at a time per connection
+			QUICConfig: &quic.Config{MaxIncomingStreams: 1},
+		})
+		m := newTestManager(Limits{MaxConnsPerOrigin: tCase.maxConns})
+
+		// the first response stays open, the second request needs another stream
+		req, _ := http.NewRequest(http.MethodGet, "https://"+h3Addr, nil)
+		first, err := m.RoundTripH3(req, false)
+		if err != nil {
+			t.Fatalf("%s: first request failed: %v", tCase.name, err)
+		}
+		done := make(chan error, 1)
+		go func() {
+			req, _ := http.NewRequest(http.MethodGet, "https://"+h3Addr, nil)
+			resp, err := m.RoundTripH3(req, false)
+			if err == nil {
+				resp.Body.Close()
+			}
+			done <- err
+		}()
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+		first.Body.Close()
+		if err := <-done; err != nil {
+			t.Errorf("%s: second request failed: %v", tCase.name, err)
+		}
+		m.Close()
+
+		if opened := m.H3Stats.Opened.Load(); opened != tCase.expectedOpened {
+			t.Errorf("%s: expected %d connections, got %d", tCase.name, tCase.expectedOpened, opened)
+		}
+		if limited := m.H3Stats.StreamLimited.Load(); limited != tCase.expectedOpened-1 {
+			t.Errorf("%s: expected %d stream limited dials, got %d", tCase.name, tCase.expectedOpened-1, limited)
+		}
+	}
+}
+
+func TestManager_IdleTimeout(t *testing.T) {
+	h3Addr := testutil.StartH3Server(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	m := newTestManager(Limits{IdleTimeout: 50 * time.Millisecond})
+	defer m.Close()
+
+	get(t, func(req *http.Request) (*http.Response, error) { return m.RoundTripH3(req, false) }, "https://"+h3Addr)
+	deadline := time.Now().Add(2 * time.Second)
+	for m.H3Stats.Closed.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if closed := m.H3Stats.Closed.Load(); closed != 1 {
+		t.Fatalf("expected the idle connection to be closed, got %d closed", closed)
+	}
+
+	// the next request dials again
+	req, _ := http.NewRequest(http.MethodGet, "https://"+h3Addr, nil)
+	if _, err := m.RoundTripH3(req, true); err != http3.ErrNoCachedConn {
+		t.Errorf("expected no cached connection, got %v", err)
+	}
+}
+
+func TestManager_H3FieldSectionLimit(t *testing.T) {
+	h3Addr := testutil.ServeH3(t, &http3.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Header.Get("Cookie")))
+		}),
+		AdditionalSettings: map[uint64]uint64{headerpolicy.SettingMaxFieldSectionSize: 512},
+	})
+	m := newTestManager(Limits{})
+	defer m.Close()
+	roundTrip := func(req *http.Request) (*http.Response, error) { return m.RoundTripH3(req, false) }
+	get(t, roundTrip, "https://"+h3Addr)
+	m.h3.mu.Lock()
+	for _, conns := range m.h3.conns {
+		for _, c := range conns {
+			select {
+			case <-c.cc.ReceivedSettings():
+			case <-time.After(5 * time.Second):
+				t.Fatalf("the SETTINGS of the server didn't arrive")
+			}
+		}
+	}
+	m.h3.mu.Unlock()
+
+	tTable := []struct {
+		name     string
+		header   http.Header
+		expected string
+		err      error
+	}{
+		// sent as crumbs, the server puts them back together
+		{name: "cookie crumbs", header: http.Header{"Cookie": {"a=1; b=2"}}, expected: "a=1; b=2"},
+		{name: "over the server limit", header: http.Header{"X-Pad": {strings.Repeat("a", 512)}}, err: headerpolicy.ErrTooLarge},
+	}
+	for _, tCase := range tTable {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+h3Addr, nil)
+		req.Header = tCase.header
+		resp, err := roundTrip(req)
+		if tCase.err != nil {
+			if !errors.Is(err, tCase.err) {
+				t.Errorf("%s: expected %v, got %v", tCase.name, tCase.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", tCase.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tCase.expected {
+			t.Errorf("%s: expected the server to get %q, got %q", tCase.name, tCase.expected, body)
+		}
+		if len(req.Header["Cookie"]) != 1 {
+			t.Errorf("%s: the request must not be modified, got %v", tCase.name, req.Header)
+		}
+	}
+	m.h3.mu.Lock()
+	defer m.h3.mu.Unlock()
+	for _, conns := range m.h3.conns {
+		for _, c := range conns {
+			if c.inflight != 0 {
+				t.Errorf("expected the refused request to release its connection, %d in flight", c.inflight)
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package upstream
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// streamLimit is the number of bidirectional streams the peer allows in
+// total, it only grows: the initial transport parameter, then MAX_STREAMS frames
+type streamLimit struct {
+	maxBidi atomic.Int64
+}
+
+func (l *streamLimit) raise(n int64) {
+	for {
+		current := l.maxBidi.Load()
+		if n <= current || l.maxBidi.CompareAndSwap(current, n) {
+			return
+		}
+	}
+}
+
+// traceStreamLimits Return a copy of quicConf whose tracer also records the
+// stream limit of every connection, the tracer of quicConf keeps working
+func (m *Manager) traceStreamLimits(quicConf *quic.Config) *quic.Config {
+	if quicConf == nil {
+		quicConf = &quic.Config{}
+	}
+	quicConf = quicConf.Clone()
+	next := quicConf.Tracer
+	quicConf.Tracer = func(ctx context.Context, p logging.Perspective, connID quic.ConnectionID) *logging.ConnectionTracer {
+		tracer := m.streamLimitTracer(ctx)
+		if next != nil {
+			if t := next(ctx, p, connID); t != nil {
+				return logging.NewMultiplexedConnectionTracer(tracer, t)
+			}
+		}
+		return tracer
+	}
+	return quicConf
+}
+
+// streamLimitTracer Create the tracer recording the stream limit of the
+// connection identified by the tracing ID in ctx
+func (m *Manager) streamLimitTracer(ctx context.Context) *logging.ConnectionTracer {
+	id, _ := ctx.Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	limit := &streamLimit{}
+	m.streamLimits.Set(id, limit)
+	onParameters := func(tp *logging.TransportParameters) {
+		limit.raise(int64(tp.MaxBidiStreamNum))
+	}
+	return &logging.ConnectionTracer{
+		ReceivedTransportParameters: onParameters,
+		// the limit remembered for 0-RTT
+		RestoredTransportParameters: onParameters,
+		ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, _ logging.ByteCount, _ logging.ECN, frames []logging.Frame) {
+			for _, f := range frames {
+				if f, ok := f.(*logging.MaxStreamsFrame); ok && f.Type == logging.StreamTypeBidi {
+					limit.raise(int64(f.MaxStreamNum))
+				}
+			}
+		},
+		Close: func() { m.streamLimits.Delete(id) },
+	}
+}
+
+// streamLimitOf Return the stream limit recorded for conn, nil if it wasn't
+// dialed with the config of the manager
+func (m *Manager) streamLimitOf(conn quic.Connection) *streamLimit {
+	id, _ := conn.Context().Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	limit, _ := m.streamLimits.Get(id)
+	return limit
+}
@@ -16,8 +16,9 @@ type Service struct {
 	AltAuthority AltAuthority
 
 	// https://datatracker.ietf.org/doc/html/rfc7838#section-3.1
-	MaxAge  int
-	Persist int
+	MaxAge    int
+	HasMaxAge bool // false when "ma" is absent, the default freshness applies
+	Persist   int
 }
 
 // AltAuthority represents the host and port of an alternative service.
@@ -46,6 +47,9 @@ func Parse(s string) ([]Service, error) {
 		}
 		services = append(services, svc)
 	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("invalid parameter: %q", s)
+	}
 	return services, nil
 }
 
@@ -70,11 +74,13 @@ func parseService(s string) (Service, error) {
 
 		switch key {
 		case "ma":
+			// delta-seconds, ma=0 means the alternative is already stale
 			ma, err := strconv.Atoi(value)
-			if err != nil {
+			if err != nil || ma < 0 {
 				return svc, fmt.Errorf("invalid value for 'ma': %q", value)
 			}
 			svc.MaxAge = ma
+			svc.HasMaxAge = true
 		case "persist":
 			p, err := strconv.Atoi(value)
 			if err != nil {
@@ -0,0 +1,278 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultMaxAge is the freshness lifetime of an alternative without an explicit
+// "ma" parameter (24 hours).
+// https://datatracker.ietf.org/doc/html/rfc7838#section-3.1
+const DefaultMaxAge = 24 * 60 * 60
+
+const (
+	// brokenBaseDelay is how long an alternative is skipped after its first failure,
+	// every further consecutive failure doubles it up to brokenMaxDelay.
+	brokenBaseDelay = 5 * time.Minute
+	brokenMaxDelay  = 48 * time.Hour
+)
+
+// Origin identifies an origin server by scheme, host and port.
+type Origin struct {
+	Scheme string
+	Host   string
+	Port   string
+}
+
+// OriginFromURL Build the origin of u, filling in the default port of the scheme
+func OriginFromURL(u *url.URL) Origin {
+	port := u.Port()
+	if port == "" {
+		if u.Scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+	return Origin{Scheme: u.Scheme, Host: u.Hostname(), Port: port}
+}
+
+func (o Origin) String() string {
+	return o.Scheme + "://" + net.JoinHostPort(o.Host, o.Port)
+}
+
+// Alternative is a cached alternative service of an origin.
+type Alternative struct {
+	ProtocolID string
+	Host       string // never empty, defaults to the host of the origin
+	Port       string
+	Expires    time.Time
+	Persist    bool
+}
+
+// Addr returns the host:port to connect to.
+func (a Alternative) Addr() string {
+	return net.JoinHostPort(a.Host, a.Port)
+}
+
+// brokenKey identifies one alternative of one origin.
+type brokenKey struct {
+	origin     Origin
+	protocolID string
+	addr       string
+}
+
+// brokenState records the consecutive failures of an alternative.
+type brokenState struct {
+	failures int
+	until    time.Time
+}
+
+// AltSvcCache stores the alternative services advertised by origins, honouring
+// the ma, persist and clear semantics of RFC 7838. Alternatives that failed are
+// marked broken and skipped with exponential backoff. It is safe for concurrent use.
+type AltSvcCache struct {
+	entries *SafeMap[Origin, []Alternative]
+	broken  *SafeMap[brokenKey, brokenState]
+	now     func() time.Time
+}
+
+// DefaultAltSvcCache is shared by the clients and the proxies.
+var DefaultAltSvcCache = NewAltSvcCache()
+
+func NewAltSvcCache() *AltSvcCache {
+	return &AltSvcCache{
+		entries: NewSafeMap[Origin, []Alternative](),
+		broken:  NewSafeMap[brokenKey, brokenState](),
+		now:     time.Now,
+	}
+}
+
+// Update Parse an Alt-Svc header received from origin and store the result
+func (c *AltSvcCache) Update(origin Origin, header string) error {
+	if strings.TrimSpace(header) == "" {
+		return nil
+	}
+	services, err := Parse(header)
+	if err != nil {
+		return err
+	}
+	c.Store(origin, services)
+	return nil
+}
+
+// Store Replace all cached alternatives of origin with services.
+// A newly received Alt-Svc invalidates everything cached before, see
+// https://datatracker.ietf.org/doc/html/rfc7838#section-3.1
+func (c *AltSvcCache) Store(origin Origin, services []Service) {
+	now := c.now()
+	alts := make([]Alternative, 0, len(services))
+	for _, svc := range services {
+		if svc.Clear {
+			c.Clear(origin)
+			return
+		}
+		maxAge := svc.MaxAge
+		if !svc.HasMaxAge {
+			maxAge = DefaultMaxAge
+		}
+		host := svc.AltAuthority.Host
+		if host == "" {
+			host = origin.Host
+		}
+		alts = append(alts, Alternative{
+			ProtocolID: svc.ProtocolID,
+			Host:       host,
+			Port:       svc.AltAuthority.Port,
+			Expires:    now.Add(time.Duration(maxAge) * time.Second),
+			Persist:    svc.Persist == 1,
+		})
+	}
+	if len(alts) == 0 {
+		c.Clear(origin)
+		return
+	}
+	c.entries.Set(origin, alts)
+}
+
+// Lookup Return the fresh alternatives of origin that are not marked broken, best first.
+// Alternatives are ranked by the position of their protocol in protocolIDs and
+// then by the order the origin listed them in, which reflects its preference.
+// If protocolIDs is empty every protocol is returned.
+func (c *AltSvcCache) Lookup(origin Origin, protocolIDs ...string) []Alternative {
+	now := c.now()
+	var result []Alternative
+	c.entries.Compute(origin, func(alts []Alternative, exists bool) ([]Alternative, bool) {
+		if !exists {
+			return nil, false
+		}
+		fresh := alts[:0:0]
+		for _, alt := range alts {
+			if alt.Expires.After(now) {
+				fresh = append(fresh, alt)
+			}
+		}
+		result = slices.Clone(fresh)
+		return fresh, len(fresh) > 0
+	})
+	result = slices.DeleteFunc(result, func(alt Alternative) bool {
+		return c.isBroken(origin, alt, now)
+	})
+	if len(protocolIDs) == 0 {
+		return result
+	}
+
+	rank := func(alt Alternative) int {
+		return slices.Index(protocolIDs, alt.ProtocolID)
+	}
+	result = slices.DeleteFunc(result, func(alt Alternative) bool {
+		return rank(alt) < 0
+	})
+	sort.SliceStable(result, func(i, j int) bool {
+		return rank(result[i]) < rank(result[j])
+	})
+	return result
+}
+
+// MarkBroken Record a failure of alt and return how long it will be skipped
+func (c *AltSvcCache) MarkBroken(origin Origin, alt Alternative) time.Duration {
+	var delay time.Duration
+	key := brokenKey{origin: origin, protocolID: alt.ProtocolID, addr: alt.Addr()}
+	c.broken.Compute(key, func(state brokenState, _ bool) (brokenState, bool) {
+		delay = brokenBaseDelay << state.failures
+		if delay <= 0 || delay > brokenMaxDelay {
+			delay = brokenMaxDelay
+		}
+		state.failures++
+		state.until = c.now().Add(delay)
+		return state, true
+	})
+	return delay
+}
+
+// MarkWorking Forget the failures of alt after it was used successfully
+func (c *AltSvcCache) MarkWorking(origin Origin, alt Alternative) {
+	c.broken.Delete(brokenKey{origin: origin, protocolID: alt.ProtocolID, addr: alt.Addr()})
+}
+
+// IsBroken Report whether alt is currently skipped because of recent failures
+func (c *AltSvcCache) IsBroken(origin Origin, alt Alternative) bool {
+	return c.isBroken(origin, alt, c.now())
+}
+
+func (c *AltSvcCache) isBroken(origin Origin, alt Alternative, now time.Time) bool {
+	state, ok := c.broken.Get(brokenKey{origin: origin, protocolID: alt.ProtocolID, addr: alt.Addr()})
+	return ok && state.until.After(now)
+}
+
+// Clear Drop every alternative of origin
+func (c *AltSvcCache) Clear(origin Origin) {
+	c.entries.Delete(origin)
+}
+
+// NetworkChanged Flush every alternative not marked with persist=1.
+// https://datatracker.ietf.org/doc/html/rfc7838#section-2.2
+// Broken marks are forgotten as well, an alternative blocked on the old
+// network may well work on the new one.
+func (c *AltSvcCache) NetworkChanged() {
+	for _, key := range c.broken.Keys() {
+		c.broken.Delete(key)
+	}
+	for _, origin := range c.entries.Keys() {
+		c.entries.Compute(origin, func(alts []Alternative, exists bool) ([]Alternative, bool) {
+			kept := slices.DeleteFunc(slices.Clone(alts), func(alt Alternative) bool {
+				return !alt.Persist
+			})
+			return kept, len(kept) > 0
+		})
+	}
+}
+
+// WatchNetwork Poll the local interface addresses every interval and call
+// NetworkChanged whenever they differ, until ctx is done.
+func (c *AltSvcCache) WatchNetwork(ctx context.Context, interval time.Duration) {
+	WatchInterfaces(ctx, interval, func() {
+		log.Printf("[AltSvc] Network changed, flushing non-persistent alternatives")
+		c.NetworkChanged()
+	})
+}
+
+// WatchInterfaces Poll the local interface addresses every interval and call
+// changed whenever they differ, until ctx is done.
+func WatchInterfaces(ctx context.Context, interval time.Duration, changed func()) {
+	last := interfaceAddrs()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := interfaceAddrs()
+			if !slices.Equal(last, current) {
+				changed()
+				last = current
+			}
+		}
+	}
+}
+
+// interfaceAddrs Get the sorted list of local interface addresses
+func interfaceAddrs() []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	result := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		result = append(result, addr.String())
+	}
+	sort.Strings(result)
+	return result
+}
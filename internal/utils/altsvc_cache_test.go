@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestCache(now *time.Time) *AltSvcCache {
+	c := NewAltSvcCache()
+	c.now = func() time.Time { return *now }
+	return c
+}
+
+func TestOriginFromURL(t *testing.T) {
+	tTable := []struct {
+		input    string
+		expected Origin
+	}{
+		{input: "http://example.com/a", expected: Origin{Scheme: "http", Host: "example.com", Port: "80"}},
+		{input: "https://example.com", expected: Origin{Scheme: "https", Host: "example.com", Port: "443"}},
+		{input: "https://[::1]:8443/", expected: Origin{Scheme: "https", Host: "::1", Port: "8443"}},
+	}
+	for _, tCase := range tTable {
+		u, _ := url.Parse(tCase.input)
+		if origin := OriginFromURL(u); origin != tCase.expected {
+			t.Errorf("expected %v for %s but got %v", tCase.expected, tCase.input, origin)
+		}
+	}
+}
+
+func TestAltSvcCache_MaxAge(t *testing.T) {
+	now := time.Now()
+	c := newTestCache(&now)
+	origin := Origin{Scheme: "https", Host: "example.com", Port: "443"}
+
+	if err := c.Update(origin, `h3=":8443"; ma=60`); err != nil {
+		t.Fatalf("failed to update cache: %v", err)
+	}
+	alts := c.Lookup(origin, "h3")
+	if len(alts) != 1 || alts[0].Addr() != "example.com:8443" {
+		t.Fatalf("expected example.com:8443, got %v", alts)
+	}
+
+	now = now.Add(61 * time.Second)
+	if alts := c.Lookup(origin, "h3"); len(alts) != 0 {
+		t.Errorf("expected alternative to expire, got %v", alts)
+	}
+}
+
+func TestAltSvcCache_MaxAgeZero(t *testing.T) {
+	now := time.Now()
+	c := newTestCache(&now)
+	origin := Origin{Scheme: "https", Host: "example.com", Port: "443"}
+
+	// an explicit ma=0 is stale right away, unlike a missing ma
+	if err := c.Update(origin, `h3=":8443"; ma=0, h3=":9443"`); err != nil {
+		t.Fatalf("failed to update cache: %v", err)
+	}
+	alts := c.Lookup(origin, "h3")
+	if len(alts) != 1 || alts[0].Addr() != "example.com:9443" {
+		t.Fatalf("expected example.com:9443 only, got %v", alts)
+	}
+	if expires := alts[0].Expires.Sub(now); expires != DefaultMaxAge*time.Second {
+		t.Errorf("expected the default max age, got %v", expires)
+	}
+}
+
+func TestAltSvcCache_Clear(t *testing.T) {
+	now := time.Now()
+	c := newTestCache(&now)
+	origin := Origin{Scheme: "https", Host: "example.com", Port: "443"}
+
+	_ = c.Update(origin, `h3=":8443", h2="alt.example.com:443"`)
+	if alts := c.Lookup(origin); len(alts) != 2 {
+		t.Fatalf("expected 2 alternatives, got %v", alts)
+	}
+	_ = c.Update(origin, `clear`)
+	if alts := c.Lookup(origin); len(alts) != 0 {
+		t.Errorf("expected no alternatives after clear, got %v", alts)
+	}
+}
+
+func TestAltSvcCache_Replace(t *testing.T) {
+	now := time.Now()
+	c := newTestCache(&now)
+	origin := Origin{Scheme: "https", Host: "example.com", Port: "443"}
+
+	_ = c.Update(origin, `h3=":8443"`)
+	_ = c.Update(origin, `h3=":9443"`)
+	alts := c.Lookup(origin, "h3")
+	if len(alts) != 1 || alts[0].Port != "9443" {
+		t.Errorf("expected the newer header to replace the old one, got %v", alts)
+	}
+}
+
+func TestAltSvcCache_NetworkChanged(t *testing.T) {
+	now := time.Now()
+	c := newTestCache(&now)
+	a := Origin{Scheme: "https", Host: "a.example.com", Port: "443"}
+	b := Origin{Scheme: "https", Host: "b.example.com", Port: "443"}
+
+	_ = c.Update(a, `h3=":443"; persist=1, h3-29=":443"`)
+	_ = c.Update(b, `h3=":443"`)
+	c.NetworkChanged()
+
+	alts := c.Lookup(a)
+	if len(alts) != 1 || alts[0].ProtocolID != "h3" || !alts[0].Persist {
+		t.Errorf("expected only the persistent alternative to survive, got %v", alts)
+	}
+	if alts := c.Lookup(b); len(alts) != 0 {
+		t.Errorf("expected non-persistent alternatives to be flushed, got %v", alts)
+	}
+}
+
+func TestAltSvcCache_Rank(t *testing.T) {
+	now := time.Now()
+	c := newTestCache(&now)
+	origin := Origin{Scheme: "https", Host: "example.com", Port: "443"}
+
+	_ = c.Update(origin, `h2=":443", h3-29=":8444", h3=":8443", h3="alt.example.com:8443"`)
+	alts := c.Lookup(origin, "h3", "h3-29")
+	expected := []string{"example.com:8443", "alt.example.com:8443", "example.com:8444"}
+	if len(alts) != len(expected) {
+		t.Fatalf("expected %d alternatives, got %v", len(expected), alts)
+	}
+	for i, alt := range alts {
+		if alt.Addr() != expected[i] {
+			t.Errorf("expected %s at rank %d, got %s", expected[i], i, alt.Addr())
+		}
+	}
+}
+
+func TestAltSvcCache_Broken(t *testing.T) {
+	now := time.Now()
+	c := newTestCache(&now)
+	origin := Origin{Scheme: "https", Host: "example.com", Port: "443"}
+
+	_ = c.Update(origin, `h3=":8443", h3=":9443"`)
+	first := c.Lookup(origin, "h3")[0]
+
+	if delay := c.MarkBroken(origin, first); delay != brokenBaseDelay {
+		t.Errorf("expected first backoff %v, got %v", brokenBaseDelay, delay)
+	}
+	alts := c.Lookup(origin, "h3")
+	if len(alts) != 1 || alts[0].Port != "9443" {
+		t.Fatalf("expected broken alternative to be skipped, got %v", alts)
+	}
+	if delay := c.MarkBroken(origin, first); delay != 2*brokenBaseDelay {
+		t.Errorf("expected backoff to double to %v, got %v", 2*brokenBaseDelay, delay)
+	}
+
+	now = now.Add(2*brokenBaseDelay + time.Second)
+	if c.IsBroken(origin, first) {
+		t.Errorf("expected backoff to elapse")
+	}
+	c.MarkWorking(origin, first)
+	if delay := c.MarkBroken(origin, first); delay != brokenBaseDelay {
+		t.Errorf("expected backoff to restart after MarkWorking, got %v", delay)
+	}
+
+	c.NetworkChanged()
+	if c.IsBroken(origin, first) {
+		t.Errorf("expected network change to forget broken alternatives")
+	}
+}
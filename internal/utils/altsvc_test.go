@@ -20,13 +20,13 @@ func TestParse(t *testing.T) {
 		{
 			input: `h2=":443"; ma=2592000;`,
 			expected: []Service{
-				{ProtocolID: "h2", AltAuthority: AltAuthority{Port: "443"}, MaxAge: 2592000},
+				{ProtocolID: "h2", AltAuthority: AltAuthority{Port: "443"}, MaxAge: 2592000, HasMaxAge: true},
 			},
 		},
 		{
 			input: `h2=":443"; ma=2592000; persist=1`,
 			expected: []Service{
-				{ProtocolID: "h2", AltAuthority: AltAuthority{Port: "443"}, MaxAge: 2592000, Persist: 1},
+				{ProtocolID: "h2", AltAuthority: AltAuthority{Port: "443"}, MaxAge: 2592000, HasMaxAge: true, Persist: 1},
 			},
 		},
 		{
@@ -39,8 +39,8 @@ func TestParse(t *testing.T) {
 		{
 			input: `h3-25=":443"; ma=3600, h2=":443"; ma=3600`,
 			expected: []Service{
-				{ProtocolID: "h3-25", AltAuthority: AltAuthority{Port: "443"}, MaxAge: 3600},
-				{ProtocolID: "h2", AltAuthority: AltAuthority{Port: "443"}, MaxAge: 3600},
+				{ProtocolID: "h3-25", AltAuthority: AltAuthority{Port: "443"}, MaxAge: 3600, HasMaxAge: true},
+				{ProtocolID: "h2", AltAuthority: AltAuthority{Port: "443"}, MaxAge: 3600, HasMaxAge: true},
 			},
 		},
 	}
@@ -65,6 +65,10 @@ func TestParseErrors(t *testing.T) {
 			input:     ``,
 			errPrefix: `invalid parameter`,
 		},
+		{
+			input:     `h3=":443"; ma=-1`,
+			errPrefix: `invalid value for 'ma'`,
+		},
 	}
 
 	for _, tCase := range tTable {
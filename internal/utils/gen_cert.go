@@ -10,6 +10,7 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"log"
 	"math/big"
 	"net"
@@ -24,6 +25,7 @@ type TLSCertificateGenerator struct {
 	ValidFrom  string        // Valid From (format: "Jan 2 15:04:05 2006")
 	ValidFor   time.Duration // Validity period
 	IsCA       bool          // Is Certificate Authority
+	ClientAuth bool          // Usable as a TLS client certificate too, for mutual TLS
 	RsaBits    int           // Bits of RSA key to generate
 	EcdsaCurve string        // Type of elliptic curve to use
 	Ed25519Key bool          // Use Ed25519 key
@@ -108,6 +110,9 @@ func (t *TLSCertificateGenerator) Generate() error {
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 	}
+	if t.ClientAuth {
+		template.ExtKeyUsage = append(template.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+	}
 
 	hosts := strings.Split(t.Host, ",")
 	for _, h := range hosts {
@@ -175,3 +180,19 @@ func writePemFile(path string, pemType string, data []byte) error {
 
 	return nil
 }
+
+// EnsureCertificate Generate a self-signed certificate if none exists yet
+func EnsureCertificate(certPath, keyPath string) error {
+	if _, err := os.Stat(certPath); err == nil {
+		if _, err := os.Stat(keyPath); err == nil {
+			return nil
+		}
+	}
+	certGenerator := *DefaultTLSCertificateGenerator
+	certGenerator.CertPath = certPath
+	certGenerator.KeyPath = keyPath
+	if err := certGenerator.Generate(); err != nil {
+		return fmt.Errorf("failed to generate certificate: %w", err)
+	}
+	return nil
+}
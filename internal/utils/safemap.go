@@ -43,3 +43,28 @@ func (s *SafeMap[K, V]) Keys() []K {
 	}
 	return keys
 }
+
+// Compute atomically updates the value stored under key. fn receives the
+// current value and whether it exists; returning false removes the key.
+func (s *SafeMap[K, V]) Compute(key K, fn func(value V, exists bool) (V, bool)) {
+	s.Lock()
+	defer s.Unlock()
+	value, exists := s.m[key]
+	if newValue, keep := fn(value, exists); keep {
+		s.m[key] = newValue
+	} else {
+		delete(s.m, key)
+	}
+}
+
+// Range calls fn for every entry while holding the read lock, stopping early
+// if fn returns false. fn must not modify the map.
+func (s *SafeMap[K, V]) Range(fn func(key K, value V) bool) {
+	s.RLock()
+	defer s.RUnlock()
+	for k, v := range s.m {
+		if !fn(k, v) {
+			return
+		}
+	}
+}
@@ -47,6 +47,53 @@ func TestSafeMap_Keys(t *testing.T) {
 	}
 }
 
+func TestSafeMap_Compute(t *testing.T) {
+	sm := NewSafeMap[string, int]()
+	sm.Compute("apple", func(v int, exists bool) (int, bool) {
+		if exists {
+			t.Errorf("Expected apple to not exist")
+		}
+		return v + 1, true
+	})
+	sm.Compute("apple", func(v int, exists bool) (int, bool) {
+		return v + 1, true
+	})
+	if value, exists := sm.Get("apple"); !exists || value != 2 {
+		t.Errorf("Expected apple=2, got %v, exists: %v", value, exists)
+	}
+
+	sm.Compute("apple", func(v int, exists bool) (int, bool) {
+		return 0, false
+	})
+	if _, exists := sm.Get("apple"); exists {
+		t.Errorf("Expected apple to be deleted")
+	}
+}
+
+func TestSafeMap_Range(t *testing.T) {
+	sm := NewSafeMap[string, int]()
+	sm.Set("apple", 10)
+	sm.Set("banana", 20)
+
+	sum := 0
+	sm.Range(func(_ string, v int) bool {
+		sum += v
+		return true
+	})
+	if sum != 30 {
+		t.Errorf("Expected sum 30, got %d", sum)
+	}
+
+	visited := 0
+	sm.Range(func(_ string, _ int) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Errorf("Expected Range to stop after 1 entry, visited %d", visited)
+	}
+}
+
 func TestSafeMap_ConcurrentAccess(t *testing.T) {
 	sm := NewSafeMap[int, int]()
 	var wg sync.WaitGroup
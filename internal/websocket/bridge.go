@@ -0,0 +1,150 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	h2h3convert "quic-proxy/internal/h2h3-convert"
+)
+
+// handshakeTimeout bounds opening the upstream side of a WebSocket
+const handshakeTimeout = 10 * time.Second
+
+// closeTimeout is how long the bridge waits for the other side to answer a
+// Close frame before dropping both connections
+const closeTimeout = 5 * time.Second
+
+// errClosed ends a relay once a Close frame passed through it
+var errClosed = errors.New("close frame relayed")
+
+// Bridge Relay frames between down and up until both sides sent a Close
+// frame or one of them failed. When a side goes away without a Close frame,
+// the other one gets a Close frame with a status translated from the failure.
+// Both connections are closed when Bridge returns.
+func Bridge(down, up *Conn) error {
+	defer down.Close()
+	defer up.Close()
+	errCh := make(chan error, 2)
+	go func() { errCh <- relay(up, down) }()
+	go func() { errCh <- relay(down, up) }()
+
+	err := <-errCh
+	select {
+	case err2 := <-errCh:
+		if err == errClosed {
+			err = err2
+		}
+	case <-time.After(closeTimeout):
+	}
+	if err == errClosed {
+		return nil
+	}
+	return err
+}
+
+// relay Copy the frames of src to dst, up to and including the Close frame
+func relay(dst, src *Conn) error {
+	for {
+		f, err := src.ReadFrame()
+		if err != nil {
+			code := CloseCodeForError(err)
+			dst.WriteFrame(CloseFrame(code, code.Reason()))
+			return err
+		}
+		if f.Opcode == OpClose {
+			if _, _, err := ParseClose(f.Payload); err != nil {
+				f = CloseFrame(CloseProtocolError, "invalid close frame")
+			}
+			if err := dst.WriteFrame(f); err != nil {
+				return err
+			}
+			return errClosed
+		}
+		if err := dst.WriteFrame(f); err != nil {
+			// answer the sender instead, the receiver is gone
+			code := CloseCodeForError(err)
+			src.WriteFrame(CloseFrame(code, code.Reason()))
+			return err
+		}
+	}
+}
+
+// CloseCodeForError Translate the failure of one side into the Close status
+// sent to the other side. 1006 can't be sent, so a side that went away
+// without a Close frame becomes 1001 Going Away, and an HTTP/3 stream reset
+// is translated by its error code.
+func CloseCodeForError(err error) CloseCode {
+	var h3Err *http3.Error
+	switch {
+	case errors.Is(err, ErrProtocol):
+		return CloseProtocolError
+	case errors.Is(err, ErrMessageTooBig):
+		return CloseMessageTooBig
+	case errors.As(err, &h3Err):
+		switch h3Err.ErrorCode {
+		case http3.ErrCodeNoError, http3.ErrCodeRequestCanceled:
+			return CloseGoingAway
+		case http3.ErrCodeExcessiveLoad:
+			return CloseTryAgainLater
+		default:
+			return CloseInternalError
+		}
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return CloseGoingAway
+	default:
+		return CloseInternalError
+	}
+}
+
+// Reason Return the reason sent along with a translated status
+func (code CloseCode) Reason() string {
+	switch code {
+	case CloseGoingAway:
+		return "peer went away"
+	case CloseProtocolError:
+		return "protocol error"
+	case CloseTryAgainLater:
+		return "peer overloaded"
+	case CloseMessageTooBig:
+		return "message too big"
+	default:
+		return "peer failed"
+	}
+}
+
+// DialFunc opens the upstream side of a WebSocket, header are the forwarded
+// headers of the handshake. DialH1 and DialH3 do the handshake.
+type DialFunc func(ctx context.Context, header http.Header) (*Conn, *http.Response, error)
+
+// Proxy Open the upstream side of the WebSocket requested by r with dial,
+// answer r the way upstream answered and bridge the frames until both sides
+// closed. A refused handshake is passed on with its status and body, so the
+// client sees the 401 or 403 of the backend.
+func Proxy(w http.ResponseWriter, r *http.Request, dial DialFunc) error {
+	if err := Validate(w, r); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), handshakeTimeout)
+	up, resp, err := dial(ctx, ForwardHeader(r.Header))
+	cancel()
+	if err != nil {
+		if resp != nil {
+			defer resp.Body.Close()
+			h2h3convert.WriteResponse(w, r, resp)
+		} else {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		return err
+	}
+	down, err := Accept(w, r, ResponseHeader(resp))
+	if err != nil {
+		up.Close()
+		return err
+	}
+	return Bridge(down, up)
+}
@@ -0,0 +1,140 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// MaxMessageSize bounds a message reassembled by ReadMessage
+const MaxMessageSize = 16 * MaxFramePayload
+
+var ErrMessageTooBig = errors.New("websocket message too big")
+
+// CloseError is returned by ReadMessage when the peer sent a Close frame
+type CloseError struct {
+	Code   CloseCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed by peer: %d %q", e.Code, e.Reason)
+}
+
+// Conn is one side of a WebSocket after the handshake, an upgraded HTTP/1.1
+// connection or an HTTP/3 request stream
+type Conn struct {
+	// Proto is the protocol the WebSocket runs over, HTTP/1.1 or HTTP/3.0
+	Proto string
+
+	r      io.Reader
+	w      io.Writer
+	closer io.Closer
+	// client tells whether this side opened the WebSocket, its frames are masked
+	client bool
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+// ReadFrame Read the next frame of the peer
+func (c *Conn) ReadFrame() (Frame, error) {
+	return ReadFrame(c.r, !c.client)
+}
+
+// WriteFrame Send f to the peer, safe for concurrent use. Nothing may follow
+// a Close frame, later frames are refused with errClosed.
+func (c *Conn) WriteFrame(f Frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return errClosed
+	}
+	c.closeSent = f.Opcode == OpClose
+	return WriteFrame(c.w, f, c.client)
+}
+
+// ReadMessage Read the next data message of the peer, reassembling its
+// fragments. Pings are answered and pongs dropped on the way. A Close frame is
+// returned as a *CloseError, answering it is up to the caller.
+func (c *Conn) ReadMessage() (Opcode, []byte, error) {
+	var op Opcode
+	var msg []byte
+	for {
+		f, err := c.ReadFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		if f.RSV != 0 {
+			// no extension is negotiated when the messages are terminated here
+			return 0, nil, fmt.Errorf("%w: unexpected RSV bits", ErrProtocol)
+		}
+		switch f.Opcode {
+		case OpPing:
+			if err := c.WriteFrame(Frame{Fin: true, Opcode: OpPong, Payload: f.Payload}); err != nil && err != errClosed {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			code, reason, err := ParseClose(f.Payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			return 0, nil, &CloseError{Code: code, Reason: reason}
+		case OpContinuation:
+			if op == 0 {
+				return 0, nil, fmt.Errorf("%w: continuation without a message", ErrProtocol)
+			}
+		case OpText, OpBinary:
+			if op != 0 {
+				return 0, nil, fmt.Errorf("%w: message interrupted by another one", ErrProtocol)
+			}
+			op = f.Opcode
+		default:
+			return 0, nil, fmt.Errorf("%w: unknown opcode %#x", ErrProtocol, byte(f.Opcode))
+		}
+		if len(msg)+len(f.Payload) > MaxMessageSize {
+			return 0, nil, ErrMessageTooBig
+		}
+		msg = append(msg, f.Payload...)
+		if f.Fin {
+			return op, msg, nil
+		}
+	}
+}
+
+// WriteMessage Send a data message, fragmented into frames of at most MaxFramePayload
+func (c *Conn) WriteMessage(op Opcode, msg []byte) error {
+	for {
+		n := min(len(msg), MaxFramePayload)
+		if err := c.WriteFrame(Frame{Fin: n == len(msg), Opcode: op, Payload: msg[:n]}); err != nil {
+			return err
+		}
+		msg = msg[n:]
+		if len(msg) == 0 {
+			return nil
+		}
+		op = OpContinuation
+	}
+}
+
+// Close Close the underlying connection or request stream
+func (c *Conn) Close() error {
+	return c.closer.Close()
+}
+
+// streamCloser ends an HTTP/3 request stream in both directions
+type streamCloser struct {
+	str http3.Stream
+}
+
+func (s streamCloser) Close() error {
+	s.str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	return s.str.Close()
+}
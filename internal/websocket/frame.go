@@ -0,0 +1,223 @@
+// Package websocket bridges WebSockets between HTTP/1.1 Upgrade (RFC 6455)
+// and HTTP/3 extended CONNECT (RFC 9220). After the handshake both carry the
+// same frames, so the bridge relays them one by one, fragments and extension
+// bits included, and only re-masks them for the side it is a client of.
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// Opcode is the opcode of a frame, RFC 6455 section 5.2
+type Opcode byte
+
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xa
+)
+
+// IsControl reports whether op is a control opcode
+func (op Opcode) IsControl() bool {
+	return op&0x8 != 0
+}
+
+// MaxFramePayload bounds the payload of a relayed frame, larger messages must be fragmented
+const MaxFramePayload = 1 << 20
+
+// maxControlPayload is the largest payload of a control frame, RFC 6455 section 5.5
+const maxControlPayload = 125
+
+var ErrProtocol = errors.New("websocket protocol error")
+
+// Frame is a WebSocket frame with its payload unmasked
+type Frame struct {
+	Fin     bool
+	RSV     byte // RSV1-3 as the high bits of the first byte, set by extensions
+	Opcode  Opcode
+	Payload []byte
+}
+
+// ReadFrame Read a frame from r. masked tells whether the peer is a client,
+// whose frames must be masked, while a server's frames must not be.
+func ReadFrame(r io.Reader, masked bool) (Frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return Frame{}, err
+	}
+	f := Frame{
+		Fin:    head[0]&0x80 != 0,
+		RSV:    head[0] & 0x70,
+		Opcode: Opcode(head[0] & 0x0f),
+	}
+	if head[1]&0x80 != 0 != masked {
+		return Frame{}, fmt.Errorf("%w: unexpected masking", ErrProtocol)
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return Frame{}, unexpectedEOF(err)
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return Frame{}, unexpectedEOF(err)
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if f.Opcode.IsControl() && (length > maxControlPayload || !f.Fin) {
+		return Frame{}, fmt.Errorf("%w: invalid control frame", ErrProtocol)
+	}
+	if length > MaxFramePayload {
+		return Frame{}, fmt.Errorf("%w: frame of %d bytes too large", ErrProtocol, length)
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return Frame{}, unexpectedEOF(err)
+		}
+	}
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return Frame{}, unexpectedEOF(err)
+	}
+	if masked {
+		mask(f.Payload, key)
+	}
+	return f, nil
+}
+
+// WriteFrame Write f to w in a single Write call, masked with a fresh key if
+// this side is the client
+func WriteFrame(w io.Writer, f Frame, masked bool) error {
+	b := make([]byte, 0, 14+len(f.Payload))
+	first := f.RSV & 0x70
+	if f.Fin {
+		first |= 0x80
+	}
+	b = append(b, first|byte(f.Opcode))
+
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch length := len(f.Payload); {
+	case length < 126:
+		b = append(b, maskBit|byte(length))
+	case length <= 0xffff:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(length))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(length))
+	}
+
+	if masked {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		b = append(b, key[:]...)
+		start := len(b)
+		b = append(b, f.Payload...)
+		mask(b[start:], key)
+	} else {
+		b = append(b, f.Payload...)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// mask Apply the masking key to payload, masking and unmasking are the same
+func mask(payload []byte, key [4]byte) {
+	for i := range payload {
+		payload[i] ^= key[i%4]
+	}
+}
+
+// unexpectedEOF Turn an io.EOF inside a frame into io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// CloseCode is the status code of a Close frame, RFC 6455 section 7.4
+type CloseCode uint16
+
+const (
+	CloseNormal           CloseCode = 1000
+	CloseGoingAway        CloseCode = 1001
+	CloseProtocolError    CloseCode = 1002
+	CloseUnsupportedData  CloseCode = 1003
+	CloseNoStatus         CloseCode = 1005 // never sent, the Close frame had no payload
+	CloseAbnormal         CloseCode = 1006 // never sent, the connection ended without a Close frame
+	CloseInvalidPayload   CloseCode = 1007
+	ClosePolicyViolation  CloseCode = 1008
+	CloseMessageTooBig    CloseCode = 1009
+	CloseInternalError    CloseCode = 1011
+	CloseTryAgainLater    CloseCode = 1013
+	CloseTLSHandshakeFail CloseCode = 1015 // never sent
+)
+
+// Sendable reports whether code may appear in a Close frame, RFC 6455 section 7.4.2
+func (code CloseCode) Sendable() bool {
+	switch {
+	case code < 1000, code == CloseNoStatus, code == CloseAbnormal, code == CloseTLSHandshakeFail:
+		return false
+	case code <= 1014, code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// ParseClose Extract the status code and reason of a Close frame payload, an
+// empty payload gives CloseNoStatus
+func ParseClose(payload []byte) (CloseCode, string, error) {
+	if len(payload) == 0 {
+		return CloseNoStatus, "", nil
+	}
+	if len(payload) == 1 {
+		return 0, "", fmt.Errorf("%w: truncated close code", ErrProtocol)
+	}
+	code := CloseCode(binary.BigEndian.Uint16(payload))
+	reason := payload[2:]
+	if !code.Sendable() {
+		return 0, "", fmt.Errorf("%w: invalid close code %d", ErrProtocol, code)
+	}
+	if !utf8.Valid(reason) {
+		return 0, "", fmt.Errorf("%w: close reason isn't UTF-8", ErrProtocol)
+	}
+	return code, string(reason), nil
+}
+
+// CloseFrame Build a Close frame, CloseNoStatus gives one without payload
+func CloseFrame(code CloseCode, reason string) Frame {
+	f := Frame{Fin: true, Opcode: OpClose}
+	if code != CloseNoStatus {
+		f.Payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		f.Payload = append(f.Payload, reason...)
+		if len(f.Payload) > maxControlPayload {
+			f.Payload = f.Payload[:maxControlPayload]
+			// don't cut the reason inside a UTF-8 sequence
+			for !utf8.Valid(f.Payload[2:]) {
+				f.Payload = f.Payload[:len(f.Payload)-1]
+			}
+		}
+	}
+	return f
+}
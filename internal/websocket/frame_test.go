@@ -0,0 +1,131 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tTable := []struct {
+		frame  Frame
+		masked bool
+	}{
+		{frame: Frame{Fin: true, Opcode: OpText, Payload: []byte("hello")}, masked: true},
+		{frame: Frame{Fin: true, Opcode: OpText, Payload: []byte("hello")}, masked: false},
+		{frame: Frame{Fin: false, Opcode: OpBinary, Payload: bytes.Repeat([]byte{1}, 125)}},
+		{frame: Frame{Fin: true, Opcode: OpContinuation, Payload: bytes.Repeat([]byte{2}, 126)}, masked: true},
+		{frame: Frame{Fin: true, Opcode: OpBinary, Payload: bytes.Repeat([]byte{3}, 65535)}},
+		{frame: Frame{Fin: true, Opcode: OpBinary, Payload: bytes.Repeat([]byte{4}, 65536)}, masked: true},
+		// permessage-deflate sets RSV1, it is relayed untouched
+		{frame: Frame{Fin: true, RSV: 0x40, Opcode: OpText, Payload: []byte{0xf2, 0x48}}},
+		{frame: Frame{Fin: true, Opcode: OpPing, Payload: []byte{}}, masked: true},
+	}
+
+	for i, tCase := range tTable {
+		var buf bytes.Buffer
+		if err := WriteFrame(&buf, tCase.frame, tCase.masked); err != nil {
+			t.Fatalf("case %d: WriteFrame failed: %v", i, err)
+		}
+		if tCase.masked && bytes.Contains(buf.Bytes(), []byte("hello")) {
+			t.Errorf("case %d: payload wasn't masked", i)
+		}
+		f, err := ReadFrame(&buf, tCase.masked)
+		if err != nil {
+			t.Fatalf("case %d: ReadFrame failed: %v", i, err)
+		}
+		if f.Fin != tCase.frame.Fin || f.RSV != tCase.frame.RSV || f.Opcode != tCase.frame.Opcode || !bytes.Equal(f.Payload, tCase.frame.Payload) {
+			t.Errorf("case %d: expected %+v, got %+v", i, tCase.frame, f)
+		}
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	frame := func(f Frame, masked bool) []byte {
+		var buf bytes.Buffer
+		WriteFrame(&buf, f, masked)
+		return buf.Bytes()
+	}
+	text := Frame{Fin: true, Opcode: OpText, Payload: []byte("hello")}
+
+	tTable := []struct {
+		name     string
+		data     []byte
+		masked   bool
+		expected error
+	}{
+		{name: "unmasked client frame", data: frame(text, false), masked: true, expected: ErrProtocol},
+		{name: "masked server frame", data: frame(text, true), masked: false, expected: ErrProtocol},
+		{name: "fragmented control frame", data: frame(Frame{Opcode: OpPing}, false), expected: ErrProtocol},
+		{name: "large control frame", data: frame(Frame{Fin: true, Opcode: OpClose, Payload: make([]byte, 126)}, false), expected: ErrProtocol},
+		{name: "truncated payload", data: frame(text, false)[:4], expected: io.ErrUnexpectedEOF},
+		{name: "empty", data: nil, expected: io.EOF},
+	}
+
+	for _, tCase := range tTable {
+		if _, err := ReadFrame(bytes.NewReader(tCase.data), tCase.masked); !errors.Is(err, tCase.expected) {
+			t.Errorf("%s: expected %v, got %v", tCase.name, tCase.expected, err)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	tTable := []struct {
+		payload        []byte
+		expectedCode   CloseCode
+		expectedReason string
+		expectedErr    bool
+	}{
+		{payload: nil, expectedCode: CloseNoStatus},
+		{payload: CloseFrame(CloseNormal, "bye").Payload, expectedCode: CloseNormal, expectedReason: "bye"},
+		{payload: CloseFrame(4000, "").Payload, expectedCode: 4000},
+		{payload: []byte{0x03}, expectedErr: true},
+		{payload: CloseFrame(CloseAbnormal, "").Payload, expectedErr: true},
+		{payload: CloseFrame(999, "").Payload, expectedErr: true},
+		{payload: append(CloseFrame(CloseNormal, "").Payload, 0xff), expectedErr: true},
+	}
+
+	for _, tCase := range tTable {
+		code, reason, err := ParseClose(tCase.payload)
+		if tCase.expectedErr {
+			if !errors.Is(err, ErrProtocol) {
+				t.Errorf("ParseClose(%x): expected a protocol error, got %d %q", tCase.payload, code, reason)
+			}
+			continue
+		}
+		if err != nil || code != tCase.expectedCode || reason != tCase.expectedReason {
+			t.Errorf("ParseClose(%x): expected %d %q, got %d %q, %v", tCase.payload, tCase.expectedCode, tCase.expectedReason, code, reason, err)
+		}
+	}
+
+	// a long reason is cut to fit a control frame without breaking UTF-8
+	f := CloseFrame(CloseNormal, strings.Repeat("é", 100))
+	if _, _, err := ParseClose(f.Payload); err != nil || len(f.Payload) > 125 {
+		t.Errorf("expected a valid close frame of at most 125 bytes, got %d bytes, %v", len(f.Payload), err)
+	}
+}
+
+func TestCloseCodeForError(t *testing.T) {
+	tTable := []struct {
+		err      error
+		expected CloseCode
+	}{
+		{err: io.EOF, expected: CloseGoingAway},
+		{err: io.ErrUnexpectedEOF, expected: CloseGoingAway},
+		{err: ErrProtocol, expected: CloseProtocolError},
+		{err: &http3.Error{ErrorCode: http3.ErrCodeRequestCanceled}, expected: CloseGoingAway},
+		{err: &http3.Error{ErrorCode: http3.ErrCodeExcessiveLoad}, expected: CloseTryAgainLater},
+		{err: &http3.Error{ErrorCode: http3.ErrCodeInternalError}, expected: CloseInternalError},
+		{err: errors.New("boom"), expected: CloseInternalError},
+	}
+
+	for _, tCase := range tTable {
+		if code := CloseCodeForError(tCase.err); code != tCase.expected {
+			t.Errorf("CloseCodeForError(%v): expected %d, got %d", tCase.err, tCase.expected, code)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http/httpguts"
+	h2h3convert "quic-proxy/internal/h2h3-convert"
+)
+
+// ProtocolWebSocket is the :protocol of an extended CONNECT for a WebSocket
+const ProtocolWebSocket = "websocket"
+
+// version is the only WebSocket version, RFC 6455 section 4.1
+const version = "13"
+
+// acceptGUID is hashed with the key of the client, RFC 6455 section 1.3
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ErrHandshakeRefused = errors.New("websocket handshake refused")
+
+// handshakeHeaders are the headers of one hop of the handshake, they are never forwarded
+var handshakeHeaders = []string{
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Accept",
+	"Sec-Websocket-Version",
+}
+
+// IsUpgrade reports whether r asks for an RFC 6455 upgrade
+func IsUpgrade(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade") &&
+		httpguts.HeaderValuesContainsToken(r.Header["Upgrade"], ProtocolWebSocket)
+}
+
+// IsExtendedConnect reports whether r is an RFC 9220 extended CONNECT for a WebSocket
+func IsExtendedConnect(r *http.Request) bool {
+	return r.Method == http.MethodConnect && r.Proto == ProtocolWebSocket
+}
+
+// IsWebSocket reports whether r opens a WebSocket in either way
+func IsWebSocket(r *http.Request) bool {
+	return IsUpgrade(r) || IsExtendedConnect(r)
+}
+
+// ForwardHeader Return the headers of r to send on the next hop of the
+// handshake: subprotocols, extensions, Origin, cookies and the like
+func ForwardHeader(h http.Header) http.Header {
+	h = h.Clone()
+	h2h3convert.StripConnectionHeaders(h)
+	for _, name := range handshakeHeaders {
+		h.Del(name)
+	}
+	return h
+}
+
+// computeAccept Compute the Sec-WebSocket-Accept for key
+func computeAccept(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// newKey Generate a random Sec-WebSocket-Key
+func newKey() (string, error) {
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key[:]), nil
+}
+
+// Validate Check the handshake of r, answering it with an error if it is invalid
+func Validate(w http.ResponseWriter, r *http.Request) error {
+	if r.Header.Get("Sec-WebSocket-Version") != version {
+		w.Header().Set("Sec-WebSocket-Version", version)
+		http.Error(w, "unsupported WebSocket version", http.StatusBadRequest)
+		return fmt.Errorf("%w: version %q", ErrHandshakeRefused, r.Header.Get("Sec-WebSocket-Version"))
+	}
+	if IsExtendedConnect(r) {
+		if _, ok := w.(http3.HTTPStreamer); !ok {
+			http.Error(w, "extended CONNECT is only supported over HTTP/3", http.StatusNotImplemented)
+			return fmt.Errorf("%w: extended CONNECT over %s", ErrHandshakeRefused, r.Proto)
+		}
+		return nil
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return fmt.Errorf("%w: invalid key %q", ErrHandshakeRefused, key)
+	}
+	return nil
+}
+
+// Accept Complete the handshake of r, sending header along with the success
+// response, typically the subprotocol and extensions the backend selected.
+// An RFC 6455 upgrade is answered with 101 on the hijacked connection, an
+// extended CONNECT with 200 on the HTTP/3 stream. If the handshake is
+// invalid, Accept answers it with an error and returns the error.
+func Accept(w http.ResponseWriter, r *http.Request, header http.Header) (*Conn, error) {
+	if err := Validate(w, r); err != nil {
+		return nil, err
+	}
+	if IsExtendedConnect(r) {
+		for k, vv := range header {
+			w.Header()[k] = vv
+		}
+		w.WriteHeader(http.StatusOK)
+		str := w.(http3.HTTPStreamer).HTTPStream()
+		return &Conn{Proto: "HTTP/3.0", r: str, w: str, closer: streamCloser{str}}, nil
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "connection can't be upgraded", http.StatusInternalServerError)
+		return nil, err
+	}
+	resp := &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header.Clone(),
+	}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Header.Set("Upgrade", ProtocolWebSocket)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Sec-WebSocket-Accept", computeAccept(key))
+	if err := resp.Write(brw); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{Proto: r.Proto, r: brw.Reader, w: conn, closer: conn}, nil
+}
+
+// ResponseHeader Return the headers of the success response of resp to send
+// back on the previous hop of the handshake
+func ResponseHeader(resp *http.Response) http.Header {
+	h := ForwardHeader(resp.Header)
+	h.Del("Content-Length")
+	return h
+}
+
+// DialH1 Open a WebSocket to u with an RFC 6455 upgrade on conn, which the
+// caller dialed to the host of u. host is sent as Host, header are the
+// forwarded headers of the handshake. If the server refuses the upgrade, the
+// response is returned along with ErrHandshakeRefused. conn belongs to the
+// WebSocket, or to the body of the refusal, and is closed on any other error.
+func DialH1(ctx context.Context, conn net.Conn, u *url.URL, host string, header http.Header) (ws *Conn, resp *http.Response, err error) {
+	defer func() {
+		if err != nil && resp == nil {
+			conn.Close()
+		}
+	}()
+	key, err := newKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Host:       host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header.Clone(),
+	}
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("Upgrade", ProtocolWebSocket)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", version)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err = req.Write(conn); err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(br, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = closeBoth{resp.Body, conn}
+		return nil, resp, fmt.Errorf("%w: %s", ErrHandshakeRefused, resp.Status)
+	}
+	if !httpguts.HeaderValuesContainsToken(resp.Header["Upgrade"], ProtocolWebSocket) ||
+		resp.Header.Get("Sec-WebSocket-Accept") != computeAccept(key) {
+		return nil, nil, fmt.Errorf("%w: invalid Sec-WebSocket-Accept", ErrHandshakeRefused)
+	}
+	return &Conn{Proto: resp.Proto, r: br, w: conn, closer: conn, client: true}, resp, nil
+}
+
+// DialH3 Open a WebSocket to u with an RFC 9220 extended CONNECT on cc. If
+// the server refuses it, the response is returned along with ErrHandshakeRefused.
+func DialH3(ctx context.Context, cc *http3.ClientConn, u *url.URL, host string, header http.Header) (*Conn, *http.Response, error) {
+	select {
+	case <-cc.ReceivedSettings():
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	if !cc.Settings().EnableExtendedConnect {
+		return nil, nil, fmt.Errorf("%w: server doesn't support extended CONNECT", ErrHandshakeRefused)
+	}
+	str, err := cc.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	u = &url.URL{Scheme: "https", Host: u.Host, Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Proto:  ProtocolWebSocket,
+		URL:    u,
+		Host:   host,
+		Header: header.Clone(),
+	}
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("Sec-WebSocket-Version", version)
+	if err := str.SendRequestHeader(req); err != nil {
+		str.Close()
+		return nil, nil, err
+	}
+	resp, err := str.ReadResponse()
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body = closeBoth{resp.Body, streamCloser{str}}
+		return nil, resp, fmt.Errorf("%w: %s", ErrHandshakeRefused, resp.Status)
+	}
+	return &Conn{Proto: resp.Proto, r: str, w: str, closer: streamCloser{str}, client: true}, resp, nil
+}
+
+// closeBoth closes the connection of a refused handshake along with its body
+type closeBoth struct {
+	io.ReadCloser
+	conn io.Closer
+}
+
+func (c closeBoth) Close() error {
+	c.ReadCloser.Close()
+	return c.conn.Close()
+}
@@ -0,0 +1,151 @@
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"quic-proxy/internal/testutil"
+)
+
+// echo Accept the WebSocket of r and echo its frames, the Close frame included
+func echo(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/forbidden" {
+		http.Error(w, "go away", http.StatusForbidden)
+		return
+	}
+	conn, err := Accept(w, r, http.Header{"Sec-Websocket-Protocol": r.Header["Sec-Websocket-Protocol"]})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		f, err := conn.ReadFrame()
+		if err != nil {
+			return
+		}
+		conn.WriteFrame(f)
+		if f.Opcode == OpClose {
+			return
+		}
+	}
+}
+
+// dial Open a WebSocket to path on the h1 or h3 echo server
+func dial(t *testing.T, proto, path string) (*Conn, *http.Response, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	header := http.Header{"Sec-Websocket-Protocol": {"chat"}}
+	if proto == "h1" {
+		server := httptest.NewServer(http.HandlerFunc(echo))
+		t.Cleanup(server.Close)
+		u, _ := url.Parse(server.URL + path)
+		conn, err := net.Dial("tcp", u.Host)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		return DialH1(ctx, conn, u, u.Host, header)
+	}
+	addr := testutil.StartH3Server(t, http.HandlerFunc(echo))
+	qconn, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}}, nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { qconn.CloseWithError(0, "") })
+	u, _ := url.Parse("https://" + addr + path)
+	return DialH3(ctx, (&http3.Transport{}).NewClientConn(qconn), u, addr, header)
+}
+
+func TestDial(t *testing.T) {
+	for _, proto := range []string{"h1", "h3"} {
+		conn, resp, err := dial(t, proto, "/chat")
+		if err != nil {
+			t.Fatalf("%s: handshake failed: %v", proto, err)
+		}
+		if resp.Header.Get("Sec-WebSocket-Protocol") != "chat" {
+			t.Errorf("%s: expected the subprotocol to be selected, got %q", proto, resp.Header.Get("Sec-WebSocket-Protocol"))
+		}
+
+		for _, f := range []Frame{
+			{Fin: false, Opcode: OpText, Payload: []byte("hel")},
+			{Fin: true, Opcode: OpContinuation, Payload: []byte("lo")},
+			{Fin: true, Opcode: OpPing, Payload: []byte("ping")},
+			CloseFrame(CloseNormal, "bye"),
+		} {
+			if err := conn.WriteFrame(f); err != nil {
+				t.Fatalf("%s: WriteFrame failed: %v", proto, err)
+			}
+			got, err := conn.ReadFrame()
+			if err != nil || got.Fin != f.Fin || got.Opcode != f.Opcode || string(got.Payload) != string(f.Payload) {
+				t.Errorf("%s: expected the echo of %+v, got %+v, %v", proto, f, got, err)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestDial_Refused(t *testing.T) {
+	for _, proto := range []string{"h1", "h3"} {
+		_, resp, err := dial(t, proto, "/forbidden")
+		if !errors.Is(err, ErrHandshakeRefused) || resp == nil {
+			t.Fatalf("%s: expected the handshake to be refused, got %v", proto, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden || string(body) != "go away\n" {
+			t.Errorf("%s: expected the 403 of the server, got %d %q", proto, resp.StatusCode, body)
+		}
+	}
+}
+
+// pipe Connect a client and a server Conn
+func pipe() (client, server *Conn) {
+	a, b := net.Pipe()
+	return &Conn{r: a, w: a, closer: a, client: true}, &Conn{r: b, w: b, closer: b}
+}
+
+func TestBridge(t *testing.T) {
+	client, down := pipe()
+	up, backend := pipe()
+	done := make(chan error, 1)
+	go func() { done <- Bridge(down, up) }()
+
+	// backend frames reach the client unmasked and client frames the backend
+	go backend.WriteFrame(Frame{Fin: true, Opcode: OpText, Payload: []byte("welcome")})
+	if f, err := client.ReadFrame(); err != nil || string(f.Payload) != "welcome" {
+		t.Fatalf("expected the backend frame, got %+v, %v", f, err)
+	}
+	go client.WriteFrame(Frame{Fin: true, Opcode: OpBinary, Payload: []byte{1, 2, 3}})
+	if f, err := backend.ReadFrame(); err != nil || f.Opcode != OpBinary || len(f.Payload) != 3 {
+		t.Fatalf("expected the client frame, got %+v, %v", f, err)
+	}
+
+	// the backend going away without a Close frame becomes 1001 for the client
+	backend.Close()
+	f, err := client.ReadFrame()
+	if err != nil || f.Opcode != OpClose {
+		t.Fatalf("expected a Close frame, got %+v, %v", f, err)
+	}
+	if code, _, _ := ParseClose(f.Payload); code != CloseGoingAway {
+		t.Errorf("expected close code %d, got %d", CloseGoingAway, code)
+	}
+	go client.WriteFrame(CloseFrame(CloseGoingAway, ""))
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected the bridge to report the lost backend")
+		}
+	case <-time.After(closeTimeout + time.Second):
+		t.Errorf("bridge didn't end")
+	}
+}
@@ -0,0 +1,133 @@
+package webtransport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/qlog"
+	h3datagram "quic-proxy/internal/h3-datagram"
+	happyeyeballs "quic-proxy/internal/happy-eyeballs"
+)
+
+// closeGrace is how long the client keeps the connection of a closed session,
+// so that WT_CLOSE_SESSION and the end of the CONNECT stream get delivered
+const closeGrace = time.Second
+
+// maxRefusalBody is how much of the body of a refusal is kept
+const maxRefusalBody = 4096
+
+var ErrSessionRefused = errors.New("webtransport session refused")
+
+// Dialer opens WebTransport sessions, each on its own QUIC connection
+type Dialer struct {
+	TLSClientConfig *tls.Config
+	Dialer          *happyeyeballs.Dialer
+}
+
+// Dial Open a session to rawURL, an https URL, sending header with the
+// CONNECT request. If the server refuses the session, the response is
+// returned along with ErrSessionRefused.
+func (d *Dialer) Dial(ctx context.Context, rawURL string, header http.Header) (*http.Response, *Session, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, nil, fmt.Errorf("webtransport URL must be https: %q", rawURL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = u.Host + ":443"
+	}
+	tlsConf := &tls.Config{}
+	if d.TLSClientConfig != nil {
+		tlsConf = d.TLSClientConfig.Clone()
+	}
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName = u.Hostname()
+	}
+	tlsConf.NextProtos = []string{http3.NextProtoH3}
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &happyeyeballs.Dialer{}
+	}
+	qconn, err := dialer.DialQUIC(ctx, addr, tlsConf, &quic.Config{
+		EnableDatagrams: true,
+		Tracer:          qlog.DefaultConnectionTracer,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m := newManager()
+	transport := &http3.Transport{
+		AdditionalSettings: map[uint64]uint64{SettingEnableWebTransport: 1},
+		StreamHijacker:     m.hijackStream,
+		UniStreamHijacker:  m.hijackUniStream,
+	}
+	h3datagram.EnableTransport(transport)
+	cc := transport.NewClientConn(qconn)
+	closeConn := func() { qconn.CloseWithError(0, "") }
+	resp, session, err := dial(ctx, m, cc, transport.EnableDatagrams, u, header, closeConn)
+	if err != nil {
+		closeConn()
+	}
+	return resp, session, err
+}
+
+// dial Send the CONNECT request of a session on cc, closeConn runs once the session ended
+func dial(ctx context.Context, m *manager, cc *http3.ClientConn, enabled bool, u *url.URL, header http.Header, closeConn func()) (*http.Response, *Session, error) {
+	datagrams, err := h3datagram.Negotiated(ctx, cc, enabled)
+	if err != nil {
+		return nil, nil, err
+	}
+	settings := cc.Settings()
+	if !settings.EnableExtendedConnect || settings.Other[SettingEnableWebTransport] != 1 {
+		return nil, nil, fmt.Errorf("%w: server doesn't support WebTransport", ErrSessionRefused)
+	}
+	str, err := cc.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Proto:  ProtocolWebTransport,
+		URL:    u,
+		Host:   u.Host,
+		Header: header.Clone(),
+	}
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("Sec-Webtransport-Http3-Draft02", "1")
+	if err := str.SendRequestHeader(req); err != nil {
+		str.Close()
+		return nil, nil, err
+	}
+	resp, err := str.ReadResponse()
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// the connection is closed right away, keep what the body says
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxRefusalBody))
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		str.Close()
+		return resp, nil, fmt.Errorf("%w: %s", ErrSessionRefused, resp.Status)
+	}
+	connID, _ := cc.Context().Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	session := m.session(sessionKey{conn: connID, id: str.StreamID()})
+	session.closeConn = closeConn
+	session.establish(str, cc, datagrams)
+	return resp, session, nil
+}
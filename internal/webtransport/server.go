@@ -0,0 +1,72 @@
+package webtransport
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	h3datagram "quic-proxy/internal/h3-datagram"
+)
+
+var ErrNotWebTransport = errors.New("not a WebTransport request")
+
+// Server accepts WebTransport sessions on an h3 server
+type Server struct {
+	h3Server *http3.Server
+	manager  *manager
+}
+
+// NewServer Enable WebTransport on s: announce it in the SETTINGS, enable
+// datagrams and take the WebTransport streams away from HTTP/3. s must not
+// be serving yet.
+func NewServer(s *http3.Server) *Server {
+	m := newManager()
+	if s.AdditionalSettings == nil {
+		s.AdditionalSettings = make(map[uint64]uint64)
+	}
+	s.AdditionalSettings[SettingEnableWebTransport] = 1
+	h3datagram.EnableServer(s)
+	s.StreamHijacker = m.hijackStream
+	s.UniStreamHijacker = m.hijackUniStream
+	return &Server{h3Server: s, manager: m}
+}
+
+// IsWebTransport reports whether r opens a WebTransport session
+func IsWebTransport(r *http.Request) bool {
+	return r.Method == http.MethodConnect && r.Proto == ProtocolWebTransport
+}
+
+// Upgrade Accept the session r asks for, answering it with 200. If r can't
+// open a session, Upgrade answers it with an error and returns the error.
+// The session outlives the handler.
+func (s *Server) Upgrade(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	if !IsWebTransport(r) {
+		http.Error(w, "WebTransport requires an extended CONNECT", http.StatusBadRequest)
+		return nil, ErrNotWebTransport
+	}
+	hijacker, ok := w.(http3.Hijacker)
+	if !ok {
+		http.Error(w, "WebTransport is only supported over HTTP/3", http.StatusNotImplemented)
+		return nil, fmt.Errorf("%w: %s", ErrNotWebTransport, r.Proto)
+	}
+	conn := hijacker.Connection()
+	datagrams, err := h3datagram.NegotiatedForRequest(r.Context(), s.h3Server, w)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, err
+	}
+	if conn.Settings().Other[SettingEnableWebTransport] != 1 {
+		http.Error(w, "client didn't enable WebTransport", http.StatusBadRequest)
+		return nil, fmt.Errorf("%w: SETTINGS_ENABLE_WEBTRANSPORT missing", ErrNotWebTransport)
+	}
+	connID, _ := conn.Context().Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+
+	w.Header().Set("Sec-Webtransport-Http3-Draft", "draft02")
+	w.WriteHeader(http.StatusOK)
+	str := w.(http3.HTTPStreamer).HTTPStream()
+	session := s.manager.session(sessionKey{conn: connID, id: str.StreamID()})
+	session.establish(str, conn, datagrams)
+	return session, nil
+}
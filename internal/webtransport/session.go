@@ -0,0 +1,265 @@
+package webtransport
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	h3datagram "quic-proxy/internal/h3-datagram"
+)
+
+// streamOpener opens the streams of a session, http3.Connection and
+// *http3.ClientConn implement it
+type streamOpener interface {
+	OpenStreamSync(ctx context.Context) (quic.Stream, error)
+	OpenUniStreamSync(ctx context.Context) (quic.SendStream, error)
+}
+
+// Session is a WebTransport session, on the server or on the client
+type Session struct {
+	key     sessionKey
+	manager *manager
+
+	// set once the CONNECT request was answered
+	established chan struct{}
+	str         http3.Stream
+	opener      streamOpener
+	datagram    *h3datagram.Session
+	// closeConn closes the connection the client dialed for the session
+	closeConn func()
+
+	bidi chan quic.Stream
+	uni  chan quic.ReceiveStream
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	mu       sync.Mutex
+	resets   []func(quic.StreamErrorCode)
+	shutDown bool
+}
+
+func newSession(key sessionKey, m *manager) *Session {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &Session{
+		key:         key,
+		manager:     m,
+		established: make(chan struct{}),
+		bidi:        make(chan quic.Stream, maxQueuedStreams),
+		uni:         make(chan quic.ReceiveStream, maxQueuedStreams),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// establish Attach the answered CONNECT stream to the session
+func (s *Session) establish(str http3.Stream, opener streamOpener, datagrams bool) {
+	s.str = str
+	s.opener = opener
+	s.datagram = h3datagram.NewSession(str, datagrams, s.handleCapsule)
+	close(s.established)
+	go func() {
+		// the CONNECT stream ending without WT_CLOSE_SESSION closes the session with code 0
+		<-s.datagram.Done()
+		s.shutdown(&SessionError{Remote: true}, errCodeSessionGone)
+	}()
+}
+
+// handleCapsule Close the session on WT_CLOSE_SESSION, other capsules are dropped
+func (s *Session) handleCapsule(c h3datagram.Capsule) {
+	if c.Type != capsuleCloseSession || len(c.Value) < 4 {
+		return
+	}
+	s.shutdown(&SessionError{
+		Remote:    true,
+		ErrorCode: binary.BigEndian.Uint32(c.Value),
+		Message:   string(c.Value[4:]),
+	}, errCodeSessionGone)
+}
+
+// queueStream Queue a bidirectional stream of the peer until it is accepted
+func (s *Session) queueStream(str quic.Stream) {
+	if !s.track(func(code quic.StreamErrorCode) {
+		str.CancelRead(code)
+		str.CancelWrite(code)
+	}) {
+		return
+	}
+	select {
+	case s.bidi <- str:
+	default:
+		str.CancelRead(errCodeBufferedStreamRejected)
+		str.CancelWrite(errCodeBufferedStreamRejected)
+	}
+}
+
+// queueUniStream Queue a unidirectional stream of the peer until it is accepted
+func (s *Session) queueUniStream(str quic.ReceiveStream) {
+	if !s.track(func(code quic.StreamErrorCode) { str.CancelRead(code) }) {
+		return
+	}
+	select {
+	case s.uni <- str:
+	default:
+		str.CancelRead(errCodeBufferedStreamRejected)
+	}
+}
+
+// track Remember how to reset a stream when the session ends, it is reset at
+// once if the session already ended
+func (s *Session) track(reset func(quic.StreamErrorCode)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutDown {
+		reset(errCodeSessionGone)
+		return false
+	}
+	s.resets = append(s.resets, reset)
+	return true
+}
+
+// AcceptStream Wait for the next bidirectional stream opened by the peer
+func (s *Session) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	select {
+	case str := <-s.bidi:
+		return str, nil
+	case <-s.ctx.Done():
+		return nil, context.Cause(s.ctx)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// AcceptUniStream Wait for the next unidirectional stream opened by the peer
+func (s *Session) AcceptUniStream(ctx context.Context) (quic.ReceiveStream, error) {
+	select {
+	case str := <-s.uni:
+		return str, nil
+	case <-s.ctx.Done():
+		return nil, context.Cause(s.ctx)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// OpenStreamSync Open a bidirectional stream, blocking until the peer allows it
+func (s *Session) OpenStreamSync(ctx context.Context) (quic.Stream, error) {
+	if err := s.Context().Err(); err != nil {
+		return nil, context.Cause(s.ctx)
+	}
+	str, err := s.opener.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	header := quicvarint.Append(nil, uint64(frameTypeStream))
+	if _, err := str.Write(quicvarint.Append(header, uint64(s.key.id))); err != nil {
+		return nil, err
+	}
+	if !s.track(func(code quic.StreamErrorCode) {
+		str.CancelRead(code)
+		str.CancelWrite(code)
+	}) {
+		return nil, context.Cause(s.ctx)
+	}
+	return str, nil
+}
+
+// OpenUniStreamSync Open a unidirectional stream, blocking until the peer allows it
+func (s *Session) OpenUniStreamSync(ctx context.Context) (quic.SendStream, error) {
+	if err := s.Context().Err(); err != nil {
+		return nil, context.Cause(s.ctx)
+	}
+	str, err := s.opener.OpenUniStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	header := quicvarint.Append(nil, uint64(streamTypeUni))
+	if _, err := str.Write(quicvarint.Append(header, uint64(s.key.id))); err != nil {
+		return nil, err
+	}
+	if !s.track(func(code quic.StreamErrorCode) { str.CancelWrite(code) }) {
+		return nil, context.Cause(s.ctx)
+	}
+	return str, nil
+}
+
+// SendDatagram Send b as a datagram of the session, in a capsule if the
+// peer didn't negotiate HTTP/3 datagrams
+func (s *Session) SendDatagram(b []byte) error {
+	return s.datagram.SendDatagram(b)
+}
+
+// ReceiveDatagram Wait for the next datagram of the session
+func (s *Session) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	b, err := s.datagram.ReceiveDatagram(ctx)
+	if err != nil && s.ctx.Err() != nil {
+		return nil, context.Cause(s.ctx)
+	}
+	return b, err
+}
+
+// Context is done when the session ended, its cause is a *SessionError
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// CloseWithError Close the session, the peer learns code and msg from WT_CLOSE_SESSION
+func (s *Session) CloseWithError(code uint32, msg string) error {
+	if len(msg) > maxCloseMessage {
+		msg = msg[:maxCloseMessage]
+	}
+	value := binary.BigEndian.AppendUint32(nil, code)
+	err := s.datagram.SendCapsule(h3datagram.Capsule{Type: capsuleCloseSession, Value: append(value, msg...)})
+	s.shutdown(&SessionError{ErrorCode: code, Message: msg}, errCodeSessionGone)
+	return err
+}
+
+// shutdown End the session with cause: reset its streams and finish the CONNECT stream
+func (s *Session) shutdown(cause *SessionError, code quic.StreamErrorCode) {
+	s.mu.Lock()
+	if s.shutDown {
+		s.mu.Unlock()
+		return
+	}
+	s.shutDown = true
+	resets := s.resets
+	s.resets = nil
+	s.mu.Unlock()
+
+	s.cancel(cause)
+	s.manager.remove(s.key)
+	for _, reset := range resets {
+		reset(code)
+	}
+	for {
+		select {
+		case str := <-s.bidi:
+			str.CancelRead(code)
+			str.CancelWrite(code)
+			continue
+		case str := <-s.uni:
+			str.CancelRead(code)
+			continue
+		default:
+		}
+		break
+	}
+	select {
+	case <-s.established:
+		s.str.Close()
+		if s.closeConn != nil {
+			go func() {
+				select {
+				case <-s.datagram.Done():
+				case <-time.After(closeGrace):
+				}
+				s.closeConn()
+			}()
+		}
+	default:
+	}
+}
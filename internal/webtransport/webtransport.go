@@ -0,0 +1,138 @@
+// Package webtransport implements WebTransport over HTTP/3 as announced by
+// SETTINGS_ENABLE_WEBTRANSPORT (draft-ietf-webtrans-http3-02), for both the
+// h3 server and the clients dialing it. A session is an extended CONNECT
+// request with :protocol=webtransport; its streams are QUIC streams that
+// start with the session ID, its datagrams are the HTTP Datagrams of the
+// CONNECT stream.
+package webtransport
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	h3datagram "quic-proxy/internal/h3-datagram"
+)
+
+// ProtocolWebTransport is the :protocol of the extended CONNECT opening a session
+const ProtocolWebTransport = "webtransport"
+
+// SettingEnableWebTransport announces WebTransport support in the HTTP/3 SETTINGS
+const SettingEnableWebTransport = 0x2b603742
+
+const (
+	// frameTypeStream starts a bidirectional WebTransport stream
+	frameTypeStream http3.FrameType = 0x41
+	// streamTypeUni starts a unidirectional WebTransport stream
+	streamTypeUni http3.StreamType = 0x54
+	// capsuleCloseSession is WT_CLOSE_SESSION, carrying an error code and message
+	capsuleCloseSession h3datagram.CapsuleType = 0x2843
+)
+
+const (
+	// errCodeSessionGone resets the streams of a session that ended
+	errCodeSessionGone = 0x170d7b68
+	// errCodeBufferedStreamRejected resets streams of a session that never came
+	errCodeBufferedStreamRejected = 0x3994bd84
+)
+
+// maxQueuedStreams is the number of streams a session buffers until they are
+// accepted, further streams are rejected
+const maxQueuedStreams = 16
+
+// establishTimeout is how long streams wait for the CONNECT request of their
+// session, they can arrive before it
+const establishTimeout = 5 * time.Second
+
+// maxCloseMessage is the longest message of WT_CLOSE_SESSION
+const maxCloseMessage = 1024
+
+// SessionError tells why a session ended
+type SessionError struct {
+	Remote    bool
+	ErrorCode uint32
+	Message   string
+}
+
+func (e *SessionError) Error() string {
+	side := "local"
+	if e.Remote {
+		side = "remote"
+	}
+	return fmt.Sprintf("webtransport session closed (%s): code %d %q", side, e.ErrorCode, e.Message)
+}
+
+// sessionKey identifies a session: the connection and its CONNECT stream
+type sessionKey struct {
+	conn quic.ConnectionTracingID
+	id   quic.StreamID
+}
+
+// manager hands the streams hijacked from HTTP/3 to their sessions
+type manager struct {
+	mu       sync.Mutex
+	sessions map[sessionKey]*Session
+}
+
+func newManager() *manager {
+	return &manager{sessions: make(map[sessionKey]*Session)}
+}
+
+// session Return the session of key, it is created unestablished if this is
+// the first stream of a session whose CONNECT request wasn't seen yet
+func (m *manager) session(key sessionKey) *Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[key]; ok {
+		return s
+	}
+	s := newSession(key, m)
+	m.sessions[key] = s
+	time.AfterFunc(establishTimeout, func() {
+		select {
+		case <-s.established:
+		default:
+			s.shutdown(&SessionError{ErrorCode: errCodeBufferedStreamRejected, Message: "session never established"}, errCodeBufferedStreamRejected)
+		}
+	})
+	return s
+}
+
+// remove Forget the session of key
+func (m *manager) remove(key sessionKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, key)
+}
+
+// hijackStream Take the bidirectional WebTransport streams, it is an http3 StreamHijacker
+func (m *manager) hijackStream(ft http3.FrameType, connID quic.ConnectionTracingID, str quic.Stream, err error) (bool, error) {
+	if err != nil || ft != frameTypeStream {
+		return false, nil
+	}
+	id, err := quicvarint.Read(quicvarint.NewReader(str))
+	if err != nil {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeGeneralProtocolError))
+		str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeGeneralProtocolError))
+		return true, nil
+	}
+	m.session(sessionKey{conn: connID, id: quic.StreamID(id)}).queueStream(str)
+	return true, nil
+}
+
+// hijackUniStream Take the unidirectional WebTransport streams, it is an http3 UniStreamHijacker
+func (m *manager) hijackUniStream(st http3.StreamType, connID quic.ConnectionTracingID, str quic.ReceiveStream, err error) bool {
+	if err != nil || st != streamTypeUni {
+		return false
+	}
+	id, err := quicvarint.Read(quicvarint.NewReader(str))
+	if err != nil {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeGeneralProtocolError))
+		return true
+	}
+	m.session(sessionKey{conn: connID, id: quic.StreamID(id)}).queueUniStream(str)
+	return true
+}
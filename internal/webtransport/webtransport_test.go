@@ -0,0 +1,191 @@
+package webtransport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"quic-proxy/internal/testutil"
+)
+
+// startServer Serve WebTransport sessions on a random loopback port, handle
+// gets every accepted session
+func startServer(t *testing.T, handle func(*Session)) string {
+	t.Helper()
+	h3Server := &http3.Server{}
+	wt := NewServer(h3Server)
+	h3Server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/private" {
+			http.Error(w, "private", http.StatusForbidden)
+			return
+		}
+		session, err := wt.Upgrade(w, r)
+		if err != nil {
+			t.Errorf("Upgrade: %v", err)
+			return
+		}
+		handle(session)
+	})
+	return testutil.ServeH3(t, h3Server)
+}
+
+// echo Echo the bidirectional streams, unidirectional streams and datagrams of session
+func echo(session *Session) {
+	go func() {
+		for {
+			str, err := session.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(str, str)
+				str.Close()
+			}()
+		}
+	}()
+	go func() {
+		for {
+			str, err := session.AcceptUniStream(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				reply, err := session.OpenUniStreamSync(context.Background())
+				if err != nil {
+					return
+				}
+				io.Copy(reply, str)
+				reply.Close()
+			}()
+		}
+	}()
+	go func() {
+		for {
+			b, err := session.ReceiveDatagram(context.Background())
+			if err != nil {
+				return
+			}
+			session.SendDatagram(b)
+		}
+	}()
+}
+
+func dialSession(t *testing.T, ctx context.Context, addr, path string) (*http.Response, *Session, error) {
+	t.Helper()
+	d := &Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	resp, session, err := d.Dial(ctx, "https://"+addr+path, nil)
+	if session != nil {
+		t.Cleanup(func() { session.CloseWithError(0, "") })
+	}
+	return resp, session, err
+}
+
+func TestSession(t *testing.T) {
+	addr := startServer(t, echo)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, session, err := dialSession(t, ctx, addr, "/echo")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	for _, msg := range []string{"first stream", "second stream"} {
+		str, err := session.OpenStreamSync(ctx)
+		if err != nil {
+			t.Fatalf("OpenStreamSync: %v", err)
+		}
+		str.Write([]byte(msg))
+		str.Close()
+		got, err := io.ReadAll(str)
+		if err != nil || string(got) != msg {
+			t.Errorf("bidirectional stream: expected %q, got %q, %v", msg, got, err)
+		}
+	}
+
+	uni, err := session.OpenUniStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("OpenUniStreamSync: %v", err)
+	}
+	uni.Write([]byte("unidirectional"))
+	uni.Close()
+	reply, err := session.AcceptUniStream(ctx)
+	if err != nil {
+		t.Fatalf("AcceptUniStream: %v", err)
+	}
+	if got, err := io.ReadAll(reply); err != nil || string(got) != "unidirectional" {
+		t.Errorf("unidirectional stream: expected %q, got %q, %v", "unidirectional", got, err)
+	}
+
+	if err := session.SendDatagram([]byte("datagram")); err != nil {
+		t.Fatalf("SendDatagram: %v", err)
+	}
+	if got, err := session.ReceiveDatagram(ctx); err != nil || string(got) != "datagram" {
+		t.Errorf("datagram: expected %q, got %q, %v", "datagram", got, err)
+	}
+}
+
+func TestSession_Close(t *testing.T) {
+	closed := make(chan error, 1)
+	addr := startServer(t, func(session *Session) {
+		go func() {
+			str, err := session.AcceptStream(context.Background())
+			if err != nil {
+				closed <- err
+				return
+			}
+			// the client says goodbye, the server closes the session
+			io.ReadAll(str)
+			session.CloseWithError(42, "bye")
+			closed <- context.Cause(session.Context())
+		}()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, session, err := dialSession(t, ctx, addr, "/close")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	str, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("OpenStreamSync: %v", err)
+	}
+	str.Write([]byte("goodbye"))
+	str.Close()
+
+	select {
+	case <-session.Context().Done():
+	case <-ctx.Done():
+		t.Fatal("session wasn't closed")
+	}
+	var sessionErr *SessionError
+	if err := context.Cause(session.Context()); !errors.As(err, &sessionErr) || !sessionErr.Remote || sessionErr.ErrorCode != 42 || sessionErr.Message != "bye" {
+		t.Errorf("client: expected remote close 42 %q, got %v", "bye", err)
+	}
+	if err := <-closed; !errors.As(err, &sessionErr) || sessionErr.Remote || sessionErr.ErrorCode != 42 {
+		t.Errorf("server: expected local close 42, got %v", err)
+	}
+	if _, err := session.OpenStreamSync(ctx); !errors.As(err, &sessionErr) {
+		t.Errorf("OpenStreamSync after close: expected SessionError, got %v", err)
+	}
+}
+
+func TestDial_Refused(t *testing.T) {
+	addr := startServer(t, echo)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, session, err := dialSession(t, ctx, addr, "/private")
+	if !errors.Is(err, ErrSessionRefused) || session != nil {
+		t.Fatalf("expected ErrSessionRefused, got %v", err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", resp.StatusCode)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "private\n" {
+		t.Errorf("expected the body of the refusal, got %q", body)
+	}
+}
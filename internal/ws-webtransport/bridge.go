@@ -0,0 +1,217 @@
+// Package ws_webtransport terminates classic WebSockets of HTTP/1.1 clients
+// and carries their messages over WebTransport sessions to an upstream h3
+// server. Each WebSocket gets a session with a single bidirectional stream,
+// so the messages keep their order; pings are answered by the bridge and the
+// Close handshake maps onto WT_CLOSE_SESSION, status code and reason included.
+package ws_webtransport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"quic-proxy/internal/config"
+	h2h3convert "quic-proxy/internal/h2h3-convert"
+	"quic-proxy/internal/websocket"
+	"quic-proxy/internal/webtransport"
+)
+
+// handshakeTimeout bounds opening the session and its stream
+const handshakeTimeout = 10 * time.Second
+
+// closeTimeout is how long the bridge waits for the other direction to
+// finish once one of them ended
+const closeTimeout = 5 * time.Second
+
+// sessionCloseWait is how long a failed stream waits for WT_CLOSE_SESSION,
+// the resets of the streams can overtake it
+const sessionCloseWait = time.Second
+
+// Bridge is an http.Handler upgrading WebSockets and bridging them to WebTransport
+type Bridge struct {
+	cfg      *config.WebTransportBridgeConfig
+	upstream *url.URL
+	dialer   *webtransport.Dialer
+}
+
+// NewBridge Create a bridge from cfg
+func NewBridge(cfg *config.WebTransportBridgeConfig) (*Bridge, error) {
+	upstream, err := url.Parse(cfg.UpstreamURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream URL: %w", err)
+	}
+	if upstream.Scheme != "https" {
+		return nil, fmt.Errorf("upstream URL must be https: %q", cfg.UpstreamURL)
+	}
+	return &Bridge{
+		cfg:      cfg,
+		upstream: upstream,
+		dialer: &webtransport.Dialer{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: cfg.Insecure},
+		},
+	}, nil
+}
+
+// ListenAndServe Accept WebSockets on the listen address
+func (b *Bridge) ListenAndServe() error {
+	ln, err := net.Listen("tcp", b.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	return b.Serve(ln)
+}
+
+// Serve Accept WebSockets on ln
+func (b *Bridge) Serve(ln net.Listener) error {
+	log.Printf("[WebTransport] Bridging WebSockets on %s to %s", ln.Addr(), b.upstream)
+	return http.Serve(ln, b)
+}
+
+// ServeHTTP Open a session to the upstream URL with the path of r, then
+// accept the WebSocket and bridge it. A refused session is passed on with its
+// status and body.
+func (b *Bridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsUpgrade(r) {
+		w.Header().Set("Upgrade", websocket.ProtocolWebSocket)
+		http.Error(w, "only WebSocket upgrades are bridged", http.StatusUpgradeRequired)
+		return
+	}
+	if err := websocket.Validate(w, r); err != nil {
+		return
+	}
+	target := b.upstream.JoinPath(r.URL.Path)
+	if !strings.HasPrefix(target.Path, "/") {
+		target.Path = "/" + target.Path
+	}
+	target.RawQuery = r.URL.RawQuery
+
+	ctx, cancel := context.WithTimeout(r.Context(), handshakeTimeout)
+	defer cancel()
+	resp, session, err := b.dialer.Dial(ctx, target.String(), websocket.ForwardHeader(r.Header))
+	if err != nil {
+		log.Printf("[WebTransport] Failed to open a session to %s: %v", target, err)
+		if resp != nil {
+			defer resp.Body.Close()
+			h2h3convert.WriteResponse(w, r, resp)
+		} else {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		return
+	}
+	str, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		log.Printf("[WebTransport] Failed to open a stream to %s: %v", target, err)
+		session.CloseWithError(0, "")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	ws, err := websocket.Accept(w, r, websocket.ResponseHeader(resp))
+	if err != nil {
+		session.CloseWithError(0, "")
+		return
+	}
+
+	log.Printf("[WebTransport] Bridging WebSocket from %s to %s", r.RemoteAddr, target)
+	if err := bridge(ws, session, str); err != nil {
+		log.Printf("[WebTransport] Bridge to %s stopped: %v", target, err)
+	}
+}
+
+// bridge Relay messages between ws and str until one side closed, the other
+// side is closed with the same status. ws and session are closed when it returns.
+func bridge(ws *websocket.Conn, session *webtransport.Session, str quic.Stream) error {
+	defer ws.Close()
+	defer session.CloseWithError(0, "")
+	errCh := make(chan error, 2)
+	go func() { errCh <- toWebTransport(ws, session, str) }()
+	go func() { errCh <- toWebSocket(ws, session, str) }()
+
+	err := <-errCh
+	select {
+	case err2 := <-errCh:
+		if err == nil {
+			err = err2
+		}
+	case <-time.After(closeTimeout):
+	}
+	return err
+}
+
+// toWebTransport Write the messages of ws to str, a Close of ws closes the session
+func toWebTransport(ws *websocket.Conn, session *webtransport.Session, str quic.Stream) error {
+	for {
+		op, msg, err := ws.ReadMessage()
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			ws.WriteFrame(websocket.CloseFrame(closeErr.Code, closeErr.Reason))
+			session.CloseWithError(sessionCode(closeErr.Code), closeErr.Reason)
+			return nil
+		}
+		if err != nil {
+			code := websocket.CloseCodeForError(err)
+			ws.WriteFrame(websocket.CloseFrame(code, code.Reason()))
+			session.CloseWithError(sessionCode(code), code.Reason())
+			return err
+		}
+		if err := writeMessage(str, op, msg); err != nil {
+			return err
+		}
+	}
+}
+
+// toWebSocket Write the messages of str to ws, the end of the session closes ws
+func toWebSocket(ws *websocket.Conn, session *webtransport.Session, str quic.Stream) error {
+	r := bufio.NewReader(str)
+	for {
+		op, msg, err := readMessage(r)
+		if err != nil {
+			select {
+			case <-session.Context().Done():
+			case <-time.After(sessionCloseWait):
+			}
+			var sessionErr *webtransport.SessionError
+			if errors.As(context.Cause(session.Context()), &sessionErr) {
+				code, reason := closeCode(sessionErr)
+				ws.WriteFrame(websocket.CloseFrame(code, reason))
+				return nil
+			}
+			code := websocket.CloseCodeForError(err)
+			ws.WriteFrame(websocket.CloseFrame(code, code.Reason()))
+			return err
+		}
+		if err := ws.WriteMessage(op, msg); err != nil {
+			return err
+		}
+	}
+}
+
+// sessionCode Map a WebSocket status to the error code of WT_CLOSE_SESSION,
+// a Close without status becomes 0
+func sessionCode(code websocket.CloseCode) uint32 {
+	if code == websocket.CloseNoStatus {
+		return 0
+	}
+	return uint32(code)
+}
+
+// closeCode Map the end of a session to the Close frame of the WebSocket, an
+// error code that can't be a WebSocket status becomes 1011
+func closeCode(err *webtransport.SessionError) (websocket.CloseCode, string) {
+	code := websocket.CloseCode(err.ErrorCode)
+	switch {
+	case err.ErrorCode == 0:
+		return websocket.CloseNoStatus, ""
+	case err.ErrorCode > 0xffff || !code.Sendable():
+		return websocket.CloseInternalError, fmt.Sprintf("session closed with code %d", err.ErrorCode)
+	}
+	return code, err.Message
+}
@@ -0,0 +1,156 @@
+package ws_webtransport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"quic-proxy/internal/config"
+	h1h3server "quic-proxy/internal/h1h3-server"
+	"quic-proxy/internal/testutil"
+	"quic-proxy/internal/websocket"
+	"quic-proxy/internal/webtransport"
+)
+
+// startBridge Bridge WebSockets to the WebTransport server at upstream
+func startBridge(t *testing.T, upstream string) string {
+	t.Helper()
+	b, err := NewBridge(&config.WebTransportBridgeConfig{UpstreamURL: "https://" + upstream, Insecure: true})
+	if err != nil {
+		t.Fatalf("NewBridge: %v", err)
+	}
+	server := httptest.NewServer(b)
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String()
+}
+
+// dialBridge Open a classic WebSocket to path through the bridge
+func dialBridge(t *testing.T, addr, path string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial bridge: %v", err)
+	}
+	u, _ := url.Parse("http://" + addr + path)
+	ws, resp, err := websocket.DialH1(ctx, conn, u, addr, nil)
+	if ws != nil {
+		t.Cleanup(func() { ws.Close() })
+	}
+	return ws, resp, err
+}
+
+// readClose Read up to the Close frame of ws
+func readClose(t *testing.T, ws *websocket.Conn) (websocket.CloseCode, string) {
+	t.Helper()
+	for {
+		f, err := ws.ReadFrame()
+		if err != nil {
+			t.Fatalf("expected a Close frame, got %v", err)
+		}
+		if f.Opcode == websocket.OpClose {
+			code, reason, err := websocket.ParseClose(f.Payload)
+			if err != nil {
+				t.Fatalf("invalid Close frame: %v", err)
+			}
+			return code, reason
+		}
+	}
+}
+
+func TestBridge_Echo(t *testing.T) {
+	upstream := testutil.ServeH3(t, h1h3server.NewDemoH3Server("", nil))
+	ws, _, err := dialBridge(t, startBridge(t, upstream), h1h3server.WebTransportEchoPath)
+	if err != nil {
+		t.Fatalf("WebSocket through the bridge failed: %v", err)
+	}
+
+	// a fragmented text message, a ping in between, then a binary message
+	ws.WriteFrame(websocket.Frame{Opcode: websocket.OpText, Payload: []byte("hel")})
+	ws.WriteFrame(websocket.Frame{Fin: true, Opcode: websocket.OpPing, Payload: []byte("ping")})
+	ws.WriteFrame(websocket.Frame{Fin: true, Opcode: websocket.OpContinuation, Payload: []byte("lo")})
+	ws.WriteMessage(websocket.OpBinary, []byte{0, 1, 2})
+
+	tTable := []struct {
+		op      websocket.Opcode
+		payload string
+	}{
+		{op: websocket.OpPong, payload: "ping"},
+		{op: websocket.OpText, payload: "hello"},
+		{op: websocket.OpBinary, payload: "\x00\x01\x02"},
+	}
+	for _, tCase := range tTable {
+		f, err := ws.ReadFrame()
+		if err != nil || f.Opcode != tCase.op || string(f.Payload) != tCase.payload {
+			t.Errorf("expected %#x %q, got %#x %q, %v", tCase.op, tCase.payload, f.Opcode, f.Payload, err)
+		}
+	}
+
+	ws.WriteFrame(websocket.CloseFrame(4001, "bye"))
+	if code, reason := readClose(t, ws); code != 4001 || reason != "bye" {
+		t.Errorf("expected the Close to be answered with 4001 %q, got %d %q", "bye", code, reason)
+	}
+}
+
+func TestBridge_UpstreamCloses(t *testing.T) {
+	tTable := []struct {
+		sessionCode uint32
+		code        websocket.CloseCode
+		reason      string
+	}{
+		{sessionCode: 4002, code: 4002, reason: "done"},
+		{sessionCode: 0, code: websocket.CloseNoStatus},
+		{sessionCode: 70000, code: websocket.CloseInternalError, reason: "session closed with code 70000"},
+	}
+
+	for _, tCase := range tTable {
+		h3Server := &http3.Server{}
+		wt := webtransport.NewServer(h3Server)
+		h3Server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session, err := wt.Upgrade(w, r)
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := session.AcceptStream(context.Background()); err == nil {
+					session.CloseWithError(tCase.sessionCode, "done")
+				}
+			}()
+		})
+		ws, _, err := dialBridge(t, startBridge(t, testutil.ServeH3(t, h3Server)), "/")
+		if err != nil {
+			t.Fatalf("WebSocket through the bridge failed: %v", err)
+		}
+		ws.WriteMessage(websocket.OpText, []byte("hello"))
+		if code, reason := readClose(t, ws); code != tCase.code || reason != tCase.reason {
+			t.Errorf("session closed with %d: expected %d %q, got %d %q", tCase.sessionCode, tCase.code, tCase.reason, code, reason)
+		}
+	}
+}
+
+func TestBridge_Refused(t *testing.T) {
+	upstream := testutil.ServeH3(t, h1h3server.NewDemoH3Server("", nil))
+	addr := startBridge(t, upstream)
+
+	// only the echo path accepts sessions, the demo handler answers 400 elsewhere
+	_, resp, err := dialBridge(t, addr, "/private")
+	if !errors.Is(err, websocket.ErrHandshakeRefused) || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected the 400 of upstream, got %v %v", resp, err)
+	}
+
+	resp, err = http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("expected 426 for a plain request, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,52 @@
+package ws_webtransport
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/quic-go/quic-go/quicvarint"
+	"quic-proxy/internal/websocket"
+)
+
+// writeMessage Write a WebSocket message to the WebTransport stream: its
+// opcode in one byte, the length of the payload as a varint, the payload
+func writeMessage(w io.Writer, op websocket.Opcode, msg []byte) error {
+	b := make([]byte, 0, 1+quicvarint.Len(uint64(len(msg)))+len(msg))
+	b = append(b, byte(op))
+	b = quicvarint.Append(b, uint64(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
+
+// readMessage Read the next message written by writeMessage, io.EOF tells
+// that the stream ended between two messages
+func readMessage(r quicvarint.Reader) (websocket.Opcode, []byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	op := websocket.Opcode(b)
+	if op != websocket.OpText && op != websocket.OpBinary {
+		return 0, nil, fmt.Errorf("%w: unexpected message type %#x", websocket.ErrProtocol, b)
+	}
+	n, err := quicvarint.Read(r)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if n > websocket.MaxMessageSize {
+		return 0, nil, websocket.ErrMessageTooBig
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	return op, msg, nil
+}
+
+// unexpectedEOF Turn an io.EOF inside a message into io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}